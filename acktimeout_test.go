@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestConsumerAckTimeout_Custom(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db}
+	b := newBroker(s, withAckTimeout(time.Hour, 0))
+
+	_, err = b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	assert.Equal(50*time.Millisecond, c.SetAckTimeout(50*time.Millisecond))
+
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+
+	// The message is returned to the topic once the custom timeout expires
+	assert.Eventually(func() bool {
+		n, err := s.Len(defaultTopic)
+		return err == nil && n == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(errAckTimeout, c.Ack())
+
+	// Another consumer, using the broker default, receives it again
+	other := b.Subscribe(defaultTopic)
+	val, err := other.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("test_value"), val)
+	assert.Equal(time.Hour, other.ackTimeout)
+	assert.NoError(other.Ack())
+}
+
+func TestConsumerAckTimeout_Clamped(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db}
+	b := newBroker(s, withAckTimeout(0, 50*time.Millisecond))
+
+	_, err = b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	assert.Equal(50*time.Millisecond, c.SetAckTimeout(time.Hour))
+
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+
+	assert.Eventually(func() bool {
+		n, err := s.Len(defaultTopic)
+		return err == nil && n == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// A NACK of an expired message has nothing left to do
+	assert.NoError(c.Nack())
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestConsumerAckTimeout_AckedInTime(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db}
+	b := newBroker(s, withAckTimeout(50*time.Millisecond, 0))
+
+	_, err = b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.Ack())
+
+	time.Sleep(100 * time.Millisecond)
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Zero(n)
+}
+
+func TestSubscribeAckTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withAckTimeout(time.Hour, time.Hour))
+
+	_, err = b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	enc := json.NewEncoder(writer)
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), reader)
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	go subscribe(b, flushThreshold{})(subW, r)
+
+	dec := NewDecodeWaiter(subW)
+
+	var out subResponse
+	assert.NoError(enc.Encode(json.RawMessage(`{"cmd":"INIT","ack_timeout":"50ms"}`)))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal("test_value", out.Msg)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The late ACK is rejected without closing the stream
+	out = subResponse{}
+	assert.NoError(enc.Encode(CmdAck))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal(errAckTimeout.Error(), out.Error)
+
+	out = subResponse{}
+	assert.NoError(enc.Encode(CmdInit))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal("test_value", out.Msg)
+}
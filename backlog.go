@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// backlogLevel is how far the depth of a topic is past its backlog thresholds.
+type backlogLevel string
+
+const (
+	backlogOK       backlogLevel = "ok"
+	backlogWarning  backlogLevel = "warning"
+	backlogCritical backlogLevel = "critical"
+)
+
+// backlogLevel returns the backlog level of the topic at the given depth.
+func (c topicConfig) backlogLevel(depth int) backlogLevel {
+	switch {
+	case c.CriticalDepth > 0 && depth >= c.CriticalDepth:
+		return backlogCritical
+	case c.WarnDepth > 0 && depth >= c.WarnDepth:
+		return backlogWarning
+	default:
+		return backlogOK
+	}
+}
+
+// backlogLevels holds the last backlog level of each topic, such that an alert
+// is only raised as the depth of a topic crosses a threshold, rather than on
+// every change in depth. The zero value is ready to use.
+type backlogLevels struct {
+	levels map[string]backlogLevel
+	sync.Mutex
+}
+
+// checkBacklog compares the depth of the topic against its backlog thresholds,
+// logging and calling the backlog hook if it has crossed one since last
+// checked.
+func (b *broker) checkBacklog(topic string) {
+	cfg := b.TopicConfig(topic)
+
+	b.backlog.Lock()
+	defer b.backlog.Unlock()
+
+	prev, ok := b.backlog.levels[topic]
+	if !ok {
+		prev = backlogOK
+	}
+
+	// Only look up the depth of topics which have, or had, a threshold
+	if cfg.WarnDepth <= 0 && cfg.CriticalDepth <= 0 && prev == backlogOK {
+		return
+	}
+
+	depth, err := b.store.Len(topic)
+	if err != nil {
+		log.Err(err).Str("topic", topic).Msg("failed to get topic length for backlog check")
+		return
+	}
+
+	level := cfg.backlogLevel(depth)
+	if level == prev {
+		return
+	}
+
+	if level == backlogOK {
+		delete(b.backlog.levels, topic)
+	} else {
+		if b.backlog.levels == nil {
+			b.backlog.levels = map[string]backlogLevel{}
+		}
+
+		b.backlog.levels[topic] = level
+	}
+
+	ev := log.Info()
+	switch level {
+	case backlogWarning:
+		ev = log.Warn().Int("threshold", cfg.WarnDepth)
+	case backlogCritical:
+		ev = log.Error().Int("threshold", cfg.CriticalDepth)
+	}
+
+	ev.Str("topic", topic).
+		Int("depth", depth).
+		Str("level", string(level)).
+		Str("previous_level", string(prev)).
+		Msg("topic backlog level changed")
+
+	b.hooks.backlog(topic, level, depth)
+}
+
+// checkBacklog checks the backlog of the topic, once the consumer has changed
+// its depth.
+func (c *consumer) checkBacklog(topic string) {
+	if c.backlog != nil {
+		c.backlog(topic)
+	}
+}
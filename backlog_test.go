@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+type backlogEvent struct {
+	level backlogLevel
+	depth int
+}
+
+func TestBacklogAlerts(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	var events []backlogEvent
+	b := newBroker(&store{db: db}, withOnBacklog(func(topic string, level backlogLevel, depth int) {
+		assert.Equal(defaultTopic, topic)
+		events = append(events, backlogEvent{level: level, depth: depth})
+	}))
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{WarnDepth: 2, CriticalDepth: 4}))
+
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+			assert.NoError(err)
+		}
+	}
+
+	// Below the threshold nothing fires
+	publish(1)
+	assert.Empty(events)
+
+	// Crossing it fires once, not on every publish past it
+	publish(2)
+	assert.Equal([]backlogEvent{{backlogWarning, 2}}, events)
+
+	// As does crossing the critical threshold
+	publish(1)
+	assert.Equal([]backlogEvent{{backlogWarning, 2}, {backlogCritical, 4}}, events)
+	events = nil
+
+	// Consuming drops the depth back through each threshold
+	c := b.Subscribe(defaultTopic)
+	for i := 0; i < 3; i++ {
+		_, err := c.Next(context.Background())
+		assert.NoError(err)
+		assert.NoError(c.Ack())
+	}
+	assert.Equal([]backlogEvent{{backlogWarning, 3}, {backlogOK, 1}}, events)
+	events = nil
+
+	// A NACK returning a message to the topic can cross it again
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	publish(1)
+	assert.Empty(events)
+
+	assert.NoError(c.Nack())
+	assert.Equal([]backlogEvent{{backlogWarning, 2}}, events)
+}
+
+func TestBacklogAlerts_NoThresholds(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	var fired bool
+	b := newBroker(&store{db: db}, withOnBacklog(func(topic string, level backlogLevel, depth int) {
+		fired = true
+	}))
+
+	for i := 0; i < 10; i++ {
+		_, err := b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+		assert.NoError(err)
+	}
+
+	assert.False(fired)
+}
+
+func TestTopicConfigValidate_Backlog(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(topicConfig{WarnDepth: 10}.validate())
+	assert.NoError(topicConfig{WarnDepth: 10, CriticalDepth: 10}.validate())
+	assert.Error(topicConfig{WarnDepth: -1}.validate())
+	assert.Error(topicConfig{WarnDepth: 10, CriticalDepth: 5}.validate())
+}
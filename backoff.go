@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// backoff computes the delay before a NACKed message is made available for
+// redelivery. The delay grows exponentially with the number of times the
+// message has been delivered, is randomised by the jitter fraction and is
+// capped at max. A zero backoff disables the delay entirely.
+type backoff struct {
+	base   time.Duration
+	max    time.Duration
+	jitter float64
+}
+
+// Delay returns the redelivery delay for a message which has been delivered
+// attempt times.
+func (b backoff) Delay(attempt int) time.Duration {
+	if b.base <= 0 || attempt < 1 {
+		return 0
+	}
+
+	d := b.base
+	for i := 1; i < attempt; i++ {
+		if (b.max > 0 && d >= b.max) || d > math.MaxInt64/2 {
+			break
+		}
+
+		d *= 2
+	}
+
+	if b.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * b.jitter * float64(d))
+	}
+
+	if b.max > 0 && d > b.max {
+		d = b.max
+	}
+
+	return d
+}
+
+// enabled reports whether redelivery should be delayed at all.
+func (b backoff) enabled() bool {
+	return b.base > 0
+}
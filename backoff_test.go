@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	bo := backoff{
+		base:   100 * time.Millisecond,
+		max:    2 * time.Second,
+		jitter: 0.2,
+	}
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1600 * time.Millisecond,
+		2 * time.Second,
+		2 * time.Second,
+	}
+
+	for i, exp := range expected {
+		attempt := i + 1
+
+		lower := time.Duration(float64(exp) * (1 - bo.jitter))
+		upper := time.Duration(float64(exp) * (1 + bo.jitter))
+		if upper > bo.max {
+			upper = bo.max
+		}
+
+		for n := 0; n < 100; n++ {
+			d := bo.Delay(attempt)
+			assert.GreaterOrEqual(t, int64(d), int64(lower), "attempt %d", attempt)
+			assert.LessOrEqual(t, int64(d), int64(upper), "attempt %d", attempt)
+		}
+	}
+}
+
+func TestBackoffDelay_NoJitter(t *testing.T) {
+	bo := backoff{
+		base: time.Second,
+		max:  10 * time.Second,
+	}
+
+	assert.Equal(t, time.Second, bo.Delay(1))
+	assert.Equal(t, 2*time.Second, bo.Delay(2))
+	assert.Equal(t, 4*time.Second, bo.Delay(3))
+	assert.Equal(t, 8*time.Second, bo.Delay(4))
+	assert.Equal(t, 10*time.Second, bo.Delay(5))
+	assert.Equal(t, 10*time.Second, bo.Delay(1000))
+}
+
+func TestBackoffDelay_Disabled(t *testing.T) {
+	var bo backoff
+
+	assert.False(t, bo.enabled())
+	assert.Equal(t, time.Duration(0), bo.Delay(1))
+	assert.Equal(t, time.Duration(0), bo.Delay(10))
+}
+
+func TestTopicConfigBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := backoff{base: time.Second, jitter: 0.2}
+
+	assert.Equal(broker, topicConfig{}.backoff(broker))
+	assert.Equal(backoff{base: 5 * time.Second, jitter: 0.2}, topicConfig{BackoffBase: "5s"}.backoff(broker))
+	assert.Equal(backoff{base: 5 * time.Second, max: time.Minute, jitter: 0.2}, topicConfig{BackoffBase: "5s", BackoffMax: "1m"}.backoff(broker))
+
+	assert.NoError(topicConfig{BackoffBase: "1s", BackoffMax: "1m"}.validate())
+	assert.Error(topicConfig{BackoffBase: "later"}.validate())
+	assert.Error(topicConfig{BackoffMax: "1m"}.validate())
+	assert.Error(topicConfig{BackoffBase: "1m", BackoffMax: "1s"}.validate())
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// withWriteBatching coalesces the inserts of publishes arriving within window
+// of the first into a single write to the store, of up to maxSize messages,
+// amortising the cost of each write and its fsync. A publish only returns once
+// its batch is committed. Publishes to topics with a maximum length are never
+// batched, as their length check must happen with their insert. A zero window
+// disables batching.
+func withWriteBatching(window time.Duration, maxSize int) brokerOption {
+	return func(b *broker) {
+		if window <= 0 {
+			return
+		}
+
+		b.batcher = &writeBatcher{
+			window:  window,
+			maxSize: maxSize,
+		}
+	}
+}
+
+// publishBatched inserts the message into its topics as part of the current
+// batch, notifying the consumers of each topic once the batch is committed.
+func (b *broker) publishBatched(topics []string, val value, meta messageMeta) (string, error) {
+	records := make([]record, 0, len(topics))
+	for _, t := range topics {
+		records = append(records, record{topic: t, value: val, meta: b.topicMeta(t, meta)})
+	}
+
+	err := b.withSpace(func() error {
+		return b.batcher.insert(records)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range records {
+		b.hooks.publish(r.topic, r.meta.ID)
+		b.throughput.published(r.topic)
+		b.taps.emit(r.topic, tapPublish, r.value, r.meta, "", r.meta.PublishedAt)
+		b.NotifyConsumer(r.topic, eventTypePublish)
+		b.checkBacklog(r.topic)
+	}
+
+	return meta.ID, nil
+}
+
+// writeBatcher collects the records of concurrent publishes, inserting them
+// into the store together once the window of the batch has passed or it is
+// full.
+type writeBatcher struct {
+	store   storer
+	window  time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	pending []*batchedWrite
+	size    int
+	timer   *time.Timer
+}
+
+// batchedWrite is the records of a single publish awaiting their batch.
+type batchedWrite struct {
+	records []record
+	done    chan error
+}
+
+// insert adds the records to the current batch, returning once the batch has
+// been committed. The records are inserted atomically, together with the
+// other records of the batch.
+func (wb *writeBatcher) insert(records []record) error {
+	w := &batchedWrite{records: records, done: make(chan error, 1)}
+
+	wb.mu.Lock()
+	wb.pending = append(wb.pending, w)
+	wb.size += len(records)
+
+	if wb.maxSize > 0 && wb.size >= wb.maxSize {
+		batch := wb.take()
+		wb.mu.Unlock()
+
+		wb.commit(batch)
+
+		return <-w.done
+	}
+
+	if wb.timer == nil {
+		wb.timer = time.AfterFunc(wb.window, wb.flush)
+	}
+	wb.mu.Unlock()
+
+	return <-w.done
+}
+
+// flush commits the current batch, without waiting for its window to pass.
+func (wb *writeBatcher) flush() {
+	wb.mu.Lock()
+	batch := wb.take()
+	wb.mu.Unlock()
+
+	wb.commit(batch)
+}
+
+// take returns the current batch, starting a new one. The lock must be held.
+func (wb *writeBatcher) take() []*batchedWrite {
+	if wb.timer != nil {
+		wb.timer.Stop()
+		wb.timer = nil
+	}
+
+	batch := wb.pending
+	wb.pending = nil
+	wb.size = 0
+
+	return batch
+}
+
+// commit inserts the records of the batch in a single write, returning the
+// result to each publish.
+func (wb *writeBatcher) commit(batch []*batchedWrite) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var records []record
+	for _, w := range batch {
+		records = append(records, w.records...)
+	}
+
+	err := wb.store.InsertAll(records)
+
+	// Only fail the publishes at fault, rather than the whole batch
+	if err != nil && len(batch) > 1 {
+		for _, w := range batch {
+			w.done <- wb.store.InsertAll(w.records)
+		}
+
+		return
+	}
+
+	for _, w := range batch {
+		w.done <- err
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// helperPublishConcurrently publishes n messages to the topic at once,
+// returning the IDs published.
+func helperPublishConcurrently(t *testing.T, b *broker, topic string, n int) []string {
+	t.Helper()
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ids []string
+	)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			id, err := b.Publish(topic, []byte(fmt.Sprintf("test_msg_%d", i)), messageMeta{})
+			assert.NoError(t, err)
+
+			mu.Lock()
+			ids = append(ids, id)
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	return ids
+}
+
+func TestWriteBatching(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath, withSyncPolicy(syncAlways, 0)).(*store)
+	t.Cleanup(s.Destroy)
+
+	syncs := helperSyncCounter(s)
+
+	var (
+		mu        sync.Mutex
+		published []string
+	)
+	b := newBroker(s,
+		withWriteBatching(time.Hour, 10),
+		withOnPublish(func(topic, id string) {
+			mu.Lock()
+			defer mu.Unlock()
+			published = append(published, id)
+		}),
+	)
+
+	// The batch is only written once full, long before its window has passed,
+	// by a single write and fsync
+	ids := helperPublishConcurrently(t, b, defaultTopic, 10)
+	assert.Len(ids, 10)
+	assert.Equal(1, syncs())
+	assert.ElementsMatch(ids, published)
+
+	// Every message is stored durably, surviving a restart
+	assert.NoError(s.Close())
+
+	s = newStore(tmpDBPath).(*store)
+	t.Cleanup(s.Destroy)
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(10, n)
+}
+
+func TestWriteBatching_Window(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withWriteBatching(10*time.Millisecond, 100))
+
+	// A batch which never fills is written once its window passes
+	start := time.Now()
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.NoError(err)
+	assert.GreaterOrEqual(int64(time.Since(start)), int64(10*time.Millisecond))
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestWriteBatching_NotifiesEach(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withWriteBatching(time.Hour, 5))
+
+	// Each waiting consumer is woken by the message it receives, despite the
+	// messages being written together
+	delivered := make(chan value, 5)
+	for i := 0; i < 5; i++ {
+		c := b.Subscribe(defaultTopic)
+
+		go func() {
+			val, err := c.Next(context.Background())
+			assert.NoError(err)
+			delivered <- val
+		}()
+	}
+
+	helperPublishConcurrently(t, b, defaultTopic, 5)
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for delivery %d", i)
+		}
+	}
+}
+
+func TestWriteBatching_MaxLength(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withWriteBatching(time.Hour, 100))
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{MaxLength: 1}))
+
+	// Topics with a maximum length aren't batched, so aren't held for the
+	// window
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.NoError(err)
+
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.Equal(errTopicFull, err)
+}
+
+func TestWriteBatching_Shutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath).(*store)
+	t.Cleanup(s.Destroy)
+
+	b := newBroker(s, withWriteBatching(time.Hour, 100))
+
+	// A pending batch is written before the store is closed
+	errc := make(chan error, 1)
+	go func() {
+		_, err := b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+		errc <- err
+	}()
+
+	assert.Eventually(func() bool {
+		b.batcher.mu.Lock()
+		defer b.batcher.mu.Unlock()
+		return len(b.batcher.pending) == 1
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(b.Shutdown())
+	assert.NoError(<-errc)
+
+	s = newStore(tmpDBPath).(*store)
+	t.Cleanup(s.Destroy)
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+// BenchmarkPublishBatching compares concurrent publishes to a store fsyncing
+// every write, with and without batching.
+func BenchmarkPublishBatching(b *testing.B) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	const publishers = 64
+
+	bench := func(b *testing.B, opts ...brokerOption) {
+		s := newStore(tmpDBPath, withSyncPolicy(syncAlways, 0)).(*store)
+		defer s.Destroy()
+
+		br := newBroker(s, opts...)
+
+		b.SetParallelism(publishers)
+		b.ResetTimer()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := br.Publish(defaultTopic, []byte("test_value"), messageMeta{}); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	}
+
+	b.Run("unbatched", func(b *testing.B) {
+		bench(b)
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		bench(b, withWriteBatching(time.Millisecond, publishers))
+	})
+}
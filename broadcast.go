@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// broadcastGroupPrefix names the private group of each broadcast consumer.
+// Named groups may not start with it.
+const broadcastGroupPrefix = "broadcast-"
+
+// SubscribeBroadcast subscribes to every message published to the topic from
+// now on, alongside its other consumers, rather than competing with them.
+//
+// Each broadcast consumer is given a private group, holding its own copy of
+// each message, which is deleted once the consumer unsubscribes. Unlike named
+// groups, the group isn't persisted, so messages published while the consumer
+// isn't subscribed are not kept for it.
+func (b *broker) SubscribeBroadcast(topic string) *consumer {
+	group := broadcastGroupPrefix + xid.New().String()
+
+	b.Lock()
+	b.registerGroup(topic, group)
+	b.Unlock()
+
+	return b.Subscribe(groupTopic(topic, group))
+}
+
+// isBroadcastGroup reports whether the group is the private group of a
+// broadcast consumer.
+func isBroadcastGroup(group string) bool {
+	return strings.HasPrefix(group, broadcastGroupPrefix)
+}
+
+// splitGroupTopic returns the topic and group of a group topic, or false if
+// the topic isn't one.
+func splitGroupTopic(t string) (topic, group string, ok bool) {
+	i := strings.Index(t, "/")
+	if i < 0 {
+		return "", "", false
+	}
+
+	return t[:i], t[i+1:], true
+}
+
+// removeBroadcast stops copying messages to the group topic of a broadcast
+// consumer which has unsubscribed, and deletes it along with the copies it
+// left unconsumed. Other group topics are left alone.
+func (b *broker) removeBroadcast(t string) {
+	topic, group, ok := splitGroupTopic(t)
+	if !ok || !isBroadcastGroup(group) {
+		return
+	}
+
+	b.Lock()
+	delete(b.groups[topic], group)
+	if len(b.groups[topic]) == 0 {
+		delete(b.groups, topic)
+	}
+	b.Unlock()
+
+	if err := b.store.DeleteTopic(t); err != nil {
+		log.Err(err).Str("topic", t).Msg("failed to delete broadcast group")
+	}
+}
+
+// deleteBroadcasts deletes the group topics left behind by the broadcast
+// consumers of a previous run.
+func (b *broker) deleteBroadcasts(topics []string) error {
+	for _, t := range topics {
+		if _, group, ok := splitGroupTopic(t); !ok || !isBroadcastGroup(group) {
+			continue
+		}
+
+		if err := b.store.DeleteTopic(t); err != nil {
+			return fmt.Errorf("deleting broadcast group %s: %v", t, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroadcast(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+	b := newBroker(s)
+
+	var (
+		sub1   = b.SubscribeBroadcast(defaultTopic)
+		sub2   = b.SubscribeBroadcast(defaultTopic)
+		worker = b.Subscribe(defaultTopic)
+	)
+
+	consume := func(c *consumer) []string {
+		var got []string
+		for {
+			val, err := c.TryNext(context.Background())
+			if err == errNoMessages {
+				return got
+			}
+			assert.NoError(err)
+			assert.NoError(c.Ack())
+
+			got = append(got, string(val))
+		}
+	}
+
+	for _, msg := range []string{"msg_1", "msg_2"} {
+		_, err := b.Publish(defaultTopic, []byte(msg), messageMeta{})
+		assert.NoError(err)
+	}
+
+	// Each broadcast consumer receives every message, without taking them from
+	// the topic's other consumers
+	assert.Equal([]string{"msg_1", "msg_2"}, consume(sub1))
+	assert.Equal([]string{"msg_1", "msg_2"}, consume(sub2))
+	assert.Equal([]string{"msg_1", "msg_2"}, consume(worker))
+
+	// Once unsubscribed, its group is deleted and no longer receives messages
+	b.Unsubscribe(sub1)
+
+	_, err := b.Publish(defaultTopic, []byte("msg_3"), messageMeta{})
+	assert.NoError(err)
+
+	assert.Equal([]string{"msg_3"}, consume(sub2))
+
+	topics, err := s.Topics()
+	assert.NoError(err)
+	assert.NotContains(topics, sub1.topic)
+	assert.Contains(topics, sub2.topic)
+}
+
+func TestBroadcast_Recover(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+
+	// Left behind by a broadcast consumer, and a named group, of a previous run
+	broadcast := groupTopic(defaultTopic, broadcastGroupPrefix+"test")
+	assert.NoError(s.Insert(broadcast, value("msg_1"), messageMeta{}))
+	assert.NoError(s.Insert(groupTopic(defaultTopic, "workers"), value("msg_1"), messageMeta{}))
+
+	b := newBroker(s)
+	assert.NoError(b.Recover())
+
+	topics, err := s.Topics()
+	assert.NoError(err)
+	assert.Equal([]string{groupTopic(defaultTopic, "workers")}, topics)
+	assert.Equal(map[string]bool{"workers": true}, b.groups[defaultTopic])
+}
+
+func TestServerBroadcast_Invalid(t *testing.T) {
+	srv := newServer(newBroker(helperNewMemStore(t)))
+
+	for query, e := range map[string]serverError{
+		"broadcast=true&group=workers":           errBroadcastGroup,
+		"group=" + broadcastGroupPrefix + "test": errReservedGroup,
+	} {
+		t.Run(query, func(t *testing.T) {
+			rec := NewRecorder()
+			srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s?%s", defaultTopic, query), nil))
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Contains(t, rec.Body.String(), e.Error())
+		})
+	}
+}
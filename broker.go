@@ -1,71 +1,599 @@
 package main
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
 )
 
 type value = []byte
 
+const (
+	errTopicFull              = brokerError("topic has reached its maximum length")
+	errUnsupportedContentType = brokerError("content type not accepted by topic")
+	errAckTimeout             = brokerError("ack timeout exceeded, message returned to topic")
+	errNoRoute                = brokerError("message was not routed to any topic")
+	errUnknownAckID           = brokerError("message is not outstanding on the consumer")
+	errNoSubscribers          = brokerError("topic has no subscribers, message dropped")
+	errCommitAhead            = brokerError("commit is beyond the last delivered sequence number")
+	errInvalidTimestamp       = brokerError("invalid producer timestamp, expected an RFC 3339 time")
+	errTimestampSkew          = brokerError("producer timestamp is too far from the server clock")
+	errTooManyDelayed         = brokerError("too many delayed messages waiting to be published")
+	errShutdown               = brokerError("broker is shutting down")
+	errConsumerNotFound       = brokerError("consumer not found")
+	errUnknownReceipt         = brokerError("unknown receipt, or its message was already resolved")
+	errNotConfirmed           = brokerError("message was not ACKed within the confirmation window")
+	errRecoverDeadLetter      = brokerError("dead-letter topics can't be recovered, recover their source topic")
+	errTopicInUse             = brokerError("topic has subscribers, disconnect them before deleting it")
+)
+
+type brokerError string
+
+func (e brokerError) Error() string {
+	return string(e)
+}
+
 type broker struct {
 	store     storer
 	consumers map[string][]consumer
+	configs   map[string]topicConfig
+	backoff   backoff
+	receipts  *receiptSender
+	hooks     *hooks
+	recovery  recoveryReport
+	now       func() time.Time
+	router    router
+	ids       idGenerator
+
+	// groups holds the consumer groups of each topic, which each receive a
+	// copy of every message published to the topic.
+	groups map[string]map[string]bool
+
+	// requireSubscriber drops publishes to topics without a subscriber,
+	// rather than storing them for later.
+	requireSubscriber bool
+
+	// maxSkew is how far the producer timestamp of a message may be from the
+	// broker's clock, zero is unlimited.
+	maxSkew time.Duration
+
+	// maxInFlight is how many consumers of a topic may hold outstanding
+	// messages at once, for topics whose config sets no limit, zero is
+	// unlimited.
+	maxInFlight int
+	inFlight    inFlight
+
+	// taps observe copies of the messages of each topic as they are published
+	// and delivered.
+	taps taps
+
+	deadLetters deadLetterPolicy
+
+	// processing records the time taken to process the messages of each topic.
+	processing processingTimes
+
+	// throughput counts the messages published to, and ACKed on, each topic.
+	throughput throughputs
+
+	// assigner assigns the partitions of partitioned topics to consumers.
+	assigner partitionAssigner
+
+	// confirms holds the messages of each topic ACKed within the confirmation
+	// window.
+	confirms confirmations
+
+	// delayed holds the delayed messages waiting to be published, and the
+	// values NACKed with a delay waiting to be returned to their topics.
+	delayed scheduler
+
+	// interceptors transform each message delivered to every consumer.
+	interceptors []deliveryInterceptor
+
+	// backlog holds the backlog level of each topic with thresholds.
+	backlog backlogLevels
+
+	// weights schedules which waiting consumer of a topic is notified next.
+	weights consumerWeights
+
+	// fetched holds the messages fetched by ID awaiting acknowledgement.
+	fetched fetchedMessages
+
+	// batcher coalesces the inserts of concurrent publishes, nil inserts
+	// each publish on its own.
+	batcher *writeBatcher
+
+	ackTimeout    time.Duration
+	maxAckTimeout time.Duration
+	onDisconnect  disconnectPolicy
+
+	// storeFull determines what happens to publishes when the store is out of
+	// space.
+	storeFull storeFullPolicy
+
+	// keepExpired moves messages which expire before they're delivered to the
+	// expired topic of their topic.
+	keepExpired bool
+
+	maxAge        time.Duration
+	sweepInterval time.Duration
+	done          chan struct{}
+	shutdownOnce  sync.Once
+
+	// stopping is closed once the broker stops delivering messages, as it
+	// shuts down.
+	stopping chan struct{}
+	stopOnce sync.Once
+
+	// publishMu serialises publishes to topics with a maximum length, such
+	// that the length check and insert happen atomically.
+	publishMu sync.Mutex
+
 	sync.RWMutex
 }
 
-func newBroker(store storer) *broker {
-	return &broker{
+// brokerOption configures optional behaviour of the broker.
+type brokerOption func(*broker)
+
+// withAckTimeout returns messages to their topic if they are not ACKed or
+// NACKed within timeout of being delivered. Consumers may override the
+// timeout, up to max. Zero disables the timeout, or the maximum.
+func withAckTimeout(timeout, max time.Duration) brokerOption {
+	return func(b *broker) {
+		b.ackTimeout = timeout
+		b.maxAckTimeout = max
+	}
+}
+
+// withBackoff delays the redelivery of NACKed messages according to the given
+// backoff schedule.
+func withBackoff(bo backoff) brokerOption {
+	return func(b *broker) {
+		b.backoff = bo
+	}
+}
+
+// topicBackoff returns the backoff of messages NACKed on the topic, set by its
+// config or else the broker's.
+func (b *broker) topicBackoff(topic string) backoff {
+	return b.TopicConfig(topic).backoff(b.backoff)
+}
+
+// withRequireSubscriber drops messages published to a topic with no
+// subscribers, rather than storing them until one subscribes. Topics may also
+// require a subscriber through their config.
+func withRequireSubscriber(require bool) brokerOption {
+	return func(b *broker) {
+		b.requireSubscriber = require
+	}
+}
+
+func newBroker(store storer, opts ...brokerOption) *broker {
+	b := &broker{
 		store:     store,
 		consumers: map[string][]consumer{},
+		configs:   map[string]topicConfig{},
+		groups:    map[string]map[string]bool{},
+		receipts:  newReceiptSender(),
+		hooks:     &hooks{},
+		ids:       xidGenerator{},
+		now:       time.Now,
+		done:      make(chan struct{}),
+		stopping:  make(chan struct{}),
+		storeFull: storeFullReject,
+	}
+
+	for _, opt := range opts {
+		opt(b)
 	}
+
+	b.inFlight.limit = b.inFlightLimit
+	setStoreClock(b.store, b.now)
+
+	// Wraps the store of the options, so that messages are routed to their
+	// partition before anything else sees them
+	b.store = &partitionedStore{storer: b.store, partitions: b.partitions}
+
+	// Options may wrap the store, so the batcher writes to it once they're all
+	// applied
+	if b.batcher != nil {
+		b.batcher.store = b.store
+	}
+
+	if b.sweepInterval > 0 {
+		go b.sweepPeriodically()
+	}
+
+	if b.deadLetters.redriveEnabled() {
+		go b.redrivePeriodically()
+	}
+
+	if b.confirms.enabled() {
+		go b.pruneConfirmedPeriodically()
+	}
+
+	return b
+}
+
+// LoadTopicConfigs loads the persisted topic configs from the store, applying
+// them to subsequent operations on their topics.
+func (b *broker) LoadTopicConfigs() error {
+	configs, err := b.store.TopicConfigs()
+	if err != nil {
+		return fmt.Errorf("loading topic configs: %v", err)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	for topic, cfg := range configs {
+		b.configs[topic] = cfg
+	}
+
+	return nil
+}
+
+// ResetDeliveries zeroes the delivery count of the messages waiting to be
+// consumed on the topic, returning the number of messages changed.
+func (b *broker) ResetDeliveries(topic string) (int, error) {
+	return b.store.ResetDeliveries(topic)
+}
+
+// History returns the acked messages retained for the topic, oldest first.
+func (b *broker) History(topic string) ([]historyEntry, error) {
+	return b.store.History(topic)
+}
+
+// TopicConfig returns the config of a topic. Topics which have not been
+// configured return the default config.
+func (b *broker) TopicConfig(topic string) topicConfig {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.configs[topic]
 }
 
-// Publish a message to a topic.
-func (b *broker) Publish(topic string, val value) error {
-	if err := b.store.Insert(topic, val); err != nil {
+// SetTopicConfig persists and applies the config of a topic.
+func (b *broker) SetTopicConfig(topic string, cfg topicConfig) error {
+	if err := cfg.validate(); err != nil {
 		return err
 	}
 
-	b.NotifyConsumer(topic, eventTypePublish)
+	b.Lock()
+	defer b.Unlock()
+
+	if err := b.store.PutTopicConfig(topic, cfg); err != nil {
+		return fmt.Errorf("storing topic config: %v", err)
+	}
+
+	b.configs[topic] = cfg
 
 	return nil
 }
 
+// Publish a message to a topic, returning the ID assigned to the message.
+func (b *broker) Publish(topic string, val value, meta messageMeta) (string, error) {
+	if err := b.checkSkew(meta); err != nil {
+		return "", err
+	}
+
+	return b.publish(topic, val, meta)
+}
+
+// publish publishes a message to a topic, keeping the ID it has already been
+// assigned, if any.
+func (b *broker) publish(topic string, val value, meta messageMeta) (string, error) {
+	meta, topics, err := b.prepare(topic, val, meta)
+	if err != nil {
+		return "", err
+	}
+
+	var limited bool
+	for _, t := range topics {
+		limited = limited || b.TopicConfig(t).MaxLength > 0
+	}
+
+	if limited {
+		b.publishMu.Lock()
+		defer b.publishMu.Unlock()
+
+		counts := map[string]int{}
+		for _, t := range topics {
+			counts[t]++
+		}
+
+		if err := b.checkLengths(counts); err != nil {
+			return "", err
+		}
+	}
+
+	if b.batcher != nil && !limited {
+		return b.publishBatched(topics, val, meta)
+	}
+
+	for _, t := range topics {
+		meta := b.topicMeta(t, meta)
+
+		err := b.withSpace(func() error {
+			return b.store.Insert(t, val, meta)
+		})
+		if err != nil {
+			return "", err
+		}
+
+		b.hooks.publish(t, meta.ID)
+		b.throughput.published(t)
+		b.taps.emit(t, tapPublish, val, meta, "", meta.PublishedAt)
+		b.NotifyConsumer(t, eventTypePublish)
+		b.checkBacklog(t)
+	}
+
+	return meta.ID, nil
+}
+
+// prepare assigns the message its ID, unless it already has one, and resolves
+// the topics it is to be inserted into, checking that every topic accepts it.
+func (b *broker) prepare(topic string, val value, meta messageMeta) (messageMeta, []string, error) {
+	if meta.ID == "" {
+		id, err := b.ids.NextID(topic)
+		if err != nil {
+			return meta, nil, fmt.Errorf("generating message id: %v", err)
+		}
+
+		meta.ID = id
+	}
+
+	meta.Deliveries = 0
+	meta.PublishedAt = b.now()
+	meta = b.defaultHeaders(topic, meta)
+
+	// The key orders messages across partitions, even on topics which don't
+	// keep it for compaction
+	if meta.PartitionKey == "" {
+		meta.PartitionKey = meta.Key
+	}
+
+	// The TTL is kept as the deadline it resolves to
+	meta = withTTL(meta, meta.TTL)
+	meta.TTL = 0
+
+	topics := b.route(topic, message{Value: val, Meta: meta})
+	if len(topics) == 0 {
+		return meta, nil, errNoRoute
+	}
+
+	// Only the headers under headerPrefix are stored, the rest are only
+	// needed for routing. Messages published again keep the headers stored
+	// with them.
+	if meta.Header != nil {
+		meta.Headers = userHeaders(meta.Header)
+	}
+	meta.Header = nil
+
+	topics = b.withGroups(topics)
+
+	// Drop the message from topics requiring a subscriber which have none
+	topics = b.subscribed(topics)
+	if len(topics) == 0 {
+		return meta, nil, errNoSubscribers
+	}
+
+	// Check every topic accepts the message before inserting into any
+	for _, t := range topics {
+		if !b.TopicConfig(t).acceptsContentType(meta.ContentType) {
+			return meta, nil, errUnsupportedContentType
+		}
+	}
+
+	return meta, topics, nil
+}
+
+// defaultHeaders merges the default headers of the topic into those of the
+// message, filling the content type, reply topic and key from the defaults
+// where the producer left them unset.
+func (b *broker) defaultHeaders(topic string, meta messageMeta) messageMeta {
+	cfg := b.TopicConfig(topic)
+	if len(cfg.Headers) == 0 {
+		return meta
+	}
+
+	meta.Header = cfg.mergeHeaders(meta.Header)
+
+	if meta.ContentType == "" {
+		meta.ContentType = meta.Header.Get("Content-Type")
+	}
+	if meta.ReplyTo == "" {
+		meta.ReplyTo = meta.Header.Get(headerReplyTo)
+	}
+	if meta.Key == "" {
+		meta.Key = meta.Header.Get(headerKey)
+	}
+
+	return meta
+}
+
+// checkLengths returns errTopicFull if inserting the given number of messages
+// into each topic would take it past its maximum length. publishMu must be
+// held.
+func (b *broker) checkLengths(counts map[string]int) error {
+	for t, count := range counts {
+		max := b.TopicConfig(t).MaxLength
+		if max <= 0 {
+			continue
+		}
+
+		n, err := b.store.Len(t)
+		if err != nil {
+			return fmt.Errorf("getting topic length: %v", err)
+		}
+
+		if n+count > max {
+			return errTopicFull
+		}
+	}
+
+	return nil
+}
+
+// topicMeta returns the metadata of the message as stored on the topic.
+func (b *broker) topicMeta(topic string, meta messageMeta) messageMeta {
+	cfg := b.TopicConfig(topic)
+
+	// Keys are only kept on compacted topics
+	if !cfg.Compact {
+		meta.Key = ""
+	}
+
+	return withTTL(meta, cfg.ttl())
+}
+
+// Peek returns up to limit messages waiting to be consumed on the topic, in the
+// order they will be consumed.
+func (b *broker) Peek(topic string, limit int) ([]pendingMessage, error) {
+	return b.store.Peek(topic, limit)
+}
+
 // Subscribe to a topic and return a consumer for the topic.
 func (b *broker) Subscribe(topic string) *consumer {
 	b.Lock()
 	defer b.Unlock()
 
-	cons := consumer{
+	cons := b.newConsumer(topic)
+
+	b.consumers[topic] = append(b.consumers[topic], cons)
+	b.weights.set(topic, cons.id, defaultWeight)
+
+	return &cons
+}
+
+// newConsumer returns a consumer of the topic, configured by the broker, which
+// isn't yet subscribed.
+func (b *broker) newConsumer(topic string) consumer {
+	return consumer{
 		id:        xid.New().String(),
 		topic:     topic,
+		source:    topic,
 		store:     b.store,
 		eventChan: make(chan eventType),
+		kick:      make(chan struct{}),
+		stopping:  b.stopping,
 		notifier:  b,
+		publisher: b,
+		backoff:   b.topicBackoff,
+		receipts:  b.receipts,
+		hooks:     b.hooks,
+		now:       b.now,
+
+		ackTimeout:    b.ackTimeout,
+		maxAckTimeout: b.maxAckTimeout,
+		onDisconnect:  b.onDisconnect,
+		deadLetters:   b.deadLetters,
+		keepExpired:   b.keepExpired,
+		processing:    &b.processing,
+		throughput:    &b.throughput,
+		confirms:      &b.confirms,
+		slots:         &b.inFlight,
+		partitions:    b.partitions,
+		assigner:      &b.assigner,
+		taps:          &b.taps,
+		delayed:       &b.delayed,
+		interceptors:  b.interceptors,
+		backlog:       b.checkBacklog,
 	}
+}
 
-	b.consumers[topic] = append(b.consumers[topic], cons)
+// Unsubscribe removes a consumer from its topic, once it has gone away. The
+// group of a broadcast consumer is removed along with it, and the partitions
+// it holds are released.
+func (b *broker) Unsubscribe(cons *consumer) {
+	// Deferred first, so they run once the broker is unlocked
+	defer b.removeBroadcast(cons.topic)
+	defer b.releasePartitions(cons)
 
-	return &cons
+	b.Lock()
+	defer b.Unlock()
+
+	conss := b.consumers[cons.topic]
+	for i, c := range conss {
+		if c.id == cons.id {
+			b.consumers[cons.topic] = append(conss[:i], conss[i+1:]...)
+			break
+		}
+	}
+
+	b.weights.remove(cons.topic, cons.id)
+
+	if len(b.consumers[cons.topic]) == 0 {
+		delete(b.consumers, cons.topic)
+	}
+}
+
+// subscribed filters out the topics which require a subscriber and have
+// none.
+func (b *broker) subscribed(topics []string) []string {
+	b.RLock()
+	defer b.RUnlock()
+
+	var out []string
+	for _, t := range topics {
+		require := b.requireSubscriber || b.configs[t].RequireSubscriber
+		if require && len(b.consumers[t]) == 0 {
+			continue
+		}
+
+		out = append(out, t)
+	}
+
+	return out
 }
 
 // Shutdown the broker.
 func (b *broker) Shutdown() error {
+	b.shutdownOnce.Do(func() {
+		close(b.done)
+
+		if b.batcher != nil {
+			b.batcher.flush()
+		}
+
+		if n := b.delayed.stop(); n > 0 {
+			log.Info().Int("count", n).Msg("delayed messages held in the store until restart")
+		}
+	})
+
 	return b.store.Close()
 }
 
 // NotifyConsumers notifies a waiting consumer of a topic that an event has
-// occurred.
+// occurred, choosing between them in proportion to their weights.
 func (b *broker) NotifyConsumer(topic string, ev eventType) {
 	b.RLock()
 	defer b.RUnlock()
 
-	for _, c := range b.consumers[topic] {
+	conss := b.consumers[topic]
+
+	// Consumers replaying the topic read every message published, rather than
+	// taking turns
+	if ev == eventTypePublish {
+		for _, c := range conss {
+			if c.replay != nil {
+				c.replay.notify()
+			}
+		}
+	}
+
+	b.weights.notify(topic, conss, func(c consumer) bool {
+		if c.replay != nil {
+			return false
+		}
+
 		select {
 		case c.eventChan <- ev:
-			return
+			return true
 		default: // If there is noone listening noop
+			return false
 		}
-	}
+	})
 }
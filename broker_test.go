@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"testing"
 
 	gomock "github.com/golang/mock/gomock"
@@ -17,11 +18,13 @@ func TestBrokerPublish(t *testing.T) {
 	)
 
 	mockStore := NewMockstorer(ctrl)
-	mockStore.EXPECT().Insert(topic, value)
+	mockStore.EXPECT().Insert(topic, value, gomock.Any())
 
 	b := newBroker(mockStore)
 
-	assert.NoError(t, b.Publish(topic, value))
+	id, err := b.Publish(topic, value, messageMeta{})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
 }
 
 func TestBrokerSubscribe(t *testing.T) {
@@ -39,3 +42,145 @@ func TestBrokerSubscribe(t *testing.T) {
 
 	assert.IsType(t, &consumer{}, c)
 }
+
+func TestBrokerPublish_RequireSubscriber(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		topic = "test_topic"
+		value = []byte("test_value")
+	)
+
+	// Only the publish made while subscribed is stored
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().Insert(topic, value, gomock.Any()).Times(1)
+
+	b := newBroker(mockStore, withRequireSubscriber(true))
+
+	_, err := b.Publish(topic, value, messageMeta{})
+	assert.Equal(t, errNoSubscribers, err)
+
+	c := b.Subscribe(topic)
+
+	id, err := b.Publish(topic, value, messageMeta{})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	b.Unsubscribe(c)
+
+	_, err = b.Publish(topic, value, messageMeta{})
+	assert.Equal(t, errNoSubscribers, err)
+}
+
+func TestBrokerPublish_RequireSubscriberTopicConfig(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		topic = "test_topic"
+		other = "other_topic"
+		value = []byte("test_value")
+	)
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().PutTopicConfig(topic, gomock.Any())
+	mockStore.EXPECT().Insert(other, value, gomock.Any())
+
+	b := newBroker(mockStore)
+	assert.NoError(t, b.SetTopicConfig(topic, topicConfig{RequireSubscriber: true}))
+
+	_, err := b.Publish(topic, value, messageMeta{})
+	assert.Equal(t, errNoSubscribers, err)
+
+	// Other topics still store for later by default
+	_, err = b.Publish(other, value, messageMeta{})
+	assert.NoError(t, err)
+}
+
+func TestBrokerPublish_DefaultHeaders(t *testing.T) {
+	defaults := map[string]string{
+		"content-type": "application/json",
+		headerReplyTo:  "replies",
+		"X-Tenant":     "acme",
+	}
+
+	tests := []struct {
+		name       string
+		defaults   map[string]string
+		header     http.Header
+		meta       messageMeta
+		wantHeader http.Header
+		wantMeta   messageMeta
+	}{
+		{
+			name:     "inherits topic defaults",
+			defaults: defaults,
+			header:   http.Header{"X-Other": {"other"}},
+			wantHeader: http.Header{
+				"Content-Type":  {"application/json"},
+				"X-Mq-Reply-To": {"replies"},
+				"X-Tenant":      {"acme"},
+				"X-Other":       {"other"},
+			},
+			wantMeta: messageMeta{ContentType: "application/json", ReplyTo: "replies"},
+		},
+		{
+			name:     "producer overrides defaults",
+			defaults: defaults,
+			header: http.Header{
+				"Content-Type": {"text/plain"},
+				"X-Tenant":     {"initech"},
+			},
+			meta: messageMeta{ContentType: "text/plain"},
+			wantHeader: http.Header{
+				"Content-Type":  {"text/plain"},
+				"X-Mq-Reply-To": {"replies"},
+				"X-Tenant":      {"initech"},
+			},
+			wantMeta: messageMeta{ContentType: "text/plain", ReplyTo: "replies"},
+		},
+		{
+			name:       "no defaults",
+			header:     http.Header{"X-Tenant": {"initech"}},
+			wantHeader: http.Header{"X-Tenant": {"initech"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			// Routers see the headers the message is published with
+			var routed http.Header
+			b := newBroker(helperNewMemStore(t), withRouter(func(topic string, msg message) []string {
+				routed = msg.Meta.Header
+				return []string{topic}
+			}))
+			assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{Headers: tt.defaults}))
+
+			meta := tt.meta
+			meta.Header = tt.header
+
+			_, err := b.Publish(defaultTopic, []byte("test_value"), meta)
+			assert.NoError(err)
+			assert.Equal(tt.wantHeader, routed)
+
+			msgs, err := b.Peek(defaultTopic, 1)
+			assert.NoError(err)
+			assert.Equal(tt.wantMeta.ContentType, msgs[0].meta.ContentType)
+			assert.Equal(tt.wantMeta.ReplyTo, msgs[0].meta.ReplyTo)
+
+			// The producer's headers are left as they were
+			assert.Equal(tt.header, meta.Header)
+		})
+	}
+}
+
+func TestTopicConfigValidate_Headers(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(topicConfig{Headers: map[string]string{"X-Tenant": "acme"}}.validate())
+	assert.Error(topicConfig{Headers: map[string]string{"": "acme"}}.validate())
+	assert.Error(topicConfig{Headers: map[string]string{"X Tenant": "acme"}}.validate())
+}
@@ -0,0 +1,162 @@
+package main
+
+// cacheEntry is a value cached along with its metadata.
+type cacheEntry struct {
+	val  value
+	meta messageMeta
+}
+
+// topicCache holds a contiguous window of values on a topic, starting at the
+// offset start.
+type topicCache struct {
+	start   int
+	entries []cacheEntry
+}
+
+func (tc *topicCache) end() int {
+	return tc.start + len(tc.entries)
+}
+
+// headCache is a write-through cache of values waiting at the head of each
+// topic, bounded to size values per topic. It mirrors the store exactly for
+// the offsets it holds, such that a hit can be served without reading from
+// the store. It is not safe for concurrent use, the store lock must be held.
+type headCache struct {
+	size   int
+	topics map[string]*topicCache
+}
+
+// newHeadCache returns a cache holding up to size values per topic. A size of
+// zero or less disables the cache, returning nil.
+func newHeadCache(size int) *headCache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &headCache{
+		size:   size,
+		topics: map[string]*topicCache{},
+	}
+}
+
+// take removes and returns the value at offset, if it is at the start of the
+// cached window for the topic.
+func (c *headCache) take(topic string, offset int) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+
+	tc, ok := c.topics[topic]
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	// Drop anything which has fallen behind the head, it can no longer be read
+	for len(tc.entries) > 0 && tc.start < offset {
+		tc.entries = tc.entries[1:]
+		tc.start++
+	}
+
+	if len(tc.entries) == 0 || tc.start != offset {
+		c.dropEmpty(topic)
+		return cacheEntry{}, false
+	}
+
+	e := tc.entries[0]
+	tc.entries = tc.entries[1:]
+	tc.start++
+	c.dropEmpty(topic)
+
+	return e, true
+}
+
+// append caches a value inserted at the tail of the topic, so long as it
+// extends the cached window and there is space for it.
+func (c *headCache) append(topic string, offset int, e cacheEntry) {
+	if c == nil {
+		return
+	}
+
+	tc, ok := c.topics[topic]
+	if !ok {
+		c.topics[topic] = &topicCache{start: offset, entries: []cacheEntry{e}}
+		return
+	}
+
+	if tc.end() != offset || len(tc.entries) >= c.size {
+		return
+	}
+
+	tc.entries = append(tc.entries, e)
+}
+
+// prepend caches a value returned to the head of the topic. To keep the window
+// contiguous, the value is only cached if it directly precedes the window,
+// evicting the last value of the window if it is full.
+func (c *headCache) prepend(topic string, offset int, e cacheEntry) {
+	if c == nil {
+		return
+	}
+
+	tc, ok := c.topics[topic]
+	if !ok {
+		c.topics[topic] = &topicCache{start: offset, entries: []cacheEntry{e}}
+		return
+	}
+
+	if tc.start != offset+1 {
+		return
+	}
+
+	if len(tc.entries) >= c.size {
+		tc.entries = tc.entries[:len(tc.entries)-1]
+	}
+
+	tc.entries = append([]cacheEntry{e}, tc.entries...)
+	tc.start = offset
+}
+
+// replace swaps the value cached at offset, if the offset is cached.
+func (c *headCache) replace(topic string, offset int, e cacheEntry) {
+	if c == nil {
+		return
+	}
+
+	tc, ok := c.topics[topic]
+	if !ok || offset < tc.start || offset >= tc.end() {
+		return
+	}
+
+	tc.entries[offset-tc.start] = e
+}
+
+// drop removes every cached value of the topic.
+func (c *headCache) drop(topic string) {
+	if c == nil {
+		return
+	}
+
+	delete(c.topics, topic)
+}
+
+func (c *headCache) dropEmpty(topic string) {
+	if tc, ok := c.topics[topic]; ok && len(tc.entries) == 0 {
+		delete(c.topics, topic)
+	}
+}
+
+// resetDeliveries zeroes the delivery count of each cached value of the topic.
+func (c *headCache) resetDeliveries(topic string) {
+	if c == nil {
+		return
+	}
+
+	tc, ok := c.topics[topic]
+	if !ok {
+		return
+	}
+
+	for i := range tc.entries {
+		tc.entries[i].meta.Deliveries = 0
+	}
+}
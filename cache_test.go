@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helperCacheScenario runs a mix of inserts, deliveries, ACKs and NACKs
+// against the store, returning the values in the order they were delivered.
+func helperCacheScenario(t *testing.T, s storer) []string {
+	t.Helper()
+
+	var delivered []string
+
+	next := func() int {
+		val, _, offset, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+
+		delivered = append(delivered, string(val))
+
+		return offset
+	}
+
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, s.Insert(defaultTopic, []byte(fmt.Sprintf("msg_%d", i)), messageMeta{ID: fmt.Sprint(i)}))
+	}
+
+	a := next()
+	b := next()
+
+	// NACK both, returning them to the head in reverse order
+	assert.NoError(t, s.Nack(defaultTopic, a))
+	assert.NoError(t, s.Nack(defaultTopic, b))
+
+	a = next()
+	assert.NoError(t, s.Ack(defaultTopic, a))
+
+	for i := 6; i <= 8; i++ {
+		assert.NoError(t, s.Insert(defaultTopic, []byte(fmt.Sprintf("msg_%d", i)), messageMeta{ID: fmt.Sprint(i)}))
+	}
+
+	b = next()
+	assert.NoError(t, s.Nack(defaultTopic, b))
+
+	for {
+		_, _, offset, err := s.GetNext(defaultTopic)
+		if err == errNoMessages {
+			break
+		}
+		assert.NoError(t, err)
+
+		meta, err := s.GetMeta(defaultTopic, offset)
+		assert.NoError(t, err)
+		delivered = append(delivered, fmt.Sprintf("%s:%d", meta.ID, meta.Deliveries))
+
+		assert.NoError(t, s.Ack(defaultTopic, offset))
+	}
+
+	return delivered
+}
+
+func TestHeadCacheConsistency(t *testing.T) {
+	uncached := newStore(tmpDBPath)
+	expected := helperCacheScenario(t, uncached)
+	uncached.Destroy()
+
+	assert.Equal(t, []string{
+		"msg_1", "msg_2", "msg_2", "msg_1",
+		"1:3", "3:1", "4:1", "5:1", "6:1", "7:1", "8:1",
+	}, expected)
+
+	for _, size := range []int{1, 2, 3, 100} {
+		t.Run(fmt.Sprintf("size_%d", size), func(t *testing.T) {
+			s := newStore(tmpDBPath, withHeadCache(size))
+			t.Cleanup(s.Destroy)
+
+			assert.Equal(t, expected, helperCacheScenario(t, s))
+		})
+	}
+}
+
+func TestHeadCacheHit(t *testing.T) {
+	s := newStore(tmpDBPath, withHeadCache(2)).(*store)
+	t.Cleanup(s.Destroy)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("msg_1"), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("msg_2"), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("msg_3"), messageMeta{}))
+
+	for _, exp := range []string{"msg_1", "msg_2", "msg_3"} {
+		val, _, _, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+		assert.Equal(t, exp, string(val))
+	}
+
+	// Only the value which did not fit in the cache is read from the db
+	assert.Equal(t, 1, s.reads)
+}
+
+func BenchmarkGetNext(b *testing.B) {
+	for _, size := range []int{0, 16} {
+		b.Run(fmt.Sprintf("cache_%d", size), func(b *testing.B) {
+			s := newStore(tmpDBPath, withHeadCache(size)).(*store)
+			defer s.Destroy()
+
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				if err := s.Insert(defaultTopic, []byte("test_value"), messageMeta{}); err != nil {
+					b.Fatal(err)
+				}
+
+				_, _, offset, err := s.GetNext(defaultTopic)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err := s.Ack(defaultTopic, offset); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(s.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
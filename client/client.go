@@ -0,0 +1,194 @@
+// Package client publishes to and subscribes to the topics of a miniqueue
+// server, wrapping its HTTP protocol.
+//
+// Subscriptions stream over a single full duplex request, so the server must
+// be reached over HTTP/2, as it is when served with TLS.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+
+	headerKey          = "X-MQ-Key"
+	headerPartitionKey = "X-MQ-Partition-Key"
+	headerPrefix       = "X-Miniqueue-"
+)
+
+// Client is a client of a miniqueue server. It is safe for concurrent use.
+type Client struct {
+	addr string
+	http *http.Client
+
+	// minBackoff and maxBackoff bound the wait between attempts to reconnect
+	// a subscription, which doubles with each failed attempt.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient makes requests with the given client, such as one trusting
+// the certificate of the server. The default client is used otherwise.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithReconnectBackoff waits from min up to max between attempts to reconnect
+// a subscription, doubling the wait with each failed attempt.
+func WithReconnectBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// New returns a client of the server at addr, e.g. https://localhost:8080.
+func New(addr string, opts ...Option) *Client {
+	c := &Client{
+		addr:       strings.TrimSuffix(addr, "/"),
+		http:       http.DefaultClient,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Error is an error returned by the server.
+type Error struct {
+	// Code is the HTTP status the server responded with, zero for an error
+	// sent on a subscription.
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("miniqueue: %s", e.Message)
+	}
+
+	return fmt.Sprintf("miniqueue: %d %s", e.Code, e.Message)
+}
+
+// PublishOption configures a published message.
+type PublishOption func(*http.Request)
+
+// ContentType publishes the message with the media type, e.g.
+// application/json.
+func ContentType(contentType string) PublishOption {
+	return func(r *http.Request) {
+		r.Header.Set("Content-Type", contentType)
+	}
+}
+
+// Key publishes the message with the key, replacing the message with the same
+// key waiting on a compacted topic.
+func Key(key string) PublishOption {
+	return func(r *http.Request) {
+		r.Header.Set(headerKey, key)
+	}
+}
+
+// PartitionKey publishes the message with the partition key. On a partitioned
+// topic, messages with the same partition key are delivered in order, one at a
+// time. The key set by Key is used otherwise.
+func PartitionKey(key string) PublishOption {
+	return func(r *http.Request) {
+		r.Header.Set(headerPartitionKey, key)
+	}
+}
+
+// Header publishes the message with the header, delivered along with it in
+// Message.Headers. The name is sent prefixed with X-Miniqueue-.
+func Header(name, value string) PublishOption {
+	return func(r *http.Request) {
+		r.Header.Set(headerPrefix+name, value)
+	}
+}
+
+// Priority publishes the message with a priority from 0 up to 9, delivered
+// ahead of the messages waiting on the topic with a lower priority.
+func Priority(p int) PublishOption {
+	return func(r *http.Request) {
+		q := r.URL.Query()
+		q.Set("priority", strconv.Itoa(p))
+		r.URL.RawQuery = q.Encode()
+	}
+}
+
+// Publish publishes body to the topic, returning the ID assigned to the
+// message. A message dropped as the topic has no subscribers, where the topic
+// requires one, is published with an empty ID.
+func (c *Client) Publish(ctx context.Context, topic string, body []byte, opts ...PublishOption) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.topicURL("publish", topic), bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("creating request: %v", err)
+	}
+
+	for _, opt := range opts {
+		opt(req)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("publishing: %v", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusCreated:
+	case http.StatusNoContent:
+		return "", nil
+	default:
+		return "", responseError(res)
+	}
+
+	var pub struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&pub); err != nil {
+		return "", fmt.Errorf("decoding response: %v", err)
+	}
+
+	return pub.ID, nil
+}
+
+// topicURL returns the URL of the endpoint for the topic.
+func (c *Client) topicURL(endpoint, topic string) string {
+	return c.addr + "/" + endpoint + "/" + url.PathEscape(topic)
+}
+
+// responseError returns the error the server responded with.
+func responseError(res *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+	if err := json.Unmarshal(b, &body); err != nil || body.Error == "" {
+		body.Error = strings.TrimSpace(string(b))
+	}
+
+	return &Error{Code: res.StatusCode, Message: body.Error}
+}
@@ -0,0 +1,351 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	cmdInit  = "INIT"
+	cmdAck   = "ACK"
+	cmdNack  = "NACK"
+	cmdClose = "CLOSE"
+)
+
+// ErrResolved is returned when ACKing or NACKing a message which has already
+// been ACKed or NACKed, or whose handler has returned.
+var ErrResolved = errors.New("miniqueue: message already resolved")
+
+// Handler processes a message delivered to a subscription. A message the
+// handler neither ACKs nor NACKs is ACKed once it returns nil, or NACKed with
+// the error as the reason otherwise.
+type Handler func(ctx context.Context, msg *Message) error
+
+// Message is a message delivered to a subscription.
+type Message struct {
+	ID          string
+	Body        []byte
+	ContentType string
+
+	// PublishedAt is the time the message was published.
+	PublishedAt time.Time
+
+	// Deliveries is the number of times the message has been delivered,
+	// including this one.
+	Deliveries int
+
+	// Headers are the headers the message was published with, keyed by their
+	// name without the X-Miniqueue- prefix.
+	Headers map[string]string
+
+	// Priority is the priority the message was published with.
+	Priority int
+
+	// Seq counts up from 1 with each message delivered on a connection,
+	// starting again once the subscription reconnects.
+	Seq int
+
+	// Redelivered is set if the message has been delivered before, to this or
+	// another consumer.
+	Redelivered bool
+
+	// NackReasons are the reasons the message was previously NACKed for.
+	NackReasons []string
+
+	conn     *subConn
+	resolved bool
+}
+
+// Ack acknowledges the message, removing it from the topic.
+func (m *Message) Ack() error {
+	return m.resolve(command{Cmd: cmdAck})
+}
+
+// Nack negatively acknowledges the message, returning it to the topic to be
+// delivered again.
+func (m *Message) Nack() error {
+	return m.resolve(command{Cmd: cmdNack})
+}
+
+// NackWithReason negatively acknowledges the message, recording the reason
+// with it.
+func (m *Message) NackWithReason(reason string) error {
+	return m.resolve(command{Cmd: cmdNack, Reason: reason})
+}
+
+// NackWithDelay negatively acknowledges the message, holding it back from
+// redelivery for the delay rather than the topic's backoff.
+func (m *Message) NackWithDelay(delay time.Duration) error {
+	return m.resolve(command{Cmd: cmdNack, Delay: delay.String()})
+}
+
+func (m *Message) resolve(cmd command) error {
+	if m.resolved {
+		return ErrResolved
+	}
+	m.resolved = true
+
+	return m.conn.send(cmd)
+}
+
+// Subscribe consumes the topic, calling handler with each message in turn,
+// until ctx is done, returning its error. Messages are consumed one at a time,
+// the next being delivered once the last is ACKed or NACKed.
+//
+// A lost connection is reconnected with backoff, the server returning the
+// message outstanding on it to the topic. A subscription the server rejects
+// as invalid, with a 4xx status, is not retried, returning an *Error.
+func (c *Client) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	backoff := c.minBackoff
+
+	for {
+		err := c.consume(ctx, topic, handler, func() { backoff = c.minBackoff })
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var serr *Error
+		if errors.As(err, &serr) && isPermanent(serr.Code) {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// isPermanent reports whether a subscription rejected with the status will be
+// rejected again if retried.
+func isPermanent(code int) bool {
+	return code >= 400 && code < 500 &&
+		code != http.StatusRequestTimeout &&
+		code != http.StatusTooManyRequests
+}
+
+// consume consumes the topic over a single connection until it fails, calling
+// delivered with each message received.
+func (c *Client) consume(ctx context.Context, topic string, handler Handler, delivered func()) error {
+	conn, err := c.dial(ctx, topic)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	for {
+		msg, err := conn.next()
+		if err != nil {
+			return err
+		}
+
+		delivered()
+
+		herr := handler(ctx, msg)
+		if !msg.resolved {
+			if herr != nil {
+				err = msg.NackWithReason(herr.Error())
+			} else {
+				err = msg.Ack()
+			}
+		}
+		msg.resolved = true
+
+		if err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// command is sent to the server to drive the subscription.
+type command struct {
+	Cmd    string `json:"cmd"`
+	Reason string `json:"reason,omitempty"`
+	Delay  string `json:"delay,omitempty"`
+}
+
+// frame is a response sent by the server on a subscription.
+type frame struct {
+	Signal      string   `json:"signal,omitempty"`
+	ID          string   `json:"id,omitempty"`
+	Msg         string   `json:"msg,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Seq         int      `json:"seq,omitempty"`
+	Redelivered bool     `json:"redelivered,omitempty"`
+	NackReasons []string `json:"nack_reasons,omitempty"`
+	Stream      bool     `json:"stream,omitempty"`
+
+	PublishedAt time.Time         `json:"published_at,omitempty"`
+	Deliveries  int               `json:"deliveries,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+}
+
+// subConn is a single connection of a subscription, streaming commands in the
+// request body and messages in the response.
+type subConn struct {
+	body *io.PipeWriter
+	res  *http.Response
+	enc  *json.Encoder
+	dec  *json.Decoder
+
+	// src is the source of dec, which changes as streamed messages are read
+	src io.Reader
+}
+
+// dial subscribes to the topic, sending INIT as the subscription is made.
+func (c *Client) dial(ctx context.Context, topic string) (*subConn, error) {
+	init, err := json.Marshal(command{Cmd: cmdInit})
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+
+	// The transport closing the body closes the pipe, so that commands to a
+	// server which has gone away fail rather than block
+	body := struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(append(init, '\n')), pr), pr}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.topicURL("subscribe", topic), body)
+	if err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("subscribing: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		pw.Close()
+
+		return nil, responseError(res)
+	}
+
+	return &subConn{
+		body: pw,
+		res:  res,
+		enc:  json.NewEncoder(pw),
+		dec:  json.NewDecoder(res.Body),
+		src:  res.Body,
+	}, nil
+}
+
+// next reads the next message sent by the server, skipping frames which carry
+// none, such as keepalives.
+func (s *subConn) next() (*Message, error) {
+	for {
+		var f frame
+		if err := s.dec.Decode(&f); err != nil {
+			return nil, fmt.Errorf("decoding response: %v", err)
+		}
+
+		if f.Error != "" {
+			return nil, &Error{Message: f.Error}
+		}
+		if f.Signal != "" {
+			continue
+		}
+
+		body := []byte(f.Msg)
+		if f.Stream {
+			var buf bytes.Buffer
+
+			// The stream follows the newline terminating the frame
+			s.src = io.MultiReader(s.dec.Buffered(), s.src)
+
+			var newline [1]byte
+			if _, err := io.ReadFull(s.src, newline[:]); err != nil {
+				return nil, fmt.Errorf("reading streamed message: %v", err)
+			}
+
+			if err := readStream(&buf, s.src); err != nil {
+				return nil, fmt.Errorf("reading streamed message: %v", err)
+			}
+			s.dec = json.NewDecoder(s.src)
+
+			body = buf.Bytes()
+		}
+
+		return &Message{
+			ID:          f.ID,
+			Body:        body,
+			ContentType: f.ContentType,
+			PublishedAt: f.PublishedAt,
+			Deliveries:  f.Deliveries,
+			Headers:     f.Headers,
+			Priority:    f.Priority,
+			Seq:         f.Seq,
+			Redelivered: f.Redelivered,
+			NackReasons: f.NackReasons,
+			conn:        s,
+		}, nil
+	}
+}
+
+// send writes the command to the server. Its response is read by next.
+func (s *subConn) send(cmd command) error {
+	if err := s.enc.Encode(cmd); err != nil {
+		return fmt.Errorf("sending %s: %v", cmd.Cmd, err)
+	}
+
+	return nil
+}
+
+// close closes the subscription, returning any outstanding message to the
+// topic.
+func (s *subConn) close() {
+	_ = s.send(command{Cmd: cmdClose})
+	s.body.Close()
+
+	// Wait for the server to finish with the stream, so that the outstanding
+	// message is released by the time the close returns
+	_, _ = io.Copy(ioutil.Discard, s.res.Body)
+	s.res.Body.Close()
+}
+
+// readStream copies the body of a streamed message from r to w, read as
+// chunks prefixed by their length as a big endian uint32, until an empty
+// chunk.
+func readStream(w io.Writer, r io.Reader) error {
+	var prefix [4]byte
+
+	for {
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			return err
+		}
+
+		n := binary.BigEndian.Uint32(prefix[:])
+		if n == 0 {
+			return nil
+		}
+
+		if _, err := io.CopyN(w, r, int64(n)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomarrell/miniqueue/client"
+)
+
+func helperNewClient(t *testing.T, b *broker) *client.Client {
+	t.Helper()
+
+	srv := helperNewTLSServer(t, newServer(b))
+
+	return client.New(srv.URL,
+		client.WithHTTPClient(srv.Client()),
+		client.WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond),
+	)
+}
+
+func TestClientSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	c := helperNewClient(t, b)
+
+	large := bytes.Repeat([]byte("a"), streamThreshold+1)
+
+	var ids []string
+	for _, body := range [][]byte{[]byte("test_value_1"), large, []byte("test_value_3")} {
+		id, err := c.Publish(context.Background(), defaultTopic, body, client.Header("Trace-Id", "test_trace"))
+		assert.NoError(err)
+		ids = append(ids, id)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var got []*client.Message
+	err := c.Subscribe(ctx, defaultTopic, func(ctx context.Context, msg *client.Message) error {
+		got = append(got, msg)
+
+		switch len(got) {
+		case 1:
+			// The failed message is NACKed, and delivered again
+			return errors.New("test_failure")
+		case 2:
+			// The connection is lost, returning the next message to the topic
+			assert.NoError(msg.Ack())
+			assert.Equal(client.ErrResolved, msg.Ack())
+
+			return nil
+		case 3:
+			assert.NoError(b.DisconnectConsumer(defaultTopic, b.ConsumerIDs(defaultTopic)[0]))
+		case 5:
+			cancel()
+		}
+
+		return nil
+	})
+	assert.Equal(context.Canceled, err)
+
+	if !assert.Len(got, 5) {
+		return
+	}
+
+	assert.Equal(ids[0], got[0].ID)
+	assert.Equal(map[string]string{"Trace-Id": "test_trace"}, got[0].Headers)
+	assert.False(got[0].PublishedAt.IsZero())
+	assert.Equal(ids[0], got[1].ID)
+	assert.True(got[1].Redelivered)
+	assert.Equal(2, got[1].Deliveries)
+	assert.Equal([]string{"test_failure"}, got[1].NackReasons)
+
+	assert.Equal(ids[1], got[2].ID)
+	assert.Equal(large, got[2].Body)
+
+	// The subscription reconnected after it was disconnected
+	assert.Equal(ids[1], got[3].ID)
+	assert.Equal(1, got[3].Seq)
+	assert.Equal(ids[2], got[4].ID)
+	assert.Equal(value("test_value_3"), value(got[4].Body))
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Zero(n)
+}
+
+func TestClientNackWithDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	c := helperNewClient(t, newBroker(helperNewMemStore(t)))
+
+	_, err := c.Publish(context.Background(), defaultTopic, []byte("test_value"))
+	assert.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var nacked time.Time
+	err = c.Subscribe(ctx, defaultTopic, func(ctx context.Context, msg *client.Message) error {
+		if nacked.IsZero() {
+			nacked = time.Now()
+			return msg.NackWithDelay(100 * time.Millisecond)
+		}
+
+		// Redelivered once the delay has elapsed
+		assert.GreaterOrEqual(int64(time.Since(nacked)), int64(100*time.Millisecond))
+		cancel()
+
+		return nil
+	})
+	assert.Equal(context.Canceled, err)
+}
+
+func TestClientPublish_Rejected(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{ContentType: "application/json"}))
+
+	c := helperNewClient(t, b)
+
+	_, err := c.Publish(context.Background(), defaultTopic, []byte("test_value"), client.ContentType("text/plain"))
+
+	var cerr *client.Error
+	assert.True(errors.As(err, &cerr))
+	assert.Equal(&client.Error{Code: http.StatusUnsupportedMediaType, Message: errContentType.Error()}, cerr)
+
+	id, err := c.Publish(context.Background(), defaultTopic, []byte(`{}`), client.ContentType("application/json"))
+	assert.NoError(err)
+	assert.NotEmpty(id)
+}
+
+func TestClientSubscribe_Rejected(t *testing.T) {
+	assert := assert.New(t)
+
+	c := helperNewClient(t, newBroker(helperNewMemStore(t)))
+
+	err := c.Subscribe(context.Background(), fmt.Sprintf("%s/%s", defaultTopic, "nested"), func(context.Context, *client.Message) error {
+		return nil
+	})
+
+	var cerr *client.Error
+	assert.True(errors.As(err, &cerr))
+	assert.Equal(http.StatusNotFound, cerr.Code)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// command is sent by a subscribed client to drive its consumer. It is either
+// encoded as a plain string, e.g. "ACK", or as an object carrying options,
+// e.g. {"cmd": "INIT", "block": false}.
+type command struct {
+	Cmd string `json:"cmd"`
+
+	// Hello names the protocol spoken by the client, sent alone as the first
+	// frame when the server requires a handshake, e.g. "miniqueue/1".
+	Hello string `json:"hello,omitempty"`
+
+	// Block determines whether the consumer waits for a message when the topic
+	// is empty. Only read on INIT, defaults to true.
+	Block *bool `json:"block,omitempty"`
+
+	// AckTimeout overrides the broker's ack timeout for the consumer, as a
+	// duration e.g. "30s". Only read on INIT.
+	AckTimeout string `json:"ack_timeout,omitempty"`
+
+	// From replays the log of the topic from "earliest", "latest" or an
+	// offset, rather than consuming it. Only read on INIT.
+	From json.RawMessage `json:"from,omitempty"`
+
+	// Prefetch is how many messages the consumer may hold outstanding at once,
+	// which are streamed without waiting for each to be ACKed. Only read on
+	// INIT.
+	Prefetch int `json:"prefetch,omitempty"`
+
+	// Snapshot requests the depth of the topic is sent before the first
+	// message. Only read on INIT.
+	Snapshot bool `json:"snapshot,omitempty"`
+
+	// IDs are the outstanding messages to ACK or NACK together. If empty, the
+	// most recently delivered message is used.
+	IDs []string `json:"ids,omitempty"`
+
+	// Result is published to the reply topic of the current message when it
+	// is ACKed. Ignored if the message has no reply topic.
+	Result *string `json:"result,omitempty"`
+
+	// Reason is recorded with the message when it is NACKed, e.g. "timeout".
+	Reason string `json:"reason,omitempty"`
+
+	// Delay holds NACKed messages back from redelivery for this long, as a
+	// duration e.g. "30s", in place of the backoff. Only read on NACK.
+	Delay string `json:"delay,omitempty"`
+
+	// Seq is the sequence number up to which outstanding messages are
+	// acknowledged by COMMIT.
+	Seq int `json:"seq,omitempty"`
+}
+
+// UnmarshalJSON decodes either form of command.
+func (c *command) UnmarshalJSON(b []byte) error {
+	*c = command{}
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`"`)) {
+		return json.Unmarshal(b, &c.Cmd)
+	}
+
+	// Avoid recursing into this method
+	type plain command
+
+	return json.Unmarshal(b, (*plain)(c))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandUnmarshal(t *testing.T) {
+	assert := assert.New(t)
+
+	var cmd command
+	assert.NoError(json.Unmarshal([]byte(`"ACK"`), &cmd))
+	assert.Equal(command{Cmd: CmdAck}, cmd)
+
+	assert.NoError(json.Unmarshal([]byte(`{"cmd":"INIT","block":false}`), &cmd))
+	assert.Equal(CmdInit, cmd.Cmd)
+	if assert.NotNil(cmd.Block) {
+		assert.False(*cmd.Block)
+	}
+
+	assert.NoError(json.Unmarshal([]byte(`{"cmd":"INIT"}`), &cmd))
+	assert.Equal(command{Cmd: CmdInit}, cmd)
+
+	assert.Error(json.Unmarshal([]byte(`12`), &cmd))
+}
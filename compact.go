@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Compacted topics keep only the latest value published with each key. The
+// store indexes the offset of the value waiting with each key, and of the
+// value awaiting acknowledgement with each key, so that a publish can replace
+// the waiting value in place.
+//
+// The length of the topic is included in the index keys, as both topics and
+// message keys may contain any character.
+const (
+	pendingKeyFmt     = "miniqueue-key-%d-%s-%s"
+	outstandingKeyFmt = "miniqueue-key-ack-%d-%s-%s"
+)
+
+func pendingKey(topic, key string) []byte {
+	return []byte(fmt.Sprintf(pendingKeyFmt, len(topic), topic, key))
+}
+
+func outstandingKey(topic, key string) []byte {
+	return []byte(fmt.Sprintf(outstandingKeyFmt, len(topic), topic, key))
+}
+
+// replacePending replaces the value waiting on the topic with the same key as
+// meta, reporting whether there was one to replace. The replaced value keeps
+// its place in the topic. The cache is updated once the returned function is
+// called.
+func (s *store) replacePending(db readWriter, topic string, val value, meta messageMeta) (cache func(), replaced bool, err error) {
+	offset, ok, err := keyOffset(db, pendingKey(topic, meta.Key), metaFmt, topic, meta.Key)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, nil
+	}
+
+	// The body of the replaced value, if it has one, goes with it
+	old, err := getMeta(db, metaFmt, topic, offset)
+	if err != nil {
+		return nil, false, err
+	}
+
+	batch := new(leveldb.Batch)
+	deleteBody(batch, topic, old)
+	batch.Put([]byte(fmt.Sprintf(topicFmt, topic, offset)), val)
+	batch.Put([]byte(fmt.Sprintf(metaFmt, topic, offset)), encodeMeta(meta))
+
+	if err := db.Write(batch, nil); err != nil {
+		return nil, false, fmt.Errorf("replacing value with key %s: %v", meta.Key, err)
+	}
+
+	return func() {
+		s.cache.replace(topic, offset, cacheEntry{val: val, meta: meta})
+	}, true, nil
+}
+
+// keyOffset returns the offset held by the index key, so long as the metadata
+// at that offset, given the key format, still carries the message key. A stale
+// index is reported as not found.
+func keyOffset(db readWriter, indexKey []byte, keyFmt, topic, key string) (int, bool, error) {
+	pos, err := db.Get(indexKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("getting offset of key %s: %v", key, err)
+	}
+
+	offset, err := binary.ReadVarint(bytes.NewReader(pos))
+	if err != nil {
+		return 0, false, fmt.Errorf("reading offset of key %s: %v", key, err)
+	}
+
+	meta, err := getMeta(db, keyFmt, topic, int(offset))
+	if err != nil {
+		return 0, false, err
+	}
+
+	return int(offset), meta.Key == key, nil
+}
+
+// keyOffsetTx returns the offset held by the index key, so long as the
+// metadata at that offset, given the key format, still carries the message
+// key. A stale index is reported as not found.
+func keyOffsetTx(tx *leveldb.Transaction, indexKey []byte, keyFmt, topic, key string) (int, bool, error) {
+	pos, err := tx.Get(indexKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("getting offset of key %s: %v", key, err)
+	}
+
+	offset, err := binary.ReadVarint(bytes.NewReader(pos))
+	if err != nil {
+		return 0, false, fmt.Errorf("reading offset of key %s: %v", key, err)
+	}
+
+	meta, err := getMetaTx(tx, keyFmt, topic, int(offset))
+	if err != nil {
+		return 0, false, err
+	}
+
+	return int(offset), meta.Key == key, nil
+}
+
+// indexKey records the offset of the value with the key waiting on the topic.
+// Values without a key aren't indexed.
+func indexKey(db readWriter, topic, key string, offset int) error {
+	if key == "" {
+		return nil
+	}
+
+	if err := db.Put(pendingKey(topic, key), encodePos(offset), nil); err != nil {
+		return fmt.Errorf("putting pending key %s: %v", key, err)
+	}
+
+	return nil
+}
+
+// releaseKey adds the deletion of the outstanding index of the value awaiting
+// acknowledgement with meta to the batch, allowing the next value with its key
+// to be consumed.
+func releaseKey(batch *leveldb.Batch, topic string, meta messageMeta) {
+	if meta.Key != "" {
+		batch.Delete(outstandingKey(topic, meta.Key))
+	}
+}
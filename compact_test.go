@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestCompact_ReplacesPending(t *testing.T) {
+	for _, size := range []int{0, 10} {
+		s := newStore(tmpDBPath, withHeadCache(size))
+
+		assert := assert.New(t)
+
+		assert.NoError(s.Insert(defaultTopic, []byte("a1"), messageMeta{ID: "1", Key: "a"}))
+		assert.NoError(s.Insert(defaultTopic, []byte("b1"), messageMeta{ID: "2", Key: "b"}))
+		assert.NoError(s.Insert(defaultTopic, []byte("a2"), messageMeta{ID: "3", Key: "a"}))
+		assert.NoError(s.Insert(defaultTopic, []byte("none"), messageMeta{ID: "4"}))
+
+		n, err := s.Len(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(3, n)
+
+		// The latest value with the key keeps the place of the one it replaced
+		val, meta, _, err := s.GetNext(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(value("a2"), val)
+		assert.Equal("3", meta.ID)
+
+		val, _, _, err = s.GetNext(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(value("b1"), val)
+
+		val, _, _, err = s.GetNext(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(value("none"), val)
+
+		s.Destroy()
+	}
+}
+
+func TestCompact_WaitsForOutstanding(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	assert.NoError(s.Insert(defaultTopic, []byte("a1"), messageMeta{Key: "a"}))
+
+	_, _, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(err)
+
+	// The outstanding value isn't replaced, the new value waits behind it
+	assert.NoError(s.Insert(defaultTopic, []byte("a2"), messageMeta{Key: "a"}))
+	assert.NoError(s.Insert(defaultTopic, []byte("a3"), messageMeta{Key: "a"}))
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	_, _, _, err = s.GetNext(defaultTopic)
+	assert.Equal(errNoMessages, err)
+
+	assert.NoError(s.Ack(defaultTopic, offset))
+
+	val, _, _, err := s.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(value("a3"), val)
+}
+
+func TestCompact_SkipsHeldBack(t *testing.T) {
+	for _, size := range []int{0, 10} {
+		s := newStore(tmpDBPath, withHeadCache(size))
+
+		assert := assert.New(t)
+
+		assert.NoError(s.Insert(defaultTopic, []byte("a1"), messageMeta{Key: "a"}))
+
+		_, _, offset, err := s.GetNext(defaultTopic)
+		assert.NoError(err)
+
+		assert.NoError(s.Insert(defaultTopic, []byte("a2"), messageMeta{Key: "a"}))
+		assert.NoError(s.Insert(defaultTopic, []byte("b1"), messageMeta{Key: "b"}))
+		assert.NoError(s.Insert(defaultTopic, []byte("none"), messageMeta{}))
+
+		// The values behind the held back value are delivered in order
+		val, _, _, err := s.GetNext(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(value("b1"), val)
+
+		val, _, _, err = s.GetNext(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(value("none"), val)
+
+		_, _, _, err = s.GetNext(defaultTopic)
+		assert.Equal(errNoMessages, err)
+
+		n, err := s.Len(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(1, n)
+
+		assert.NoError(s.Ack(defaultTopic, offset))
+
+		val, _, _, err = s.GetNext(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(value("a2"), val)
+
+		s.Destroy()
+	}
+}
+
+func TestCompact_NackSuperseded(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	assert.NoError(s.Insert(defaultTopic, []byte("a1"), messageMeta{Key: "a"}))
+
+	_, _, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(err)
+
+	assert.NoError(s.Insert(defaultTopic, []byte("a2"), messageMeta{Key: "a"}))
+
+	// The newer value with the key supersedes the nacked value
+	assert.NoError(s.Nack(defaultTopic, offset))
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	val, _, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(value("a2"), val)
+
+	// Without a newer value, the nacked value is returned and may be replaced
+	assert.NoError(s.Nack(defaultTopic, offset))
+	assert.NoError(s.Insert(defaultTopic, []byte("a3"), messageMeta{Key: "a"}))
+
+	n, err = s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	val, _, _, err = s.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(value("a3"), val)
+}
+
+func TestBrokerPublish_Compact(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	assert.NoError(b.SetTopicConfig("compacted", topicConfig{Compact: true}))
+
+	for _, topic := range []string{"compacted", defaultTopic} {
+		_, err = b.Publish(topic, []byte("a1"), messageMeta{Key: "a"})
+		assert.NoError(err)
+		_, err = b.Publish(topic, []byte("a2"), messageMeta{Key: "a"})
+		assert.NoError(err)
+	}
+
+	// Keys are ignored on topics without compaction
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	c := b.Subscribe("compacted")
+
+	val, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("a2"), val)
+
+	_, err = b.Publish("compacted", []byte("a3"), messageMeta{Key: "a"})
+	assert.NoError(err)
+
+	// Consumers aren't safe for concurrent use, so another waits for the key
+	c2 := b.Subscribe("compacted")
+
+	next := make(chan value)
+	go func() {
+		val, err := c2.Next(context.Background())
+		assert.NoError(err)
+		next <- val
+	}()
+
+	// The consumer waits until the outstanding value with the key is acked
+	select {
+	case <-next:
+		t.Fatal("received value while its key was outstanding")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(c.Ack())
+
+	select {
+	case val := <-next:
+		assert.Equal(value("a3"), val)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for value after ack")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configFlag is the flag giving the path to the config file.
+	configFlag = "config"
+
+	// configTopicsKey is the key of the config file declaring topics, mapping
+	// each topic name to its config as in the -topics file. Given a path
+	// instead, it sets the -topics flag like any other.
+	configTopicsKey = "topics"
+
+	// configEnvPrefix prefixes the environment variable setting each flag,
+	// named after the flag in upper case with dashes replaced by underscores,
+	// e.g. MINIQUEUE_ACK_TIMEOUT for -ack-timeout.
+	configEnvPrefix = "MINIQUEUE_"
+)
+
+// loadConfig sets each flag of fs which wasn't given on the command line from
+// its environment variable, or else from the YAML config file named by the
+// config flag, returning the topics declared in the file. Keys in the file are
+// flag names, e.g.
+//
+//	port: 8443
+//	level: info
+//	ack-timeout: 30s
+//	topics:
+//	  orders: { max_length: 1000 }
+//
+// Unknown keys and invalid values are rejected, such that a mistake in the
+// config fails startup rather than being ignored.
+func loadConfig(fs *flag.FlagSet, getenv func(string) string) (map[string]topicConfig, error) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := configEnv(f.Name)
+
+		val := getenv(env)
+		if err != nil || set[f.Name] || val == "" {
+			return
+		}
+
+		if serr := fs.Set(f.Name, val); serr != nil {
+			err = fmt.Errorf("%s: %v", env, serr)
+			return
+		}
+
+		set[f.Name] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	path := fs.Lookup(configFlag).Value.String()
+	if path == "" {
+		return nil, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %v", err)
+	}
+
+	var cfg map[string]interface{}
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("decoding config file %s: %v", path, err)
+	}
+
+	var topics map[string]topicConfig
+	for key, val := range cfg {
+		if _, ok := val.(map[string]interface{}); ok && key == configTopicsKey {
+			if topics, err = configTopics(val); err != nil {
+				return nil, fmt.Errorf("config file %s: %v", path, err)
+			}
+
+			continue
+		}
+
+		if key == configFlag || fs.Lookup(key) == nil {
+			return nil, fmt.Errorf("config file %s: unknown option %s", path, key)
+		}
+
+		if set[key] {
+			continue
+		}
+
+		s, err := configValue(val)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %s: %v", path, key, err)
+		}
+
+		if err := fs.Set(key, s); err != nil {
+			return nil, fmt.Errorf("config file %s: %s: %v", path, key, err)
+		}
+	}
+
+	return topics, nil
+}
+
+// configEnv returns the name of the environment variable setting the flag.
+func configEnv(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configValue formats a value from the config file as it would be given on the
+// command line. A list is joined with commas, as taken by -peers.
+func configValue(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+
+			items = append(items, s)
+		}
+
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("expected a value, got a mapping")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// configTopics decodes the topics declared in the config file.
+func configTopics(val interface{}) (map[string]topicConfig, error) {
+	raw, err := json.Marshal(val)
+	if err != nil {
+		return nil, fmt.Errorf("encoding topics: %v", err)
+	}
+
+	return decodeTopics(raw)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func helperConfigFlags(args ...string) (*flag.FlagSet, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+
+	fs.String(configFlag, "", "")
+	fs.Int("port", defaultPort, "")
+	fs.String("level", defaultLogLevel, "")
+	fs.Duration("ack-timeout", defaultAckTimeout, "")
+	fs.String("peers", defaultPeers, "")
+	fs.String("topics", defaultTopicsFile, "")
+
+	return fs, fs.Parse(args)
+}
+
+func helperWriteConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "miniqueue.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	path := helperWriteConfigFile(t, `
+port: 8443
+level: info
+ack-timeout: 30s
+peers:
+  - https://peer-1:8080
+  - https://peer-2:8080
+topics:
+  orders: { max_length: 1000 }
+`)
+
+	fs, err := helperConfigFlags("-config", path, "-port", "9000")
+	assert.NoError(err)
+
+	env := map[string]string{"MINIQUEUE_LEVEL": "disabled"}
+
+	topics, err := loadConfig(fs, func(key string) string { return env[key] })
+	assert.NoError(err)
+
+	// The command line takes precedence over the environment, which takes
+	// precedence over the file
+	assert.Equal("9000", fs.Lookup("port").Value.String())
+	assert.Equal("disabled", fs.Lookup("level").Value.String())
+	assert.Equal((30 * time.Second).String(), fs.Lookup("ack-timeout").Value.String())
+	assert.Equal("https://peer-1:8080,https://peer-2:8080", fs.Lookup("peers").Value.String())
+	assert.Equal(map[string]topicConfig{"orders": {MaxLength: 1000}}, topics)
+
+	// The file itself may be given by the environment, and a path given to
+	// topics sets the flag
+	path = helperWriteConfigFile(t, `topics: ./topics.json`)
+
+	fs, err = helperConfigFlags()
+	assert.NoError(err)
+
+	env = map[string]string{"MINIQUEUE_CONFIG": path}
+
+	topics, err = loadConfig(fs, func(key string) string { return env[key] })
+	assert.NoError(err)
+	assert.Nil(topics)
+	assert.Equal("./topics.json", fs.Lookup("topics").Value.String())
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+	}{
+		{name: "malformed yaml", file: "port: [8080"},
+		{name: "unknown option", file: "prot: 8080"},
+		{name: "nested config", file: "config: ./other.yaml"},
+		{name: "invalid value", file: "port: eighty"},
+		{name: "mapping value", file: "level: { name: info }"},
+		{name: "invalid topic", file: "topics: { orders: { max_length: -1 } }"},
+		{name: "unknown topic setting", file: "topics: { orders: { max_len: 100 } }"},
+		{name: "invalid env", file: "", env: map[string]string{"MINIQUEUE_PORT": "eighty"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := helperConfigFlags("-config", helperWriteConfigFile(t, tt.file))
+			assert.NoError(t, err)
+
+			_, err = loadConfig(fs, func(key string) string { return tt.env[key] })
+			assert.Error(t, err)
+		})
+	}
+
+	fs, err := helperConfigFlags("-config", filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.NoError(t, err)
+
+	_, err = loadConfig(fs, func(string) string { return "" })
+	assert.Error(t, err)
+}
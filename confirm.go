@@ -0,0 +1,319 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// withConfirmWindow keeps ACKed messages as confirmed for the window, during
+// which a duplicate ACK of one succeeds rather than failing as unknown, and
+// it may be looked up or replayed onto its topic. After the window, it is
+// forgotten. Confirmed messages are held in memory, so don't survive a
+// restart. Zero forgets ACKed messages immediately.
+func withConfirmWindow(window time.Duration) brokerOption {
+	return func(b *broker) {
+		b.confirms.window = window
+	}
+}
+
+// confirmedMessage is a message ACKed within the confirmation window.
+type confirmedMessage struct {
+	val     value
+	meta    messageMeta
+	ackedAt time.Time
+}
+
+// confirmations holds the messages of each topic ACKed within the window. The
+// zero value keeps nothing.
+type confirmations struct {
+	window time.Duration
+	topics map[string]*confirmedTopic
+	sync.Mutex
+}
+
+// confirmedTopic holds the messages ACKed on a topic in the order they were
+// ACKed, such that those whose window has passed are forgotten from the front,
+// indexed by ID.
+type confirmedTopic struct {
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func (cs *confirmations) enabled() bool {
+	return cs != nil && cs.window > 0
+}
+
+// add confirms the message ACKed on the topic at now, forgetting the messages
+// of the topic whose window has passed.
+func (cs *confirmations) add(topic string, val value, meta messageMeta, now time.Time) {
+	if !cs.enabled() {
+		return
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	cs.prune(topic, now)
+
+	if cs.topics == nil {
+		cs.topics = map[string]*confirmedTopic{}
+	}
+
+	ct := cs.topics[topic]
+	if ct == nil {
+		ct = &confirmedTopic{order: list.New(), ids: map[string]*list.Element{}}
+		cs.topics[topic] = ct
+	}
+
+	// A message ACKed again moves to the back
+	if e, ok := ct.ids[meta.ID]; ok {
+		ct.order.Remove(e)
+	}
+
+	ct.ids[meta.ID] = ct.order.PushBack(confirmedMessage{val: val, meta: meta, ackedAt: now})
+}
+
+// get returns the message with the ID, if it was ACKed on the topic within
+// the window of now.
+func (cs *confirmations) get(topic, id string, now time.Time) (confirmedMessage, bool) {
+	if !cs.enabled() {
+		return confirmedMessage{}, false
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	cs.prune(topic, now)
+
+	ct := cs.topics[topic]
+	if ct == nil {
+		return confirmedMessage{}, false
+	}
+
+	e, ok := ct.ids[id]
+	if !ok {
+		return confirmedMessage{}, false
+	}
+
+	m := e.Value.(confirmedMessage)
+
+	// The clock may have stepped back, leaving it behind a newer message
+	if cs.expired(m, now) {
+		return confirmedMessage{}, false
+	}
+
+	return m, true
+}
+
+// sweep forgets the messages of every topic whose window has passed at now, so
+// that they don't linger on topics no longer ACKed on.
+func (cs *confirmations) sweep(now time.Time) {
+	if !cs.enabled() {
+		return
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	for topic := range cs.topics {
+		cs.prune(topic, now)
+	}
+}
+
+// prune forgets the messages of the topic whose window has passed at now,
+// oldest first, stopping at the first still within it. The lock must be held.
+func (cs *confirmations) prune(topic string, now time.Time) {
+	ct := cs.topics[topic]
+	if ct == nil {
+		return
+	}
+
+	for e := ct.order.Front(); e != nil; e = ct.order.Front() {
+		m := e.Value.(confirmedMessage)
+		if !cs.expired(m, now) {
+			break
+		}
+
+		ct.order.Remove(e)
+		delete(ct.ids, m.meta.ID)
+	}
+
+	if ct.order.Len() == 0 {
+		delete(cs.topics, topic)
+	}
+}
+
+func (cs *confirmations) expired(m confirmedMessage, now time.Time) bool {
+	return now.Sub(m.ackedAt) > cs.window
+}
+
+// pruneConfirmedPeriodically forgets confirmed messages whose window has
+// passed, by the clock of the broker, until the broker is shut down.
+func (b *broker) pruneConfirmedPeriodically() {
+	ticker := time.NewTicker(b.confirms.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.confirms.sweep(b.now())
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// unconfirmed returns the IDs which aren't of messages ACKed within the
+// confirmation window and no longer outstanding, which are ACKed again.
+func (c *consumer) unconfirmed(ids []string) []string {
+	if !c.confirms.enabled() {
+		return ids
+	}
+
+	now := c.now()
+
+	filtered := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := c.confirms.get(c.topic, id, now); ok && !c.isOutstanding(id) {
+			continue
+		}
+
+		filtered = append(filtered, id)
+	}
+
+	return filtered
+}
+
+// isOutstanding reports whether the message with the ID is outstanding on the
+// consumer.
+func (c *consumer) isOutstanding(id string) bool {
+	for _, d := range c.outstanding {
+		if d.meta.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Confirmed returns the message with the ID ACKed on the topic within the
+// confirmation window, or errNotConfirmed.
+func (b *broker) Confirmed(topic, id string) (confirmedMessage, error) {
+	m, ok := b.confirms.get(topic, id, b.now())
+	if !ok {
+		return confirmedMessage{}, errNotConfirmed
+	}
+
+	return m, nil
+}
+
+// Replay publishes the message with the ID ACKed on the topic within the
+// confirmation window onto the topic again, keeping its ID.
+func (b *broker) Replay(topic, id string) (string, error) {
+	m, err := b.Confirmed(topic, id)
+	if err != nil {
+		return "", err
+	}
+
+	return b.publish(topic, m.val, m.meta)
+}
+
+// confirmedResponse is a message ACKed within the confirmation window.
+type confirmedResponse struct {
+	ID          string    `json:"id"`
+	Msg         string    `json:"msg"`
+	ContentType string    `json:"content_type,omitempty"`
+	AckedAt     time.Time `json:"acked_at"`
+}
+
+// getConfirmed returns a message ACKed within the confirmation window.
+func getConfirmed(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "get_confirmed").
+			Str("topic", vars[topicVarKey]).
+			Str("msg_id", vars[msgIDVarKey]).
+			Logger()
+
+		m, err := broker.Confirmed(vars[topicVarKey], vars[msgIDVarKey])
+		if errors.Is(err, errNotConfirmed) {
+			log.Debug().Msg("message not confirmed")
+
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errNotConfirmed.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to get confirmed message")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errConfirmed.Error())
+
+			return
+		}
+
+		respondConfirmed(log, json.NewEncoder(w), confirmedResponse{
+			ID:          m.meta.ID,
+			Msg:         string(m.val),
+			ContentType: m.meta.ContentType,
+			AckedAt:     m.ackedAt,
+		})
+	}
+}
+
+// replayConfirmed publishes a message ACKed within the confirmation window
+// onto its topic again.
+func replayConfirmed(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "replay_confirmed").
+			Str("topic", vars[topicVarKey]).
+			Str("msg_id", vars[msgIDVarKey]).
+			Logger()
+
+		id, err := broker.Replay(vars[topicVarKey], vars[msgIDVarKey])
+		if errors.Is(err, errNotConfirmed) {
+			log.Debug().Msg("message not confirmed")
+
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errNotConfirmed.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to replay message")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errReplay.Error())
+
+			return
+		}
+
+		log.Info().Msg("replayed confirmed message")
+
+		w.WriteHeader(http.StatusCreated)
+		respondPublished(log, json.NewEncoder(w), id)
+	}
+}
+
+func respondConfirmed(log zerolog.Logger, e *json.Encoder, res confirmedResponse) {
+	if err := e.Encode(res); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
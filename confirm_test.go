@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+
+	b := newBroker(helperNewMemStore(t),
+		withClock(func() time.Time { return now }),
+		withConfirmWindow(time.Minute),
+	)
+	s := newServer(b)
+
+	id, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{ContentType: "text/plain"})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	_, err = c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.AckIDs([]string{id}))
+
+	// The ACKed message is removed from the topic
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Zero(n)
+
+	// Within the window, a duplicate ACK succeeds, and the message can be
+	// looked up
+	now = now.Add(30 * time.Second)
+	assert.NoError(c.AckIDs([]string{id}))
+
+	rec := NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/confirmed/%s/%s", defaultTopic, id), nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var out confirmedResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal(id, out.ID)
+	assert.Equal("test_value", out.Msg)
+	assert.Equal("text/plain", out.ContentType)
+	assert.True(now.Add(-30 * time.Second).Equal(out.AckedAt))
+
+	// An ID which was never ACKed is still unknown
+	assert.Equal(errUnknownAckID, c.AckIDs([]string{id, "unknown"}))
+
+	// Once the window has passed, the message is forgotten
+	now = now.Add(31 * time.Second)
+	assert.Equal(errUnknownAckID, c.AckIDs([]string{id}))
+
+	rec = NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/confirmed/%s/%s", defaultTopic, id), nil))
+	assert.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestConfirmWindow_Replay(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+
+	b := newBroker(helperNewMemStore(t),
+		withClock(func() time.Time { return now }),
+		withConfirmWindow(time.Minute),
+	)
+	s := newServer(b)
+
+	id, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	_, err = c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.Ack())
+
+	rec := NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/confirmed/%s/%s/replay", defaultTopic, id), nil))
+	assert.Equal(http.StatusCreated, rec.Code)
+
+	var out pubResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal(id, out.ID)
+
+	// The replayed message is delivered again with the same ID
+	val, err := c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("test_value"), val)
+	assert.Equal(id, c.Meta().ID)
+
+	// Redelivered, a duplicate ACK acknowledges it rather than being ignored
+	assert.NoError(c.AckIDs([]string{id}))
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Zero(n)
+
+	// Once the window has passed, it can't be replayed
+	now = now.Add(2 * time.Minute)
+
+	rec = NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/confirmed/%s/%s/replay", defaultTopic, id), nil))
+	assert.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestConfirmWindow_Disabled(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+
+	id, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	_, err = c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.AckIDs([]string{id}))
+
+	// Without a window, ACKed messages are forgotten immediately
+	assert.Equal(errUnknownAckID, c.AckIDs([]string{id}))
+
+	_, err = b.Confirmed(defaultTopic, id)
+	assert.Equal(errNotConfirmed, err)
+}
+
+func TestConfirmations_Expiry(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	cs := confirmations{window: time.Minute}
+
+	cs.add("topic_a", []byte("first"), messageMeta{ID: "first"}, now)
+	cs.add("topic_a", []byte("second"), messageMeta{ID: "second"}, now.Add(30*time.Second))
+	cs.add("topic_b", []byte("other"), messageMeta{ID: "other"}, now)
+
+	// Only the messages at the front whose window has passed are forgotten
+	cs.sweep(now.Add(61 * time.Second))
+
+	_, ok := cs.get("topic_a", "first", now.Add(61*time.Second))
+	assert.False(ok)
+	_, ok = cs.get("topic_a", "second", now.Add(61*time.Second))
+	assert.True(ok)
+
+	// Including on topics with nothing else ACKed or looked up
+	assert.NotContains(cs.topics, "topic_b")
+	assert.Equal(1, cs.topics["topic_a"].order.Len())
+
+	cs.sweep(now.Add(91 * time.Second))
+	assert.Empty(cs.topics)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// connCap enforces a hard ceiling on the number of publishes and subscribe
+// commands processed over the lifetime of each client connection. A cap of
+// zero is unlimited.
+type connCap struct {
+	max int
+
+	counts map[string]int
+	sync.Mutex
+}
+
+func newConnCap(max int) *connCap {
+	return &connCap{
+		max:    max,
+		counts: map[string]int{},
+	}
+}
+
+// take counts an operation against the connection, returning false once the
+// connection has exceeded its cap.
+func (c *connCap) take(conn string) bool {
+	if c.max <= 0 {
+		return true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.counts[conn]++
+
+	return c.counts[conn] <= c.max
+}
+
+// forget drops the count of a connection once it has closed.
+func (c *connCap) forget(conn string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.counts, conn)
+}
+
+// ConnState tracks the lifetime of client connections, to be set as the
+// ConnState hook of the http.Server.
+func (s *server) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		s.connCap.forget(conn.RemoteAddr().String())
+	}
+}
+
+// capPublishes rejects publishes once their connection has exceeded its cap,
+// closing the connection.
+func capPublishes(c *connCap, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !c.take(r.RemoteAddr) {
+			log := log.With().
+				Str("handler", "publish").
+				Str("remote_addr", r.RemoteAddr).
+				Logger()
+
+			log.Warn().Msg("connection exceeded its cap, closing")
+
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusTooManyRequests)
+			respondError(log, json.NewEncoder(w), errConnectionCap.Error())
+
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+type connCapKey struct{}
+
+// capSubscribers makes the cap of the connection available to the subscribe
+// handler, which counts each command received against it.
+func capSubscribers(c *connCap, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), connCapKey{}, c)
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// takeCommand counts a subscribe command against the cap of its connection,
+// returning false once the connection has exceeded its cap.
+func takeCommand(r *http.Request) bool {
+	c, ok := r.Context().Value(connCapKey{}).(*connCap)
+	if !ok {
+		return true
+	}
+
+	return c.take(r.RemoteAddr)
+}
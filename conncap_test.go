@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnCap(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newConnCap(2)
+	assert.True(c.take("a"))
+	assert.True(c.take("a"))
+	assert.True(c.take("b"))
+	assert.False(c.take("a"))
+
+	// A new connection from the same address starts afresh
+	c.forget("a")
+	assert.True(c.take("a"))
+
+	// Zero is unlimited
+	c = newConnCap(0)
+	for i := 0; i < 100; i++ {
+		assert.True(c.take("a"))
+	}
+}
+
+func TestServerConnectionCapPublish(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t, withConnectionCap(3))
+	defer srvCloser()
+
+	// Publishes under the cap complete normally
+	for i := 0; i < 3; i++ {
+		res := helperPublishMessage(t, srv, defaultTopic, "test_msg")
+		res.Body.Close()
+	}
+
+	res, err := srv.Client().Post(fmt.Sprintf("%s/publish/%s", srv.URL, defaultTopic), "", strings.NewReader("test_msg"))
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	assert.Equal(http.StatusTooManyRequests, res.StatusCode)
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal(errConnectionCap.Error(), out.Error)
+}
+
+func TestServerConnectionCapSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t, withConnectionCap(5))
+	defer srvCloser()
+
+	// The publishes share the connection, counting towards its cap
+	for _, msg := range []string{"test_msg_1", "test_msg_2"} {
+		res := helperPublishMessage(t, srv, defaultTopic, msg)
+		res.Body.Close()
+	}
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	enc := json.NewEncoder(writer)
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/subscribe/%s", srv.URL, defaultTopic), reader)
+	assert.NoError(err)
+
+	go func() {
+		assert.NoError(enc.Encode(json.RawMessage(`{"cmd":"INIT","block":false}`)))
+	}()
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	dec := json.NewDecoder(res.Body)
+
+	// Commands under the cap are processed normally
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("test_msg_1", out.Msg)
+
+	assert.NoError(enc.Encode(CmdAck))
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("test_msg_2", out.Msg)
+
+	out = subResponse{}
+	assert.NoError(enc.Encode(CmdAck))
+	assert.NoError(dec.Decode(&out))
+	assert.True(out.Empty)
+
+	// The next command exceeds the cap, ending the stream
+	out = subResponse{}
+	assert.NoError(enc.Encode(CmdPeekAll))
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(errConnectionCap.Error(), out.Error)
+
+	_, err = io.ReadAll(res.Body)
+	assert.NoError(err)
+	assert.Equal(streamStatusError, res.Trailer.Get(trailerStreamStatus))
+}
@@ -4,11 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 const (
 	eventTypePublish = eventType("publish")
 	eventTypeNack    = eventType("nack")
+	eventTypeAck     = eventType("ack")
 )
 
 type eventType string
@@ -17,61 +22,861 @@ type notifier interface {
 	NotifyConsumer(topic string, ev eventType)
 }
 
-// consumer handles providing values iteratively to a single consumer.
+type publisher interface {
+	Publish(topic string, val value, meta messageMeta) (string, error)
+}
+
+// consumer handles providing values iteratively to a single consumer. Its
+// methods are called from the goroutine serving the consumer, and must not be
+// called concurrently.
 type consumer struct {
 	id        string
 	topic     string
+	source    string
 	ackOffset int
+	meta      messageMeta
 	store     storer
 	eventChan chan eventType
 	notifier  notifier
+	publisher publisher
+	backoff   func(topic string) backoff
+	receipts  *receiptSender
+	hooks     *hooks
+	now       func() time.Time
+
+	// limiter throttles deliveries to the consumer, nil is unlimited.
+	limiter *tokenBucket
+
+	// ackTimeout is how long a delivered value may be outstanding before it is
+	// returned to the topic, zero waits indefinitely. It is capped at
+	// maxAckTimeout, if set.
+	ackTimeout    time.Duration
+	maxAckTimeout time.Duration
+
+	// onDisconnect determines whether outstanding values are acked or nacked
+	// when the client goes away.
+	onDisconnect disconnectPolicy
+
+	// deadLetters determines when NACKed values are dead-lettered rather than
+	// returned to the topic.
+	deadLetters deadLetterPolicy
+
+	// keepExpired moves values which missed their delivery deadline to the
+	// expired topic, rather than dropping them.
+	keepExpired bool
+
+	// processing records the time taken to process ACKed values.
+	processing *processingTimes
+
+	// throughput counts the values ACKed on the topic.
+	throughput *throughputs
+
+	// confirms holds the values ACKed within the confirmation window.
+	confirms *confirmations
+
+	// slots limits the consumers of the topic holding outstanding values.
+	slots *inFlight
+
+	// partitions returns the number of partitions of a topic, and assigner
+	// assigns them to consumers. The consumer takes values from source, the
+	// partition it holds, or its topic if it holds none.
+	partitions func(topic string) int
+	assigner   *partitionAssigner
+
+	// taps observe copies of the values delivered to the consumer.
+	taps *taps
+
+	// interceptors transform each value before it is delivered, in order.
+	interceptors []deliveryInterceptor
+
+	// delayed schedules the values NACKed with a delay, counted against the
+	// caps on delayed messages.
+	delayed *scheduler
+
+	// streamBodies leaves the bodies of large values in the store on
+	// delivery, to be read through Body.
+	streamBodies bool
+
+	// replay is set once the consumer replays the log of its topic, reading
+	// messages from a cursor rather than consuming them.
+	replay *replayCursor
+
+	// kick is closed once the consumer is disconnected by an operator, or as
+	// the broker shuts down.
+	kick chan struct{}
+
+	// stopping is closed once the broker stops delivering messages, as it
+	// shuts down.
+	stopping <-chan struct{}
+
+	// backlog checks the backlog of a topic once its depth has changed.
+	backlog func(topic string)
+
+	// outstanding holds the values delivered to the consumer which await an
+	// ACK or NACK, oldest first. The value at ackOffset is the most recent.
+	outstanding []*delivery
+
+	// seq is the sequence number of the last delivery to the consumer.
+	seq int
+}
+
+// delivery is a value delivered to a consumer, awaiting an ACK or NACK.
+type delivery struct {
+	ackOffset int
+	val       value
+	meta      messageMeta
+	at        time.Time
+	timer     *time.Timer
+}
+
+// stop stops the ack timeout of the delivery, reporting whether it had
+// already expired, returning the value to the topic.
+func (d *delivery) stop() (expired bool) {
+	if d.timer == nil {
+		return false
+	}
+
+	expired = !d.timer.Stop()
+	d.timer = nil
+
+	return expired
 }
 
 // Next will attempt to retrieve the next value on the topic, or it will
-// block waiting for a msg indicating there is a new value available.
+// block waiting for a msg indicating there is a new value available. Any
+// failure of the underlying store is returned immediately.
 func (c *consumer) Next(ctx context.Context) (val value, err error) {
-	val, ao, err := c.store.GetNext(c.topic)
-	if errors.Is(err, errTopicEmpty) {
-		select {
-		case <-c.eventChan:
-		case <-ctx.Done():
-			return nil, errRequestCancelled
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	if c.replay != nil {
+		return c.nextReplay(ctx, true)
+	}
+
+	for {
+		if c.stopped() {
+			return nil, errShuttingDown
 		}
 
-		return c.Next(ctx)
+		// Wait for a slot while the topic has too many consumers in flight
+		if ok, released := c.slots.acquire(c.topic, c.id); !ok {
+			select {
+			case <-released:
+				continue
+			case <-c.stopping:
+				continue
+			case <-ctx.Done():
+				return nil, errRequestCancelled
+			}
+		}
+
+		val, meta, ao, err := c.getNext()
+		if errors.Is(err, errNoMessages) {
+			c.releaseSlot()
+
+			select {
+			case <-c.eventChan:
+				continue
+			case <-c.stopping:
+				continue
+			case <-ctx.Done():
+				return nil, errRequestCancelled
+			}
+		}
+		if errors.Is(err, errDecrypt) {
+			if err := c.quarantine(val, ao, meta); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+		if err != nil {
+			c.releaseSlot()
+			return nil, fmt.Errorf("getting next from store: %v", err)
+		}
+
+		if pastDeadline(c.topic, meta, c.now()) {
+			if err := c.drop(val, ao, meta); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		return c.delivered(val, ao, meta), nil
 	}
-	if err != nil {
-		return nil, fmt.Errorf("getting next from store: %v", err)
+}
+
+// TryNext retrieves the next value on the topic without blocking, returning
+// errNoMessages if the topic is empty, or has too many consumers in flight.
+// Only a rate limit may cause it to wait.
+func (c *consumer) TryNext(ctx context.Context) (val value, err error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	if c.replay != nil {
+		return c.nextReplay(ctx, false)
+	}
+
+	for {
+		if c.stopped() {
+			return nil, errShuttingDown
+		}
+
+		if ok, _ := c.slots.acquire(c.topic, c.id); !ok {
+			return nil, errNoMessages
+		}
+
+		val, meta, ao, err := c.getNext()
+		if errors.Is(err, errNoMessages) {
+			c.releaseSlot()
+			return nil, errNoMessages
+		}
+		if errors.Is(err, errDecrypt) {
+			if err := c.quarantine(val, ao, meta); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+		if err != nil {
+			c.releaseSlot()
+			return nil, fmt.Errorf("getting next from store: %v", err)
+		}
+
+		if pastDeadline(c.topic, meta, c.now()) {
+			if err := c.drop(val, ao, meta); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		return c.delivered(val, ao, meta), nil
+	}
+}
+
+// drop removes a value which missed its delivery deadline, rather than
+// delivering it late, moving it to the expired topic if they're kept.
+func (c *consumer) drop(val value, ackOffset int, meta messageMeta) error {
+	if c.keepExpired {
+		val, err := readBody(c.store, c.source, ackOffset, val, &meta)
+		if err != nil {
+			return err
+		}
+
+		expired := meta
+		expired.Deliveries = 0
+		expired.Key = ""
+
+		if err := c.store.Insert(c.topic+expiredSuffix, val, expired); err != nil {
+			return fmt.Errorf("moving to %s: %v", c.topic+expiredSuffix, err)
+		}
+	}
+
+	if err := c.store.Drop(c.source, ackOffset); err != nil {
+		return fmt.Errorf("dropping topic %s with offset %d: %v", c.source, ackOffset, err)
+	}
+
+	log.Info().
+		Str("topic", c.topic).
+		Str("msg_id", meta.ID).
+		Time("deliver_by", meta.DeliverBy).
+		Msg("dropped message past its delivery deadline")
+
+	if meta.Notify != "" {
+		c.receipts.Send(meta.Notify, receipt{
+			ID:      meta.ID,
+			Topic:   c.topic,
+			Outcome: receiptOutcomeExpired,
+		})
+	}
+
+	if c.keepExpired {
+		c.notifier.NotifyConsumer(c.topic+expiredSuffix, eventTypePublish)
+	}
+
+	return nil
+}
+
+// delivered records the value at ackOffset as outstanding, starting its ack
+// timeout, and returns the value as it is to be delivered to the consumer.
+func (c *consumer) delivered(val value, ackOffset int, meta messageMeta) value {
+	c.seq++
+	meta.Seq = c.seq
+
+	c.ackOffset = ackOffset
+
+	d := &delivery{ackOffset: ackOffset, val: val, meta: meta, at: c.now()}
+	c.startAckTimer(d)
+	c.outstanding = append(c.outstanding, d)
+
+	c.hooks.deliver(c.topic, meta.ID, c.id)
+	c.checkBacklog(c.topic)
+
+	val, c.meta = c.intercept(val, meta)
+	c.taps.emit(c.topic, tapDeliver, val, c.meta, c.id, d.at)
+
+	return val
+}
+
+// startAckTimer returns the delivery to the topic once the ack timeout
+// expires, if one is set.
+func (c *consumer) startAckTimer(d *delivery) {
+	if c.ackTimeout <= 0 {
+		return
+	}
+
+	source, topic, id, ackOffset := c.source, c.topic, c.id, d.ackOffset
+	d.timer = time.AfterFunc(c.ackTimeout, func() {
+		log.Warn().
+			Str("topic", topic).
+			Str("consumer_id", id).
+			Msg("ack timeout exceeded, returning message to topic")
+
+		if err := c.nack(source, ackOffset); err != nil {
+			log.Err(err).Msg("failed to nack after ack timeout")
+		}
+	})
+}
+
+// current returns the most recent delivery, if it is still outstanding.
+func (c *consumer) current() *delivery {
+	for _, d := range c.outstanding {
+		if d.ackOffset == c.ackOffset {
+			return d
+		}
+	}
+
+	return nil
+}
+
+// remove removes the delivery from the outstanding deliveries.
+func (c *consumer) remove(d *delivery) {
+	for i, o := range c.outstanding {
+		if o == d {
+			c.outstanding = append(c.outstanding[:i], c.outstanding[i+1:]...)
+			c.releaseSlot()
+			c.releasePartition(true)
+
+			return
+		}
+	}
+}
+
+// lookup returns the outstanding deliveries with the given message IDs. If any
+// ID is not outstanding, or is repeated, errUnknownAckID is returned.
+func (c *consumer) lookup(ids []string) ([]*delivery, error) {
+	seen := map[string]bool{}
+
+	ds := make([]*delivery, 0, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			return nil, errUnknownAckID
+		}
+		seen[id] = true
+
+		var found *delivery
+		for _, d := range c.outstanding {
+			if d.meta.ID == id {
+				found = d
+				break
+			}
+		}
+
+		if found == nil {
+			return nil, errUnknownAckID
+		}
+
+		ds = append(ds, found)
+	}
+
+	return ds, nil
+}
+
+// SetAckTimeout sets how long values delivered to the consumer may be
+// outstanding before being returned to the topic, capped at the maximum
+// allowed by the broker. The timeout in effect is returned.
+func (c *consumer) SetAckTimeout(d time.Duration) time.Duration {
+	if c.maxAckTimeout > 0 && d > c.maxAckTimeout {
+		d = c.maxAckTimeout
 	}
 
-	c.ackOffset = ao
+	c.ackTimeout = d
+
+	return d
+}
+
+// LimitRate throttles deliveries to the consumer to at most rate per second.
+func (c *consumer) LimitRate(rate float64) {
+	c.limiter = newTokenBucket(rate)
+}
+
+// StreamBodies leaves the body of each value larger than streamThreshold in
+// the store as it is delivered, to be read through Body rather than held in
+// memory whole. Such values are delivered empty, with their size in
+// meta.BodySize.
+func (c *consumer) StreamBodies() {
+	c.streamBodies = true
+}
+
+// streamsBodies reports whether large values are left in the store on
+// delivery. Interceptors transform the whole value, so values are read whole
+// while the consumer has any.
+func (c *consumer) streamsBodies() bool {
+	return c.streamBodies && len(c.interceptors) == 0
+}
+
+// Body returns a reader over the previously consumed value, along with its
+// size, reading a body left in the store a chunk at a time. The reader must be
+// closed.
+func (c *consumer) Body() (io.ReadCloser, int, error) {
+	return c.store.Reader(c.source, c.ackOffset)
+}
+
+// Meta returns the metadata of the previously consumed value.
+func (c *consumer) Meta() messageMeta {
+	return c.meta
+}
+
+// Peek returns up to limit messages waiting on the consumer's topic without
+// consuming them.
+func (c *consumer) Peek(limit int) ([]pendingMessage, error) {
+	msgs, err := c.store.Peek(c.topic, limit)
+	if err != nil {
+		return nil, fmt.Errorf("peeking topic %s: %v", c.topic, err)
+	}
 
-	return val, err
+	return msgs, nil
 }
 
-// Ack acknowledges the previously consumed value.
+// Ack acknowledges the previously consumed value, sending a receipt to the
+// producer if one was requested. A duplicate ACK, when no value is
+// outstanding, is ignored. A consumer replaying its topic moves on to the next
+// message, leaving the topic as it is.
 func (c *consumer) Ack() error {
-	if err := c.store.Ack(c.topic, c.ackOffset); err != nil {
-		return fmt.Errorf("acking topic %s with offset %d: %v", c.topic, c.ackOffset, err)
+	if c.replay != nil {
+		c.replay.ack()
+		return nil
+	}
+
+	d := c.current()
+	if d == nil {
+		log.Info().
+			Str("topic", c.topic).
+			Str("consumer_id", c.id).
+			Msg("ignoring duplicate ACK, no outstanding message")
+
+		return nil
+	}
+
+	return c.ack([]*delivery{d}, nil)
+}
+
+// AckWithResult acknowledges the previously consumed value, publishing the
+// result to the reply topic the value was published with. Without a reply
+// topic, or while replaying, the result is ignored.
+func (c *consumer) AckWithResult(result value) error {
+	if c.replay != nil {
+		c.replay.ack()
+		return nil
+	}
+
+	d := c.current()
+	if d == nil {
+		log.Info().
+			Str("topic", c.topic).
+			Str("consumer_id", c.id).
+			Msg("ignoring duplicate ACK, no outstanding message")
+
+		return nil
+	}
+
+	return c.ack([]*delivery{d}, result)
+}
+
+// AckIDs acknowledges the outstanding values with the given message IDs
+// atomically. If any ID is not outstanding, none are acknowledged.
+func (c *consumer) AckIDs(ids []string) error {
+	// A duplicate ACK of a value confirmed within the window succeeds
+	ids = c.unconfirmed(ids)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ds, err := c.lookup(ids)
+	if err != nil {
+		return err
+	}
+
+	return c.ack(ds, nil)
+}
+
+// ack acknowledges the deliveries, first publishing the result as a reply to
+// those with a reply topic if one is given.
+func (c *consumer) ack(ds []*delivery, result value) error {
+	// Any delivery which has expired has already been returned to the topic,
+	// invalidating the whole ACK
+	var expired []*delivery
+	for _, d := range ds {
+		if d.stop() {
+			expired = append(expired, d)
+		}
+	}
+
+	if len(expired) > 0 {
+		for _, d := range expired {
+			c.remove(d)
+		}
+
+		for _, d := range ds {
+			if d.timer == nil && !containsDelivery(expired, d) {
+				c.startAckTimer(d)
+			}
+		}
+
+		return errAckTimeout
+	}
+
+	if result != nil {
+		for _, d := range ds {
+			if err := c.reply(d, result); err != nil {
+				for _, d := range ds {
+					c.startAckTimer(d)
+				}
+
+				return err
+			}
+		}
+	}
+
+	offsets := make([]int, 0, len(ds))
+	for _, d := range ds {
+		offsets = append(offsets, d.ackOffset)
+
+		// Confirmed values are kept whole, so a body left in the store is
+		// read before the ACK deletes it
+		if c.confirms.enabled() && d.meta.BodySize > 0 {
+			val, err := readBody(c.store, c.source, d.ackOffset, d.val, &d.meta)
+			if err != nil {
+				for _, d := range ds {
+					c.startAckTimer(d)
+				}
+
+				return err
+			}
+
+			d.val = val
+		}
+	}
+
+	if err := c.store.Ack(c.source, offsets...); err != nil {
+		// The values remain outstanding, and may still time out
+		for _, d := range ds {
+			c.startAckTimer(d)
+		}
+
+		return fmt.Errorf("acking topic %s with offsets %v: %v", c.source, offsets, err)
+	}
+
+	var keyed bool
+	for _, d := range ds {
+		c.remove(d)
+		c.hooks.ack(c.topic, d.meta.ID, c.id)
+		c.throughput.acked(c.topic)
+		c.processed(d)
+		c.confirms.add(c.topic, d.val, d.meta, c.now())
+		keyed = keyed || d.meta.Key != ""
+
+		if d.meta.Notify != "" {
+			c.receipts.Send(d.meta.Notify, receipt{
+				ID:      d.meta.ID,
+				Topic:   c.topic,
+				Outcome: receiptOutcomeAcked,
+			})
+		}
+	}
+
+	// A value held back behind one of the acked keys may now be consumed
+	if keyed {
+		c.notifier.NotifyConsumer(c.topic, eventTypeAck)
 	}
 
 	return nil
 }
 
+// Commit acknowledges every outstanding value delivered to the consumer up to
+// and including the sequence number seq at once. Committing beyond the last
+// delivery returns errCommitAhead, acknowledging nothing.
+func (c *consumer) Commit(seq int) error {
+	if seq > c.seq {
+		return errCommitAhead
+	}
+
+	var ds []*delivery
+	for _, d := range c.outstanding {
+		if d.meta.Seq <= seq {
+			ds = append(ds, d)
+		}
+	}
+
+	// Everything up to seq has already been acknowledged
+	if len(ds) == 0 {
+		return nil
+	}
+
+	return c.ack(ds, nil)
+}
+
 // Nack negatively acknowledges a message, returning it for consumption by other
-// consumers.
+// consumers. If a backoff is configured for the topic, or else the broker, the
+// message is only returned once the backoff delay for its delivery count has
+// elapsed. A message which has used up its deliveries is dead-lettered
+// instead, if configured.
 func (c *consumer) Nack() error {
-	if err := c.store.Nack(c.topic, c.ackOffset); err != nil {
-		return fmt.Errorf("nacking topic %s with offset %d: %v", c.topic, c.ackOffset, err)
+	return c.NackWithReason("")
+}
+
+// NackWithReason negatively acknowledges a message as Nack does, recording the
+// reason with the message. An empty reason is not recorded. A consumer
+// replaying its topic is delivered the message again.
+func (c *consumer) NackWithReason(reason string) error {
+	if c.replay != nil {
+		c.replay.nack()
+		return nil
 	}
 
-	c.notifier.NotifyConsumer(c.topic, eventTypeNack)
+	d := c.current()
+	if d == nil {
+		return nil
+	}
+
+	return c.nackDelivery(d, reason)
+}
+
+// NackIDs negatively acknowledges the outstanding values with the given
+// message IDs, recording the reason with each. If any ID is not outstanding,
+// none are negatively acknowledged.
+func (c *consumer) NackIDs(ids []string, reason string) error {
+	ds, err := c.lookup(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range ds {
+		if err := c.nackDelivery(d, reason); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NackAfter negatively acknowledges the outstanding values with the given
+// message IDs, or the most recently delivered if none are given, recording
+// the reason with each. Each value is returned to the topic once the delay has
+// elapsed, in place of the backoff. A consumer replaying its topic is
+// delivered the message again straight away.
+func (c *consumer) NackAfter(ids []string, reason string, delay time.Duration) error {
+	if c.replay != nil {
+		c.replay.nack()
+		return nil
+	}
+
+	var ds []*delivery
+	if len(ids) > 0 {
+		var err error
+		if ds, err = c.lookup(ids); err != nil {
+			return err
+		}
+	} else if d := c.current(); d != nil {
+		ds = []*delivery{d}
+	}
+
+	for _, d := range ds {
+		if err := c.nackDeliveryAfter(d, reason, delay); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// NackAll negatively acknowledges every outstanding value, used when the
+// consumer goes away. Values already NACKed with a delay are no longer
+// outstanding, so aren't returned a second time.
+func (c *consumer) NackAll() error {
+	return c.NackAllWithReason("")
+}
+
+// NackAllWithReason negatively acknowledges every outstanding value as NackAll
+// does, recording the reason with each.
+func (c *consumer) NackAllWithReason(reason string) error {
+	for len(c.outstanding) > 0 {
+		if err := c.nackDelivery(c.outstanding[0], reason); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *consumer) nackDelivery(d *delivery, reason string) error {
+	return c.nackDeliveryAfter(d, reason, c.backoff(c.topic).Delay(d.meta.Deliveries))
+}
+
+// nackDeliveryAfter returns the value to the topic once the delay has elapsed,
+// or immediately if it is zero or the value can't be delayed.
+func (c *consumer) nackDeliveryAfter(d *delivery, reason string, delay time.Duration) error {
+	// The value has already been returned to the topic
+	if d.stop() {
+		c.remove(d)
+		return nil
+	}
+
+	// Failing to record the reason shouldn't prevent the value being returned
+	if reason != "" {
+		if err := c.store.NackReason(c.source, d.ackOffset, reason); err != nil {
+			log.Err(err).Msg("failed to record nack reason")
+		}
+	}
+
+	if c.deadLetters.exhausted(c.topic, d.meta) {
+		return c.deadLetter(d)
+	}
+
+	if delay > 0 {
+		err := c.nackLater(d, delay)
+		if err == nil {
+			return nil
+		}
+
+		// Returned straight away instead, rather than left outstanding
+		if !errors.Is(err, errTooManyDelayed) && !errors.Is(err, errShutdown) {
+			return err
+		}
+
+		log.Warn().
+			Err(err).
+			Str("topic", c.topic).
+			Str("msg_id", d.meta.ID).
+			Msg("failed to delay nack, returning value straight away")
+	}
+
+	if err := c.nack(c.source, d.ackOffset); err != nil {
+		return err
+	}
+
+	c.remove(d)
+	c.hooks.nack(c.topic, d.meta.ID, c.id)
+
+	return nil
+}
+
+// nackLater schedules the value to be returned to the topic once the delay has
+// elapsed. It is counted against the caps on delayed messages until then,
+// returning errTooManyDelayed if the topic or broker is at its cap.
+func (c *consumer) nackLater(d *delivery, delay time.Duration) error {
+	// Messages behind the value in its partition wait for it, so that
+	// messages with the same key stay in order
+	source, ackOffset := c.source, d.ackOffset
+	partitioned := source != c.topic
+	if partitioned {
+		c.assigner.block(source)
+	}
+
+	err := c.delayed.schedule(c.topic, time.Now().Add(delay), func() {
+		if !partitioned {
+			if err := c.nack(source, ackOffset); err != nil {
+				log.Err(err).Msg("failed to nack after delay")
+			}
+
+			return
+		}
+
+		// Unblocked once the value is back, then the consumer still holding
+		// the partition, if any, is woken along with the topic
+		err := c.store.Nack(source, ackOffset)
+		c.assigner.unblock(source)
+		if err != nil {
+			log.Err(err).Str("topic", source).Msg("failed to nack after delay")
+			return
+		}
+
+		select {
+		case c.eventChan <- eventTypeNack:
+		default:
+		}
+
+		c.returned()
+	})
+	if err != nil {
+		if partitioned {
+			c.assigner.unblock(source)
+		}
+
+		return err
+	}
+
+	c.remove(d)
+	c.hooks.nack(c.topic, d.meta.ID, c.id)
+
+	return nil
+}
+
+// nack returns the value at ackOffset to source, the topic or partition it was
+// taken from.
+func (c *consumer) nack(source string, ackOffset int) error {
+	if err := c.store.Nack(source, ackOffset); err != nil {
+		return fmt.Errorf("nacking topic %s with offset %d: %v", source, ackOffset, err)
+	}
+
+	c.returned()
+
+	return nil
+}
+
+// returned notifies the consumers of the topic that a value has been returned
+// to it.
+func (c *consumer) returned() {
+	c.notifier.NotifyConsumer(c.topic, eventTypeNack)
+
+	c.checkBacklog(c.topic)
+}
+
 // EventChan returns a channel to notify the consumer of events occurring on the
 // topic.
 func (c *consumer) EventChan() <-chan eventType {
 	return c.eventChan
 }
+
+// reply publishes the result to the reply topic of the delivery. The reply is
+// published before the delivery is acked, such that it is not lost if the ACK
+// fails.
+func (c *consumer) reply(d *delivery, result value) error {
+	if d.meta.ReplyTo == "" {
+		return nil
+	}
+
+	_, err := c.publisher.Publish(d.meta.ReplyTo, result, messageMeta{InReplyTo: d.meta.ID})
+	if errors.Is(err, errNoSubscribers) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("publishing reply to %s: %v", d.meta.ReplyTo, err)
+	}
+
+	return nil
+}
+
+func containsDelivery(ds []*delivery, d *delivery) bool {
+	for _, o := range ds {
+		if o == d {
+			return true
+		}
+	}
+
+	return false
+}
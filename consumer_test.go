@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -20,8 +22,8 @@ func TestConsumerNext(t *testing.T) {
 	)
 
 	mockStore := NewMockstorer(ctrl)
-	mockStore.EXPECT().GetNext(topic).Return(msg1, 0, nil)
-	mockStore.EXPECT().GetNext(topic).Return(msg2, 1, nil)
+	mockStore.EXPECT().GetNext(topic).Return(msg1, messageMeta{}, 0, nil)
+	mockStore.EXPECT().GetNext(topic).Return(msg2, messageMeta{}, 1, nil)
 
 	b := newBroker(mockStore)
 	c := b.Subscribe(topic)
@@ -36,3 +38,348 @@ func TestConsumerNext(t *testing.T) {
 	assert.Equal(msg2, msg)
 	assert.Equal(c.ackOffset, 1)
 }
+
+func TestConsumerNext_WaitsWhenEmpty(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		topic = "test_topic"
+		msg1  = []byte("message1")
+	)
+
+	mockStore := NewMockstorer(ctrl)
+	gomock.InOrder(
+		mockStore.EXPECT().GetNext(topic).Return(nil, messageMeta{}, 0, errNoMessages),
+		mockStore.EXPECT().GetNext(topic).Return(msg1, messageMeta{}, 0, nil),
+	)
+
+	b := newBroker(mockStore)
+	c := b.Subscribe(topic)
+
+	// Unblock the consumer once it is waiting on an event
+	go func() {
+		c.eventChan <- eventTypePublish
+	}()
+
+	msg, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(msg1, msg)
+}
+
+func TestConsumerNext_EmptyCancelled(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "test_topic"
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return(nil, messageMeta{}, 0, errNoMessages)
+
+	b := newBroker(mockStore)
+	c := b.Subscribe(topic)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	msg, err := c.Next(ctx)
+	assert.Equal(errRequestCancelled, err)
+	assert.Nil(msg)
+}
+
+func TestConsumerNext_StoreError(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "test_topic"
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return(nil, messageMeta{}, 0, errors.New("store failure"))
+
+	b := newBroker(mockStore)
+	c := b.Subscribe(topic)
+
+	msg, err := c.Next(context.Background())
+	assert.Error(err)
+	assert.False(errors.Is(err, errNoMessages))
+	assert.Nil(msg)
+}
+
+func TestConsumerNack_Backoff(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		topic = "test_topic"
+		msg1  = []byte("message1")
+	)
+
+	nacked := make(chan struct{})
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return(msg1, messageMeta{Deliveries: 2}, 3, nil)
+	mockStore.EXPECT().Nack(topic, 3).DoAndReturn(func(string, int) error {
+		close(nacked)
+		return nil
+	})
+
+	b := newBroker(mockStore, withBackoff(backoff{
+		base: 50 * time.Millisecond,
+		max:  time.Second,
+	}))
+	c := b.Subscribe(topic)
+
+	_, err := c.Next(context.Background())
+	assert.NoError(err)
+
+	start := time.Now()
+	assert.NoError(c.Nack())
+
+	select {
+	case <-nacked:
+		assert.GreaterOrEqual(int64(time.Since(start)), int64(100*time.Millisecond))
+	case <-time.After(time.Second):
+		assert.FailNow("timed out waiting for delayed nack")
+	}
+}
+
+func TestConsumerNack_BackoffDisconnect(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		topic = "test_topic"
+		msg1  = []byte("message1")
+	)
+
+	nacked := make(chan struct{})
+
+	// The value is only expected to be returned once, by the backoff
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return(msg1, messageMeta{Deliveries: 1}, 3, nil)
+	mockStore.EXPECT().Nack(topic, 3).DoAndReturn(func(string, int) error {
+		close(nacked)
+		return nil
+	})
+
+	b := newBroker(mockStore, withBackoff(backoff{
+		base: 50 * time.Millisecond,
+		max:  time.Second,
+	}))
+	c := b.Subscribe(topic)
+
+	_, err := c.Next(context.Background())
+	assert.NoError(err)
+
+	assert.NoError(c.Nack())
+
+	// The consumer goes away while the redelivery is pending
+	assert.NoError(c.Disconnected())
+	b.Unsubscribe(c)
+
+	select {
+	case <-nacked:
+	case <-time.After(time.Second):
+		assert.FailNow("timed out waiting for delayed nack")
+	}
+
+	// Long enough for a second redelivery, had one been scheduled, to happen
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestConsumerNack_TopicBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{BackoffBase: "50ms", BackoffMax: "1s"}))
+
+	_, err := b.Publish(defaultTopic, value("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+
+	start := time.Now()
+	assert.NoError(c.Nack())
+
+	// The topic's backoff delays the redelivery, though the broker has none
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	val, err := c.Next(ctx)
+	assert.NoError(err)
+	assert.Equal(value("test_value"), val)
+	assert.GreaterOrEqual(int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestConsumerAck_Duplicate(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		topic = "test_topic"
+		msg1  = []byte("message1")
+	)
+
+	// The store is only expected to be acked once
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return(msg1, messageMeta{}, 3, nil)
+	mockStore.EXPECT().Ack(topic, 3).Return(nil)
+
+	b := newBroker(mockStore)
+	c := b.Subscribe(topic)
+
+	_, err := c.Next(context.Background())
+	assert.NoError(err)
+
+	assert.NoError(c.Ack())
+	assert.NoError(c.Ack())
+}
+
+func TestConsumerAckIDs(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "test_topic"
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message1"), messageMeta{ID: "a"}, 0, nil)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message2"), messageMeta{ID: "b"}, 1, nil)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message3"), messageMeta{ID: "c"}, 2, nil)
+	mockStore.EXPECT().Ack(topic, 0, 2).Return(nil)
+
+	b := newBroker(mockStore)
+	c := b.Subscribe(topic)
+
+	for i := 0; i < 3; i++ {
+		_, err := c.TryNext(context.Background())
+		assert.NoError(err)
+	}
+
+	assert.NoError(c.AckIDs([]string{"a", "c"}))
+
+	// Only the unacked message remains outstanding
+	assert.Len(c.outstanding, 1)
+	assert.Equal("b", c.outstanding[0].meta.ID)
+}
+
+func TestConsumerStatus_NothingOutstanding(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c := newBroker(NewMockstorer(ctrl)).Subscribe("test_topic")
+
+	assert.Equal(t, consumerStatus{}, c.Status())
+}
+
+func TestConsumerCommit(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "test_topic"
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message1"), messageMeta{ID: "a"}, 0, nil)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message2"), messageMeta{ID: "b"}, 1, nil)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message3"), messageMeta{ID: "c"}, 2, nil)
+	mockStore.EXPECT().Ack(topic, 0, 1).Return(nil)
+
+	b := newBroker(mockStore)
+	c := b.Subscribe(topic)
+
+	for i := 0; i < 3; i++ {
+		_, err := c.TryNext(context.Background())
+		assert.NoError(err)
+	}
+
+	// Everything up to the second delivery is acked at once
+	assert.NoError(c.Commit(2))
+	assert.Len(c.outstanding, 1)
+	assert.Equal("c", c.outstanding[0].meta.ID)
+
+	// Committing an already committed position is a noop
+	assert.NoError(c.Commit(1))
+	assert.Len(c.outstanding, 1)
+}
+
+func TestConsumerCommit_Ahead(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "test_topic"
+
+	// The store must not be acked at all
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message1"), messageMeta{ID: "a"}, 0, nil)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message2"), messageMeta{ID: "b"}, 1, nil)
+
+	b := newBroker(mockStore)
+	c := b.Subscribe(topic)
+
+	for i := 0; i < 2; i++ {
+		_, err := c.TryNext(context.Background())
+		assert.NoError(err)
+	}
+
+	assert.Equal(errCommitAhead, c.Commit(3))
+	assert.Len(c.outstanding, 2)
+}
+
+func TestConsumerAckIDs_Unknown(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "test_topic"
+
+	// The store must not be acked at all
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message1"), messageMeta{ID: "a"}, 0, nil)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message2"), messageMeta{ID: "b"}, 1, nil)
+
+	b := newBroker(mockStore)
+	c := b.Subscribe(topic)
+
+	for i := 0; i < 2; i++ {
+		_, err := c.TryNext(context.Background())
+		assert.NoError(err)
+	}
+
+	assert.Equal(errUnknownAckID, c.AckIDs([]string{"a", "unknown"}))
+	assert.Equal(errUnknownAckID, c.AckIDs([]string{"a", "a"}))
+	assert.Equal(errUnknownAckID, c.NackIDs([]string{"b", "unknown"}, ""))
+
+	assert.Len(c.outstanding, 2)
+}
+
+func TestConsumerAckWithResult_NoReplyTo(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	topic := "test_topic"
+
+	// The result is ignored, only the message is acked
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(topic).Return([]byte("message1"), messageMeta{ID: "a"}, 0, nil)
+	mockStore.EXPECT().Ack(topic, 0).Return(nil)
+
+	b := newBroker(mockStore)
+	c := b.Subscribe(topic)
+
+	_, err := c.Next(context.Background())
+	assert.NoError(err)
+
+	assert.NoError(c.AckWithResult([]byte("result")))
+}
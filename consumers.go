@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const consumerIDVarKey = "id"
+
+// consumerResponse describes a consumer subscribed to a topic.
+type consumerResponse struct {
+	ID string `json:"id"`
+}
+
+// ConsumerIDs returns the IDs of the consumers subscribed to the topic, in the
+// order they subscribed.
+func (b *broker) ConsumerIDs(topic string) []string {
+	b.RLock()
+	defer b.RUnlock()
+
+	ids := make([]string, 0, len(b.consumers[topic]))
+	for _, c := range b.consumers[topic] {
+		ids = append(ids, c.id)
+	}
+
+	return ids
+}
+
+// DisconnectConsumer removes the consumer from the topic, signalling it to
+// stop and return its outstanding messages to the topic. It returns
+// errConsumerNotFound if no such consumer is subscribed.
+func (b *broker) DisconnectConsumer(topic, id string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	conss := b.consumers[topic]
+	for i, c := range conss {
+		if c.id != id {
+			continue
+		}
+
+		b.consumers[topic] = append(conss[:i], conss[i+1:]...)
+		if len(b.consumers[topic]) == 0 {
+			delete(b.consumers, topic)
+		}
+
+		// Already closed if the broker is shutting down
+		if !c.kicked() {
+			close(c.kick)
+		}
+		b.weights.remove(topic, id)
+
+		return nil
+	}
+
+	return errConsumerNotFound
+}
+
+// kicked reports whether the consumer has been disconnected by
+// DisconnectConsumer.
+func (c *consumer) kicked() bool {
+	select {
+	case <-c.kick:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchKick returns a context which is cancelled once the consumer is
+// disconnected, and unblocks a pending read of the next command of the
+// subscribe request. The returned function stops watching.
+func watchKick(ctx context.Context, r *http.Request, cons *consumer) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		select {
+		case <-cons.kick:
+		case <-ctx.Done():
+			return
+		}
+
+		cancel()
+
+		// Over HTTP/1 a read holds the body open, leaving only the connection
+		// to close. HTTP/2 multiplexes the connection, and unblocks reads of a
+		// closed body.
+		if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok && r.ProtoMajor < 2 {
+			_ = conn.Close()
+			return
+		}
+
+		_ = r.Body.Close()
+	}()
+
+	return ctx, cancel
+}
+
+// listConsumers lists the consumers subscribed to the topic, or to a consumer
+// group of the topic with ?group=.
+func listConsumers(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "list_consumers").
+			Logger()
+
+		topic, ok := consumerTopic(r)
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		ids := broker.ConsumerIDs(topic)
+
+		res := make([]consumerResponse, 0, len(ids))
+		for _, id := range ids {
+			res = append(res, consumerResponse{ID: id})
+		}
+
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// disconnectConsumer forcibly disconnects a consumer, ending its subscribe
+// stream and returning its outstanding messages to the topic.
+func disconnectConsumer(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "disconnect_consumer").
+			Logger()
+
+		topic, ok := consumerTopic(r)
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		id := mux.Vars(r)[consumerIDVarKey]
+
+		log = log.With().
+			Str("topic", topic).
+			Str("consumer_id", id).
+			Logger()
+
+		err := broker.DisconnectConsumer(topic, id)
+		if errors.Is(err, errConsumerNotFound) {
+			log.Debug().Msg("consumer not found")
+
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errConsumerNotFound.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to disconnect consumer")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errDisconnect.Error())
+
+			return
+		}
+
+		log.Info().Msg("disconnected consumer")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// consumerTopic returns the topic of the consumers addressed by the request,
+// which is a group topic if a group is given.
+func consumerTopic(r *http.Request) (string, bool) {
+	topic, ok := mux.Vars(r)[topicVarKey]
+	if !ok {
+		return "", false
+	}
+
+	if group := r.URL.Query().Get(groupQueryKey); group != "" {
+		return groupTopic(topic, group), true
+	}
+
+	return topic, true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestDisconnectConsumer(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	srv := httptest.NewUnstartedServer(newServer(b))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.NoError(err)
+
+	// The consumer holds the message without ever ACKing it
+	_, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal("test_msg", out.Msg)
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Zero(n)
+
+	// Find it by listing the consumers of the topic
+	res, err := srv.Client().Get(fmt.Sprintf("%s/consumers/%s", srv.URL, defaultTopic))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	var consumers []consumerResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&consumers))
+	res.Body.Close()
+	assert.Len(consumers, 1)
+
+	disconnect := func(id string) int {
+		res, err := srv.Client().Post(fmt.Sprintf("%s/consumers/%s/%s/disconnect", srv.URL, defaultTopic, id), "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	start := time.Now()
+	assert.Equal(http.StatusNoContent, disconnect(consumers[0].ID))
+
+	// The stream ends promptly, with the consumer told why
+	out = subResponse{}
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(errKicked.Error(), out.Error)
+
+	assert.Equal(io.EOF, decoder.Decode(&out))
+	assert.Less(int64(time.Since(start)), int64(time.Second))
+
+	// Its message is requeued and it is removed from the broker
+	n, err = b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	assert.Zero(b.subscribers(defaultTopic))
+	assert.Empty(b.ConsumerIDs(defaultTopic))
+
+	// It can't be disconnected twice
+	assert.Equal(http.StatusNotFound, disconnect(consumers[0].ID))
+}
+
+func TestDisconnectConsumer_Waiting(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	srv := httptest.NewUnstartedServer(newServer(b))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The consumer is blocked waiting for a message on the empty topic, so
+	// nothing is written until it is disconnected
+	body, bodyW := io.Pipe()
+	defer bodyW.Close()
+
+	go func() {
+		_ = json.NewEncoder(bodyW).Encode(CmdInit)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/subscribe/%s", srv.URL, defaultTopic), body)
+	assert.NoError(err)
+
+	resc := make(chan *http.Response, 1)
+	go func() {
+		res, err := srv.Client().Do(req)
+		assert.NoError(err)
+		resc <- res
+	}()
+
+	assert.Eventually(func() bool {
+		return len(b.ConsumerIDs(defaultTopic)) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	assert.NoError(b.DisconnectConsumer(defaultTopic, b.ConsumerIDs(defaultTopic)[0]))
+
+	var res *http.Response
+	select {
+	case res = <-resc:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the disconnected consumer to stop")
+	}
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(res.Body)
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(errKicked.Error(), out.Error)
+	assert.Equal(io.EOF, decoder.Decode(&out))
+
+	assert.Equal(errConsumerNotFound, b.DisconnectConsumer(defaultTopic, "unknown"))
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// dlqSuffix names the dead-letter topic of a topic, which holds the
+	// messages which exhausted their deliveries, e.g. "orders.dlq".
+	dlqSuffix = ".dlq"
+	// redriveSuffix names the topic holding the dead-lettered messages of a
+	// topic which are waiting to be redriven, e.g. "orders.dlq.redrive".
+	redriveSuffix = dlqSuffix + ".redrive"
+)
+
+// deadLetterPolicy determines when NACKed messages are dead-lettered, rather
+// than returned to their topic, and what happens to them once they are.
+type deadLetterPolicy struct {
+	// maxDeliveries is the number of deliveries after which a NACKed message
+	// is dead-lettered, zero never dead-letters.
+	maxDeliveries int
+
+	// alertURL is sent a deadLetterAlert for each dead-lettered message, empty
+	// sends none.
+	alertURL string
+
+	// redriveDelay is how long a dead-lettered message waits before it is
+	// returned to its topic, zero disables redrive. A message is redriven at
+	// most maxRedrives times, after which it stays on the dead-letter topic,
+	// such that a message which always fails can't loop forever.
+	redriveDelay time.Duration
+	maxRedrives  int
+}
+
+// withDeadLetter moves NACKed messages which have been delivered maxDeliveries
+// times to the dead-letter topic of their topic. Zero disables dead-lettering.
+func withDeadLetter(maxDeliveries int) brokerOption {
+	return func(b *broker) {
+		b.deadLetters.maxDeliveries = maxDeliveries
+	}
+}
+
+// withDeadLetterAlert sends an alert to the URL each time a message is
+// dead-lettered.
+func withDeadLetterAlert(url string) brokerOption {
+	return func(b *broker) {
+		b.deadLetters.alertURL = url
+	}
+}
+
+// withRedrive returns dead-lettered messages to their topic once delay has
+// passed, up to max times per message. Zero disables redrive.
+func withRedrive(delay time.Duration, max int) brokerOption {
+	return func(b *broker) {
+		b.deadLetters.redriveDelay = delay
+		b.deadLetters.maxRedrives = max
+	}
+}
+
+func (p deadLetterPolicy) redriveEnabled() bool {
+	return p.maxDeliveries > 0 && p.redriveDelay > 0 && p.maxRedrives > 0
+}
+
+// exhausted reports whether the message NACKed on the topic has used up its
+// deliveries. Messages on dead-letter topics are never dead-lettered again.
+func (p deadLetterPolicy) exhausted(topic string, meta messageMeta) bool {
+	return p.maxDeliveries > 0 &&
+		meta.Deliveries >= p.maxDeliveries &&
+		!isDeadLetterTopic(topic)
+}
+
+// destination returns the topic a message dead-lettered from the topic is
+// moved to, which depends on whether it has redrives remaining.
+func (p deadLetterPolicy) destination(topic string, meta messageMeta) string {
+	if p.redriveEnabled() && meta.Redrives < p.maxRedrives {
+		return topic + redriveSuffix
+	}
+
+	return topic + dlqSuffix
+}
+
+func isDeadLetterTopic(topic string) bool {
+	return strings.HasSuffix(topic, dlqSuffix) || strings.HasSuffix(topic, redriveSuffix)
+}
+
+// deadLetterAlert is sent to the alert URL when a message is dead-lettered.
+type deadLetterAlert struct {
+	ID          string   `json:"id"`
+	Topic       string   `json:"topic"`
+	Deliveries  int      `json:"deliveries"`
+	Redrives    int      `json:"redrives"`
+	NackReasons []string `json:"nack_reasons,omitempty"`
+
+	// DeadLetterTopic is the topic the message was moved to. It is the redrive
+	// topic if the message will be returned to its topic automatically.
+	DeadLetterTopic string `json:"dead_letter_topic"`
+}
+
+// deadLetterRecord describes why a message was dead-lettered, sent with the
+// message once it has been.
+type deadLetterRecord struct {
+	// Topic is the topic the message was dead-lettered from.
+	Topic      string    `json:"topic"`
+	Deliveries int       `json:"deliveries"`
+	At         time.Time `json:"at"`
+
+	// LastError is the reason the message was last NACKed for, if any.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// newDeadLetterRecord returns the record of the last time the message was
+// dead-lettered, nil if it never has been.
+func newDeadLetterRecord(meta messageMeta) *deadLetterRecord {
+	if meta.DeadLetterSource == "" {
+		return nil
+	}
+
+	rec := &deadLetterRecord{
+		Topic:      meta.DeadLetterSource,
+		Deliveries: meta.DeadLetterDeliveries,
+		At:         meta.DeadLetteredAt,
+	}
+
+	if n := len(meta.NackReasons); n > 0 {
+		rec.LastError = meta.NackReasons[n-1]
+	}
+
+	return rec
+}
+
+// deadLetter moves the delivery to the dead-letter topic, or to wait for
+// redrive if it has redrives remaining, alerting if configured.
+func (c *consumer) deadLetter(d *delivery) error {
+	// The stored metadata holds any NACK reason just recorded
+	meta, err := c.store.GetMeta(c.source, d.ackOffset)
+	if err != nil {
+		return fmt.Errorf("getting meta of topic %s with offset %d: %v", c.source, d.ackOffset, err)
+	}
+
+	// A body left in the store is deleted along with the value
+	val := d.val
+	if d.meta.BodySize > 0 {
+		if val, err = readBody(c.store, c.source, d.ackOffset, val, &meta); err != nil {
+			return err
+		}
+	}
+
+	dest := c.deadLetters.destination(c.topic, meta)
+	deliveries := meta.Deliveries
+
+	meta.Deliveries = 0
+	meta.Key = ""
+	meta.DeadLetterSource = c.topic
+	meta.DeadLetteredAt = c.now()
+	meta.DeadLetterDeliveries = deliveries
+
+	if err := c.store.Insert(dest, val, meta); err != nil {
+		return fmt.Errorf("dead-lettering to %s: %v", dest, err)
+	}
+
+	// Failing here leaves the value on both topics, which is preferable to
+	// losing it
+	if err := c.store.Drop(c.source, d.ackOffset); err != nil {
+		return fmt.Errorf("dropping topic %s with offset %d: %v", c.source, d.ackOffset, err)
+	}
+
+	c.remove(d)
+	c.hooks.nack(c.topic, meta.ID, c.id)
+	c.notifier.NotifyConsumer(dest, eventTypePublish)
+
+	log.Warn().
+		Str("topic", c.topic).
+		Str("msg_id", meta.ID).
+		Str("dead_letter_topic", dest).
+		Int("deliveries", deliveries).
+		Int("redrives", meta.Redrives).
+		Msg("dead-lettered message")
+
+	if c.deadLetters.alertURL != "" {
+		c.receipts.Alert(c.deadLetters.alertURL, deadLetterAlert{
+			ID:              meta.ID,
+			Topic:           c.topic,
+			Deliveries:      deliveries,
+			Redrives:        meta.Redrives,
+			NackReasons:     meta.NackReasons,
+			DeadLetterTopic: dest,
+		})
+	}
+
+	return nil
+}
+
+// redrivePeriodically redrives dead-lettered messages until the broker is shut
+// down.
+func (b *broker) redrivePeriodically() {
+	ticker := time.NewTicker(b.deadLetters.redriveDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := b.redrive(); err != nil {
+				log.Err(err).Msg("failed to redrive dead-lettered messages")
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// redrive returns the messages waiting for redrive whose delay has passed to
+// the topic they were dead-lettered from, returning the number redriven.
+func (b *broker) redrive() (int, error) {
+	topics, err := b.store.Topics()
+	if err != nil {
+		return 0, fmt.Errorf("listing topics: %v", err)
+	}
+
+	var redriven int
+	for _, t := range topics {
+		if !strings.HasSuffix(t, redriveSuffix) {
+			continue
+		}
+
+		for {
+			val, meta, ackOffset, err := b.store.GetNext(t)
+			if errors.Is(err, errNoMessages) {
+				break
+			}
+			if errors.Is(err, errDecrypt) {
+				dest := meta.DeadLetterSource + dlqSuffix
+
+				if err := quarantine(b.store, t, dest, val, ackOffset, meta, b.now()); err != nil {
+					return redriven, err
+				}
+
+				b.NotifyConsumer(dest, eventTypePublish)
+				continue
+			}
+			if err != nil {
+				return redriven, fmt.Errorf("getting next from %s: %v", t, err)
+			}
+
+			// Messages wait in the order they were dead-lettered, so none
+			// behind this one are due either
+			if b.now().Before(meta.DeadLetteredAt.Add(b.deadLetters.redriveDelay)) {
+				if err := b.store.Nack(t, ackOffset); err != nil {
+					return redriven, fmt.Errorf("nacking topic %s with offset %d: %v", t, ackOffset, err)
+				}
+
+				break
+			}
+
+			val, err = readBody(b.store, t, ackOffset, val, &meta)
+			if err != nil {
+				return redriven, err
+			}
+
+			meta.Deliveries = 0
+			meta.Redrives++
+
+			if err := b.store.Insert(meta.DeadLetterSource, val, meta); err != nil {
+				return redriven, fmt.Errorf("redriving to %s: %v", meta.DeadLetterSource, err)
+			}
+
+			if err := b.store.Drop(t, ackOffset); err != nil {
+				return redriven, fmt.Errorf("dropping topic %s with offset %d: %v", t, ackOffset, err)
+			}
+
+			b.NotifyConsumer(meta.DeadLetterSource, eventTypePublish)
+			redriven++
+
+			log.Info().
+				Str("topic", meta.DeadLetterSource).
+				Str("msg_id", meta.ID).
+				Int("redrives", meta.Redrives).
+				Msg("redrove dead-lettered message")
+		}
+	}
+
+	return redriven, nil
+}
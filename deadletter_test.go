@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestDeadLetter_Alert(t *testing.T) {
+	assert := assert.New(t)
+
+	alerts := make(chan deadLetterAlert, 1)
+	alertSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert deadLetterAlert
+		assert.NoError(json.NewDecoder(r.Body).Decode(&alert))
+		alerts <- alert
+	}))
+	defer alertSrv.Close()
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withDeadLetter(2), withDeadLetterAlert(alertSrv.URL), withNotifyAllow(loopbackNetworks))
+
+	id, err := b.Publish(defaultTopic, []byte("poison"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+
+	val, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("poison"), val)
+	assert.NoError(c.NackWithReason("first"))
+
+	// The message is returned until it has used up its deliveries
+	select {
+	case <-alerts:
+		t.Fatal("received alert before the message was dead-lettered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.NackWithReason("second"))
+
+	select {
+	case alert := <-alerts:
+		assert.Equal(deadLetterAlert{
+			ID:              id,
+			Topic:           defaultTopic,
+			Deliveries:      2,
+			NackReasons:     []string{"first", "second"},
+			DeadLetterTopic: defaultTopic + dlqSuffix,
+		}, alert)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for alert")
+	}
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(0, n)
+
+	// The dead-letter topic may be consumed like any other, and NACKing on it
+	// doesn't dead-letter again
+	dlq := b.Subscribe(defaultTopic + dlqSuffix)
+	for i := 0; i < 3; i++ {
+		val, err = dlq.Next(context.Background())
+		assert.NoError(err)
+		assert.Equal(value("poison"), val)
+		assert.Equal(defaultTopic, dlq.Meta().DeadLetterSource)
+		assert.NoError(dlq.Nack())
+	}
+}
+
+func TestDeadLetter_Record(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBroker(helperNewMemStore(t), withDeadLetter(2), withClock(func() time.Time { return now }))
+
+	_, err := b.Publish(defaultTopic, []byte("poison"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	for _, reason := range []string{"first", "second"} {
+		_, err := c.TryNext(context.Background())
+		assert.NoError(err)
+		assert.NoError(c.NackWithReason(reason))
+	}
+
+	// The dead-lettered message records its deliveries and its last error
+	want := &deadLetterRecord{
+		Topic:      defaultTopic,
+		Deliveries: 2,
+		At:         now,
+		LastError:  "second",
+	}
+
+	rec := NewRecorder()
+	newServer(b).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/topics/"+defaultTopic+dlqSuffix+"/peek", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var peeked []peekResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&peeked))
+	if assert.Len(peeked, 1) {
+		assert.Equal(want, peeked[0].DeadLetter)
+	}
+
+	dlq := b.Subscribe(defaultTopic + dlqSuffix)
+	val, err := dlq.TryNext(context.Background())
+	assert.NoError(err)
+
+	res := messageFrame(val, dlq.Meta(), false)
+	assert.Equal(want, res.DeadLetter)
+
+	// Messages which were never dead-lettered carry no record
+	assert.Nil(messageFrame(val, messageMeta{}, false).DeadLetter)
+}
+
+func TestDeadLetter_RedriveCapped(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Now()
+	const delay = time.Hour
+
+	b := newBroker(&store{db: db},
+		withDeadLetter(1),
+		withRedrive(delay, 2),
+		withClock(func() time.Time { return now }),
+	)
+	t.Cleanup(func() { _ = b.Shutdown() })
+
+	_, err = b.Publish(defaultTopic, []byte("poison"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+
+	for redrives := 0; redrives < 2; redrives++ {
+		_, err := c.Next(context.Background())
+		assert.NoError(err)
+		assert.Equal(redrives, c.Meta().Redrives)
+		assert.NoError(c.Nack())
+
+		n, err := b.store.Len(defaultTopic + redriveSuffix)
+		assert.NoError(err)
+		assert.Equal(1, n)
+
+		// Nothing is redriven before the delay has passed
+		redriven, err := b.redrive()
+		assert.NoError(err)
+		assert.Equal(0, redriven)
+
+		now = now.Add(delay)
+
+		redriven, err = b.redrive()
+		assert.NoError(err)
+		assert.Equal(1, redriven)
+	}
+
+	// Once out of redrives, the message stays on the dead-letter topic
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(2, c.Meta().Redrives)
+	assert.NoError(c.Nack())
+
+	now = now.Add(delay)
+
+	redriven, err := b.redrive()
+	assert.NoError(err)
+	assert.Equal(0, redriven)
+
+	for topic, want := range map[string]int{
+		defaultTopic:                 0,
+		defaultTopic + redriveSuffix: 0,
+		defaultTopic + dlqSuffix:     1,
+	} {
+		n, err := b.store.Len(topic)
+		assert.NoError(err)
+		assert.Equal(want, n, topic)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestConsumerDeliverBy(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBroker(&store{db: db}, withClock(func() time.Time { return now }))
+
+	for _, m := range []struct {
+		val       string
+		deliverBy time.Time
+	}{
+		{val: "late", deliverBy: now.Add(time.Second)},
+		{val: "on_time", deliverBy: now.Add(time.Hour)},
+		{val: "late_again", deliverBy: now.Add(time.Second)},
+		{val: "no_deadline"},
+	} {
+		_, err := b.Publish(defaultTopic, []byte(m.val), messageMeta{DeliverBy: m.deliverBy})
+		assert.NoError(err)
+	}
+
+	now = now.Add(time.Minute)
+
+	c := b.Subscribe(defaultTopic)
+
+	// Messages past their deadline are dropped rather than delivered late
+	val, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("on_time"), val)
+	assert.Equal(1, c.Meta().Deliveries)
+	assert.NoError(c.Ack())
+
+	val, err = c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("no_deadline"), val)
+	assert.NoError(c.Ack())
+
+	_, err = c.TryNext(context.Background())
+	assert.Equal(errNoMessages, err)
+}
+
+func TestPublishDeliverBy(t *testing.T) {
+	tests := []struct {
+		name      string
+		deliverBy string
+		code      int
+		want      time.Time
+	}{
+		{name: "valid", deliverBy: "2020-01-01T00:00:00Z", code: http.StatusCreated, want: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "invalid", deliverBy: "tomorrow", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			db, err := leveldb.Open(storage.NewMemStorage(), nil)
+			assert.NoError(err)
+
+			s := &store{db: db}
+			b := newBroker(s)
+
+			w := NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/publish/"+defaultTopic+"?deliverBy="+tt.deliverBy, strings.NewReader("test_value"))
+			r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+			publish(b)(w, r)
+			assert.Equal(tt.code, w.Code)
+
+			if tt.code != http.StatusCreated {
+				return
+			}
+
+			msgs, err := s.Peek(defaultTopic, 1)
+			assert.NoError(err)
+			assert.Len(msgs, 1)
+			assert.True(tt.want.Equal(msgs[0].meta.DeliverBy))
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// loadTopicsFile reads the topics declared in the JSON file at path, which maps
+// each topic name to its config, e.g.
+//
+//	{ "orders": { "max_length": 1000 }, "events": { "compact": true } }
+//
+// Unknown settings and invalid configs are rejected, such that a mistake in the
+// file fails startup rather than being ignored.
+func loadTopicsFile(path string) (map[string]topicConfig, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading topics file: %v", err)
+	}
+
+	topics, err := decodeTopics(raw)
+	if err != nil {
+		return nil, fmt.Errorf("topics file %s: %v", path, err)
+	}
+
+	return topics, nil
+}
+
+// decodeTopics decodes and validates the topics declared in raw JSON, mapping
+// each topic name to its config.
+func decodeTopics(raw []byte) (map[string]topicConfig, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	var topics map[string]topicConfig
+	if err := dec.Decode(&topics); err != nil {
+		return nil, fmt.Errorf("decoding topics: %v", err)
+	}
+
+	for topic, cfg := range topics {
+		if topic == "" {
+			return nil, errors.New("topic name must not be empty")
+		}
+
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("topic %s: %v", topic, err)
+		}
+	}
+
+	return topics, nil
+}
+
+// DeclareTopics applies the config of each declared topic, replacing any
+// config stored for it, so that the topics are set up before any traffic.
+func (b *broker) DeclareTopics(topics map[string]topicConfig) error {
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+
+	sort.Strings(names)
+
+	for _, topic := range names {
+		if err := b.SetTopicConfig(topic, topics[topic]); err != nil {
+			return fmt.Errorf("declaring topic %s: %v", topic, err)
+		}
+	}
+
+	return nil
+}
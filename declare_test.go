@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestDeclareTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	path := helperWriteTopicsFile(t, `{
+		"orders": { "max_length": 100, "content_type": "application/json" },
+		"prices": { "compact": true, "require_subscriber": true }
+	}`)
+
+	topics, err := loadTopicsFile(path)
+	assert.NoError(err)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db}
+	b := newBroker(s)
+	assert.NoError(b.LoadTopicConfigs())
+	assert.NoError(b.DeclareTopics(topics))
+
+	want := map[string]topicConfig{
+		"orders": {MaxLength: 100, ContentType: "application/json"},
+		"prices": {Compact: true, RequireSubscriber: true},
+	}
+
+	for topic, cfg := range want {
+		assert.Equal(cfg, b.TopicConfig(topic))
+	}
+
+	// The declared configs are persisted like any other
+	stored, err := s.TopicConfigs()
+	assert.NoError(err)
+	assert.Equal(want, stored)
+}
+
+func TestLoadTopicsFile_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{name: "malformed json", file: `{"orders": {`},
+		{name: "unknown setting", file: `{"orders": {"max_len": 100}}`},
+		{name: "invalid config", file: `{"orders": {"max_length": -1}}`},
+		{name: "empty topic name", file: `{"": {}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTopicsFile(helperWriteTopicsFile(t, tt.file))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := loadTopicsFile(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func helperWriteTopicsFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "topics.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	// decodeErrorsQueryKey is the subscribe query parameter holding how many
+	// consecutive malformed commands the stream tolerates before it is closed.
+	decodeErrorsQueryKey = "max_decode_errors"
+
+	// decodeErrorReason is recorded with the messages NACKed when a stream is
+	// closed for sending malformed commands.
+	decodeErrorReason = "malformed command"
+)
+
+// parseMaxDecodeErrors parses the number of consecutive malformed commands a
+// stream tolerates, a positive integer.
+func parseMaxDecodeErrors(raw string) (int, error) {
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, errInvalidDecodeErrs
+	}
+
+	return n, nil
+}
+
+// resumeDecoding returns a decoder for the commands following the one which
+// failed to decode with err, along with the source it reads from. A command
+// which isn't valid JSON leaves the decoder of src unable to continue, so the
+// rest of its line is discarded and decoding resumes on the next.
+func resumeDecoding(dec *json.Decoder, src io.Reader, err error) (*json.Decoder, io.Reader) {
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return dec, src
+	}
+
+	r := bufio.NewReader(io.MultiReader(dec.Buffered(), src))
+
+	// The buffer starts with whatever followed the last command decoded, so
+	// skip to the end of the first line with any content. Any error is met
+	// again by the next decode.
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil || len(bytes.TrimSpace(line)) > 0 {
+			break
+		}
+	}
+
+	return json.NewDecoder(r), r
+}
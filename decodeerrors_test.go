@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func helperSubscribePipe(t *testing.T, b brokerer, query string) (*json.Encoder, *io.PipeWriter, *DecodeWaiter, *ResponseRecorder, <-chan struct{}) {
+	t.Helper()
+
+	reader, writer := io.Pipe()
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s?%s", defaultTopic, query), reader)
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		subscribe(b, flushThreshold{})(subW, r)
+	}()
+
+	return json.NewEncoder(writer), writer, NewDecodeWaiter(subW), subW, done
+}
+
+func TestSubscribeDecodeErrors_Tolerated(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+
+	for _, msg := range []string{"test_value_1", "test_value_2"} {
+		_, err := b.Publish(defaultTopic, []byte(msg), messageMeta{})
+		assert.NoError(err)
+	}
+
+	enc, writer, dec, _, _ := helperSubscribePipe(t, b, decodeErrorsQueryKey+"=2")
+	defer writer.Close()
+
+	var out subResponse
+	assert.NoError(enc.Encode(CmdInit))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal("test_value_1", out.Msg)
+
+	// Malformed commands which aren't consecutive never reach the limit
+	for _, malformed := range []string{"not json\n", `{"cmd": 5}` + "\n"} {
+		_, err := io.WriteString(writer, malformed)
+		assert.NoError(err)
+
+		out = subResponse{}
+		assert.NoError(dec.WaitAndDecode(&out))
+		assert.Equal(errDecodingCmd.Error(), out.Error)
+
+		assert.NoError(enc.Encode(CmdNack))
+
+		out = subResponse{}
+		assert.NoError(dec.WaitAndDecode(&out))
+		assert.NotEmpty(out.Msg)
+	}
+
+	// The stream carries on
+	assert.NoError(enc.Encode(CmdAck))
+
+	out = subResponse{}
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Empty(out.Error)
+}
+
+func TestSubscribeDecodeErrors_Limit(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+
+	id, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	enc, writer, dec, subW, done := helperSubscribePipe(t, b, decodeErrorsQueryKey+"=2")
+	defer writer.Close()
+
+	var out subResponse
+	assert.NoError(enc.Encode(CmdInit))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal("test_value", out.Msg)
+
+	for i := 0; i < 2; i++ {
+		_, err := io.WriteString(writer, "not json\n")
+		assert.NoError(err)
+
+		out = subResponse{}
+		assert.NoError(dec.WaitAndDecode(&out))
+		assert.Equal(errDecodingCmd.Error(), out.Error)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the stream to close")
+	}
+
+	assert.Equal(streamStatusError, subW.Header().Get(trailerStreamStatus))
+
+	// The outstanding message is NACKed with the reason
+	msgs, err := b.Peek(defaultTopic, 1)
+	assert.NoError(err)
+	if assert.Len(msgs, 1) {
+		assert.Equal(id, msgs[0].meta.ID)
+		assert.Equal([]string{decodeErrorReason}, msgs[0].meta.NackReasons)
+	}
+}
+
+func TestSubscribeDecodeErrors_Invalid(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newServer(newBroker(helperNewMemStore(t)))
+
+	rec := NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s?%s=0", defaultTopic, decodeErrorsQueryKey), nil))
+
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal(errInvalidDecodeErrs.Error(), out.Error)
+}
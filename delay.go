@@ -0,0 +1,402 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// delayedPrefix prefixes the keys of the delayed messages held in the
+	// store, which are keyed by when they are due and then by ID, such that
+	// they're stored in the order they're due.
+	delayedPrefix = "miniqueue-delayed-"
+	delayedKeyFmt = delayedPrefix + "%020d-%s"
+)
+
+// delayedMessage is a message held in the store until it is due to be
+// published to its topic.
+type delayedMessage struct {
+	Topic string      `json:"topic"`
+	Value value       `json:"value"`
+	Meta  messageMeta `json:"meta"`
+	At    time.Time   `json:"at"`
+
+	// Header holds the headers the message was published with, which its meta
+	// doesn't store, such that it's published as it would have been at once.
+	Header http.Header `json:"header,omitempty"`
+}
+
+func (m delayedMessage) key() []byte {
+	return []byte(fmt.Sprintf(delayedKeyFmt, m.At.UnixNano(), m.Meta.ID))
+}
+
+// withMaxDelayed caps the number of delayed messages waiting to be published,
+// on each topic and in total. A delayed publish beyond either cap is rejected.
+// Zero is unlimited.
+func withMaxDelayed(perTopic, total int) brokerOption {
+	return func(b *broker) {
+		b.delayed.maxPerTopic = perTopic
+		b.delayed.maxTotal = total
+	}
+}
+
+// PublishDelayed publishes a message to a topic once delay has passed,
+// returning the ID assigned to the message. The message is checked against
+// the topic when it is published, rather than when it is scheduled, and
+// dropped if rejected then. Delayed messages are held in the store until they
+// are published, and are restored by Recover if the broker stops before then.
+func (b *broker) PublishDelayed(topic string, val value, meta messageMeta, delay time.Duration) (string, error) {
+	if err := b.checkSkew(meta); err != nil {
+		return "", err
+	}
+
+	id, err := b.ids.NextID(topic)
+	if err != nil {
+		return "", fmt.Errorf("generating message id: %v", err)
+	}
+
+	meta.ID = id
+
+	msg := delayedMessage{
+		Topic:  topic,
+		Value:  val,
+		Meta:   meta,
+		At:     time.Now().Add(delay),
+		Header: meta.Header,
+	}
+
+	if err := b.store.InsertDelayed(msg); err != nil {
+		return "", fmt.Errorf("storing delayed message: %v", err)
+	}
+
+	if err := b.delayed.schedule(topic, msg.At, func() { b.publishDue(msg) }); err != nil {
+		if err := b.store.DeleteDelayed(msg); err != nil {
+			log.Err(err).
+				Str("topic", topic).
+				Str("msg_id", id).
+				Msg("failed to delete rejected delayed message")
+		}
+
+		return "", err
+	}
+
+	return id, nil
+}
+
+// publishDue publishes the delayed message now that it is due, then deletes it
+// from the store. Failing to delete it leaves it to be published again on
+// restart, which is preferable to losing it.
+func (b *broker) publishDue(msg delayedMessage) {
+	log := log.With().
+		Str("topic", msg.Topic).
+		Str("msg_id", msg.Meta.ID).
+		Logger()
+
+	meta := msg.Meta
+	meta.Header = msg.Header
+
+	if _, err := b.publish(msg.Topic, msg.Value, meta); err != nil {
+		log.Err(err).Msg("failed to publish delayed message")
+	}
+
+	if err := b.store.DeleteDelayed(msg); err != nil {
+		log.Err(err).Msg("failed to delete published delayed message")
+	}
+}
+
+// restoreDelayed schedules the delayed messages held in the store by a
+// previous run, returning how many there were. Those which fell due while the
+// broker was stopped are published straight away. Restored messages don't
+// count against the caps on delayed messages, having been accepted already.
+func (b *broker) restoreDelayed() (int, error) {
+	msgs, err := b.store.Delayed()
+	if err != nil {
+		return 0, fmt.Errorf("getting delayed messages: %v", err)
+	}
+
+	for _, msg := range msgs {
+		msg := msg
+
+		if err := b.delayed.restore(msg.Topic, msg.At, func() { b.publishDue(msg) }); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(msgs), nil
+}
+
+// DelayedLen returns the number of delayed messages waiting to be published to
+// the topic, including values NACKed with a delay.
+func (b *broker) DelayedLen(topic string) int {
+	return b.delayed.len(topic)
+}
+
+// scheduledFunc is a function to be run by the scheduler once its time has
+// come.
+type scheduledFunc struct {
+	at    time.Time
+	topic string
+	fn    func()
+}
+
+// scheduledQueue is a min-heap of scheduled functions, earliest first.
+type scheduledQueue []scheduledFunc
+
+func (q scheduledQueue) Len() int            { return len(q) }
+func (q scheduledQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q scheduledQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *scheduledQueue) Push(x interface{}) { *q = append(*q, x.(scheduledFunc)) }
+
+func (q *scheduledQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	f := old[n-1]
+	*q = old[:n-1]
+
+	return f
+}
+
+// scheduler runs functions once their delay has passed, using a single timer
+// armed for the earliest. The number waiting on each topic, and in total, may
+// be capped. The zero value is ready to use, and unlimited.
+type scheduler struct {
+	queue   scheduledQueue
+	pending map[string]int
+	timer   *time.Timer
+	stopped bool
+
+	maxPerTopic int
+	maxTotal    int
+
+	sync.Mutex
+}
+
+// schedule runs fn at the given time, returning errTooManyDelayed if the
+// topic or scheduler is at its cap.
+func (s *scheduler) schedule(topic string, at time.Time, fn func()) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stopped {
+		return errShutdown
+	}
+
+	if s.maxTotal > 0 && len(s.queue) >= s.maxTotal {
+		return errTooManyDelayed
+	}
+
+	if s.maxPerTopic > 0 && s.pending[topic] >= s.maxPerTopic {
+		return errTooManyDelayed
+	}
+
+	s.push(topic, at, fn)
+
+	return nil
+}
+
+// restore runs fn at the given time, regardless of the caps.
+func (s *scheduler) restore(topic string, at time.Time, fn func()) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stopped {
+		return errShutdown
+	}
+
+	s.push(topic, at, fn)
+
+	return nil
+}
+
+// push adds fn to the queue, rearming the timer. The lock must be held.
+func (s *scheduler) push(topic string, at time.Time, fn func()) {
+	if s.pending == nil {
+		s.pending = map[string]int{}
+	}
+
+	heap.Push(&s.queue, scheduledFunc{at: at, topic: topic, fn: fn})
+	s.pending[topic]++
+
+	s.arm()
+}
+
+// arm sets the timer to fire when the earliest function is due. The lock must
+// be held.
+func (s *scheduler) arm() {
+	if len(s.queue) == 0 {
+		return
+	}
+
+	d := time.Until(s.queue[0].at)
+
+	if s.timer == nil {
+		s.timer = time.AfterFunc(d, s.fire)
+		return
+	}
+
+	s.timer.Stop()
+	s.timer.Reset(d)
+}
+
+// fire runs every function which is due, in the order they are due, then
+// rearms the timer for the next.
+func (s *scheduler) fire() {
+	s.Lock()
+
+	if s.stopped {
+		s.Unlock()
+		return
+	}
+
+	now := time.Now()
+
+	var due []scheduledFunc
+	for len(s.queue) > 0 && !s.queue[0].at.After(now) {
+		f := heap.Pop(&s.queue).(scheduledFunc)
+		due = append(due, f)
+
+		s.pending[f.topic]--
+		if s.pending[f.topic] == 0 {
+			delete(s.pending, f.topic)
+		}
+	}
+
+	s.arm()
+	s.Unlock()
+
+	for _, f := range due {
+		f.fn()
+	}
+}
+
+// len returns the number of functions waiting to run for the topic.
+func (s *scheduler) len(topic string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.pending[topic]
+}
+
+// stop discards every function waiting to run, returning how many there were.
+// The delayed messages they would have published remain in the store.
+// Nothing may be scheduled afterwards.
+func (s *scheduler) stop() int {
+	s.Lock()
+	defer s.Unlock()
+
+	s.stopped = true
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	n := len(s.queue)
+	s.queue = nil
+	s.pending = nil
+
+	return n
+}
+
+// publishDelayed schedules the message to be published once the delay has
+// passed, responding with its ID.
+func publishDelayed(log zerolog.Logger, w http.ResponseWriter, broker brokerer, topic string, val value, meta messageMeta, delay time.Duration) {
+	log = log.With().Dur("delay", delay).Logger()
+
+	id, err := broker.PublishDelayed(topic, val, meta, delay)
+	if errors.Is(err, errTooManyDelayed) {
+		log.Warn().Msg("too many delayed messages")
+
+		w.WriteHeader(http.StatusTooManyRequests)
+		respondError(log, json.NewEncoder(w), errDelayedLimit.Error())
+
+		return
+	}
+	if errors.Is(err, errInvalidTimestamp) || errors.Is(err, errTimestampSkew) {
+		log.Debug().Err(err).Msg("producer timestamp rejected")
+
+		w.WriteHeader(http.StatusBadRequest)
+		respondError(log, json.NewEncoder(w), err.Error())
+
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("failed to schedule delayed message")
+
+		w.WriteHeader(http.StatusInternalServerError)
+		respondError(log, json.NewEncoder(w), errPublish.Error())
+
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	respondPublished(log, json.NewEncoder(w), id)
+
+	log.Debug().
+		Str("msg_id", id).
+		Msg("scheduled delayed message")
+}
+
+// InsertDelayed holds the message in the store until it is due.
+func (s *store) InsertDelayed(msg delayedMessage) error {
+	s.Lock()
+	defer s.Unlock()
+
+	val, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("encoding delayed message: %v", err)
+	}
+
+	if err := s.db.Put(msg.key(), val, nil); err != nil {
+		return fmt.Errorf("putting delayed message: %v", err)
+	}
+
+	return s.written()
+}
+
+// DeleteDelayed deletes the message from the store once it has been
+// published.
+func (s *store) DeleteDelayed(msg delayedMessage) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.db.Delete(msg.key(), nil); err != nil {
+		return fmt.Errorf("deleting delayed message: %v", err)
+	}
+
+	return s.written()
+}
+
+// Delayed returns the messages held in the store until they're due, earliest
+// first.
+func (s *store) Delayed() ([]delayedMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(delayedPrefix)), nil)
+	defer iter.Release()
+
+	var msgs []delayedMessage
+	for iter.Next() {
+		var msg delayedMessage
+		if err := json.Unmarshal(iter.Value(), &msg); err != nil {
+			return nil, fmt.Errorf("decoding delayed message %s: %v", iter.Key(), err)
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating delayed messages: %v", err)
+	}
+
+	return msgs, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestPublishDelayed(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	defer b.delayed.stop()
+
+	id, err := b.PublishDelayed(defaultTopic, []byte("test_msg"), messageMeta{}, 20*time.Millisecond)
+	assert.NoError(err)
+	assert.Equal(1, b.DelayedLen(defaultTopic))
+
+	// Not published until the delay has passed
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Zero(n)
+
+	assert.Eventually(func() bool {
+		n, err := b.store.Len(defaultTopic)
+		return err == nil && n == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Zero(b.DelayedLen(defaultTopic))
+
+	// Keeping the ID it was given when scheduled
+	msgs, err := b.store.Peek(defaultTopic, 1)
+	assert.NoError(err)
+	assert.Equal(id, msgs[0].meta.ID)
+}
+
+func TestPublishDelayedCap(t *testing.T) {
+	tests := []struct {
+		name     string
+		perTopic int
+		total    int
+		topics   []string
+	}{
+		{name: "per topic", perTopic: 2, topics: []string{defaultTopic, defaultTopic, defaultTopic}},
+		{name: "total", total: 2, topics: []string{"a", "b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			db, err := leveldb.Open(storage.NewMemStorage(), nil)
+			assert.NoError(err)
+
+			b := newBroker(&store{db: db}, withMaxDelayed(tt.perTopic, tt.total))
+			defer b.delayed.stop()
+
+			// Schedule up to the cap, one firing soon
+			_, err = b.PublishDelayed(tt.topics[0], []byte("soon"), messageMeta{}, 20*time.Millisecond)
+			assert.NoError(err)
+			_, err = b.PublishDelayed(tt.topics[1], []byte("later"), messageMeta{}, time.Hour)
+			assert.NoError(err)
+
+			_, err = b.PublishDelayed(tt.topics[2], []byte("rejected"), messageMeta{}, time.Hour)
+			assert.Equal(errTooManyDelayed, err)
+
+			// Once one fires, there is room again
+			assert.Eventually(func() bool {
+				n, err := b.store.Len(tt.topics[0])
+				return err == nil && n == 1
+			}, time.Second, 5*time.Millisecond)
+
+			_, err = b.PublishDelayed(tt.topics[2], []byte("accepted"), messageMeta{}, time.Hour)
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	assert := assert.New(t)
+
+	var s scheduler
+	defer s.stop()
+
+	var (
+		mu  sync.Mutex
+		ran []int
+		wg  sync.WaitGroup
+	)
+
+	// Functions run in the order they are due, regardless of when scheduled
+	for i, delay := range []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		i := i
+		wg.Add(1)
+
+		assert.NoError(s.schedule(defaultTopic, time.Now().Add(delay), func() {
+			defer wg.Done()
+
+			mu.Lock()
+			ran = append(ran, i)
+			mu.Unlock()
+		}))
+	}
+
+	assert.Equal(3, s.len(defaultTopic))
+
+	wg.Wait()
+	assert.Equal([]int{1, 2, 0}, ran)
+	assert.Zero(s.len(defaultTopic))
+
+	// Nothing may be scheduled once stopped
+	assert.NoError(s.schedule(defaultTopic, time.Now().Add(time.Hour), func() {}))
+	assert.Equal(1, s.stop())
+	assert.Equal(errShutdown, s.schedule(defaultTopic, time.Now().Add(time.Hour), func() {}))
+}
+
+func TestPublishDelayedHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withMaxDelayed(1, 0))
+	defer b.delayed.stop()
+
+	srv := newServer(b)
+
+	publish := func(delay string) int {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?delay=%s", defaultTopic, delay), strings.NewReader("test_msg"))
+		srv.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	assert.Equal(http.StatusAccepted, publish("1h"))
+	assert.Equal(http.StatusTooManyRequests, publish("1h"))
+	assert.Equal(http.StatusBadRequest, publish("-1s"))
+	assert.Equal(http.StatusBadRequest, publish("soon"))
+
+	// Delayed messages aren't stored until published
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Zero(n)
+}
+
+func TestPublishDelayed_Restore(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withMaxDelayed(1, 0))
+
+	id, err := b.PublishDelayed(defaultTopic, []byte("later"), messageMeta{}, time.Hour)
+	assert.NoError(err)
+
+	// A delayed publish rejected by the cap isn't held
+	_, err = b.PublishDelayed(defaultTopic, []byte("rejected"), messageMeta{}, time.Hour)
+	assert.Equal(errTooManyDelayed, err)
+
+	// Stopping leaves the delayed message held in the store
+	assert.Equal(1, b.delayed.stop())
+
+	held, err := b.store.Delayed()
+	assert.NoError(err)
+	if assert.Len(held, 1) {
+		assert.Equal(id, held[0].Meta.ID)
+		assert.Equal(value("later"), held[0].Value)
+	}
+
+	// Along with one which falls due while stopped
+	due := delayedMessage{
+		Topic: defaultTopic,
+		Value: []byte("due"),
+		Meta:  messageMeta{ID: "due_id"},
+		At:    time.Now().Add(-time.Minute),
+	}
+	assert.NoError(b.store.InsertDelayed(due))
+
+	// On restart, both are restored regardless of the cap, and the one which is
+	// due is published straight away
+	restarted := newBroker(&store{db: db}, withMaxDelayed(1, 0))
+	defer restarted.delayed.stop()
+
+	assert.NoError(restarted.Recover())
+	assert.Equal(2, restarted.RecoveryReport().Delayed)
+
+	assert.Eventually(func() bool {
+		n, err := restarted.store.Len(defaultTopic)
+		return err == nil && n == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(1, restarted.DelayedLen(defaultTopic))
+
+	msgs, err := restarted.store.Peek(defaultTopic, 1)
+	assert.NoError(err)
+	assert.Equal("due_id", msgs[0].meta.ID)
+
+	held, err = restarted.store.Delayed()
+	assert.NoError(err)
+	if assert.Len(held, 1) {
+		assert.Equal(id, held[0].Meta.ID)
+	}
+}
+
+func TestPublishDeliverAt(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	defer b.delayed.stop()
+
+	srv := newServer(b)
+
+	publish := func(query string) int {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?%s", defaultTopic, query), strings.NewReader("test_msg"))
+		srv.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	at := time.Now().Add(time.Hour).UTC()
+
+	assert.Equal(http.StatusAccepted, publish("deliverAt="+at.Format(time.RFC3339Nano)))
+
+	held, err := b.store.Delayed()
+	assert.NoError(err)
+	if assert.Len(held, 1) {
+		assert.WithinDuration(at, held[0].At, time.Second)
+	}
+
+	// A time which has passed publishes straight away
+	assert.Equal(http.StatusCreated, publish("deliverAt=2020-01-01T00:00:00Z"))
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	assert.Equal(http.StatusBadRequest, publish("deliverAt=soon"))
+	assert.Equal(http.StatusBadRequest, publish("delay=1h&deliverAt="+at.Format(time.RFC3339)))
+}
+
+func TestNackAfter_Delayed(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withMaxDelayed(1, 0))
+	defer b.delayed.stop()
+
+	for _, v := range []string{"delayed", "returned"} {
+		_, err := b.Publish(defaultTopic, []byte(v), messageMeta{})
+		assert.NoError(err)
+	}
+
+	c := b.Subscribe(defaultTopic)
+
+	val, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("delayed"), val)
+	assert.NoError(c.NackAfter(nil, "", 200*time.Millisecond))
+
+	// Delayed NACKs count against the caps on delayed messages
+	assert.Equal(1, b.DelayedLen(defaultTopic))
+	_, err = b.PublishDelayed(defaultTopic, []byte("test_msg"), messageMeta{}, time.Hour)
+	assert.Equal(errTooManyDelayed, err)
+
+	// Beyond the cap, the value is returned straight away
+	val, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("returned"), val)
+	assert.NoError(c.NackAfter(nil, "", time.Hour))
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+	assert.Empty(c.outstanding)
+
+	assert.Eventually(func() bool {
+		n, err := b.store.Len(defaultTopic)
+		return err == nil && n == 2
+	}, time.Second, 5*time.Millisecond)
+	assert.Zero(b.DelayedLen(defaultTopic))
+}
@@ -0,0 +1,68 @@
+package main
+
+import "errors"
+
+// disconnectPolicy determines what happens to the messages outstanding on a
+// consumer when its client disconnects.
+type disconnectPolicy string
+
+const (
+	// disconnectNack returns outstanding messages to the topic, for delivery
+	// to another consumer. This is the default.
+	disconnectNack = disconnectPolicy("nack")
+	// disconnectAck drops outstanding messages, for workloads which prefer
+	// loss to duplication.
+	disconnectAck = disconnectPolicy("ack")
+)
+
+// parseDisconnectPolicy parses the disconnect policy requested by a consumer.
+func parseDisconnectPolicy(s string) (disconnectPolicy, error) {
+	switch p := disconnectPolicy(s); p {
+	case disconnectNack, disconnectAck:
+		return p, nil
+	default:
+		return "", errDisconnectPolicy
+	}
+}
+
+// withDisconnectPolicy sets the default disconnect policy of consumers, which
+// may be overridden when subscribing.
+func withDisconnectPolicy(p disconnectPolicy) brokerOption {
+	return func(b *broker) {
+		b.onDisconnect = p
+	}
+}
+
+// SetDisconnectPolicy overrides the broker's disconnect policy for the
+// consumer.
+func (c *consumer) SetDisconnectPolicy(p disconnectPolicy) {
+	c.onDisconnect = p
+}
+
+// Disconnected handles the client of the consumer going away, acking or
+// nacking the outstanding messages according to the disconnect policy.
+func (c *consumer) Disconnected() error {
+	if c.onDisconnect == disconnectAck {
+		return c.AckAll()
+	}
+
+	return c.NackAll()
+}
+
+// AckAll acknowledges every outstanding value. Values which have already been
+// returned to the topic by their ack timeout are skipped.
+func (c *consumer) AckAll() error {
+	for len(c.outstanding) > 0 {
+		ds := append([]*delivery(nil), c.outstanding...)
+
+		// The expired values have been removed, retry the remainder
+		err := c.ack(ds, nil)
+		if errors.Is(err, errAckTimeout) {
+			continue
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDisconnectPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := parseDisconnectPolicy("ack")
+	assert.NoError(err)
+	assert.Equal(disconnectAck, p)
+
+	p, err = parseDisconnectPolicy("nack")
+	assert.NoError(err)
+	assert.Equal(disconnectNack, p)
+
+	_, err = parseDisconnectPolicy("drop")
+	assert.Equal(errDisconnectPolicy, err)
+}
+
+func TestConsumerDisconnected(t *testing.T) {
+	topic := "test_topic"
+
+	t.Run("nack by default", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockStore := NewMockstorer(ctrl)
+		mockStore.EXPECT().GetNext(topic).Return([]byte("message1"), messageMeta{}, 0, nil)
+		mockStore.EXPECT().Nack(topic, 0).Return(nil)
+
+		c := newBroker(mockStore).Subscribe(topic)
+
+		_, err := c.TryNext(context.Background())
+		assert.NoError(t, err)
+		assert.NoError(t, c.Disconnected())
+	})
+
+	t.Run("ack from broker option", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockStore := NewMockstorer(ctrl)
+		mockStore.EXPECT().GetNext(topic).Return([]byte("message1"), messageMeta{}, 0, nil)
+		mockStore.EXPECT().GetNext(topic).Return([]byte("message2"), messageMeta{}, 1, nil)
+		mockStore.EXPECT().Ack(topic, 0, 1).Return(nil)
+
+		c := newBroker(mockStore, withDisconnectPolicy(disconnectAck)).Subscribe(topic)
+
+		for i := 0; i < 2; i++ {
+			_, err := c.TryNext(context.Background())
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, c.Disconnected())
+	})
+
+	t.Run("consumer override", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockStore := NewMockstorer(ctrl)
+		mockStore.EXPECT().GetNext(topic).Return([]byte("message1"), messageMeta{}, 0, nil)
+		mockStore.EXPECT().Nack(topic, 0).Return(nil)
+
+		c := newBroker(mockStore, withDisconnectPolicy(disconnectAck)).Subscribe(topic)
+		c.SetDisconnectPolicy(disconnectNack)
+
+		_, err := c.TryNext(context.Background())
+		assert.NoError(t, err)
+		assert.NoError(t, c.Disconnected())
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// recoverSummary describes the outcome of recovering the dead-lettered
+// messages of a topic.
+type recoverSummary struct {
+	// Recovered is the number of messages returned to the topic from its
+	// dead-letter topics.
+	Recovered int `json:"recovered"`
+
+	// Skipped is the number of messages left on the dead-letter topic, having
+	// used up their redrives, or being unreadable.
+	Skipped int `json:"skipped"`
+
+	// Reset is the number of messages already waiting on the topic whose
+	// delivery counts were reset.
+	Reset int `json:"reset"`
+}
+
+// RecoverDeadLetters returns the dead-lettered messages of the topic, both
+// those on its dead-letter topic and those waiting for redrive, to the topic
+// with their delivery counts reset, as a redrive would. The delivery counts of
+// the messages already waiting on the topic are reset too.
+//
+// Each recovery counts as a redrive, so a message which has used up the
+// redrives allowed by the broker stays on the dead-letter topic, stopping a
+// message which always fails from looping. Without a redrive limit, every
+// message is recovered.
+func (b *broker) RecoverDeadLetters(topic string) (recoverSummary, error) {
+	var summary recoverSummary
+
+	if isDeadLetterTopic(topic) {
+		return summary, errRecoverDeadLetter
+	}
+
+	n, err := b.store.ResetDeliveries(topic)
+	if err != nil {
+		return summary, fmt.Errorf("resetting delivery counts: %v", err)
+	}
+
+	summary.Reset = n
+
+	for _, dlq := range []string{topic + dlqSuffix, topic + redriveSuffix} {
+		recovered, skipped, err := b.recoverFrom(dlq, topic)
+
+		summary.Recovered += recovered
+		summary.Skipped += skipped
+
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	if summary.Recovered > 0 {
+		b.NotifyConsumer(topic, eventTypePublish)
+		b.checkBacklog(topic)
+	}
+
+	return summary, nil
+}
+
+// recoverFrom moves the messages waiting on the dead-letter topic dlq to the
+// topic, returning the number recovered and skipped. Skipped messages are
+// returned to dlq once every other message has been recovered.
+func (b *broker) recoverFrom(dlq, topic string) (recovered, skipped int, err error) {
+	var skippedOffsets []int
+
+	defer func() {
+		for _, ackOffset := range skippedOffsets {
+			if nackErr := b.store.Nack(dlq, ackOffset); nackErr != nil && err == nil {
+				err = fmt.Errorf("nacking topic %s with offset %d: %v", dlq, ackOffset, nackErr)
+			}
+		}
+	}()
+
+	for {
+		val, meta, ackOffset, err := b.store.GetNext(dlq)
+		if errors.Is(err, errNoMessages) {
+			return recovered, skipped, nil
+		}
+		if errors.Is(err, errDecrypt) || (err == nil && b.deadLetters.maxRedrives > 0 && meta.Redrives >= b.deadLetters.maxRedrives) {
+			skippedOffsets = append(skippedOffsets, ackOffset)
+			skipped++
+
+			continue
+		}
+		if err != nil {
+			return recovered, skipped, fmt.Errorf("getting next from %s: %v", dlq, err)
+		}
+
+		val, err = readBody(b.store, dlq, ackOffset, val, &meta)
+		if err != nil {
+			return recovered, skipped, err
+		}
+
+		meta.Deliveries = 0
+		meta.Redrives++
+
+		if err := b.store.Insert(topic, val, meta); err != nil {
+			return recovered, skipped, fmt.Errorf("recovering to %s: %v", topic, err)
+		}
+
+		// Failing here leaves the value on both topics, which is preferable
+		// to losing it
+		if err := b.store.Drop(dlq, ackOffset); err != nil {
+			return recovered, skipped, fmt.Errorf("dropping topic %s with offset %d: %v", dlq, ackOffset, err)
+		}
+
+		recovered++
+
+		log.Info().
+			Str("topic", topic).
+			Str("msg_id", meta.ID).
+			Int("redrives", meta.Redrives).
+			Msg("recovered dead-lettered message")
+	}
+}
+
+// recoverDeadLetters returns the dead-lettered messages of a topic to it, with
+// their delivery counts reset.
+func recoverDeadLetters(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "recover_dead_letters").
+			Logger()
+
+		topic, ok := mux.Vars(r)[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().Str("topic", topic).Logger()
+
+		summary, err := broker.RecoverDeadLetters(topic)
+		if errors.Is(err, errRecoverDeadLetter) {
+			log.Debug().Msg("recovering a dead-letter topic")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errRecoverDeadLetter.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).
+				Int("recovered", summary.Recovered).
+				Msg("failed to recover dead-lettered messages")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errRecover.Error())
+
+			return
+		}
+
+		log.Info().
+			Int("recovered", summary.Recovered).
+			Int("skipped", summary.Skipped).
+			Int("reset", summary.Reset).
+			Msg("recovered dead-lettered messages")
+
+		if err := json.NewEncoder(w).Encode(summary); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t), withDeadLetter(1))
+	s := newServer(b)
+
+	for i := 0; i < 3; i++ {
+		_, err := b.Publish(defaultTopic, []byte(fmt.Sprintf("test_value_%d", i)), messageMeta{})
+		assert.NoError(err)
+	}
+
+	// Each message fails, and is dead-lettered
+	c := b.Subscribe(defaultTopic)
+	for i := 0; i < 3; i++ {
+		_, err := c.TryNext(context.Background())
+		assert.NoError(err)
+		assert.NoError(c.Nack())
+	}
+	b.Unsubscribe(c)
+
+	n, err := b.store.Len(defaultTopic + dlqSuffix)
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	rec := NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/topics/%s/recover", defaultTopic), nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var out recoverSummary
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal(recoverSummary{Recovered: 3}, out)
+
+	// The dead-letter topic is empty, and the messages are back on the topic
+	// in order, with their delivery counts zeroed
+	n, err = b.store.Len(defaultTopic + dlqSuffix)
+	assert.NoError(err)
+	assert.Zero(n)
+
+	msgs, err := b.Peek(defaultTopic, 10)
+	assert.NoError(err)
+	if assert.Len(msgs, 3) {
+		for i, m := range msgs {
+			assert.Equal(value(fmt.Sprintf("test_value_%d", i)), m.val)
+			assert.Zero(m.meta.Deliveries)
+			assert.Equal(1, m.meta.Redrives)
+		}
+	}
+}
+
+func TestRecoverDeadLetters_RedriveCap(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t), withDeadLetter(1), withRedrive(0, 1))
+
+	_, err := b.Publish(defaultTopic, []byte("poison"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	deadLetter := func() {
+		_, err := c.TryNext(context.Background())
+		assert.NoError(err)
+		assert.NoError(c.Nack())
+	}
+
+	deadLetter()
+
+	out, err := b.RecoverDeadLetters(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, out.Recovered)
+
+	// Having used up its redrives, a message which fails again stays put
+	deadLetter()
+
+	out, err = b.RecoverDeadLetters(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(recoverSummary{Skipped: 1}, out)
+
+	n, err := b.store.Len(defaultTopic + dlqSuffix)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	// A dead-letter topic can't itself be recovered
+	_, err = b.RecoverDeadLetters(defaultTopic + dlqSuffix)
+	assert.Equal(errRecoverDeadLetter, err)
+}
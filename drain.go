@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	drainMaxQueryKey      = "max"
+	drainMaxBytesQueryKey = "maxBytes"
+
+	// defaultDrainMax is the number of messages drained when no maximum is
+	// requested.
+	defaultDrainMax = 100
+)
+
+// drainedResponse is a message consumed from a topic by a drain.
+type drainedResponse struct {
+	ID          string `json:"id"`
+	Msg         string `json:"msg"`
+	ContentType string `json:"content_type,omitempty"`
+	InReplyTo   string `json:"in_reply_to,omitempty"`
+	Redelivered bool   `json:"redelivered,omitempty"`
+
+	PublishedAt time.Time         `json:"published_at"`
+	Deliveries  int               `json:"deliveries"`
+	Headers     map[string]string `json:"headers,omitempty"`
+
+	NackReasons []string          `json:"nack_reasons,omitempty"`
+	DeadLetter  *deadLetterRecord `json:"dead_letter,omitempty"`
+}
+
+// Drain consumes up to max messages waiting on the topic at once, acking them.
+// With maxBytes, it stops before the total size of the messages would exceed
+// it, though a single message is always drained even if it alone exceeds it.
+// A maxBytes of zero is unlimited.
+func (b *broker) Drain(topic string, max, maxBytes int) ([]pendingMessage, error) {
+	c := b.Subscribe(topic)
+	defer b.Unsubscribe(c)
+
+	var (
+		msgs []pendingMessage
+		size int
+	)
+
+	for len(msgs) < max {
+		val, err := c.TryNext(context.Background())
+		if errors.Is(err, errNoMessages) {
+			break
+		}
+		if err != nil {
+			if err := c.NackAll(); err != nil {
+				log.Err(err).Msg("failed to nack drained messages")
+			}
+
+			return nil, err
+		}
+
+		if maxBytes > 0 && len(msgs) > 0 && size+len(val) > maxBytes {
+			if err := c.release(); err != nil {
+				return nil, err
+			}
+
+			break
+		}
+
+		size += len(val)
+		msgs = append(msgs, pendingMessage{val: val, meta: c.Meta()})
+	}
+
+	if err := c.AckAll(); err != nil {
+		return nil, fmt.Errorf("acking drained messages: %v", err)
+	}
+
+	return msgs, nil
+}
+
+// release returns the most recent delivery to the front of the topic, without
+// counting it as NACKed. It still counts as a delivery.
+func (c *consumer) release() error {
+	d := c.current()
+	if d == nil {
+		return nil
+	}
+
+	c.remove(d)
+
+	// The value has already been returned to the topic
+	if d.stop() {
+		return nil
+	}
+
+	return c.nack(c.source, d.ackOffset)
+}
+
+// drain consumes a batch of messages from the topic in a single request.
+func drain(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "drain").
+			Logger()
+
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		max, err := parseDrainLimit(r.URL.Query().Get(drainMaxQueryKey), defaultDrainMax)
+		if err != nil {
+			log.Debug().Err(err).Msg("invalid drain max")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidDrainMax.Error())
+
+			return
+		}
+
+		maxBytes, err := parseDrainLimit(r.URL.Query().Get(drainMaxBytesQueryKey), 0)
+		if err != nil {
+			log.Debug().Err(err).Msg("invalid drain max bytes")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidMaxBytes.Error())
+
+			return
+		}
+
+		msgs, err := broker.Drain(topic, max, maxBytes)
+		if err != nil {
+			log.Err(err).Msg("failed to drain topic")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errDrain.Error())
+
+			return
+		}
+
+		log.Debug().
+			Int("count", len(msgs)).
+			Msg("drained messages")
+
+		respondDrained(log, json.NewEncoder(w), msgs)
+	}
+}
+
+// parseDrainLimit parses a positive limit of a drain, returning def if unset.
+func parseDrainLimit(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid limit %q", s)
+	}
+
+	return n, nil
+}
+
+func respondDrained(log zerolog.Logger, e *json.Encoder, msgs []pendingMessage) {
+	res := make([]drainedResponse, 0, len(msgs))
+	for _, m := range msgs {
+		res = append(res, drainedResponse{
+			ID:          m.meta.ID,
+			Msg:         string(m.val),
+			ContentType: m.meta.ContentType,
+			InReplyTo:   m.meta.InReplyTo,
+			Redelivered: m.meta.Deliveries > 1,
+			PublishedAt: m.meta.PublishedAt,
+			Deliveries:  m.meta.Deliveries,
+			Headers:     m.meta.Headers,
+			NackReasons: m.meta.NackReasons,
+			DeadLetter:  newDeadLetterRecord(m.meta),
+		})
+	}
+
+	if err := e.Encode(res); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestBrokerDrain(t *testing.T) {
+	tests := []struct {
+		name     string
+		msgs     []string
+		max      int
+		maxBytes int
+		want     []string
+		pending  int
+	}{
+		{
+			name:    "count bounded",
+			msgs:    []string{"a", "b", "c"},
+			max:     2,
+			want:    []string{"a", "b"},
+			pending: 1,
+		},
+		{
+			name:     "bytes bounded stops at the threshold",
+			msgs:     []string{"aaaa", "bbbb", "cccc"},
+			max:      defaultDrainMax,
+			maxBytes: 10,
+			want:     []string{"aaaa", "bbbb"},
+			pending:  1,
+		},
+		{
+			name:     "bytes bounded includes a message reaching the threshold",
+			msgs:     []string{"aaaa", "bbbb", "cc"},
+			max:      defaultDrainMax,
+			maxBytes: 10,
+			want:     []string{"aaaa", "bbbb", "cc"},
+		},
+		{
+			name:     "oversized message is drained alone",
+			msgs:     []string{strings.Repeat("a", 20), "b"},
+			max:      defaultDrainMax,
+			maxBytes: 10,
+			want:     []string{strings.Repeat("a", 20)},
+			pending:  1,
+		},
+		{
+			name: "empty topic",
+			max:  defaultDrainMax,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			db, err := leveldb.Open(storage.NewMemStorage(), nil)
+			assert.NoError(err)
+
+			b := newBroker(&store{db: db})
+			for _, msg := range tt.msgs {
+				_, err := b.Publish(defaultTopic, []byte(msg), messageMeta{})
+				assert.NoError(err)
+			}
+
+			msgs, err := b.Drain(defaultTopic, tt.max, tt.maxBytes)
+			assert.NoError(err)
+
+			var got []string
+			for _, m := range msgs {
+				got = append(got, string(m.val))
+			}
+			assert.Equal(tt.want, got)
+
+			// The remainder stays on the topic, in order
+			n, err := b.store.Len(defaultTopic)
+			assert.NoError(err)
+			assert.Equal(tt.pending, n)
+
+			if tt.pending > 0 {
+				rest, err := b.Drain(defaultTopic, defaultDrainMax, 0)
+				assert.NoError(err)
+				assert.Equal(tt.msgs[len(tt.want)], string(rest[0].val))
+			}
+
+			// The consumer used to drain is gone
+			assert.Zero(b.subscribers(defaultTopic))
+		})
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	srv := newServer(b)
+
+	for _, msg := range []string{"aaaa", "bbbb", "cccc"} {
+		_, err := b.Publish(defaultTopic, []byte(msg), messageMeta{})
+		assert.NoError(err)
+	}
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/drain/%s?maxBytes=8", defaultTopic), nil)
+	srv.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var res []drainedResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&res))
+	assert.Len(res, 2)
+	assert.Equal("aaaa", res[0].Msg)
+	assert.Equal("bbbb", res[1].Msg)
+	assert.NotEmpty(res[0].ID)
+
+	for _, query := range []string{"?maxBytes=0", "?maxBytes=lots", "?max=-1"} {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/drain/%s%s", defaultTopic, query), nil)
+		srv.ServeHTTP(rec, req)
+		assert.Equal(http.StatusBadRequest, rec.Code, query)
+	}
+}
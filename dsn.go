@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Store schemes accepted in a DSN.
+const (
+	// schemeLevelDB persists the store to a LevelDB database at the path of
+	// the DSN, e.g. leveldb:///var/lib/miniqueue.
+	schemeLevelDB = "leveldb"
+	// schemeMemory holds the store in memory, losing it on exit, e.g.
+	// memory://.
+	schemeMemory = "memory"
+)
+
+// openStore opens the store described by the DSN. A DSN without a scheme is
+// treated as the path of a LevelDB database.
+func openStore(dsn string, opts ...storeOption) (storer, error) {
+	if !strings.Contains(dsn, "://") {
+		return openLevelDB(dsn, opts...)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parsing store DSN: %v", err)
+	}
+
+	switch u.Scheme {
+	case schemeLevelDB:
+		path := u.Host + u.Path
+		if path == "" {
+			return nil, fmt.Errorf("store DSN %q has no path", dsn)
+		}
+
+		return openLevelDB(path, opts...)
+	case schemeMemory:
+		db, err := leveldb.Open(storage.NewMemStorage(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("opening memory store: %v", err)
+		}
+
+		return newStoreFromDB("", db, opts...), nil
+	default:
+		return nil, fmt.Errorf("unsupported store scheme %q, expected %s or %s", u.Scheme, schemeLevelDB, schemeMemory)
+	}
+}
+
+func openLevelDB(path string, opts ...storeOption) (storer, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening leveldb at %s: %v", path, err)
+	}
+
+	return newStoreFromDB(path, db, opts...), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenStore(t *testing.T) {
+	tests := []struct {
+		name     string
+		dsn      string
+		wantPath string
+	}{
+		{name: "bare path", dsn: tmpDBPath, wantPath: tmpDBPath},
+		{name: "leveldb", dsn: "leveldb://" + tmpDBPath, wantPath: tmpDBPath},
+		{name: "memory", dsn: "memory://", wantPath: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			s, err := openStore(tt.dsn, withHeadCache(10))
+			assert.NoError(err)
+			t.Cleanup(s.Destroy)
+
+			assert.IsType(&store{}, s)
+			assert.Equal(tt.wantPath, s.(*store).path)
+
+			// Options are applied whatever the backend
+			assert.NotNil(s.(*store).cache)
+
+			// The store is usable
+			assert.NoError(s.Insert(defaultTopic, []byte("test_value"), messageMeta{}))
+
+			val, _, _, err := s.GetNext(defaultTopic)
+			assert.NoError(err)
+			assert.Equal("test_value", string(val))
+		})
+	}
+}
+
+func TestOpenStore_Invalid(t *testing.T) {
+	for _, dsn := range []string{
+		"bolt:///tmp/miniqueue.db",
+		"wal:///tmp/miniqueue",
+		"leveldb://",
+	} {
+		_, err := openStore(dsn)
+		assert.Error(t, err, dsn)
+	}
+
+	_, err := openStore("bolt:///tmp/miniqueue.db")
+	assert.EqualError(t, err, `unsupported store scheme "bolt", expected leveldb or memory`)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Queue is a MiniQueue broker for use within a Go program, publishing and
+// consuming messages in-process without the HTTP server. It is safe for
+// concurrent use, while each Consumer should only be used by one goroutine.
+//
+// As MiniQueue is built as a command, the Queue can't yet be imported by other
+// modules. It is the API a library package would expose, and is kept stable
+// with that in mind.
+type Queue struct {
+	broker *broker
+}
+
+// Open opens a Queue on the store described by the DSN, as accepted by the
+// -db flag, e.g. "memory://" or "leveldb:///var/lib/miniqueue". Messages left
+// outstanding by a previous run are returned to their topics.
+func Open(dsn string) (*Queue, error) {
+	s, err := openStore(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBroker(s)
+
+	if err := b.LoadTopicConfigs(); err != nil {
+		_ = s.Close()
+		return nil, fmt.Errorf("loading topic configs: %v", err)
+	}
+
+	if err := b.Recover(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+
+	return &Queue{broker: b}, nil
+}
+
+// Publish publishes the message to the topic, returning its ID.
+func (q *Queue) Publish(topic string, msg []byte) (string, error) {
+	return q.broker.Publish(topic, msg, messageMeta{})
+}
+
+// Subscribe returns a new Consumer of the topic. Each message published to the
+// topic is delivered to one of its consumers.
+func (q *Queue) Subscribe(topic string) *Consumer {
+	return &Consumer{
+		broker: q.broker,
+		cons:   q.broker.Subscribe(topic),
+	}
+}
+
+// Close shuts down the Queue, closing its store.
+func (q *Queue) Close() error {
+	return q.broker.Shutdown()
+}
+
+// Consumer consumes the messages of a topic of a Queue.
+type Consumer struct {
+	broker *broker
+	cons   *consumer
+}
+
+// Next waits for the next message on the topic, returning it once delivered.
+// The message must then be acknowledged with Ack or Nack.
+func (c *Consumer) Next(ctx context.Context) ([]byte, error) {
+	return c.cons.Next(ctx)
+}
+
+// Ack acknowledges the last delivered message, removing it from the topic.
+func (c *Consumer) Ack() error {
+	return c.cons.Ack()
+}
+
+// Nack negatively acknowledges the last delivered message, returning it to the
+// front of the topic to be delivered again.
+func (c *Consumer) Nack() error {
+	return c.cons.Nack()
+}
+
+// Close unsubscribes the Consumer, returning any outstanding messages to the
+// topic.
+func (c *Consumer) Close() error {
+	defer c.broker.Unsubscribe(c.cons)
+
+	return c.cons.NackAll()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleQueue() {
+	q, err := Open("memory://")
+	if err != nil {
+		panic(err)
+	}
+	defer q.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := q.Publish("greetings", []byte(msg)); err != nil {
+			panic(err)
+		}
+	}
+
+	c := q.Subscribe("greetings")
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		msg, err := c.Next(context.Background())
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Println(string(msg))
+
+		if err := c.Ack(); err != nil {
+			panic(err)
+		}
+	}
+
+	// Output:
+	// hello
+	// world
+}
+
+func TestQueue_NackAndClose(t *testing.T) {
+	assert := assert.New(t)
+
+	q, err := Open("memory://")
+	assert.NoError(err)
+	defer q.Close()
+
+	_, err = q.Publish(defaultTopic, []byte("test_value_1"))
+	assert.NoError(err)
+	_, err = q.Publish(defaultTopic, []byte("test_value_2"))
+	assert.NoError(err)
+
+	c := q.Subscribe(defaultTopic)
+
+	msg, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal([]byte("test_value_1"), msg)
+
+	// A NACKed message is delivered again
+	assert.NoError(c.Nack())
+
+	msg, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal([]byte("test_value_1"), msg)
+
+	// Closing returns the outstanding message to another consumer
+	assert.NoError(c.Close())
+
+	c = q.Subscribe(defaultTopic)
+	defer c.Close()
+
+	msg, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal([]byte("test_value_1"), msg)
+}
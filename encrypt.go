@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const errDecrypt = storeError("failed to decrypt value")
+
+// withEncryption encrypts the values of messages before they are written to
+// the store, decrypting them as they are read back, such that they are only
+// ever stored encrypted. Clients publish and receive plaintext as usual.
+func withEncryption(aead cipher.AEAD) brokerOption {
+	return func(b *broker) {
+		b.store = &encryptedStore{storer: b.store, aead: aead}
+	}
+}
+
+// newCipher returns the AES-GCM cipher for the key, which must be 16, 24 or 32
+// bytes long, selecting AES-128, AES-192 or AES-256.
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// loadCipher returns the AES-GCM cipher for the hex encoded key in the file at
+// path.
+func loadCipher(path string) (cipher.AEAD, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key: %v", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key: %v", err)
+	}
+
+	return newCipher(key)
+}
+
+// encryptedStore wraps a store, encrypting each value inserted into it and
+// decrypting each value read from it. Every value is sealed with a random
+// nonce, which is stored ahead of its ciphertext. Metadata is stored as is.
+type encryptedStore struct {
+	storer
+	aead cipher.AEAD
+}
+
+func (e *encryptedStore) encrypt(val value) (value, error) {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(val)+e.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %v", err)
+	}
+
+	return e.aead.Seal(nonce, nonce, val, nil), nil
+}
+
+func (e *encryptedStore) decrypt(val value) (value, error) {
+	if len(val) < e.aead.NonceSize() {
+		return nil, errDecrypt
+	}
+
+	nonce, ciphertext := val[:e.aead.NonceSize()], val[e.aead.NonceSize():]
+
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+
+	return plaintext, nil
+}
+
+// Unwrap returns the wrapped store.
+func (e *encryptedStore) Unwrap() storer {
+	return e.storer
+}
+
+func (e *encryptedStore) Insert(topic string, val value, meta messageMeta) error {
+	sealed, err := e.encrypt(val)
+	if err != nil {
+		return err
+	}
+
+	return e.storer.Insert(topic, sealed, meta)
+}
+
+func (e *encryptedStore) InsertAll(records []record) error {
+	sealed, err := e.sealAll(records)
+	if err != nil {
+		return err
+	}
+
+	return e.storer.InsertAll(sealed)
+}
+
+func (e *encryptedStore) ReplaceAll(topics []string, records []record) error {
+	sealed, err := e.sealAll(records)
+	if err != nil {
+		return err
+	}
+
+	return e.storer.ReplaceAll(topics, sealed)
+}
+
+// sealAll returns the records with their values encrypted.
+func (e *encryptedStore) sealAll(records []record) ([]record, error) {
+	sealed := make([]record, 0, len(records))
+	for _, r := range records {
+		val, err := e.encrypt(r.value)
+		if err != nil {
+			return nil, err
+		}
+
+		r.value = val
+		sealed = append(sealed, r)
+	}
+
+	return sealed, nil
+}
+
+func (e *encryptedStore) InsertDelayed(msg delayedMessage) error {
+	sealed, err := e.encrypt(msg.Value)
+	if err != nil {
+		return err
+	}
+
+	msg.Value = sealed
+
+	return e.storer.InsertDelayed(msg)
+}
+
+// Delayed decrypts the delayed messages held, failing if any can't be
+// decrypted.
+func (e *encryptedStore) Delayed() ([]delayedMessage, error) {
+	msgs, err := e.storer.Delayed()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, msg := range msgs {
+		plaintext, err := e.decrypt(msg.Value)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting delayed message %s: %v", msg.Meta.ID, err)
+		}
+
+		msgs[i].Value = plaintext
+	}
+
+	return msgs, nil
+}
+
+// GetNext returns errDecrypt along with the value as stored if it can't be
+// decrypted, leaving it awaiting acknowledgement at ackOffset so that it may
+// be quarantined. Values are only authenticated whole, so are always read
+// whole, never left in the store to be streamed.
+func (e *encryptedStore) GetNext(topic string) (value, messageMeta, int, error) {
+	val, meta, ackOffset, err := e.storer.GetNext(topic)
+	if err != nil {
+		return val, meta, ackOffset, err
+	}
+
+	if val, err = readBody(e.storer, topic, ackOffset, val, &meta); err != nil {
+		return nil, meta, ackOffset, err
+	}
+
+	plaintext, err := e.decrypt(val)
+	if err != nil {
+		return val, meta, ackOffset, err
+	}
+
+	return plaintext, meta, ackOffset, nil
+}
+
+// Fetch decrypts the fetched value in the same way as GetNext.
+func (e *encryptedStore) Fetch(topic, id string) (value, messageMeta, int, error) {
+	val, meta, ackOffset, err := e.storer.Fetch(topic, id)
+	if err != nil {
+		return val, meta, ackOffset, err
+	}
+
+	if val, err = readBody(e.storer, topic, ackOffset, val, &meta); err != nil {
+		return nil, meta, ackOffset, err
+	}
+
+	plaintext, err := e.decrypt(val)
+	if err != nil {
+		return val, meta, ackOffset, err
+	}
+
+	return plaintext, meta, ackOffset, nil
+}
+
+// Reader decrypts the value awaiting acknowledgement at ackOffset whole.
+func (e *encryptedStore) Reader(topic string, ackOffset int) (io.ReadCloser, int, error) {
+	r, _, err := e.storer.Reader(topic, ackOffset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+
+	val, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading value: %v", err)
+	}
+
+	plaintext, err := e.decrypt(val)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(plaintext)), len(plaintext), nil
+}
+
+// Peek returns values which can't be decrypted as they are stored, as they
+// are only quarantined once consumed.
+func (e *encryptedStore) Peek(topic string, limit int) ([]pendingMessage, error) {
+	msgs, err := e.storer.Peek(topic, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range msgs {
+		if msgs[i].val, err = e.decrypt(m.val); err != nil {
+			log.Warn().Str("topic", topic).Str("msg_id", m.meta.ID).Msg("failed to decrypt pending message")
+			msgs[i].val = m.val
+		}
+	}
+
+	return msgs, nil
+}
+
+// History returns values which can't be decrypted as they are stored.
+func (e *encryptedStore) History(topic string) ([]historyEntry, error) {
+	entries, err := e.storer.History(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, h := range entries {
+		if entries[i].Value, err = e.decrypt(h.Value); err != nil {
+			log.Warn().Str("topic", topic).Str("msg_id", h.Meta.ID).Msg("failed to decrypt retained message")
+			entries[i].Value = h.Value
+		}
+	}
+
+	return entries, nil
+}
+
+// ReadLog returns values which can't be decrypted as they are stored.
+func (e *encryptedStore) ReadLog(topic string, offset int) (logEntry, error) {
+	entry, err := e.storer.ReadLog(topic, offset)
+	if err != nil {
+		return logEntry{}, err
+	}
+
+	plaintext, err := e.decrypt(entry.Value)
+	if err != nil {
+		log.Warn().Str("topic", topic).Str("msg_id", entry.Meta.ID).Msg("failed to decrypt logged message")
+		return entry, nil
+	}
+
+	entry.Value = plaintext
+
+	return entry, nil
+}
+
+// quarantine moves a value awaiting acknowledgement at ackOffset on the topic,
+// which couldn't be decrypted, to the dead-letter topic dest. It is stored as
+// it was read, so is left intact for inspection, and is never redriven.
+func quarantine(s storer, topic, dest string, val value, ackOffset int, meta messageMeta, now time.Time) error {
+	log.Error().
+		Str("topic", topic).
+		Str("msg_id", meta.ID).
+		Str("dead_letter_topic", dest).
+		Msg("failed to decrypt message, dead-lettering it")
+
+	meta.DeadLetterDeliveries = meta.Deliveries
+	meta.Deliveries = 0
+	meta.Key = ""
+	meta.DeadLetterSource = topic
+	meta.DeadLetteredAt = now
+
+	if err := s.Insert(dest, val, meta); err != nil {
+		return fmt.Errorf("dead-lettering to %s: %v", dest, err)
+	}
+
+	if err := s.Drop(topic, ackOffset); err != nil {
+		return fmt.Errorf("dropping topic %s with offset %d: %v", topic, ackOffset, err)
+	}
+
+	return nil
+}
+
+// quarantine dead-letters a value of the consumer's topic which couldn't be
+// decrypted, rather than delivering it.
+func (c *consumer) quarantine(val value, ackOffset int, meta messageMeta) error {
+	dest := c.topic + dlqSuffix
+
+	if err := quarantine(c.store, c.source, dest, val, ackOffset, meta, c.now()); err != nil {
+		return err
+	}
+
+	c.notifier.NotifyConsumer(dest, eventTypePublish)
+
+	return nil
+}
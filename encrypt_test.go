@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func helperNewCipher(t *testing.T, key string) cipher.AEAD {
+	t.Helper()
+
+	aead, err := newCipher([]byte(key))
+	assert.NoError(t, err)
+
+	return aead
+}
+
+func TestEncryption(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+	b := newBroker(s, withEncryption(helperNewCipher(t, "0123456789abcdef0123456789abcdef")))
+
+	_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+	_, err = b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	// Only ciphertext is stored, each with its own nonce
+	stored, err := s.Peek(defaultTopic, 2)
+	assert.NoError(err)
+	assert.Len(stored, 2)
+	assert.NotContains(string(stored[0].val), "test_value")
+	assert.NotEqual(stored[0].val, stored[1].val)
+
+	// Whereas the plaintext is read back
+	peeked, err := b.Peek(defaultTopic, 1)
+	assert.NoError(err)
+	assert.Equal(value("test_value"), peeked[0].val)
+
+	c := b.Subscribe(defaultTopic)
+
+	val, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("test_value"), val)
+	assert.NoError(c.Ack())
+}
+
+func TestEncryption_DecryptFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+
+	// Stored under a different key, so can't be decrypted
+	other := newBroker(s, withEncryption(helperNewCipher(t, "fedcba9876543210")))
+	_, err := other.Publish(defaultTopic, []byte("undecryptable"), messageMeta{ID: "bad"})
+	assert.NoError(err)
+
+	b := newBroker(s, withEncryption(helperNewCipher(t, "0123456789abcdef")))
+	_, err = b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	stored, err := s.Peek(defaultTopic, 1)
+	assert.NoError(err)
+
+	// The undecryptable message is dead-lettered, rather than delivered
+	c := b.Subscribe(defaultTopic)
+
+	val, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("test_value"), val)
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(0, n)
+
+	// Intact, as it was stored
+	dlq := b.Subscribe(defaultTopic + dlqSuffix)
+
+	val, err = dlq.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(stored[0].val, val)
+	assert.Equal(defaultTopic, dlq.meta.DeadLetterSource)
+	assert.Equal("bad", dlq.meta.ID)
+}
+
+func TestNewCipher(t *testing.T) {
+	_, err := newCipher([]byte("too_short"))
+	assert.Error(t, err)
+}
+
+func TestEncryption_Follower(t *testing.T) {
+	// Replicated values are applied as stored, beneath the encryption
+	s := helperNewMemStore(t)
+	b := newBroker(s, withEncryption(helperNewCipher(t, "0123456789abcdef")))
+
+	f, err := newFollower(b, "https://primary:8080", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, s, f.store)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// expiredSuffix names the topic holding the messages of a topic which expired
+// before they were delivered, e.g. "orders.expired".
+const expiredSuffix = ".expired"
+
+// withExpiredTopic moves messages which expire before they're delivered to the
+// expired topic of their topic, for inspection, rather than dropping them.
+func withExpiredTopic(keep bool) brokerOption {
+	return func(b *broker) {
+		b.keepExpired = keep
+	}
+}
+
+// isExpiredTopic reports whether the topic holds expired messages, which never
+// expire again.
+func isExpiredTopic(topic string) bool {
+	return strings.HasSuffix(topic, expiredSuffix)
+}
+
+// withTTL returns the metadata of a message with its delivery deadline brought
+// forward to ttl after it was published, if that is sooner. Zero leaves the
+// deadline as it is.
+func withTTL(meta messageMeta, ttl time.Duration) messageMeta {
+	if ttl <= 0 {
+		return meta
+	}
+
+	deadline := meta.PublishedAt.Add(ttl)
+	if meta.DeliverBy.IsZero() || deadline.Before(meta.DeliverBy) {
+		meta.DeliverBy = deadline
+	}
+
+	return meta
+}
+
+// pastDeadline reports whether the delivery deadline of a message waiting on
+// the topic has passed.
+func pastDeadline(topic string, meta messageMeta, now time.Time) bool {
+	return !meta.DeliverBy.IsZero() && now.After(meta.DeliverBy) && !isExpiredTopic(topic)
+}
+
+// sweepExpired removes the messages past their delivery deadline from every
+// topic, rather than waiting for them to reach a consumer.
+func (b *broker) sweepExpired() error {
+	expired, err := b.store.SweepExpired(b.now(), b.keepExpired)
+	if err != nil {
+		return fmt.Errorf("sweeping expired messages: %v", err)
+	}
+
+	for topic, metas := range expired {
+		log.Info().
+			Str("topic", topic).
+			Int("count", len(metas)).
+			Msg("swept messages past their delivery deadline")
+
+		b.expired(topic, metas)
+	}
+
+	return nil
+}
+
+// expired sends the receipts of messages swept from the topic, and wakes the
+// consumers of its expired topic if they were moved there.
+func (b *broker) expired(topic string, metas []messageMeta) {
+	for _, meta := range metas {
+		if meta.Notify != "" {
+			b.receipts.Send(meta.Notify, receipt{
+				ID:      meta.ID,
+				Topic:   topic,
+				Outcome: receiptOutcomeExpired,
+			})
+		}
+	}
+
+	if b.keepExpired {
+		b.NotifyConsumer(topic+expiredSuffix, eventTypePublish)
+	}
+}
+
+// SweepExpired removes the messages waiting on each topic whose delivery
+// deadline has passed by now, wherever they are in the topic, returning the
+// metadata of those removed from each. With keep, they are moved to the
+// expired topic of their topic instead. Messages on expired topics are never
+// swept.
+func (s *store) SweepExpired(now time.Time, keep bool) (map[string][]messageMeta, error) {
+	topics, err := s.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	swept := map[string][]messageMeta{}
+	for _, topic := range topics {
+		if isExpiredTopic(topic) {
+			continue
+		}
+
+		metas, err := s.sweepExpiredTopic(topic, now, keep)
+		if len(metas) > 0 {
+			swept[topic] = metas
+		}
+		if err != nil {
+			return swept, fmt.Errorf("sweeping topic %s: %v", topic, err)
+		}
+	}
+
+	return swept, nil
+}
+
+func (s *store) sweepExpiredTopic(topic string, now time.Time, keep bool) ([]messageMeta, error) {
+	var ids []string
+
+	err := s.Iterate(topic, func(_ value, meta messageMeta) error {
+		if pastDeadline(topic, meta, now) {
+			ids = append(ids, meta.ID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var swept []messageMeta
+	for _, id := range ids {
+		// Taking the value as a delivery closes the gap it leaves in the topic
+		val, meta, ackOffset, err := s.Fetch(topic, id)
+		if errors.Is(err, errMsgNotFound) || errors.Is(err, errMsgOutstanding) {
+			// Delivered since the topic was iterated
+			continue
+		}
+		if err != nil {
+			return swept, err
+		}
+
+		if keep {
+			if val, err = readBody(s, topic, ackOffset, val, &meta); err != nil {
+				return swept, err
+			}
+
+			meta.Deliveries = 0
+			meta.Key = ""
+
+			if err := s.Insert(topic+expiredSuffix, val, meta); err != nil {
+				return swept, fmt.Errorf("moving to %s: %v", topic+expiredSuffix, err)
+			}
+		}
+
+		// Failing here leaves the value on both topics, which is preferable to
+		// losing it
+		if err := s.Drop(topic, ackOffset); err != nil {
+			return swept, fmt.Errorf("dropping offset %d: %v", ackOffset, err)
+		}
+
+		swept = append(swept, meta)
+	}
+
+	return swept, nil
+}
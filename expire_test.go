@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestPublishTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &store{db: db}
+	b := newBroker(s, withClock(func() time.Time { return now }))
+
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{TTL: "1h"}))
+
+	for _, meta := range []messageMeta{
+		{},
+		{TTL: time.Minute},
+		{TTL: 2 * time.Hour},
+		{TTL: time.Minute, DeliverBy: now.Add(time.Second)},
+	} {
+		_, err := b.Publish(defaultTopic, []byte("test_value"), meta)
+		assert.NoError(err)
+	}
+
+	// The earliest of the TTLs and deadline is kept as the deadline
+	msgs, err := s.Peek(defaultTopic, 4)
+	assert.NoError(err)
+	assert.Len(msgs, 4)
+
+	for i, want := range []time.Time{
+		now.Add(time.Hour),
+		now.Add(time.Minute),
+		now.Add(time.Hour),
+		now.Add(time.Second),
+	} {
+		assert.True(want.Equal(msgs[i].meta.DeliverBy), i)
+		assert.Zero(msgs[i].meta.TTL, i)
+	}
+}
+
+func TestPublishTTL_Query(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  string
+		code int
+	}{
+		{name: "valid", ttl: "30s", code: http.StatusCreated},
+		{name: "invalid", ttl: "soon", code: http.StatusBadRequest},
+		{name: "negative", ttl: "-30s", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			db, err := leveldb.Open(storage.NewMemStorage(), nil)
+			assert.NoError(err)
+
+			now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			s := &store{db: db}
+			b := newBroker(s, withClock(func() time.Time { return now }))
+
+			w := NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/publish/"+defaultTopic+"?ttl="+tt.ttl, strings.NewReader("test_value"))
+			r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+			publish(b)(w, r)
+			assert.Equal(tt.code, w.Code)
+
+			if tt.code != http.StatusCreated {
+				return
+			}
+
+			msgs, err := s.Peek(defaultTopic, 1)
+			assert.NoError(err)
+			assert.Len(msgs, 1)
+			assert.True(now.Add(30 * time.Second).Equal(msgs[0].meta.DeliverBy))
+		})
+	}
+}
+
+func TestTopicConfigValidate_TTL(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(topicConfig{TTL: "90s"}.validate())
+	assert.Error(topicConfig{TTL: "soon"}.validate())
+	assert.Error(topicConfig{TTL: "0s"}.validate())
+}
+
+func TestBrokerSweepExpired(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		keep := keep
+
+		t.Run(map[bool]string{false: "drop", true: "keep"}[keep], func(t *testing.T) {
+			assert := assert.New(t)
+
+			db, err := leveldb.Open(storage.NewMemStorage(), nil)
+			assert.NoError(err)
+
+			now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			s := &store{db: db}
+			b := newBroker(s,
+				withExpiredTopic(keep),
+				withClock(func() time.Time { return now }),
+			)
+
+			for _, m := range []struct {
+				val string
+				ttl time.Duration
+			}{
+				{val: "outstanding", ttl: time.Second},
+				{val: "fresh"},
+				{val: "expired", ttl: time.Second},
+				{val: "fresh_again", ttl: time.Hour},
+			} {
+				_, err := b.Publish(defaultTopic, []byte(m.val), messageMeta{TTL: m.ttl})
+				assert.NoError(err)
+			}
+
+			c := b.Subscribe(defaultTopic)
+			val, err := c.Next(context.Background())
+			assert.NoError(err)
+			assert.Equal(value("outstanding"), val)
+
+			now = now.Add(time.Minute)
+
+			// Expired messages are swept from anywhere in the topic, leaving
+			// the outstanding message alone
+			assert.NoError(b.sweep())
+
+			msgs, err := s.Peek(defaultTopic, 10)
+			assert.NoError(err)
+			assert.Len(msgs, 2)
+			assert.Equal(value("fresh"), msgs[0].val)
+			assert.Equal(value("fresh_again"), msgs[1].val)
+
+			_, err = s.GetMeta(defaultTopic, c.ackOffset)
+			assert.NoError(err)
+
+			expired, err := s.Peek(defaultTopic+expiredSuffix, 10)
+			assert.NoError(err)
+
+			if !keep {
+				assert.Empty(expired)
+				return
+			}
+
+			assert.Len(expired, 1)
+			assert.Equal(value("expired"), expired[0].val)
+
+			// Expired topics are never swept themselves
+			assert.NoError(b.sweep())
+
+			n, err := s.Len(defaultTopic + expiredSuffix)
+			assert.NoError(err)
+			assert.Equal(1, n)
+		})
+	}
+}
+
+func TestConsumerDeliverBy_ExpiredTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBroker(&store{db: db},
+		withExpiredTopic(true),
+		withClock(func() time.Time { return now }),
+	)
+
+	_, err = b.Publish(defaultTopic, []byte("late"), messageMeta{TTL: time.Second})
+	assert.NoError(err)
+	_, err = b.Publish(defaultTopic, []byte("on_time"), messageMeta{})
+	assert.NoError(err)
+
+	now = now.Add(time.Minute)
+
+	// The late message is moved aside rather than delivered
+	c := b.Subscribe(defaultTopic)
+	val, err := c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("on_time"), val)
+	assert.NoError(c.Ack())
+
+	// Where it's delivered from the expired topic, despite its deadline
+	expired := b.Subscribe(defaultTopic + expiredSuffix)
+	val, err = expired.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("late"), val)
+	assert.Equal(1, expired.Meta().Deliveries)
+	assert.NoError(expired.Ack())
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	// importModeQueryKey is the import query parameter determining what
+	// happens to the messages already waiting on the topic, either append or
+	// replace.
+	importModeQueryKey = "mode"
+
+	importAppend  = "append"
+	importReplace = "replace"
+)
+
+// exportedMessage is a message waiting on a topic, as exported and imported,
+// one per line. The message is base64 encoded, so that any value survives the
+// round trip.
+type exportedMessage struct {
+	messageMeta
+	Msg []byte `json:"msg"`
+}
+
+// importResponse is the response to an import.
+type importResponse struct {
+	Imported int `json:"imported"`
+}
+
+// Iterate calls fn with each value waiting on the topic in order, along with
+// its metadata. The values are read from a snapshot of the store, so
+// publishes and deliveries made while iterating are not seen, and aren't held
+// up by fn.
+func (s *store) Iterate(topic string, fn func(val value, meta messageMeta) error) error {
+	s.Lock()
+	snap, err := s.db.GetSnapshot()
+	s.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("taking snapshot: %v", err)
+	}
+	defer snap.Release()
+
+	pos := func(keyFmt string) (int, error) {
+		b, err := snap.Get([]byte(fmt.Sprintf(keyFmt, topic)), nil)
+		if err != nil {
+			return 0, err
+		}
+
+		i, err := binary.ReadVarint(bytes.NewReader(b))
+		if err != nil {
+			return 0, fmt.Errorf("reading offset position varint: %v", err)
+		}
+
+		return int(i), nil
+	}
+
+	head, err := pos(headPosKeyFmt)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tail, err := pos(tailPosKeyFmt)
+	if err != nil {
+		return err
+	}
+
+	for offset := head; offset < tail; offset++ {
+		val, err := snap.Get([]byte(fmt.Sprintf(topicFmt, topic, offset)), nil)
+		if err != nil {
+			return fmt.Errorf("getting value from topic %s at offset %d: %v", topic, offset, err)
+		}
+
+		var meta messageMeta
+		b, err := snap.Get([]byte(fmt.Sprintf(metaFmt, topic, offset)), nil)
+		if err == nil {
+			meta, err = decodeMeta(b)
+		}
+		if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+			return fmt.Errorf("getting meta from topic %s at offset %d: %v", topic, offset, err)
+		}
+
+		if meta.BodySize > 0 {
+			if val, err = getBody(snap, topic, meta); err != nil {
+				return err
+			}
+
+			meta.BodySize = 0
+		}
+
+		if err := fn(val, meta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Iterate decrypts each value, passing on those which can't be decrypted as
+// they are stored, as Peek does.
+func (e *encryptedStore) Iterate(topic string, fn func(val value, meta messageMeta) error) error {
+	return e.storer.Iterate(topic, func(val value, meta messageMeta) error {
+		plaintext, err := e.decrypt(val)
+		if err != nil {
+			log.Warn().Str("topic", topic).Str("msg_id", meta.ID).Msg("failed to decrypt exported message")
+			plaintext = val
+		}
+
+		return fn(plaintext, meta)
+	})
+}
+
+// Export calls fn with each message waiting on the topic, in the order they
+// would be consumed, with their metadata.
+func (b *broker) Export(topic string, fn func(msg pendingMessage) error) error {
+	return b.store.Iterate(topic, func(val value, meta messageMeta) error {
+		return fn(pendingMessage{val: val, meta: meta})
+	})
+}
+
+// Import inserts the messages onto the topic in order, keeping their IDs and
+// metadata, as exported. Either every message is imported or none are. With
+// replace, the messages waiting on the topic are discarded in the same write,
+// though those awaiting acknowledgement are kept.
+func (b *broker) Import(topic string, msgs []pendingMessage, replace bool) error {
+	records := make([]record, 0, len(msgs))
+	for _, m := range msgs {
+		meta := m.meta
+
+		if meta.ID == "" {
+			id, err := b.ids.NextID(topic)
+			if err != nil {
+				return fmt.Errorf("generating message id: %v", err)
+			}
+
+			meta.ID = id
+		}
+
+		if meta.PublishedAt.IsZero() {
+			meta.PublishedAt = b.now()
+		}
+
+		records = append(records, record{topic: topic, value: m.val, meta: b.topicMeta(topic, meta)})
+	}
+
+	switch {
+	case replace:
+		// The waiting messages are only discarded along with the import
+		if err := b.store.ReplaceAll([]string{topic}, records); err != nil {
+			return err
+		}
+	case len(records) == 0:
+		return nil
+	default:
+		if err := b.store.InsertAll(records); err != nil {
+			return err
+		}
+	}
+
+	b.NotifyConsumer(topic, eventTypePublish)
+	b.checkBacklog(topic)
+
+	return nil
+}
+
+// exportTopic streams the messages waiting on a topic as newline delimited
+// JSON, without consuming them.
+func exportTopic(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "export").
+			Logger()
+
+		topic, ok := mux.Vars(r)[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().Str("topic", topic).Logger()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+
+		enc := json.NewEncoder(w)
+
+		n := 0
+		err := broker.Export(topic, func(msg pendingMessage) error {
+			n++
+			return enc.Encode(exportedMessage{messageMeta: msg.meta, Msg: msg.val})
+		})
+		if err != nil && n == 0 {
+			log.Err(err).Msg("failed to export topic")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, enc, errExport.Error())
+
+			return
+		}
+		if err != nil {
+			// The response has started, so the export is cut short
+			log.Err(err).Int("exported", n).Msg("failed to export topic")
+
+			return
+		}
+
+		log.Info().Int("exported", n).Msg("exported topic")
+	}
+}
+
+// importTopic inserts the messages in the request body, as exported, onto a
+// topic.
+func importTopic(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "import").
+			Logger()
+
+		topic, ok := mux.Vars(r)[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		if rejectReservedTopic(log, w, topic) {
+			return
+		}
+
+		log = log.With().Str("topic", topic).Logger()
+
+		var replace bool
+		switch mode := r.URL.Query().Get(importModeQueryKey); mode {
+		case "", importAppend:
+		case importReplace:
+			replace = true
+		default:
+			log.Debug().Str("mode", mode).Msg("invalid import mode")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidImportMode.Error())
+
+			return
+		}
+
+		var msgs []pendingMessage
+
+		dec := json.NewDecoder(r.Body)
+		for {
+			var m exportedMessage
+			err := dec.Decode(&m)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				log.Debug().Err(err).Msg("failed to decode imported message")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errDecodingImport.Error())
+
+				return
+			}
+
+			msgs = append(msgs, pendingMessage{val: m.Msg, meta: m.messageMeta})
+		}
+
+		if err := broker.Import(topic, msgs, replace); err != nil {
+			log.Err(err).Msg("failed to import messages")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errImport.Error())
+
+			return
+		}
+
+		log.Info().Int("imported", len(msgs)).Bool("replace", replace).Msg("imported messages")
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(importResponse{Imported: len(msgs)}); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func helperExport(t *testing.T, s *server, topic string) []exportedMessage {
+	t.Helper()
+
+	rec := NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/export/%s", topic), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	var msgs []exportedMessage
+
+	dec := json.NewDecoder(rec.Body)
+	for dec.More() {
+		var m exportedMessage
+		assert.NoError(t, dec.Decode(&m))
+
+		msgs = append(msgs, m)
+	}
+
+	return msgs
+}
+
+func helperImport(t *testing.T, s *server, topic, mode string, msgs []exportedMessage) *ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	for _, m := range msgs {
+		assert.NoError(t, json.NewEncoder(&body).Encode(m))
+	}
+
+	rec := NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/import/%s?mode=%s", topic, mode), &body))
+
+	return rec
+}
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	s := newServer(b)
+
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{Compact: true}))
+	assert.NoError(b.SetTopicConfig("restored_topic", topicConfig{Compact: true}))
+
+	_, err := b.Publish(defaultTopic, []byte("test_value_1"), messageMeta{ContentType: "text/plain", ReplyTo: "replies"})
+	assert.NoError(err)
+	_, err = b.Publish(defaultTopic, []byte{0xff, 0x00, 0xfe}, messageMeta{Key: "test_key"})
+	assert.NoError(err)
+	_, err = b.Publish(defaultTopic, []byte("test_value_3"), messageMeta{})
+	assert.NoError(err)
+
+	// A NACKed message keeps its deliveries and reasons
+	c := b.Subscribe(defaultTopic)
+	_, err = c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.NackWithReason("test_reason"))
+	b.Unsubscribe(c)
+
+	exported := helperExport(t, s, defaultTopic)
+	if !assert.Len(exported, 3) {
+		return
+	}
+
+	assert.Equal([]byte("test_value_1"), exported[0].Msg)
+	assert.Equal("text/plain", exported[0].ContentType)
+	assert.Equal("replies", exported[0].ReplyTo)
+	assert.Equal(1, exported[0].Deliveries)
+	assert.Equal([]string{"test_reason"}, exported[0].NackReasons)
+	assert.Equal([]byte{0xff, 0x00, 0xfe}, exported[1].Msg)
+	assert.Equal("test_key", exported[1].Key)
+
+	// Exporting doesn't consume the messages
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	rec := helperImport(t, s, "restored_topic", importAppend, exported)
+	assert.Equal(http.StatusCreated, rec.Code)
+
+	var res importResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(3, res.Imported)
+
+	// The messages and their metadata survive the round trip, in order
+	assert.Equal(exported, helperExport(t, s, "restored_topic"))
+
+	// And the restored messages are consumed as usual
+	c = b.Subscribe("restored_topic")
+	val, err := c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("test_value_1"), val)
+	assert.Equal(exported[0].ID, c.Meta().ID)
+}
+
+func TestImport_Mode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		want []string
+	}{
+		{
+			name: "append",
+			mode: importAppend,
+			want: []string{"existing_value", "imported_value"},
+		},
+		{
+			name: "default append",
+			mode: "",
+			want: []string{"existing_value", "imported_value"},
+		},
+		{
+			name: "replace",
+			mode: importReplace,
+			want: []string{"imported_value"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			b := newBroker(helperNewMemStore(t))
+			s := newServer(b)
+
+			_, err := b.Publish(defaultTopic, []byte("existing_value"), messageMeta{})
+			assert.NoError(err)
+
+			rec := helperImport(t, s, defaultTopic, tt.mode, []exportedMessage{
+				{messageMeta: messageMeta{ID: "imported"}, Msg: []byte("imported_value")},
+			})
+			assert.Equal(http.StatusCreated, rec.Code)
+
+			var got []string
+			for _, m := range helperExport(t, s, defaultTopic) {
+				got = append(got, string(m.Msg))
+			}
+			assert.Equal(tt.want, got)
+		})
+	}
+}
+
+func TestImport_ReplaceFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+	b := newBroker(s)
+
+	_, err := b.Publish(defaultTopic, []byte("existing_value"), messageMeta{})
+	assert.NoError(err)
+
+	// Corrupt the log position of the topic, failing any insert
+	assert.NoError(s.db.Put([]byte(fmt.Sprintf(logTailPosKeyFmt, defaultTopic)), nil, nil))
+
+	err = b.Import(defaultTopic, []pendingMessage{{val: []byte("imported_value")}}, true)
+	assert.Error(err)
+
+	// The waiting messages are kept when the import fails
+	msgs, err := b.Peek(defaultTopic, peekAllLimit)
+	assert.NoError(err)
+	assert.Len(msgs, 1)
+	assert.Equal("existing_value", string(msgs[0].val))
+}
+
+func TestImport_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		body    string
+		wantErr error
+	}{
+		{
+			name:    "invalid mode",
+			mode:    "merge",
+			body:    "",
+			wantErr: errInvalidImportMode,
+		},
+		{
+			name:    "malformed message",
+			mode:    importAppend,
+			body:    `{"id": "1", "msg": "dGVzdA=="}` + "\nnot json\n",
+			wantErr: errDecodingImport,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			b := newBroker(helperNewMemStore(t))
+			s := newServer(b)
+
+			rec := NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/import/%s?mode=%s", defaultTopic, tt.mode), strings.NewReader(tt.body)))
+
+			assert.Equal(http.StatusBadRequest, rec.Code)
+
+			var out subResponse
+			assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+			assert.Equal(tt.wantErr.Error(), out.Error)
+
+			// Nothing is imported
+			n, err := b.store.Len(defaultTopic)
+			assert.NoError(err)
+			assert.Zero(n)
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+const errInjected = storeError("injected store fault")
+
+// faultOp names a store operation faults may be injected into.
+type faultOp string
+
+const (
+	faultInsert  = faultOp("insert")
+	faultGetNext = faultOp("get_next")
+	faultAck     = faultOp("ack")
+)
+
+var allFaultOps = []faultOp{faultInsert, faultGetNext, faultAck}
+
+// latencyDist draws the latency injected into a store operation.
+type latencyDist func(r *rand.Rand) time.Duration
+
+// fixedLatency delays every operation by d.
+func fixedLatency(d time.Duration) latencyDist {
+	return func(*rand.Rand) time.Duration {
+		return d
+	}
+}
+
+// uniformLatency delays operations by a duration in [min, max).
+func uniformLatency(min, max time.Duration) latencyDist {
+	return func(r *rand.Rand) time.Duration {
+		return min + time.Duration(r.Int63n(int64(max-min)))
+	}
+}
+
+// expLatency delays operations by an exponentially distributed duration with
+// the given mean, giving a long tail of slow operations.
+func expLatency(mean time.Duration) latencyDist {
+	return func(r *rand.Rand) time.Duration {
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	}
+}
+
+// faultStore wraps a storer, injecting latency and errors into Insert, GetNext
+// and Ack in order to exercise the broker under adverse conditions. Other
+// operations pass through to the wrapped store.
+type faultStore struct {
+	storer
+
+	latency map[faultOp]latencyDist
+	errRate map[faultOp]float64
+	sleep   func(time.Duration)
+
+	injected map[faultOp]int // number of errors injected per operation
+
+	rand *rand.Rand
+	sync.Mutex
+}
+
+// faultOption configures the faults injected by a faultStore.
+type faultOption func(*faultStore)
+
+// withFaultLatency delays the operations, or all of them if none are given, by
+// a duration drawn from dist.
+func withFaultLatency(dist latencyDist, ops ...faultOp) faultOption {
+	return func(s *faultStore) {
+		for _, op := range faultOps(ops) {
+			s.latency[op] = dist
+		}
+	}
+}
+
+// withFaultErrors fails the operations, or all of them if none are given,
+// with errInjected with probability rate.
+func withFaultErrors(rate float64, ops ...faultOp) faultOption {
+	return func(s *faultStore) {
+		for _, op := range faultOps(ops) {
+			s.errRate[op] = rate
+		}
+	}
+}
+
+// withFaultSeed seeds the source of latencies and errors, making the faults
+// injected reproducible.
+func withFaultSeed(seed int64) faultOption {
+	return func(s *faultStore) {
+		s.rand = rand.New(rand.NewSource(seed))
+	}
+}
+
+// withFaultSleep replaces the function used to inject latency.
+func withFaultSleep(sleep func(time.Duration)) faultOption {
+	return func(s *faultStore) {
+		s.sleep = sleep
+	}
+}
+
+func newFaultStore(s storer, opts ...faultOption) *faultStore {
+	fs := &faultStore{
+		storer:   s,
+		latency:  map[faultOp]latencyDist{},
+		errRate:  map[faultOp]float64{},
+		sleep:    time.Sleep,
+		injected: map[faultOp]int{},
+		rand:     rand.New(rand.NewSource(1)),
+	}
+
+	for _, opt := range opts {
+		opt(fs)
+	}
+
+	return fs
+}
+
+func faultOps(ops []faultOp) []faultOp {
+	if len(ops) == 0 {
+		return allFaultOps
+	}
+
+	return ops
+}
+
+// fault injects the configured latency into the operation, returning
+// errInjected if the operation should fail.
+func (s *faultStore) fault(op faultOp) error {
+	s.Lock()
+	var delay time.Duration
+	if dist, ok := s.latency[op]; ok {
+		delay = dist(s.rand)
+	}
+
+	fail := s.rand.Float64() < s.errRate[op]
+	if fail {
+		s.injected[op]++
+	}
+	s.Unlock()
+
+	if delay > 0 {
+		s.sleep(delay)
+	}
+
+	if fail {
+		return fmt.Errorf("%s: %w", op, errInjected)
+	}
+
+	return nil
+}
+
+// Injected returns the number of errors injected into the operation.
+func (s *faultStore) Injected(op faultOp) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.injected[op]
+}
+
+func (s *faultStore) Insert(topic string, value value, meta messageMeta) error {
+	if err := s.fault(faultInsert); err != nil {
+		return err
+	}
+
+	return s.storer.Insert(topic, value, meta)
+}
+
+func (s *faultStore) GetNext(topic string) (value, messageMeta, int, error) {
+	if err := s.fault(faultGetNext); err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	return s.storer.GetNext(topic)
+}
+
+func (s *faultStore) Ack(topic string, ackOffsets ...int) error {
+	if err := s.fault(faultAck); err != nil {
+		return err
+	}
+
+	return s.storer.Ack(topic, ackOffsets...)
+}
+
+func helperNewFaultStore(t *testing.T, opts ...faultOption) *faultStore {
+	t.Helper()
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(t, err)
+
+	return newFaultStore(&store{db: db}, opts...)
+}
+
+func TestFaultStoreLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	var slept []time.Duration
+	s := helperNewFaultStore(t,
+		withFaultLatency(fixedLatency(10*time.Millisecond), faultInsert),
+		withFaultLatency(uniformLatency(time.Millisecond, 5*time.Millisecond), faultGetNext),
+		withFaultSleep(func(d time.Duration) { slept = append(slept, d) }),
+	)
+
+	b := newBroker(s)
+
+	_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	_, err = b.Subscribe(defaultTopic).TryNext(context.Background())
+	assert.NoError(err)
+
+	assert.Len(slept, 2)
+	assert.Equal(10*time.Millisecond, slept[0])
+	assert.GreaterOrEqual(int64(slept[1]), int64(time.Millisecond))
+	assert.Less(int64(slept[1]), int64(5*time.Millisecond))
+}
+
+func TestFaultStoreExpLatency(t *testing.T) {
+	mean := 10 * time.Millisecond
+	dist := expLatency(mean)
+	r := rand.New(rand.NewSource(1))
+
+	var total time.Duration
+	for i := 0; i < 10000; i++ {
+		total += dist(r)
+	}
+
+	assert.InDelta(t, float64(mean), float64(total/10000), float64(mean)/10)
+}
+
+func TestFaultStoreBrokerSurfacesErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewFaultStore(t, withFaultErrors(1, faultGetNext, faultAck))
+	b := newBroker(s)
+
+	// Inserts are unaffected
+	_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+
+	_, err = c.TryNext(context.Background())
+	assert.Contains(err.Error(), errInjected.Error())
+
+	// A failing ACK leaves the message outstanding
+	s.errRate[faultGetNext] = 0
+
+	_, err = c.TryNext(context.Background())
+	assert.NoError(err)
+
+	err = c.Ack()
+	assert.Contains(err.Error(), errInjected.Error())
+	assert.Len(c.outstanding, 1)
+
+	// Once the store recovers, the message can be acked
+	s.errRate[faultAck] = 0
+
+	assert.NoError(c.Ack())
+	assert.Empty(c.outstanding)
+}
+
+func TestFaultStorePublishRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewFaultStore(t, withFaultErrors(0.5, faultInsert), withFaultSeed(42))
+	b := newBroker(s)
+
+	srv := newServer(b)
+
+	// Publishes fail with a 500, and succeed once retried
+	const published = 20
+	for i := 0; i < published; i++ {
+		for attempt := 0; ; attempt++ {
+			assert.Less(attempt, 100, "publish never succeeded")
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/publish/"+defaultTopic, strings.NewReader("test_value"))
+			req = mux.SetURLVars(req, map[string]string{"topic": defaultTopic})
+			srv.ServeHTTP(rec, req)
+
+			if rec.Code == http.StatusCreated {
+				break
+			}
+
+			assert.Equal(http.StatusInternalServerError, rec.Code)
+		}
+	}
+
+	assert.Greater(s.Injected(faultInsert), 0)
+
+	// Failed publishes store nothing
+	l, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(published, l)
+}
+
+func TestFaultStoreFailedAckKeepsTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewFaultStore(t, withFaultErrors(1, faultAck))
+	b := newBroker(s, withAckTimeout(50*time.Millisecond, 0))
+
+	_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+
+	_, err = c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Error(c.Ack())
+
+	// The message is still returned to the topic once its ack timeout expires
+	time.Sleep(100 * time.Millisecond)
+
+	val, err := b.Subscribe(defaultTopic).TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal("test_value", string(val))
+}
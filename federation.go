@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// federateQueryKey is the subscribe query parameter which, set to true,
+	// streams the messages of the topic on this instance and each of its peers
+	// as one.
+	federateQueryKey = "federate"
+
+	// federationPollInterval is how often a federated subscription which waits
+	// for a message polls its sources while none have one waiting.
+	federationPollInterval = 100 * time.Millisecond
+)
+
+// withPeers configures the instances whose messages a federated subscription
+// streams alongside those of this instance, connected to with client.
+func withPeers(peers []string, client *http.Client) serverOption {
+	return func(s *server) {
+		s.peers = peers
+		s.peerClient = client
+	}
+}
+
+// federationSource is an instance a federated subscription pulls messages
+// from. At most one message from a source is outstanding on the client at a
+// time.
+type federationSource interface {
+	// next returns the next message waiting on the source, outstanding until
+	// it is resolved, or errNoMessages if there is none.
+	next(ctx context.Context) (value, messageMeta, error)
+
+	// resolve ACKs or NACKs the message last returned by next, as the command
+	// of the client.
+	resolve(cmd command) error
+
+	// close ends the subscription to the source. If the client disconnected,
+	// the outstanding message is released according to the disconnect policy
+	// of the source, otherwise it is NACKed.
+	close(disconnected bool)
+
+	name() string
+}
+
+// localSource pulls the messages of a topic on this instance.
+type localSource struct {
+	broker brokerer
+	cons   *consumer
+}
+
+func (l *localSource) next(ctx context.Context) (value, messageMeta, error) {
+	val, err := l.cons.TryNext(ctx)
+	if err != nil {
+		return nil, messageMeta{}, err
+	}
+
+	return val, l.cons.Meta(), nil
+}
+
+func (l *localSource) resolve(cmd command) error {
+	switch {
+	case cmd.Cmd == CmdNack && cmd.Delay != "":
+		delay, err := parseNackDelay(cmd.Delay)
+		if err != nil {
+			return err
+		}
+
+		return l.cons.NackAfter(nil, cmd.Reason, delay)
+	case cmd.Cmd == CmdNack:
+		return l.cons.NackWithReason(cmd.Reason)
+	case cmd.Result != nil:
+		return l.cons.AckWithResult([]byte(*cmd.Result))
+	default:
+		return l.cons.Ack()
+	}
+}
+
+func (l *localSource) close(disconnected bool) {
+	defer l.broker.Unsubscribe(l.cons)
+
+	release := l.cons.NackAll
+	if disconnected {
+		release = l.cons.Disconnected
+	}
+
+	if err := release(); err != nil {
+		log.Err(err).Str("topic", l.cons.topic).Msg("failed to release outstanding messages")
+	}
+}
+
+func (l *localSource) name() string {
+	return "local"
+}
+
+// peerSource pulls the messages of a topic on a peer, over a non-blocking
+// subscription to it.
+type peerSource struct {
+	addr string
+
+	// body is the request body of the subscription, which commands are
+	// written to.
+	body *io.PipeWriter
+	res  *http.Response
+	enc  *json.Encoder
+	dec  *json.Decoder
+
+	// src is the source of dec, which changes as streamed messages are read
+	src io.Reader
+
+	// held is the message the peer delivered in response to the last
+	// command, outstanding on the peer but not yet passed on to the client.
+	held *pendingMessage
+}
+
+// dialPeer subscribes to the topic on the peer at addr. The subscription is
+// initialised as it is made, so that the peer responds straight away.
+func dialPeer(ctx context.Context, client *http.Client, addr, topic string) (*peerSource, error) {
+	block := false
+
+	init, err := json.Marshal(command{Cmd: CmdInit, Block: &block})
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+
+	// The transport closing the body closes the pipe, so that commands to a
+	// peer which has gone away fail rather than block
+	body := struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(append(init, '\n')), pr), pr}
+
+	target := strings.TrimSuffix(addr, "/") + "/subscribe?" + url.Values{topicQueryKey: {topic}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("connecting to peer: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		pw.Close()
+
+		return nil, fmt.Errorf("peer responded %d", res.StatusCode)
+	}
+
+	p := &peerSource{
+		addr: addr,
+		body: pw,
+		res:  res,
+		enc:  json.NewEncoder(pw),
+		dec:  json.NewDecoder(res.Body),
+		src:  res.Body,
+	}
+
+	if err := p.read(); err != nil {
+		p.close(true)
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// read reads the response of the peer to the last command, holding the
+// message it carries, if any. Failures to reach the peer are
+// errPeerUnavailable, while errors returned by the peer are errPeerRejected.
+func (p *peerSource) read() error {
+	for {
+		var res subResponse
+		if err := p.dec.Decode(&res); err != nil {
+			return fmt.Errorf("%w: decoding response: %v", errPeerUnavailable, err)
+		}
+
+		switch res.Signal {
+		case "":
+		case signalEmpty:
+			return nil
+		case signalError:
+			return fmt.Errorf("%w: %s", errPeerRejected, res.Error)
+		default:
+			// Keepalives and the like carry nothing to pass on
+			continue
+		}
+
+		msg := []byte(res.Msg)
+		if res.Stream {
+			var buf bytes.Buffer
+
+			p.src = io.MultiReader(p.dec.Buffered(), p.src)
+			if err := readStream(&buf, p.src); err != nil {
+				return fmt.Errorf("%w: reading streamed message: %v", errPeerUnavailable, err)
+			}
+			p.dec = json.NewDecoder(p.src)
+
+			msg = buf.Bytes()
+		}
+
+		meta := messageMeta{
+			ID:          res.ID,
+			ContentType: res.ContentType,
+			InReplyTo:   res.InReplyTo,
+			NackReasons: res.NackReasons,
+			Deliveries:  1,
+		}
+		if res.Redelivered {
+			meta.Deliveries = 2
+		}
+
+		p.held = &pendingMessage{val: msg, meta: meta}
+
+		return nil
+	}
+}
+
+// send writes the command to the peer, then reads its response.
+func (p *peerSource) send(cmd command) error {
+	if err := p.enc.Encode(cmd); err != nil {
+		return fmt.Errorf("%w: sending %s: %v", errPeerUnavailable, cmd.Cmd, err)
+	}
+
+	return p.read()
+}
+
+func (p *peerSource) next(ctx context.Context) (value, messageMeta, error) {
+	if p.held == nil {
+		if err := p.send(command{Cmd: CmdInit}); err != nil {
+			return nil, messageMeta{}, err
+		}
+	}
+
+	if p.held == nil {
+		return nil, messageMeta{}, errNoMessages
+	}
+
+	m := p.held
+	p.held = nil
+
+	return m.val, m.meta, nil
+}
+
+// resolve sends the ACK or NACK on to the peer, which responds with its next
+// message, held until next is called.
+func (p *peerSource) resolve(cmd command) error {
+	return p.send(command{Cmd: cmd.Cmd, Result: cmd.Result, Reason: cmd.Reason})
+}
+
+func (p *peerSource) close(disconnected bool) {
+	// Closing the stream cleanly NACKs the outstanding messages, otherwise
+	// the peer releases them as it would for any client which disconnects
+	if !disconnected {
+		if err := p.enc.Encode(CmdClose); err != nil {
+			log.Warn().Err(err).Str("peer", p.addr).Msg("failed to close peer subscription")
+		}
+	}
+
+	p.body.Close()
+
+	// Wait for the peer to finish with the stream, so that the outstanding
+	// messages are released by the time the close returns
+	if !disconnected {
+		_, _ = io.Copy(ioutil.Discard, p.res.Body)
+	}
+	p.res.Body.Close()
+}
+
+func (p *peerSource) name() string {
+	return p.addr
+}
+
+// federation streams the messages of each of its sources to a single client,
+// routing the resolution of each message back to the source it came from.
+type federation struct {
+	sources []federationSource
+
+	// current is the source of the message outstanding on the client, nil
+	// if there is none.
+	current federationSource
+
+	// turn is the index of the source polled first for the next message, so
+	// that sources take turns and none is starved.
+	turn int
+
+	// seq is the sequence number of the last message delivered to the client.
+	seq int
+}
+
+// next returns the next message waiting on any source. If block is false and
+// none has a message waiting, errNoMessages is returned rather than waiting.
+// Unavailable peers are closed and skipped from then on.
+func (f *federation) next(ctx context.Context, block bool) (value, messageMeta, error) {
+poll:
+	for {
+		n := len(f.sources)
+
+		for i := 0; i < n; i++ {
+			src := f.sources[(f.turn+i)%n]
+
+			val, meta, err := src.next(ctx)
+			if errors.Is(err, errNoMessages) {
+				continue
+			}
+			if errors.Is(err, errPeerUnavailable) {
+				f.drop(src, err)
+				continue poll
+			}
+			if err != nil {
+				return nil, messageMeta{}, err
+			}
+
+			f.turn = (f.turn + i + 1) % n
+			f.current = src
+			f.seq++
+			meta.Seq = f.seq
+
+			return val, meta, nil
+		}
+
+		if !block {
+			return nil, messageMeta{}, errNoMessages
+		}
+
+		select {
+		case <-time.After(federationPollInterval):
+		case <-ctx.Done():
+			return nil, messageMeta{}, errRequestCancelled
+		}
+	}
+}
+
+// resolve ACKs or NACKs the message outstanding on the client at its source.
+// With no message outstanding, the command is ignored.
+func (f *federation) resolve(cmd command) error {
+	src := f.current
+	if src == nil {
+		return nil
+	}
+
+	f.current = nil
+
+	err := src.resolve(cmd)
+	if errors.Is(err, errPeerUnavailable) {
+		f.drop(src, err)
+	}
+
+	return err
+}
+
+// drop closes the source and stops polling it.
+func (f *federation) drop(src federationSource, err error) {
+	log.Warn().Err(err).Str("source", src.name()).Msg("skipping unavailable federation source")
+
+	for i, s := range f.sources {
+		if s == src {
+			f.sources = append(f.sources[:i], f.sources[i+1:]...)
+			break
+		}
+	}
+
+	if f.current == src {
+		f.current = nil
+	}
+
+	src.close(true)
+}
+
+// close closes every source.
+func (f *federation) close(disconnected bool) {
+	for _, src := range f.sources {
+		src.close(disconnected)
+	}
+}
+
+// federate serves subscriptions made with federate=true by
+// subscribeFederated, passing the rest to next.
+func federate(broker brokerer, peers []string, client *http.Client, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get(federateQueryKey) != "true" {
+			next(w, r)
+			return
+		}
+
+		if len(peers) == 0 {
+			log := log.With().
+				Str("request_id", xid.New().String()).
+				Str("handler", "subscribe_federated").
+				Logger()
+
+			log.Debug().Msg("federated subscribe without peers")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errNoPeers.Error())
+
+			return
+		}
+
+		subscribeFederated(broker, peers, client)(w, r)
+	}
+}
+
+// subscribeFederated streams the messages of a topic on this instance and each
+// of its peers to the client, as a single stream. Each ACK or NACK is routed to
+// the instance the message came from. Peers which can't be reached are
+// skipped.
+//
+// Only INIT, ACK, NACK and CLOSE are supported, acting on the single message
+// outstanding on the client.
+func subscribeFederated(broker brokerer, peers []string, client *http.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "subscribe_federated").
+			Logger()
+
+		topic, ok := mux.Vars(r)[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		if rejectReservedTopic(log, w, topic) {
+			return
+		}
+
+		log = log.With().Str("topic", topic).Logger()
+
+		f := &federation{
+			sources: []federationSource{&localSource{broker: broker, cons: broker.Subscribe(topic)}},
+		}
+
+		for _, addr := range peers {
+			p, err := dialPeer(ctx, client, addr, topic)
+			if err != nil {
+				log.Warn().Err(err).Str("peer", addr).Msg("skipping unavailable peer")
+				continue
+			}
+
+			f.sources = append(f.sources, p)
+		}
+
+		log.Info().
+			Int("sources", len(f.sources)).
+			Msg("subscribing to federated topic")
+
+		disconnected := true
+		defer func() {
+			f.close(disconnected)
+		}()
+
+		setResponseHeader(w, "Trailer", trailerStreamStatus)
+
+		fw := newFlushWriter(w, flushThreshold{})
+		enc := json.NewEncoder(fw)
+		dec := json.NewDecoder(r.Body)
+
+		// Whether to wait for a message when every source is empty, set on INIT
+		block := true
+
+		for {
+			log := log
+
+			var cmd command
+			if err := dec.Decode(&cmd); isDisconnect(err) || readTimedOut(r) {
+				log.Warn().Msg("client disconnected")
+
+				return
+			} else if err != nil {
+				log.Err(err).Msg("failed decoding command")
+				respondError(log, enc, errDecodingCmd.Error())
+				setStreamStatus(w, streamStatusError)
+
+				return
+			}
+
+			log = log.With().Str("cmd", cmd.Cmd).Logger()
+
+			switch {
+			case cmd.Cmd == CmdInit:
+				log.Debug().Msg("initialising federated consumer")
+
+				if cmd.Block != nil {
+					block = *cmd.Block
+				}
+
+			case (cmd.Cmd == CmdAck || cmd.Cmd == CmdNack) && len(cmd.IDs) == 0:
+				log.Debug().Msg("resolving message")
+
+				if err := f.resolve(cmd); err != nil {
+					log.Warn().Err(err).Msg("failed to resolve message at its source")
+					respondError(log, enc, errFederatedResolve.Error())
+
+					continue
+				}
+
+			case cmd.Cmd == CmdClose:
+				log.Debug().Msg("closing stream")
+
+				disconnected = false
+				setStreamStatus(w, streamStatusClosed)
+
+				return
+
+			default:
+				log.Warn().Msg("unsupported command on federated subscription")
+				respondError(log, enc, errFederatedCmd.Error())
+
+				continue
+			}
+
+			msg, meta, err := f.next(ctx, block)
+			switch {
+			case errors.Is(err, errRequestCancelled):
+				log.Info().Msg("client disconnected while waiting for message")
+
+				return
+			case errors.Is(err, errNoMessages):
+				log.Debug().Msg("no messages available, not blocking")
+				respondEmpty(log, enc)
+			case err != nil:
+				log.Err(err).Msg("failed to get next value for topic")
+				respondError(log, enc, errNextValue.Error())
+				setStreamStatus(w, streamStatusError)
+
+				return
+			default:
+				respondMsg(log, w, fw, enc, msg, meta)
+
+				log.Debug().
+					Str("msg_id", meta.ID).
+					Str("source", f.current.name()).
+					Msg("written message to client")
+			}
+		}
+	}
+}
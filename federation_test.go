@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func helperNewTLSServer(t *testing.T, s *server) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// helperSubscribeFederated makes a non-blocking federated subscription to the
+// default topic on the server.
+func helperSubscribeFederated(t *testing.T, srv *httptest.Server) (*json.Encoder, *json.Decoder, *http.Response) {
+	t.Helper()
+
+	reader, writer := io.Pipe()
+
+	body := io.MultiReader(strings.NewReader(`{"cmd": "INIT", "block": false}`+"\n"), reader)
+
+	res := helperSubscribeBody(t, srv, defaultTopic+"?federate=true", body)
+	t.Cleanup(func() {
+		writer.Close()
+		res.Body.Close()
+	})
+
+	return json.NewEncoder(writer), json.NewDecoder(res.Body), res
+}
+
+func TestFederation(t *testing.T) {
+	assert := assert.New(t)
+
+	peerBroker := newBroker(helperNewMemStore(t))
+	peer := helperNewTLSServer(t, newServer(peerBroker))
+
+	// A peer which has gone away is skipped
+	offline := helperNewTLSServer(t, newServer(newBroker(helperNewMemStore(t))))
+	offline.Close()
+
+	b := newBroker(helperNewMemStore(t))
+	srv := helperNewTLSServer(t, newServer(b, withPeers([]string{offline.URL, peer.URL}, peer.Client())))
+
+	_, err := b.Publish(defaultTopic, []byte("local_value"), messageMeta{})
+	assert.NoError(err)
+	_, err = peerBroker.Publish(defaultTopic, []byte("peer_value"), messageMeta{})
+	assert.NoError(err)
+
+	enc, dec, res := helperSubscribeFederated(t, srv)
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	// The client receives the messages of both instances on a single stream
+	var got []string
+	for seq := 1; seq <= 2; seq++ {
+		var out subResponse
+		assert.NoError(dec.Decode(&out))
+		assert.Equal(seq, out.Seq)
+
+		got = append(got, out.Msg)
+
+		assert.NoError(enc.Encode(CmdAck))
+	}
+	assert.ElementsMatch([]string{"local_value", "peer_value"}, got)
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.True(out.Empty)
+
+	assert.NoError(enc.Encode(CmdClose))
+	_, err = ioutil.ReadAll(res.Body)
+	assert.NoError(err)
+	assert.Equal(streamStatusClosed, res.Trailer.Get(trailerStreamStatus))
+
+	// Each ACK reached the instance the message came from, as closing the
+	// stream would otherwise have returned them
+	for _, s := range []storer{b.store, peerBroker.store} {
+		n, err := s.Len(defaultTopic)
+		assert.NoError(err)
+		assert.Zero(n)
+	}
+}
+
+func TestFederation_Nack(t *testing.T) {
+	assert := assert.New(t)
+
+	peerBroker := newBroker(helperNewMemStore(t))
+	peer := helperNewTLSServer(t, newServer(peerBroker))
+
+	b := newBroker(helperNewMemStore(t))
+	srv := helperNewTLSServer(t, newServer(b, withPeers([]string{peer.URL}, peer.Client())))
+
+	_, err := peerBroker.Publish(defaultTopic, []byte("peer_value"), messageMeta{})
+	assert.NoError(err)
+
+	enc, dec, _ := helperSubscribeFederated(t, srv)
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("peer_value", out.Msg)
+	assert.False(out.Redelivered)
+
+	// The NACK returns the message to the peer, which delivers it again
+	assert.NoError(enc.Encode(command{Cmd: CmdNack, Reason: "test_reason"}))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("peer_value", out.Msg)
+	assert.True(out.Redelivered)
+	assert.Equal([]string{"test_reason"}, out.NackReasons)
+
+	// Commands acting on several messages aren't supported
+	assert.NoError(enc.Encode(command{Cmd: CmdAck, IDs: []string{out.ID}}))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(errFederatedCmd.Error(), out.Error)
+}
+
+func TestFederation_NoPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := helperNewTLSServer(t, newServer(newBroker(helperNewMemStore(t))))
+
+	res := helperSubscribeBody(t, srv, defaultTopic+"?federate=true", helperMustEncodeString(CmdInit))
+	defer res.Body.Close()
+
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal(errNoPeers.Error(), out.Error)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	msgIDVarKey   = "id"
+	receiptVarKey = "receipt"
+
+	// reasonQueryKey is the reason recorded with a fetched message when it is
+	// NACKed.
+	reasonQueryKey = "reason"
+)
+
+const (
+	errMsgNotFound    = storeError("message not found on topic")
+	errMsgOutstanding = storeError("message is awaiting acknowledgement")
+)
+
+// Fetch moves the value with the ID waiting on the topic to await
+// acknowledgement, regardless of its position in the topic. The values ahead
+// of it keep their order. errMsgOutstanding is returned if the value, or a
+// value with the same key, already awaits acknowledgement.
+func (s *store) Fetch(topic, id string) (value, messageMeta, int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	headOffset, err := getPos(s.db, headPosKeyFmt, topic)
+	if errors.Is(err, errTopicNotExist) {
+		return nil, messageMeta{}, 0, errMsgNotFound
+	}
+	if err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	tailOffset, err := getPos(s.db, tailPosKeyFmt, topic)
+	if err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	offset, meta, err := findPending(s.db, topic, id, headOffset, tailOffset)
+	if errors.Is(err, errMsgNotFound) {
+		if outstanding, err := isOutstanding(s.db, topic, id); err != nil {
+			return nil, messageMeta{}, 0, err
+		} else if outstanding {
+			return nil, messageMeta{}, 0, errMsgOutstanding
+		}
+
+		return nil, messageMeta{}, 0, errMsgNotFound
+	}
+	if err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	if meta.Key != "" {
+		_, outstanding, err := keyOffset(s.db, outstandingKey(topic, meta.Key), ackMetaFmt, topic, meta.Key)
+		if err != nil {
+			return nil, messageMeta{}, 0, err
+		}
+
+		if outstanding {
+			return nil, messageMeta{}, 0, errMsgOutstanding
+		}
+	}
+
+	return s.take(topic, headOffset, offset, meta)
+}
+
+// take moves the value waiting at the offset of the topic, with its metadata,
+// to await acknowledgement, closing the gap it leaves behind the head. The
+// lock must be held.
+func (s *store) take(topic string, headOffset, offset int, meta messageMeta) (value, messageMeta, int, error) {
+	val, err := getValue(s.db, topicFmt, topic, offset)
+	if err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	insertedOffset, err := appendValue(s.db, ackTailPosKeyFmt, ackTopicFmt, topic, val)
+	if err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	meta.Deliveries++
+
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(fmt.Sprintf(ackMetaFmt, topic, insertedOffset)), encodeMeta(meta))
+
+	if meta.Key != "" {
+		batch.Delete(pendingKey(topic, meta.Key))
+		batch.Put(outstandingKey(topic, meta.Key), encodePos(insertedOffset))
+	}
+
+	// Close the gap by moving each value ahead of the fetched value back one,
+	// then advancing the head past the first
+	for o := offset; o > headOffset; o-- {
+		v, err := getValue(s.db, topicFmt, topic, o-1)
+		if err != nil {
+			return nil, messageMeta{}, 0, err
+		}
+
+		m, err := getMeta(s.db, metaFmt, topic, o-1)
+		if err != nil {
+			return nil, messageMeta{}, 0, err
+		}
+
+		batch.Put([]byte(fmt.Sprintf(topicFmt, topic, o)), v)
+		batch.Put([]byte(fmt.Sprintf(metaFmt, topic, o)), encodeMeta(m))
+
+		if m.Key != "" {
+			batch.Put(pendingKey(topic, m.Key), encodePos(o))
+		}
+	}
+
+	batch.Delete([]byte(fmt.Sprintf(topicFmt, topic, headOffset)))
+	batch.Delete([]byte(fmt.Sprintf(metaFmt, topic, headOffset)))
+	batch.Put([]byte(fmt.Sprintf(headPosKeyFmt, topic)), encodePos(headOffset+1))
+
+	if err := s.db.Write(batch, nil); err != nil {
+		return nil, messageMeta{}, 0, fmt.Errorf("fetching value: %v", err)
+	}
+
+	// The cached values have all moved
+	s.cache.drop(topic)
+
+	if err := s.written(); err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	return val, meta, insertedOffset, nil
+}
+
+// findPending returns the offset and metadata of the value with the ID waiting
+// between the head and tail offsets of the topic.
+func findPending(db *leveldb.DB, topic, id string, headOffset, tailOffset int) (int, messageMeta, error) {
+	for offset := headOffset; offset < tailOffset; offset++ {
+		meta, err := getMeta(db, metaFmt, topic, offset)
+		if err != nil {
+			return 0, messageMeta{}, err
+		}
+
+		if meta.ID == id {
+			return offset, meta, nil
+		}
+	}
+
+	return 0, messageMeta{}, errMsgNotFound
+}
+
+// isOutstanding reports whether the value with the ID awaits acknowledgement
+// on the topic.
+func isOutstanding(db *leveldb.DB, topic, id string) (bool, error) {
+	offsets, err := outstandingOffsets(db, topic)
+	if err != nil {
+		return false, err
+	}
+
+	for _, offset := range offsets {
+		meta, err := getMeta(db, ackMetaFmt, topic, offset)
+		if err != nil {
+			return false, err
+		}
+
+		if meta.ID == id {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// fetchedMessages holds the consumers of messages fetched by ID, keyed by the
+// receipt each message is resolved with.
+type fetchedMessages struct {
+	consumers map[string]*consumer
+	sync.Mutex
+}
+
+func (f *fetchedMessages) add(c *consumer) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.consumers == nil {
+		f.consumers = map[string]*consumer{}
+	}
+
+	f.consumers[c.id] = c
+}
+
+// take removes and returns the consumer holding the message with the receipt.
+func (f *fetchedMessages) take(receipt string) (*consumer, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	c, ok := f.consumers[receipt]
+	delete(f.consumers, receipt)
+
+	return c, ok
+}
+
+// Fetch delivers the message with the ID waiting on the topic, bypassing the
+// order of the topic. The message awaits acknowledgement like any other
+// delivery, and is ACKed or NACKed by the receipt returned, the ID of the
+// consumer it is delivered to. The consumer isn't subscribed, so is never
+// delivered anything else.
+func (b *broker) Fetch(topic, id string) (*consumer, value, error) {
+	val, meta, ackOffset, err := b.store.Fetch(topic, id)
+	if errors.Is(err, errDecrypt) {
+		dest := topic + dlqSuffix
+
+		if err := quarantine(b.store, topic, dest, val, ackOffset, meta, b.now()); err != nil {
+			return nil, nil, err
+		}
+
+		b.NotifyConsumer(dest, eventTypePublish)
+
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	val, err = readBody(b.store, topic, ackOffset, val, &meta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cons := b.newConsumer(topic)
+	val = cons.delivered(val, ackOffset, meta)
+
+	b.fetched.add(&cons)
+
+	return &cons, val, nil
+}
+
+// AckReceipt ACKs the fetched message with the receipt.
+func (b *broker) AckReceipt(receipt string) error {
+	cons, ok := b.fetched.take(receipt)
+	if !ok {
+		return errUnknownReceipt
+	}
+
+	return cons.Ack()
+}
+
+// NackReceipt NACKs the fetched message with the receipt, recording the reason
+// if one is given.
+func (b *broker) NackReceipt(receipt, reason string) error {
+	cons, ok := b.fetched.take(receipt)
+	if !ok {
+		return errUnknownReceipt
+	}
+
+	return cons.NackWithReason(reason)
+}
+
+// fetchResponse is the message delivered by a fetch.
+type fetchResponse struct {
+	ID          string            `json:"id"`
+	Msg         string            `json:"msg"`
+	ContentType string            `json:"content_type,omitempty"`
+	PublishedAt time.Time         `json:"published_at"`
+	Deliveries  int               `json:"deliveries"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Receipt     string            `json:"receipt"`
+}
+
+// fetch delivers a specific message waiting on a topic by its ID, out of
+// order, to be ACKed or NACKed by the receipt in the response.
+func fetch(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "fetch").
+			Logger()
+
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		id := vars[msgIDVarKey]
+
+		log = log.With().
+			Str("topic", topic).
+			Str("msg_id", id).
+			Logger()
+
+		cons, val, err := broker.Fetch(topic, id)
+		if errors.Is(err, errMsgNotFound) {
+			log.Debug().Msg("message not found")
+
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errMsgNotFound.Error())
+
+			return
+		}
+		if errors.Is(err, errMsgOutstanding) {
+			log.Debug().Msg("message already outstanding")
+
+			w.WriteHeader(http.StatusConflict)
+			respondError(log, json.NewEncoder(w), errMsgOutstanding.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to fetch message")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errFetch.Error())
+
+			return
+		}
+
+		log.Info().Str("receipt", cons.id).Msg("fetched message")
+
+		meta := cons.Meta()
+		respondFetch(log, json.NewEncoder(w), fetchResponse{
+			ID:          meta.ID,
+			Msg:         string(val),
+			ContentType: meta.ContentType,
+			PublishedAt: meta.PublishedAt,
+			Deliveries:  meta.Deliveries,
+			Headers:     meta.Headers,
+			Receipt:     cons.id,
+		})
+	}
+}
+
+// resolveReceipt ACKs or NACKs the fetched message with the receipt in the
+// path.
+func resolveReceipt(broker brokerer, ack bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		receipt := mux.Vars(r)[receiptVarKey]
+
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "resolve_receipt").
+			Str("receipt", receipt).
+			Bool("ack", ack).
+			Logger()
+
+		var err error
+		if ack {
+			err = broker.AckReceipt(receipt)
+		} else {
+			err = broker.NackReceipt(receipt, r.URL.Query().Get(reasonQueryKey))
+		}
+
+		if errors.Is(err, errUnknownReceipt) {
+			log.Debug().Msg("unknown receipt")
+
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errUnknownReceipt.Error())
+
+			return
+		}
+		if errors.Is(err, errAckTimeout) {
+			log.Debug().Msg("ack timeout exceeded")
+
+			w.WriteHeader(http.StatusConflict)
+			respondError(log, json.NewEncoder(w), errAckTimeout.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to resolve receipt")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errResolveReceipt.Error())
+
+			return
+		}
+
+		log.Info().Msg("resolved fetched message")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func respondFetch(log zerolog.Logger, e *json.Encoder, res fetchResponse) {
+	if err := e.Encode(res); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
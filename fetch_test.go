@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func helperFetch(t *testing.T, s *server, topic, id string) (int, fetchResponse, subResponse) {
+	t.Helper()
+
+	rec := NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%s/%s/fetch", topic, id), nil))
+
+	var (
+		res  fetchResponse
+		fail subResponse
+	)
+	if rec.Code == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	} else {
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&fail))
+	}
+
+	return rec.Code, res, fail
+}
+
+func TestFetch(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	s := newServer(b)
+
+	var ids []string
+	for _, msg := range []string{"test_value_1", "test_value_2", "test_value_3"} {
+		id, err := b.Publish(defaultTopic, []byte(msg), messageMeta{})
+		assert.NoError(err)
+
+		ids = append(ids, id)
+	}
+
+	// The message is delivered out of order
+	code, res, _ := helperFetch(t, s, defaultTopic, ids[1])
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(ids[1], res.ID)
+	assert.Equal("test_value_2", res.Msg)
+	assert.Equal(1, res.Deliveries)
+	assert.NotEmpty(res.Receipt)
+
+	// The others keep their order
+	c := b.Subscribe(defaultTopic)
+
+	for _, want := range []string{"test_value_1", "test_value_3"} {
+		val, err := c.TryNext(context.Background())
+		assert.NoError(err)
+		assert.Equal(value(want), val)
+		assert.NoError(c.Ack())
+	}
+
+	// The fetched message is resolved by its receipt, once
+	rec := NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/receipts/%s/ack", res.Receipt), nil))
+	assert.Equal(http.StatusNoContent, rec.Code)
+
+	rec = NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/receipts/%s/ack", res.Receipt), nil))
+	assert.Equal(http.StatusNotFound, rec.Code)
+
+	_, err := c.TryNext(context.Background())
+	assert.Equal(errNoMessages, err)
+}
+
+func TestFetch_Nack(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	s := newServer(b)
+
+	id, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	_, res, _ := helperFetch(t, s, defaultTopic, id)
+
+	rec := NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/receipts/%s/nack?reason=test_reason", res.Receipt), nil))
+	assert.Equal(http.StatusNoContent, rec.Code)
+
+	// NACKing returns the message to the topic, along with the reason
+	msgs, err := b.Peek(defaultTopic, 1)
+	assert.NoError(err)
+	assert.Equal(id, msgs[0].meta.ID)
+	assert.Equal([]string{"test_reason"}, msgs[0].meta.NackReasons)
+}
+
+func TestFetch_Errors(t *testing.T) {
+	b := newBroker(helperNewMemStore(t))
+	s := newServer(b)
+
+	fetched, err := b.Publish(defaultTopic, []byte("test_value_1"), messageMeta{})
+	assert.NoError(t, err)
+	delivered, err := b.Publish(defaultTopic, []byte("test_value_2"), messageMeta{})
+	assert.NoError(t, err)
+
+	code, _, _ := helperFetch(t, s, defaultTopic, fetched)
+	assert.Equal(t, http.StatusOK, code)
+
+	c := b.Subscribe(defaultTopic)
+	_, err = c.TryNext(context.Background())
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		topic    string
+		id       string
+		wantCode int
+		wantErr  error
+	}{
+		{
+			name:     "missing id",
+			topic:    defaultTopic,
+			id:       "missing",
+			wantCode: http.StatusNotFound,
+			wantErr:  errMsgNotFound,
+		},
+		{
+			name:     "missing topic",
+			topic:    "missing_topic",
+			id:       fetched,
+			wantCode: http.StatusNotFound,
+			wantErr:  errMsgNotFound,
+		},
+		{
+			name:     "already fetched",
+			topic:    defaultTopic,
+			id:       fetched,
+			wantCode: http.StatusConflict,
+			wantErr:  errMsgOutstanding,
+		},
+		{
+			name:     "delivered to a consumer",
+			topic:    defaultTopic,
+			id:       delivered,
+			wantCode: http.StatusConflict,
+			wantErr:  errMsgOutstanding,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			code, _, fail := helperFetch(t, s, tt.topic, tt.id)
+			assert.Equal(tt.wantCode, code)
+			assert.Equal(tt.wantErr.Error(), fail.Error)
+		})
+	}
+}
+
+func TestStoreFetch(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+	s.cache = newHeadCache(10)
+
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{ID: "1", Key: "a"}))
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_2"), messageMeta{ID: "2", Key: "b"}))
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_3"), messageMeta{ID: "3", Key: "c"}))
+
+	val, meta, ackOffset, err := s.Fetch(defaultTopic, "3")
+	assert.NoError(err)
+	assert.Equal(value("test_value_3"), val)
+	assert.Equal(1, meta.Deliveries)
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	// Keys still index the values which moved, so may be replaced in place
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_1b"), messageMeta{ID: "1b", Key: "a"}))
+
+	// And a value with the key of the fetched value waits behind it
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_3b"), messageMeta{ID: "3b", Key: "c"}))
+
+	for _, want := range []string{"test_value_1b", "test_value_2"} {
+		val, _, _, err := s.GetNext(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(value(want), val)
+	}
+
+	_, _, _, err = s.GetNext(defaultTopic)
+	assert.Equal(errNoMessages, err)
+
+	_, _, _, err = s.Fetch(defaultTopic, "3b")
+	assert.Equal(errMsgOutstanding, err)
+
+	assert.NoError(s.Ack(defaultTopic, ackOffset))
+
+	val, _, _, err = s.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(value("test_value_3b"), val)
+}
@@ -1,17 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
 )
 
+// flushThreshold bounds how much is written to a subscribe connection before
+// it is flushed, when the client has pipelined further commands. With a zero
+// threshold, every write is flushed immediately.
+type flushThreshold struct {
+	bytes  int
+	writes int
+}
+
+func (t flushThreshold) enabled() bool {
+	return t.bytes > 0 || t.writes > 0
+}
+
+// flushWriter flushes writes through to the client. Without a threshold each
+// write is flushed immediately. With one, writes are held until the threshold
+// is reached or Flush is called, coalescing them into fewer flushes.
 type flushWriter struct {
-	f http.Flusher
-	w io.Writer
+	f         http.Flusher
+	w         io.Writer
+	threshold flushThreshold
+
+	// bytes and writes are pending a flush
+	bytes  int
+	writes int
 }
 
-func newFlushWriter(w io.Writer) flushWriter {
-	fw := flushWriter{w: w}
+func newFlushWriter(w io.Writer, threshold flushThreshold) *flushWriter {
+	fw := &flushWriter{w: w, threshold: threshold}
 	if f, ok := w.(http.Flusher); ok {
 		fw.f = f
 	}
@@ -19,11 +42,50 @@ func newFlushWriter(w io.Writer) flushWriter {
 	return fw
 }
 
-func (fw flushWriter) Write(p []byte) (n int, err error) {
+func (fw *flushWriter) Write(p []byte) (n int, err error) {
 	n, err = fw.w.Write(p)
+
+	fw.bytes += n
+	fw.writes++
+
+	if !fw.threshold.enabled() ||
+		(fw.threshold.bytes > 0 && fw.bytes >= fw.threshold.bytes) ||
+		(fw.threshold.writes > 0 && fw.writes >= fw.threshold.writes) {
+		fw.flush()
+	}
+
+	return
+}
+
+// Flush flushes any writes held back by the threshold.
+func (fw *flushWriter) Flush() {
+	if fw.pending() {
+		fw.flush()
+	}
+}
+
+// pending reports whether there are writes which have not been flushed.
+func (fw *flushWriter) pending() bool {
+	return fw.writes > 0
+}
+
+func (fw *flushWriter) flush() {
+	fw.bytes, fw.writes = 0, 0
+
 	if fw.f != nil {
 		fw.f.Flush()
 	}
+}
 
-	return
+// pipelined reports whether the client has already sent a complete command
+// which the decoder can read without waiting.
+func pipelined(dec *json.Decoder) bool {
+	buf, err := ioutil.ReadAll(dec.Buffered())
+	if err != nil {
+		return false
+	}
+
+	buf = bytes.TrimLeft(buf, " \t\r\n")
+
+	return bytes.IndexByte(buf, '\n') >= 0
 }
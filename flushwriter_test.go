@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// flushCounter records the responses written to it, counting flushes.
+type flushCounter struct {
+	*ResponseRecorder
+	flushes int
+}
+
+func (fc *flushCounter) Flush() {
+	fc.flushes++
+	fc.ResponseRecorder.Flush()
+}
+
+func TestFlushWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold flushThreshold
+		writes    []string
+		flushes   int
+		pending   bool
+	}{
+		{
+			name:    "no threshold flushes every write",
+			writes:  []string{"a", "b", "c"},
+			flushes: 3,
+		},
+		{
+			name:      "bytes threshold",
+			threshold: flushThreshold{bytes: 4},
+			writes:    []string{"ab", "cd", "ef"},
+			flushes:   1,
+			pending:   true,
+		},
+		{
+			name:      "writes threshold",
+			threshold: flushThreshold{writes: 2},
+			writes:    []string{"a", "b", "c", "d", "e"},
+			flushes:   2,
+			pending:   true,
+		},
+		{
+			name:      "either threshold",
+			threshold: flushThreshold{bytes: 3, writes: 2},
+			writes:    []string{"abc", "d", "e"},
+			flushes:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			fc := &flushCounter{ResponseRecorder: NewRecorder()}
+			fw := newFlushWriter(fc, tt.threshold)
+
+			for _, w := range tt.writes {
+				_, err := fw.Write([]byte(w))
+				assert.NoError(err)
+			}
+
+			assert.Equal(tt.flushes, fc.flushes)
+			assert.Equal(tt.pending, fw.pending())
+
+			// Flushing only does anything while writes are pending
+			fw.Flush()
+			fw.Flush()
+
+			if tt.pending {
+				assert.Equal(tt.flushes+1, fc.flushes)
+			} else {
+				assert.Equal(tt.flushes, fc.flushes)
+			}
+		})
+	}
+}
+
+func TestPipelined(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want bool
+	}{
+		{name: "nothing buffered", in: "\"ACK\"\n", want: false},
+		{name: "command buffered", in: "\"ACK\"\n\"ACK\"\n", want: true},
+		{name: "whitespace buffered", in: "\"ACK\"\n \n", want: false},
+		{name: "partial command buffered", in: "\"ACK\"\n{\"cmd\":", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := json.NewDecoder(bytes.NewBufferString(tt.in))
+
+			var cmd command
+			assert.NoError(t, dec.Decode(&cmd))
+			assert.Equal(t, tt.want, pipelined(dec))
+		})
+	}
+}
+
+func TestSubscribePipelined(t *testing.T) {
+	const count = 100
+
+	for _, threshold := range []flushThreshold{{}, {writes: 10}, {bytes: 1 << 10}} {
+		t.Run(fmt.Sprintf("%+v", threshold), func(t *testing.T) {
+			assert := assert.New(t)
+
+			fc, b := helperSubscribePipelined(t, threshold, count)
+
+			// Every message is delivered, in order
+			dec := json.NewDecoder(fc.Body)
+			for i := 0; i < count; i++ {
+				var out subResponse
+				assert.NoError(dec.Decode(&out))
+				assert.Equal(fmt.Sprintf("msg-%d", i), out.Msg)
+			}
+			assert.False(dec.More())
+
+			// The last message was returned on close
+			n, err := b.store.Len(defaultTopic)
+			assert.NoError(err)
+			assert.Equal(1, n)
+
+			if threshold.enabled() {
+				assert.Less(fc.flushes, count)
+			} else {
+				assert.GreaterOrEqual(fc.flushes, count)
+			}
+		})
+	}
+}
+
+func BenchmarkSubscribePipelined(b *testing.B) {
+	const count = 100
+
+	for _, threshold := range []flushThreshold{{}, {writes: 16}, {bytes: 4 << 10}} {
+		b.Run(fmt.Sprintf("%+v", threshold), func(b *testing.B) {
+			var flushes int
+			for i := 0; i < b.N; i++ {
+				fc, _ := helperSubscribePipelined(b, threshold, count)
+				flushes += fc.flushes
+			}
+
+			b.ReportMetric(float64(flushes)/float64(b.N), "flushes/op")
+		})
+	}
+}
+
+// helperSubscribePipelined publishes count messages, then consumes them all
+// with a single burst of pipelined commands, closing the stream before the
+// last is acked.
+func helperSubscribePipelined(t testing.TB, threshold flushThreshold, count int) (*flushCounter, *broker) {
+	t.Helper()
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(t, err)
+
+	b := newBroker(&store{db: db})
+	for i := 0; i < count; i++ {
+		_, err := b.Publish(defaultTopic, []byte(fmt.Sprintf("msg-%d", i)), messageMeta{})
+		assert.NoError(t, err)
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	assert.NoError(t, enc.Encode(CmdInit))
+	for i := 1; i < count; i++ {
+		assert.NoError(t, enc.Encode(CmdAck))
+	}
+	assert.NoError(t, enc.Encode(CmdClose))
+
+	fc := &flushCounter{ResponseRecorder: NewRecorder()}
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), &body)
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	subscribe(b, threshold)(fc, r)
+
+	return fc, b
+}
+
+func TestServerFlushThreshold_LoneCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t, withFlushThreshold(1<<20, 100))
+	defer srvCloser()
+
+	res := helperPublishMessage(t, srv, defaultTopic, "test_msg_1")
+	res.Body.Close()
+
+	enc, dec, closer := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closer()
+
+	// Responses to commands which aren't pipelined are flushed immediately,
+	// regardless of the threshold
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("test_msg_1", out.Msg)
+
+	assert.NoError(enc.Encode(CmdAck))
+
+	res = helperPublishMessage(t, srv, defaultTopic, "test_msg_2")
+	res.Body.Close()
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("test_msg_2", out.Msg)
+}
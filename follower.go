@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// replicationPath is the path followers stream the store of the primary
+	// from.
+	replicationPath = "/replication"
+
+	// followRetryDelay is how long a follower waits before reconnecting to the
+	// primary.
+	followRetryDelay = time.Second
+)
+
+// follower keeps the store of a read-only replica up to date with the store
+// of its primary, by replaying the primary's replication stream.
+type follower struct {
+	store   storer
+	snaps   snapshotter
+	broker  *broker
+	primary string
+	client  *http.Client
+
+	// synced is called each time a snapshot from the primary is loaded, used
+	// for inspection in tests.
+	synced func()
+}
+
+// withFollower makes the server a read-only follower of the primary,
+// rejecting requests which would modify its store.
+func withFollower(primary string) serverOption {
+	return func(s *server) {
+		s.primary = primary
+	}
+}
+
+// newFollower returns a follower replicating the primary into the store of the
+// broker.
+func newFollower(b *broker, primary string, client *http.Client) (*follower, error) {
+	// The primary streams values as stored, so already in their partitions,
+	// and encrypted if the follower encrypts too
+	store := b.store
+	if ps, ok := store.(*partitionedStore); ok {
+		store = ps.storer
+	}
+	if es, ok := store.(*encryptedStore); ok {
+		store = es.storer
+	}
+
+	snaps, ok := store.(snapshotter)
+	if !ok {
+		return nil, errors.New("store does not support replication")
+	}
+
+	return &follower{
+		store:   store,
+		snaps:   snaps,
+		broker:  b,
+		primary: strings.TrimSuffix(primary, "/"),
+		client:  client,
+	}, nil
+}
+
+// newFollowClient returns the client a follower connects to its primary with,
+// verifying the primary against the CA certificate at caPath, or the system
+// roots if empty.
+func newFollowClient(caPath string) (*http.Client, error) {
+	transport := &http.Transport{ForceAttemptHTTP2: true}
+
+	if caPath != "" {
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %v", err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caPath)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// run follows the primary until the context is cancelled, reconnecting and
+// resyncing from a new snapshot whenever the stream is interrupted.
+func (f *follower) run(ctx context.Context) {
+	for {
+		err := f.follow(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		log.Warn().Err(err).Str("primary", f.primary).Msg("lost replication stream, reconnecting")
+
+		select {
+		case <-time.After(followRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow loads a snapshot from the primary and applies the mutations streamed
+// after it, until the stream ends.
+func (f *follower) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.primary+replicationPath, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %v", err)
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("connecting to primary: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary responded %d", res.StatusCode)
+	}
+
+	dec := json.NewDecoder(res.Body)
+
+	var snapshot replicaOp
+	if err := dec.Decode(&snapshot); err != nil {
+		return fmt.Errorf("decoding snapshot: %v", err)
+	}
+	if snapshot.Op != opSnapshot {
+		return fmt.Errorf("expected snapshot, got %s", snapshot.Op)
+	}
+
+	if err := f.snaps.load(snapshot.Entries); err != nil {
+		return fmt.Errorf("loading snapshot: %v", err)
+	}
+	if err := f.broker.LoadTopicConfigs(); err != nil {
+		return fmt.Errorf("loading topic configs: %v", err)
+	}
+
+	log.Info().
+		Str("primary", f.primary).
+		Int("entries", len(snapshot.Entries)).
+		Msg("loaded snapshot from primary")
+
+	// The primary asks for the mutations applied to be acknowledged when it
+	// waits for followers before acknowledging writes
+	ack := func(uint64) {}
+	if snapshot.Follower != "" {
+		ack = f.ackApplied(ctx, snapshot.Follower).ack
+		ack(snapshot.Seq)
+	}
+
+	if f.synced != nil {
+		f.synced()
+	}
+
+	for {
+		var op replicaOp
+		if err := dec.Decode(&op); err != nil {
+			return fmt.Errorf("decoding op: %v", err)
+		}
+
+		if err := f.apply(op); err != nil {
+			return fmt.Errorf("applying %s: %v", op.Op, err)
+		}
+
+		ack(op.Seq)
+	}
+}
+
+// apply replays a mutation of the primary's store onto the follower's.
+func (f *follower) apply(op replicaOp) error {
+	switch op.Op {
+	case opInsert:
+		meta, err := decodeMeta(op.Meta)
+		if err != nil {
+			return err
+		}
+
+		return f.store.Insert(op.Topic, op.Value, meta)
+	case opInsertAll:
+		records, err := decodeRecords(op.Records)
+		if err != nil {
+			return err
+		}
+
+		return f.store.InsertAll(records)
+	case opReplaceAll:
+		records, err := decodeRecords(op.Records)
+		if err != nil {
+			return err
+		}
+
+		return f.store.ReplaceAll(op.Topics, records)
+	case opGetNext:
+		_, _, _, err := f.store.GetNext(op.Topic)
+		return err
+	case opFetch:
+		_, _, _, err := f.store.Fetch(op.Topic, op.ID)
+		return err
+	case opAck:
+		return f.store.Ack(op.Topic, op.Offsets...)
+	case opDrop:
+		return f.store.Drop(op.Topic, op.Offsets...)
+	case opNack:
+		return f.store.Nack(op.Topic, op.Offsets[0])
+	case opNackReason:
+		return f.store.NackReason(op.Topic, op.Offsets[0], op.Reason)
+	case opPutTopicConfig:
+		return f.broker.SetTopicConfig(op.Topic, *op.Config)
+	case opResetDeliveries:
+		_, err := f.store.ResetDeliveries(op.Topic)
+		return err
+	case opSweep:
+		_, err := f.store.Sweep(*op.Before, op.Keep)
+		return err
+	case opSweepExpired:
+		_, err := f.store.SweepExpired(*op.Before, op.Keep)
+		return err
+	case opShed:
+		_, err := f.store.Shed(op.Topic, op.Count)
+		return err
+	case opDeleteTopic:
+		return f.store.DeleteTopic(op.Topic)
+	case opPutGroup:
+		return f.store.PutGroup(op.Topic, op.Group)
+	case opNextSeq:
+		_, err := f.store.NextSeq(op.Topic)
+		return err
+	case opRecover:
+		_, err := f.store.Recover()
+		return err
+	case opInsertDelayed:
+		return f.store.InsertDelayed(*op.Delayed)
+	case opDeleteDelayed:
+		return f.store.DeleteDelayed(*op.Delayed)
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+}
+
+// rejectOnFollower rejects requests which would modify the store of a
+// follower with 421, pointing the client at the primary in the Location
+// header. RPCs are let through, as the requests they dispatch are checked in
+// turn.
+func rejectOnFollower(primary string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if primary == "" || readOnlyRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			log := log.With().
+				Str("request_id", xid.New().String()).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Logger()
+
+			log.Debug().Msg("rejecting write to follower")
+
+			w.Header().Set("Location", strings.TrimSuffix(primary, "/")+r.URL.RequestURI())
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			respondError(log, json.NewEncoder(w), errFollower.Error())
+		})
+	}
+}
+
+// readOnlyRequest reports whether the request can be served by a follower.
+func readOnlyRequest(r *http.Request) bool {
+	if isWebSocketSubscribe(r) {
+		return false
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	}
+
+	return r.URL.Path == "/rpc"
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// groupTopicFmt is the topic holding a consumer group's copy of each message
+// published to a topic. Topics cannot contain a slash, so it cannot collide
+// with a published topic.
+const groupTopicFmt = "%s/%s"
+
+const (
+	// groupPrefix prefixes the keys registering each consumer group, such that
+	// a group keeps receiving messages across restarts before it has any.
+	groupPrefix = "miniqueue-group-"
+	groupKeyFmt = groupPrefix + groupTopicFmt
+)
+
+// groupTopic returns the topic consumed by members of the group on topic.
+func groupTopic(topic, group string) string {
+	return fmt.Sprintf(groupTopicFmt, topic, group)
+}
+
+// SubscribeGroup subscribes to a topic as a member of the named consumer
+// group. Each group receives every message published to the topic once the
+// group exists, with each message delivered to a single member. Consumers
+// without a group form the default group of the topic.
+//
+// Groups are durable. A group is registered in the store as it first
+// subscribes, and its messages are kept for it while it has no members, across
+// restarts, such that a member subscribing again resumes from the oldest
+// message left unacked by the group.
+func (b *broker) SubscribeGroup(topic, group string) (*consumer, error) {
+	if err := b.addGroup(topic, group); err != nil {
+		return nil, err
+	}
+
+	return b.Subscribe(groupTopic(topic, group)), nil
+}
+
+// addGroup registers the group of the topic, persisting it if it is new.
+func (b *broker) addGroup(topic, group string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.groups[topic][group] {
+		return nil
+	}
+
+	if err := b.store.PutGroup(topic, group); err != nil {
+		return fmt.Errorf("registering group: %v", err)
+	}
+
+	b.registerGroup(topic, group)
+
+	return nil
+}
+
+// registerGroup registers the group of the topic in memory. b must be locked.
+func (b *broker) registerGroup(topic, group string) {
+	if b.groups[topic] == nil {
+		b.groups[topic] = map[string]bool{}
+	}
+
+	b.groups[topic][group] = true
+}
+
+// withGroups returns the topics along with the group topics of each.
+func (b *broker) withGroups(topics []string) []string {
+	b.RLock()
+	defer b.RUnlock()
+
+	out := append([]string(nil), topics...)
+	for _, t := range topics {
+		for g := range b.groups[t] {
+			out = append(out, groupTopic(t, g))
+		}
+	}
+
+	return out
+}
+
+// recoverGroups registers the groups stored by a previous run, along with
+// those of the recovered group topics, such that they continue to receive
+// messages published before a member resubscribes.
+func (b *broker) recoverGroups(topics map[string]topicRecovery) error {
+	stored, err := b.store.Groups()
+	if err != nil {
+		return err
+	}
+
+	for t := range topics {
+		// The partitions of a group topic recover the group topic
+		if topic, _, ok := splitPartitionTopic(t); ok {
+			t = topic
+		}
+
+		stored = append(stored, t)
+	}
+
+	// Broadcast groups end with their consumer, so aren't resumed
+	if err := b.deleteBroadcasts(stored); err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	for _, t := range stored {
+		topic, group, ok := splitGroupTopic(t)
+		if !ok || isBroadcastGroup(group) {
+			continue
+		}
+
+		b.registerGroup(topic, group)
+	}
+
+	return nil
+}
+
+// PutGroup registers the consumer group of the topic.
+func (s *store) PutGroup(topic, group string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	key := []byte(fmt.Sprintf(groupKeyFmt, topic, group))
+	if err := s.db.Put(key, nil, nil); err != nil {
+		return fmt.Errorf("putting group: %v", err)
+	}
+
+	return s.written()
+}
+
+// Groups returns the group topic of each registered consumer group.
+func (s *store) Groups() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(groupPrefix)), nil)
+	defer iter.Release()
+
+	var topics []string
+	for iter.Next() {
+		topics = append(topics, strings.TrimPrefix(string(iter.Key()), groupPrefix))
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating groups: %v", err)
+	}
+
+	return topics, nil
+}
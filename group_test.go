@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func helperSubscribeGroup(t *testing.T, b *broker, topic, group string) *consumer {
+	t.Helper()
+
+	c, err := b.SubscribeGroup(topic, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestGroupSplitsMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	var (
+		worker1 = helperSubscribeGroup(t, b, defaultTopic, "workers")
+		worker2 = helperSubscribeGroup(t, b, defaultTopic, "workers")
+		audit   = helperSubscribeGroup(t, b, defaultTopic, "audit")
+	)
+
+	msgs := []string{"msg_1", "msg_2", "msg_3", "msg_4"}
+	for _, msg := range msgs {
+		_, err := b.Publish(defaultTopic, []byte(msg), messageMeta{})
+		assert.NoError(err)
+	}
+
+	// The workers share the messages, each receiving half
+	var worked []string
+	for i := 0; i < len(msgs)/2; i++ {
+		for _, w := range []*consumer{worker1, worker2} {
+			val, err := w.TryNext(context.Background())
+			assert.NoError(err)
+			worked = append(worked, string(val))
+		}
+	}
+
+	assert.ElementsMatch(msgs, worked)
+
+	_, err = worker1.TryNext(context.Background())
+	assert.Equal(errNoMessages, err)
+
+	// The second group receives every message independently
+	var audited []string
+	for range msgs {
+		val, err := audit.TryNext(context.Background())
+		assert.NoError(err)
+		assert.NoError(audit.Ack())
+		audited = append(audited, string(val))
+	}
+
+	assert.Equal(msgs, audited)
+}
+
+func TestGroupRebalance(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	worker1 := helperSubscribeGroup(t, b, defaultTopic, "workers")
+
+	_, err = b.Publish(defaultTopic, []byte("msg_1"), messageMeta{})
+	assert.NoError(err)
+
+	val, err := worker1.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal("msg_1", string(val))
+
+	// The member leaves before acking, its message goes to a new member
+	assert.NoError(worker1.NackAll())
+	b.Unsubscribe(worker1)
+
+	worker2 := helperSubscribeGroup(t, b, defaultTopic, "workers")
+
+	val, err = worker2.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal("msg_1", string(val))
+}
+
+func TestGroupRecover(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	helperSubscribeGroup(t, b, defaultTopic, "workers")
+
+	_, err = b.Publish(defaultTopic, []byte("msg_1"), messageMeta{})
+	assert.NoError(err)
+
+	// A restarted broker keeps publishing to the group before any member
+	// resubscribes
+	b = newBroker(&store{db: db})
+	assert.NoError(b.Recover())
+
+	_, err = b.Publish(defaultTopic, []byte("msg_2"), messageMeta{})
+	assert.NoError(err)
+
+	worker := helperSubscribeGroup(t, b, defaultTopic, "workers")
+	for _, want := range []string{"msg_1", "msg_2"} {
+		val, err := worker.TryNext(context.Background())
+		assert.NoError(err)
+		assert.NoError(worker.Ack())
+		assert.Equal(want, string(val))
+	}
+}
+
+func TestGroupDurable(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	// The group is registered before anything is published to it
+	b := newBroker(&store{db: db})
+	b.Unsubscribe(helperSubscribeGroup(t, b, defaultTopic, "workers"))
+
+	b = newBroker(&store{db: db})
+	assert.NoError(b.Recover())
+
+	for _, msg := range []string{"msg_1", "msg_2"} {
+		_, err = b.Publish(defaultTopic, []byte(msg), messageMeta{})
+		assert.NoError(err)
+	}
+
+	worker := helperSubscribeGroup(t, b, defaultTopic, "workers")
+
+	val, err := worker.TryNext(context.Background())
+	assert.NoError(err)
+	assert.NoError(worker.Ack())
+	assert.Equal("msg_1", string(val))
+
+	// The unacked message is delivered again once the group resumes after
+	// another restart
+	_, err = worker.TryNext(context.Background())
+	assert.NoError(err)
+
+	b = newBroker(&store{db: db})
+	assert.NoError(b.Recover())
+
+	worker = helperSubscribeGroup(t, b, defaultTopic, "workers")
+
+	val, err = worker.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal("msg_2", string(val))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// protocolVersion is the version of the subscribe protocol spoken by the
+// server, exchanged in the handshake.
+const protocolVersion = "miniqueue/1"
+
+// protocolFeatures are the optional parts of the subscribe protocol supported
+// by the server, advertised in its hello.
+var protocolFeatures = []string{
+	"ack_ids",
+	"ack_result",
+	"block",
+	"commit",
+	"nack_reason",
+	"peekall",
+	"snapshot",
+	"status",
+}
+
+// withHandshake requires subscribers to send a hello naming the protocol they
+// speak, e.g. {"hello": "miniqueue/1"}, as their first frame, within timeout
+// of subscribing. The server responds with its own hello, advertising the
+// features it supports, before the client sends INIT. Zero disables the
+// handshake.
+func withHandshake(timeout time.Duration) serverOption {
+	return func(s *server) {
+		s.handshake = timeout
+	}
+}
+
+// helloFrame returns the hello of the server.
+func helloFrame() subResponse {
+	res := signalFrame(signalHello)
+	res.Hello = protocolVersion
+	res.Features = protocolFeatures
+
+	return res
+}
+
+// abandonHello unblocks the hello still being decoded from the request body,
+// waiting for the decode to return, so the body isn't read once the handler
+// has returned.
+func abandonHello(w http.ResponseWriter, r *http.Request, hello <-chan error) {
+	// Over HTTP/1 a read holds the body open, leaving only the connection to
+	// close, once the response is sent. HTTP/2 multiplexes the connection, and
+	// unblocks reads of a closed body.
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok && r.ProtoMajor < 2 {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		_ = conn.Close()
+	}
+
+	_ = r.Body.Close()
+	<-hello
+}
+
+// requireHandshake rejects subscribers which don't send a hello for the
+// protocol of the server within the timeout, before any other command. Zero
+// disables the handshake.
+func requireHandshake(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if timeout <= 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "handshake").
+			Logger()
+
+		// Declared before the first write, so the stream status is sent
+		setResponseHeader(w, "Trailer", trailerStreamStatus)
+
+		dec := json.NewDecoder(r.Body)
+		enc := json.NewEncoder(w)
+
+		reject := func(e serverError) {
+			respondError(log, enc, e.Error())
+			setStreamStatus(w, streamStatusError)
+		}
+
+		hello := make(chan error, 1)
+
+		var cmd command
+		go func() {
+			hello <- dec.Decode(&cmd)
+		}()
+
+		select {
+		case err := <-hello:
+			if err != nil || cmd.Hello != protocolVersion {
+				log.Debug().Err(err).Str("hello", cmd.Hello).Msg("client failed handshake")
+				reject(errHandshake)
+
+				return
+			}
+		case <-time.After(timeout):
+			log.Debug().Msg("client did not handshake in time")
+			reject(errHandshakeTimeout)
+			abandonHello(w, r, hello)
+
+			return
+		case <-r.Context().Done():
+			abandonHello(w, r, hello)
+
+			return
+		}
+
+		if err := enc.Encode(helloFrame()); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+			return
+		}
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		// Hand the commands following the hello on to the subscriber
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: io.MultiReader(dec.Buffered(), r.Body),
+			Closer: r.Body,
+		}
+
+		next(w, r)
+	}
+}
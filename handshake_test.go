@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func helperSubscribeBody(t *testing.T, srv *httptest.Server, topic string, body io.Reader) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/subscribe/%s", srv.URL, topic), body)
+	assert.NoError(t, err)
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(t, err)
+
+	return res
+}
+
+func TestHandshake(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+
+	srv := httptest.NewUnstartedServer(newServer(b, withHandshake(time.Second)))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	res := helperSubscribeBody(t, srv, defaultTopic, strings.NewReader(`{"hello": "miniqueue/1"}`+"\n"+`"INIT"`+"\n"))
+	defer res.Body.Close()
+
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	dec := json.NewDecoder(res.Body)
+
+	// The server answers with its own hello
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(signalHello, out.Signal)
+	assert.Equal(protocolVersion, out.Hello)
+	assert.Equal(protocolFeatures, out.Features)
+
+	// Then proceeds to INIT
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("test_value", out.Msg)
+}
+
+func TestHandshake_Rejected(t *testing.T) {
+	// A body which never sends anything
+	silent, w := io.Pipe()
+	defer w.Close()
+
+	tests := []struct {
+		name    string
+		body    io.Reader
+		wantErr error
+	}{
+		{
+			name:    "missing",
+			body:    helperMustEncodeString(CmdInit),
+			wantErr: errHandshake,
+		},
+		{
+			name:    "wrong version",
+			body:    strings.NewReader(`{"hello": "miniqueue/2"}` + "\n" + `"INIT"` + "\n"),
+			wantErr: errHandshake,
+		},
+		{
+			name:    "malformed",
+			body:    strings.NewReader("not json\n"),
+			wantErr: errHandshake,
+		},
+		{
+			name:    "timeout",
+			body:    silent,
+			wantErr: errHandshakeTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			b := newBroker(helperNewMemStore(t))
+
+			srv := httptest.NewUnstartedServer(newServer(b, withHandshake(50*time.Millisecond)))
+			srv.EnableHTTP2 = true
+			srv.StartTLS()
+			defer srv.Close()
+
+			_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+			assert.NoError(err)
+
+			res := helperSubscribeBody(t, srv, defaultTopic, tt.body)
+			defer res.Body.Close()
+
+			var out subResponse
+			assert.NoError(json.NewDecoder(res.Body).Decode(&out))
+			assert.Equal(tt.wantErr.Error(), out.Error)
+
+			// The stream ends without subscribing
+			_, err = ioutil.ReadAll(res.Body)
+			assert.NoError(err)
+			assert.Equal(streamStatusError, res.Trailer.Get(trailerStreamStatus))
+
+			assert.Zero(b.subscribers(defaultTopic))
+
+			n, err := b.store.Len(defaultTopic)
+			assert.NoError(err)
+			assert.Equal(1, n)
+		})
+	}
+}
+
+// readsTracker counts the reads of the wrapped body in progress.
+type readsTracker struct {
+	io.ReadCloser
+	active int32
+}
+
+func (rt *readsTracker) Read(p []byte) (int, error) {
+	atomic.AddInt32(&rt.active, 1)
+	defer atomic.AddInt32(&rt.active, -1)
+
+	return rt.ReadCloser.Read(p)
+}
+
+func TestHandshake_TimeoutStopsRead(t *testing.T) {
+	assert := assert.New(t)
+
+	// A body which never sends anything
+	silent, w := io.Pipe()
+	defer w.Close()
+
+	body := &readsTracker{ReadCloser: silent}
+
+	b := newBroker(helperNewMemStore(t))
+	srv := newServer(b, withHandshake(50*time.Millisecond))
+
+	rec := NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/subscribe/"+defaultTopic, body))
+	assert.Contains(rec.Body.String(), errHandshakeTimeout.Error())
+
+	// The hello is no longer being read once the handler has returned
+	assert.Zero(atomic.LoadInt32(&body.active))
+}
+
+func TestHandshake_Disabled(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+
+	srv := httptest.NewUnstartedServer(newServer(b))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	// Clients which don't handshake are served as before
+	res := helperSubscribeRaw(t, srv, defaultTopic)
+	defer res.Body.Close()
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal("test_value", out.Msg)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hooks are called synchronously at points in the lifecycle of a message,
+// allowing metrics, auditing or tracing to be built on top of the broker.
+// Hooks must be cheap as they block the operation which triggered them. A
+// panicking hook is recovered and logged.
+type hooks struct {
+	onPublish func(topic, id string)
+	onDeliver func(topic, id, consumerID string)
+	onAck     func(topic, id, consumerID string)
+	onNack    func(topic, id, consumerID string)
+
+	// onProcessed is called with the time a consumer took to process a
+	// message, from its delivery until the consumer ACKed it.
+	onProcessed func(topic, id, consumerID string, took time.Duration)
+
+	// onBacklog is called as the depth of a topic crosses one of its backlog
+	// thresholds, in either direction.
+	onBacklog func(topic string, level backlogLevel, depth int)
+}
+
+// withOnPublish registers a hook called after a message is published.
+func withOnPublish(fn func(topic, id string)) brokerOption {
+	return func(b *broker) {
+		b.hooks.onPublish = fn
+	}
+}
+
+// withOnDeliver registers a hook called after a message is delivered to a
+// consumer.
+func withOnDeliver(fn func(topic, id, consumerID string)) brokerOption {
+	return func(b *broker) {
+		b.hooks.onDeliver = fn
+	}
+}
+
+// withOnAck registers a hook called after a message is ACKed by a consumer.
+func withOnAck(fn func(topic, id, consumerID string)) brokerOption {
+	return func(b *broker) {
+		b.hooks.onAck = fn
+	}
+}
+
+// withOnNack registers a hook called after a message is NACKed by a consumer.
+func withOnNack(fn func(topic, id, consumerID string)) brokerOption {
+	return func(b *broker) {
+		b.hooks.onNack = fn
+	}
+}
+
+// withOnProcessed registers a hook called with the time taken to process a
+// message once it is ACKed, measured from its delivery.
+func withOnProcessed(fn func(topic, id, consumerID string, took time.Duration)) brokerOption {
+	return func(b *broker) {
+		b.hooks.onProcessed = fn
+	}
+}
+
+// withOnBacklog registers a hook called as the depth of a topic crosses one of
+// its backlog thresholds, with the level it is now at.
+func withOnBacklog(fn func(topic string, level backlogLevel, depth int)) brokerOption {
+	return func(b *broker) {
+		b.hooks.onBacklog = fn
+	}
+}
+
+func (h *hooks) publish(topic, id string) {
+	if h.onPublish == nil {
+		return
+	}
+
+	defer recoverHook("publish")
+	h.onPublish(topic, id)
+}
+
+func (h *hooks) deliver(topic, id, consumerID string) {
+	if h.onDeliver == nil {
+		return
+	}
+
+	defer recoverHook("deliver")
+	h.onDeliver(topic, id, consumerID)
+}
+
+func (h *hooks) ack(topic, id, consumerID string) {
+	if h.onAck == nil {
+		return
+	}
+
+	defer recoverHook("ack")
+	h.onAck(topic, id, consumerID)
+}
+
+func (h *hooks) nack(topic, id, consumerID string) {
+	if h.onNack == nil {
+		return
+	}
+
+	defer recoverHook("nack")
+	h.onNack(topic, id, consumerID)
+}
+
+func (h *hooks) processed(topic, id, consumerID string, took time.Duration) {
+	if h.onProcessed == nil {
+		return
+	}
+
+	defer recoverHook("processed")
+	h.onProcessed(topic, id, consumerID, took)
+}
+
+func (h *hooks) backlog(topic string, level backlogLevel, depth int) {
+	if h.onBacklog == nil {
+		return
+	}
+
+	defer recoverHook("backlog")
+	h.onBacklog(topic, level, depth)
+}
+
+func recoverHook(name string) {
+	if r := recover(); r != nil {
+		log.Error().
+			Str("hook", name).
+			Interface("panic", r).
+			Msg("recovered from panicking hook")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	var calls []string
+	record := func(event string) func(topic, id, consumerID string) {
+		return func(topic, id, consumerID string) {
+			calls = append(calls, event+" "+topic+" "+id+" "+consumerID)
+		}
+	}
+
+	b := newBroker(&store{db: db},
+		withOnPublish(func(topic, id string) {
+			calls = append(calls, "publish "+topic+" "+id)
+		}),
+		withOnDeliver(record("deliver")),
+		withOnAck(record("ack")),
+		withOnNack(record("nack")),
+	)
+
+	topic := "test_topic"
+	c := b.Subscribe(topic)
+
+	id, err := b.Publish(topic, value("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.Nack())
+
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.Ack())
+
+	assert.Equal([]string{
+		"publish " + topic + " " + id,
+		"deliver " + topic + " " + id + " " + c.id,
+		"nack " + topic + " " + id + " " + c.id,
+		"deliver " + topic + " " + id + " " + c.id,
+		"ack " + topic + " " + id + " " + c.id,
+	}, calls)
+}
+
+func TestHooks_Panic(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db},
+		withOnPublish(func(topic, id string) { panic("publish") }),
+		withOnDeliver(func(topic, id, consumerID string) { panic("deliver") }),
+		withOnAck(func(topic, id, consumerID string) { panic("ack") }),
+	)
+
+	topic := "test_topic"
+	c := b.Subscribe(topic)
+
+	_, err = b.Publish(topic, value("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	val, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("test_value"), val)
+	assert.NoError(c.Ack())
+}
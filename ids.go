@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// seqKeyFmt holds the last sequential message ID assigned on a topic.
+const seqKeyFmt = "miniqueue-seq-%s"
+
+// idScheme selects how the IDs of published messages are generated.
+type idScheme string
+
+const (
+	// idSchemeXID generates globally unique xids, the default.
+	idSchemeXID = idScheme("xid")
+	// idSchemeULID generates lexicographically sortable ULIDs.
+	idSchemeULID = idScheme("ulid")
+	// idSchemeSeq generates sequence numbers per topic, persisted in the
+	// store.
+	idSchemeSeq = idScheme("seq")
+)
+
+// idGenerator generates the IDs of published messages.
+type idGenerator interface {
+	// NextID returns the ID of a new message published to topic.
+	NextID(topic string) (string, error)
+}
+
+// withIDGenerator sets the generator of message IDs, defaulting to xids.
+func withIDGenerator(g idGenerator) brokerOption {
+	return func(b *broker) {
+		b.ids = g
+	}
+}
+
+// newIDGenerator returns the generator for the scheme. Sequential IDs are
+// persisted in the store.
+func newIDGenerator(scheme idScheme, s storer) (idGenerator, error) {
+	switch scheme {
+	case idSchemeXID:
+		return xidGenerator{}, nil
+	case idSchemeULID:
+		return ulidGenerator{now: time.Now}, nil
+	case idSchemeSeq:
+		return seqGenerator{store: s}, nil
+	default:
+		return nil, fmt.Errorf("unknown id scheme %q", scheme)
+	}
+}
+
+type xidGenerator struct{}
+
+func (xidGenerator) NextID(string) (string, error) {
+	return xid.New().String(), nil
+}
+
+// ulidAlphabet is Crockford's base32, which ULIDs are encoded in.
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator generates ULIDs, a 48 bit millisecond timestamp followed by 80
+// random bits, encoded as 26 characters which sort by time.
+type ulidGenerator struct {
+	now func() time.Time
+}
+
+func (g ulidGenerator) NextID(string) (string, error) {
+	var b [16]byte
+
+	ms := uint64(g.now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(b[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:], uint32(ms))
+
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", fmt.Errorf("reading entropy: %v", err)
+	}
+
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+
+	// Encode 5 bits at a time from the least significant end
+	out := make([]byte, 26)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(out), nil
+}
+
+// seqGenerator generates IDs counting up from 1 on each topic.
+type seqGenerator struct {
+	store storer
+}
+
+func (g seqGenerator) NextID(topic string) (string, error) {
+	seq, err := g.store.NextSeq(topic)
+	if err != nil {
+		return "", fmt.Errorf("getting next sequence number: %v", err)
+	}
+
+	return strconv.Itoa(seq), nil
+}
+
+// NextSeq increments and returns the sequence number of the topic, starting
+// from 1.
+func (s *store) NextSeq(topic string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	seq, err := getPos(s.db, seqKeyFmt, topic)
+	if err != nil && !errors.Is(err, errTopicNotExist) {
+		return 0, err
+	}
+
+	seq++
+
+	key := []byte(fmt.Sprintf(seqKeyFmt, topic))
+	if err := s.db.Put(key, encodePos(seq), nil); err != nil {
+		return 0, fmt.Errorf("putting sequence number: %v", err)
+	}
+
+	return seq, s.written()
+}
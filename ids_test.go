@@ -0,0 +1,114 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDSchemes(t *testing.T) {
+	tests := []struct {
+		scheme idScheme
+		format *regexp.Regexp
+	}{
+		{scheme: idSchemeXID, format: regexp.MustCompile(`^[0-9a-v]{20}$`)},
+		{scheme: idSchemeULID, format: regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)},
+		{scheme: idSchemeSeq, format: regexp.MustCompile(`^[1-9][0-9]*$`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.scheme), func(t *testing.T) {
+			assert := assert.New(t)
+
+			s := newStore(tmpDBPath)
+			t.Cleanup(s.Destroy)
+
+			g, err := newIDGenerator(tt.scheme, s)
+			assert.NoError(err)
+
+			b := newBroker(s, withIDGenerator(g))
+
+			id, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+			assert.NoError(err)
+			assert.Regexp(tt.format, id)
+		})
+	}
+
+	_, err := newIDGenerator("uuid", nil)
+	assert.Error(t, err)
+}
+
+func TestXIDDefault(t *testing.T) {
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	id, err := newBroker(s).Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(t, err)
+
+	_, err = xid.FromString(id)
+	assert.NoError(t, err)
+}
+
+func TestULIDSortable(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1600000000, 0)
+	g := ulidGenerator{now: func() time.Time { return now }}
+
+	first, err := g.NextID(defaultTopic)
+	assert.NoError(err)
+
+	now = now.Add(time.Millisecond)
+
+	second, err := g.NextID(defaultTopic)
+	assert.NoError(err)
+
+	assert.Len(first, 26)
+	assert.Less(first, second)
+
+	// The timestamp is held in the first 10 characters
+	assert.Equal("01EJ3PX000", first[:10])
+}
+
+func TestSeqIDsPersisted(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	g, err := newIDGenerator(idSchemeSeq, s)
+	assert.NoError(err)
+
+	var last int
+	for i := 0; i < 3; i++ {
+		id, err := g.NextID(defaultTopic)
+		assert.NoError(err)
+
+		seq, err := strconv.Atoi(id)
+		assert.NoError(err)
+		assert.Greater(seq, last)
+		last = seq
+	}
+
+	// Each topic has its own sequence
+	id, err := g.NextID("other_topic")
+	assert.NoError(err)
+	assert.Equal("1", id)
+
+	// Simulate a restart, the sequence continues where it left off
+	assert.NoError(s.Close())
+
+	s = newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	g, err = newIDGenerator(idSchemeSeq, s)
+	assert.NoError(err)
+
+	id, err = g.NextID(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(strconv.Itoa(last+1), id)
+}
@@ -0,0 +1,114 @@
+package main
+
+import "sync"
+
+// withMaxInFlight limits how many consumers of each topic may hold outstanding
+// messages at once, for topics whose config sets no limit of their own. A
+// consumer beyond the limit waits for one of the others to resolve its
+// messages, even while messages are waiting. Zero is unlimited.
+func withMaxInFlight(max int) brokerOption {
+	return func(b *broker) {
+		b.maxInFlight = max
+	}
+}
+
+// inFlightLimit returns the maximum consumers of the topic which may hold
+// outstanding messages at once, zero is unlimited.
+func (b *broker) inFlightLimit(topic string) int {
+	if max := b.TopicConfig(topic).MaxInFlight; max > 0 {
+		return max
+	}
+
+	return b.maxInFlight
+}
+
+// inFlight tracks the consumers of each topic holding outstanding messages,
+// each taking one of the limited slots of the topic.
+type inFlight struct {
+	// limit returns the number of slots of the topic, zero is unlimited.
+	limit func(topic string) int
+
+	// holders are the IDs of the consumers of each topic holding a slot.
+	holders map[string]map[string]bool
+
+	// released is closed, then replaced, each time a slot of the topic is
+	// given up, waking the consumers waiting for one.
+	released map[string]chan struct{}
+
+	sync.Mutex
+}
+
+// acquire takes a slot of the topic for the consumer, unless it already holds
+// one. If every slot is taken, ok is false and released is closed once one is
+// given up.
+func (f *inFlight) acquire(topic, id string) (ok bool, released <-chan struct{}) {
+	if f == nil || f.limit == nil {
+		return true, nil
+	}
+
+	limit := f.limit(topic)
+	if limit <= 0 {
+		return true, nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.holders == nil {
+		f.holders = map[string]map[string]bool{}
+		f.released = map[string]chan struct{}{}
+	}
+
+	holders := f.holders[topic]
+	if holders[id] {
+		return true, nil
+	}
+
+	if len(holders) >= limit {
+		if f.released[topic] == nil {
+			f.released[topic] = make(chan struct{})
+		}
+
+		return false, f.released[topic]
+	}
+
+	if holders == nil {
+		holders = map[string]bool{}
+		f.holders[topic] = holders
+	}
+	holders[id] = true
+
+	return true, nil
+}
+
+// release gives up the slot of the topic held by the consumer, if any.
+func (f *inFlight) release(topic, id string) {
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if !f.holders[topic][id] {
+		return
+	}
+
+	delete(f.holders[topic], id)
+	if len(f.holders[topic]) == 0 {
+		delete(f.holders, topic)
+	}
+
+	if ch, ok := f.released[topic]; ok {
+		close(ch)
+		delete(f.released, topic)
+	}
+}
+
+// releaseSlot gives up the in-flight slot of the consumer once it holds no
+// outstanding messages.
+func (c *consumer) releaseSlot() {
+	if len(c.outstanding) == 0 {
+		c.slots.release(c.topic, c.id)
+	}
+}
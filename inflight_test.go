@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{MaxInFlight: 2}))
+
+	for i := 0; i < 5; i++ {
+		_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+		assert.NoError(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan *consumer, 5)
+	for i := 0; i < 5; i++ {
+		c := b.Subscribe(defaultTopic)
+
+		go func() {
+			if _, err := c.Next(ctx); err == nil {
+				received <- c
+			}
+		}()
+	}
+
+	// Only two consumers receive a message, though three more are waiting
+	var inFlight []*consumer
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-received:
+			inFlight = append(inFlight, c)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a delivery")
+		}
+	}
+
+	select {
+	case <-received:
+		t.Fatal("a third consumer received a message beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Acking frees the slot for a third consumer
+	assert.NoError(inFlight[0].Ack())
+
+	select {
+	case c := <-received:
+		assert.NotEqual(inFlight[0].id, c.id)
+		assert.NotEqual(inFlight[1].id, c.id)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a delivery after the ACK")
+	}
+
+	select {
+	case <-received:
+		t.Fatal("a fourth consumer received a message beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMaxInFlight_TryNext(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t), withMaxInFlight(1))
+
+	for i := 0; i < 2; i++ {
+		_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+		assert.NoError(err)
+	}
+
+	c1 := b.Subscribe(defaultTopic)
+	c2 := b.Subscribe(defaultTopic)
+
+	_, err := c1.TryNext(context.Background())
+	assert.NoError(err)
+
+	// Other consumers find nothing available while the slot is taken
+	_, err = c2.TryNext(context.Background())
+	assert.Equal(errNoMessages, err)
+
+	// Nacking every outstanding message frees the slot
+	assert.NoError(c1.NackAll())
+
+	_, err = c2.TryNext(context.Background())
+	assert.NoError(err)
+
+	// The topic config overrides the broker's limit
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{MaxInFlight: 2}))
+
+	_, err = c1.TryNext(context.Background())
+	assert.NoError(err)
+}
@@ -0,0 +1,51 @@
+package main
+
+// deliveryInterceptor transforms a message of the topic before it is delivered
+// to a consumer, e.g. redacting fields the consumer shouldn't see. It is given
+// a copy of the message, which it may modify freely, and returns the message
+// to deliver. The stored message is unaffected, as is the ID and sequence
+// number of the delivery, which the consumer needs to acknowledge it.
+type deliveryInterceptor func(topic string, msg message) message
+
+// withDeliveryInterceptor runs the interceptor on every message delivered to
+// every consumer, before any interceptors of the consumer itself.
+// Interceptors run in the order they are added.
+func withDeliveryInterceptor(i deliveryInterceptor) brokerOption {
+	return func(b *broker) {
+		b.interceptors = append(b.interceptors, i)
+	}
+}
+
+// Intercept runs the interceptor on every message subsequently delivered to
+// the consumer, after any interceptors already added.
+func (c *consumer) Intercept(i deliveryInterceptor) {
+	// Don't append to the interceptors shared with the broker
+	c.interceptors = append(c.interceptors[:len(c.interceptors):len(c.interceptors)], i)
+}
+
+// intercept returns the message as it is to be delivered to the consumer.
+func (c *consumer) intercept(val value, meta messageMeta) (value, messageMeta) {
+	if len(c.interceptors) == 0 {
+		return val, meta
+	}
+
+	msg := message{Value: copyValue(val), Meta: meta}
+	msg.Meta.NackReasons = append([]string(nil), meta.NackReasons...)
+
+	for _, i := range c.interceptors {
+		msg = i(c.topic, msg)
+	}
+
+	msg.Meta.ID = meta.ID
+	msg.Meta.Seq = meta.Seq
+
+	return msg.Value, msg.Meta
+}
+
+func copyValue(val value) value {
+	if val == nil {
+		return nil
+	}
+
+	return append(value(nil), val...)
+}
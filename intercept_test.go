@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// redactReplyTo hides the reply topic and masks the body of each message.
+func redactReplyTo(topic string, msg message) message {
+	msg.Meta.ReplyTo = ""
+	for i := range msg.Value {
+		msg.Value[i] = '*'
+	}
+
+	return msg
+}
+
+func TestDeliveryInterceptor(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	public := helperSubscribeGroup(t, b, defaultTopic, "public")
+	public.Intercept(redactReplyTo)
+
+	internal := helperSubscribeGroup(t, b, defaultTopic, "internal")
+
+	_, err = b.Publish(defaultTopic, []byte("secret"), messageMeta{ReplyTo: "replies"})
+	assert.NoError(err)
+
+	ctx := context.Background()
+
+	// The intercepted consumer sees the redacted message
+	val, err := public.Next(ctx)
+	assert.NoError(err)
+	assert.Equal(value("******"), val)
+	assert.Empty(public.Meta().ReplyTo)
+	assert.NotEmpty(public.Meta().ID)
+	assert.Equal(1, public.Meta().Seq)
+
+	// While the other sees it in full
+	val, err = internal.Next(ctx)
+	assert.NoError(err)
+	assert.Equal(value("secret"), val)
+	assert.Equal("replies", internal.Meta().ReplyTo)
+
+	// The stored message is unaffected, so a NACKed message is redelivered
+	// intact and the reply still reaches its topic
+	assert.NoError(public.Nack())
+
+	msgs, err := b.store.Peek(groupTopic(defaultTopic, "public"), 1)
+	assert.NoError(err)
+	assert.Equal(value("secret"), msgs[0].val)
+	assert.Equal("replies", msgs[0].meta.ReplyTo)
+
+	_, err = public.Next(ctx)
+	assert.NoError(err)
+	assert.NoError(public.AckWithResult([]byte("result")))
+
+	n, err := b.store.Len("replies")
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestDeliveryInterceptor_Broker(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	var order []string
+	b := newBroker(&store{db: db}, withDeliveryInterceptor(func(topic string, msg message) message {
+		order = append(order, "broker")
+		msg.Value = []byte(strings.ToUpper(string(msg.Value)))
+
+		return msg
+	}))
+
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.NoError(err)
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	c.Intercept(func(topic string, msg message) message {
+		order = append(order, "consumer")
+		assert.Equal(defaultTopic, topic)
+
+		// Interceptors can't change the ID the message is acknowledged by
+		msg.Meta.ID = "changed"
+
+		return msg
+	})
+
+	// Other consumers only run the broker's interceptors
+	other := b.Subscribe(defaultTopic)
+
+	val, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("TEST_MSG"), val)
+	assert.NotEqual("changed", c.Meta().ID)
+	assert.NoError(c.AckIDs([]string{c.Meta().ID}))
+
+	_, err = other.Next(context.Background())
+	assert.NoError(err)
+
+	assert.Equal([]string{"broker", "consumer", "broker"}, order)
+}
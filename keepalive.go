@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// keepaliveWriter wraps the response of a subscribe connection, sending a
+// keepalive response whenever nothing else has been written for an interval.
+// This stops idle connections on empty topics from being closed by proxies.
+// Writes are serialised, such that keepalives never interleave with other
+// responses.
+type keepaliveWriter struct {
+	http.ResponseWriter
+	interval time.Duration
+	now      func() time.Time
+	last     time.Time
+
+	// held stops keepalives while a message is streamed, as they must not
+	// land between its chunks.
+	held bool
+
+	sync.Mutex
+}
+
+func newKeepaliveWriter(w http.ResponseWriter, interval time.Duration, now func() time.Time) *keepaliveWriter {
+	return &keepaliveWriter{
+		ResponseWriter: w,
+		interval:       interval,
+		now:            now,
+		last:           now(),
+	}
+}
+
+func (kw *keepaliveWriter) Write(p []byte) (int, error) {
+	kw.Lock()
+	defer kw.Unlock()
+
+	kw.last = kw.now()
+
+	return kw.ResponseWriter.Write(p)
+}
+
+// WriteHeader is serialised with keepalives, as the first keepalive otherwise
+// sends the header concurrently.
+func (kw *keepaliveWriter) WriteHeader(code int) {
+	kw.Lock()
+	defer kw.Unlock()
+
+	kw.ResponseWriter.WriteHeader(code)
+}
+
+// setHeader sets a header under the lock, as writes read the header map
+// while sending the header and trailers.
+func (kw *keepaliveWriter) setHeader(key, value string) {
+	kw.Lock()
+	defer kw.Unlock()
+
+	kw.ResponseWriter.Header().Set(key, value)
+}
+
+func (kw *keepaliveWriter) Flush() {
+	kw.Lock()
+	defer kw.Unlock()
+
+	kw.flush()
+}
+
+func (kw *keepaliveWriter) flush() {
+	if f, ok := kw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ping sends a keepalive if the connection has been idle for the interval.
+func (kw *keepaliveWriter) ping() {
+	kw.Lock()
+	defer kw.Unlock()
+
+	now := kw.now()
+	if kw.held || now.Sub(kw.last) < kw.interval {
+		return
+	}
+
+	kw.last = now
+
+	if err := json.NewEncoder(kw.ResponseWriter).Encode(signalFrame(signalKeepalive)); err != nil {
+		log.Err(err).Msg("failed to write keepalive to client")
+		return
+	}
+
+	kw.flush()
+}
+
+// hold stops keepalives until release is called.
+func (kw *keepaliveWriter) hold() {
+	kw.Lock()
+	defer kw.Unlock()
+
+	kw.held = true
+}
+
+// release resumes keepalives, the connection having just been written to.
+func (kw *keepaliveWriter) release() {
+	kw.Lock()
+	defer kw.Unlock()
+
+	kw.held = false
+	kw.last = kw.now()
+}
+
+// run pings on each tick until done is closed.
+func (kw *keepaliveWriter) run(ticks <-chan time.Time, done <-chan struct{}) {
+	for {
+		select {
+		case <-ticks:
+			kw.ping()
+		case <-done:
+			return
+		}
+	}
+}
+
+// headerSetter is implemented by writers written to from another goroutine,
+// which must guard changes to the header.
+type headerSetter interface {
+	setHeader(key, value string)
+}
+
+// setResponseHeader sets a header of the response, through the first writer
+// wrapped by w which guards its header, if any.
+func setResponseHeader(w http.ResponseWriter, key, value string) {
+	for {
+		if hs, ok := w.(headerSetter); ok {
+			hs.setHeader(key, value)
+			return
+		}
+
+		uw, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = uw.Unwrap()
+	}
+
+	w.Header().Set(key, value)
+}
+
+// keepaliveHolder is implemented by writers which send keepalives, which may
+// be held back.
+type keepaliveHolder interface {
+	hold()
+	release()
+}
+
+// holdKeepalives stops keepalives being sent on the response until the
+// returned function is called, through the first writer wrapped by w which
+// sends them, if any.
+func holdKeepalives(w http.ResponseWriter) (release func()) {
+	for {
+		if h, ok := w.(keepaliveHolder); ok {
+			h.hold()
+			return h.release
+		}
+
+		uw, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return func() {}
+		}
+		w = uw.Unwrap()
+	}
+}
+
+// keepaliveSubscribers sends keepalives on subscribe connections which have
+// been idle for the interval. Zero disables keepalives.
+func keepaliveSubscribers(interval time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if interval <= 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Declared before the first keepalive may send the header, so the stream
+		// status is sent
+		w.Header().Set("Trailer", trailerStreamStatus)
+
+		kw := newKeepaliveWriter(w, interval, time.Now)
+
+		// Tick more often than the interval, bounding how long past the interval
+		// a keepalive may be sent
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		// The pinger is stopped and waited for before returning, as the response
+		// may no longer be written to once the handler returns
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+		defer func() {
+			close(done)
+			wg.Wait()
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			kw.run(ticker.C, done)
+		}()
+
+		next(kw, r)
+	}
+}
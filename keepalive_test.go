@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	t time.Time
+	sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.t = c.t.Add(d)
+}
+
+func TestKeepaliveWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	const interval = 30 * time.Second
+
+	clock := &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rec := NewRecorder()
+	kw := newKeepaliveWriter(rec, interval, clock.Now)
+
+	// Not yet idle for the interval
+	clock.Advance(interval - time.Second)
+	kw.ping()
+	assert.Zero(rec.Body.Len())
+
+	clock.Advance(time.Second)
+	kw.ping()
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal(subResponse{Signal: signalKeepalive, Keepalive: true}, out)
+	assert.True(rec.Flushed)
+
+	// Writing a message resets the idle interval
+	clock.Advance(interval - time.Second)
+	assert.NoError(json.NewEncoder(kw).Encode(subResponse{Msg: "test_msg"}))
+
+	clock.Advance(time.Second)
+	kw.ping()
+
+	out = subResponse{}
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal("test_msg", out.Msg)
+	assert.Zero(rec.Body.Len())
+}
+
+func TestKeepaliveWriter_Run(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rec := NewRecorder()
+	kw := newKeepaliveWriter(rec, time.Minute, clock.Now)
+
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	defer close(done)
+
+	go kw.run(ticks, done)
+
+	clock.Advance(time.Minute)
+	ticks <- clock.Now()
+
+	var out subResponse
+	assert.NoError(NewDecodeWaiter(rec).WaitAndDecode(&out))
+	assert.True(out.Keepalive)
+	assert.Empty(out.Msg)
+}
+
+func TestServerKeepalive(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t, withKeepalive(50*time.Millisecond))
+	defer srvCloser()
+
+	// Nothing is published, the idle connection receives keepalives
+	_, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.True(out.Keepalive)
+
+	res := helperPublishMessage(t, srv, defaultTopic, "test_msg")
+	defer res.Body.Close()
+
+	// Keepalives may precede the message
+	for {
+		out = subResponse{}
+		if !assert.NoError(decoder.Decode(&out)) || !out.Keepalive {
+			break
+		}
+	}
+	assert.Equal("test_msg", out.Msg)
+}
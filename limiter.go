@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// subscribeRetryAfter is the duration a client is told to wait before retrying
+// a subscribe rejected due to the connection limit.
+const subscribeRetryAfter = 5 * time.Second
+
+// subLimiter bounds the number of concurrent subscribe connections, both in
+// total and per topic. A limit of zero is treated as unlimited.
+type subLimiter struct {
+	max      int
+	maxTopic int
+
+	total  int
+	topics map[string]int
+	sync.Mutex
+}
+
+func newSubLimiter(max, maxTopic int) *subLimiter {
+	return &subLimiter{
+		max:      max,
+		maxTopic: maxTopic,
+		topics:   map[string]int{},
+	}
+}
+
+// acquire attempts to reserve a connection slot for the topic, returning false
+// if either limit has been reached.
+func (l *subLimiter) acquire(topic string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return false
+	}
+
+	if l.maxTopic > 0 && l.topics[topic] >= l.maxTopic {
+		return false
+	}
+
+	l.total++
+	l.topics[topic]++
+
+	return true
+}
+
+// release frees a connection slot previously acquired for the topic.
+func (l *subLimiter) release(topic string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.total--
+	l.topics[topic]--
+
+	if l.topics[topic] <= 0 {
+		delete(l.topics, topic)
+	}
+}
+
+// limitSubscribers wraps a subscribe handler, rejecting the connection with a
+// 503 if the limiter has no slots available for the topic.
+func limitSubscribers(l *subLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topic := mux.Vars(r)[topicVarKey]
+
+		if !l.acquire(topic) {
+			log := log.With().
+				Str("handler", "subscribe").
+				Str("topic", topic).
+				Logger()
+
+			log.Warn().Msg("subscribe connection limit reached")
+
+			w.Header().Set("Retry-After", strconv.Itoa(int(subscribeRetryAfter/time.Second)))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			respondError(log, json.NewEncoder(w), errSubscribeLimit.Error())
+
+			return
+		}
+		defer l.release(topic)
+
+		next(w, r)
+	}
+}
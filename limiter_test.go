@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newSubLimiter(2, 0)
+
+	assert.True(l.acquire("a"))
+	assert.True(l.acquire("b"))
+	assert.False(l.acquire("c"))
+
+	l.release("a")
+	assert.True(l.acquire("c"))
+}
+
+func TestSubLimiter_PerTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newSubLimiter(0, 1)
+
+	assert.True(l.acquire("a"))
+	assert.False(l.acquire("a"))
+	assert.True(l.acquire("b"))
+
+	l.release("a")
+	assert.True(l.acquire("a"))
+}
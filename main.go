@@ -1,37 +1,155 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 const (
+	defaultConfigPath    = ""
 	defaultHumanReadable = false
 	defaultPort          = 8080
 	defaultCertPath      = "./testdata/localhost.pem"
 	defaultKeyPath       = "./testdata/localhost-key.pem"
+	defaultClientCA      = ""
 	defaultDBPath        = "./miniqueue"
 	defaultLogLevel      = "debug"
+	defaultNotifyAllow   = ""
+	defaultBackoffBase   = 0
+	defaultBackoffMax    = time.Minute
+	defaultBackoffJitter = 0.2
+	defaultMaxSubs       = 0
+	defaultMaxTopicSubs  = 0
+	defaultSyncPolicy    = "none"
+	defaultSyncInterval  = time.Second
+	defaultBatchWindow   = 0
+	defaultBatchMax      = 100
+	defaultCacheSize     = 0
+	defaultRetention     = 0
+	defaultRetentionMax  = 0
+	defaultReplayDur     = 0
+	defaultReplayMax     = 0
+	defaultMaxAge        = 0
+	defaultAckTimeout    = 0
+	defaultKeepalive     = 0
+	defaultMaxAckTimeout = time.Hour
+	defaultSweepInterval = time.Minute
+	defaultExpiredTopic  = false
+	defaultRequireSub    = false
+	defaultIDScheme      = "xid"
+	defaultConnCap       = 0
+	defaultOnDisconnect  = "nack"
+	defaultFlushBytes    = 0
+	defaultFlushWrites   = 0
+	defaultDrainTimeout  = 30 * time.Second
+	defaultMaxSkew       = 0
+	defaultDLQDeliveries = 0
+	defaultDLQAlert      = ""
+	defaultRedriveDelay  = 0
+	defaultMaxRedrives   = 3
+	defaultWriteTimeout  = 0
+	defaultTopicsFile    = ""
+	defaultReadTimeout   = 0
+	defaultTCPKeepalive  = 0
+	defaultMaxDelayed    = 0
+	defaultTopicDelayed  = 0
+	defaultFollow        = ""
+	defaultFollowCA      = ""
+	defaultAckReplicas   = 0
+	defaultReplicaWait   = 5 * time.Second
+	defaultEncryptKey    = ""
+	defaultHandshake     = 0
+	defaultStoreFull     = "reject"
+	defaultConfirmWindow = 0
+	defaultMaxInFlight   = 0
+	defaultPeers         = ""
+	defaultPeersCA       = ""
 )
 
 func main() {
 	var (
+		configPath    = flag.String(configFlag, defaultConfigPath, "path to a YAML file setting flags by name, and declaring topics, overridden by MINIQUEUE_<FLAG> environment variables and the command line")
 		humanReadable = flag.Bool("human", defaultHumanReadable, "human readable logging output")
 		port          = flag.Int("port", defaultPort, "port used to run the server")
 		tlsCertPath   = flag.String("cert", defaultCertPath, "path to TLS certificate")
 		tlsKeyPath    = flag.String("key", defaultKeyPath, "path to TLS key")
-		dbPath        = flag.String("db", defaultDBPath, "path to the db file")
+		clientCA      = flag.String("client-ca", defaultClientCA, "path to a CA certificate which clients must present a certificate signed by, unset accepts any client")
+		dbPath        = flag.String("db", defaultDBPath, "path to the db file, or a store DSN (leveldb:///path|memory://)")
 		logLevel      = flag.String("level", defaultLogLevel, "(disabled|debug|info)")
+		notifyAllow   = flag.String("notify-allow", defaultNotifyAllow, "comma separated CIDRs of private, loopback or link-local networks which receipts and alerts may be sent to, refused otherwise")
+		backoffBase   = flag.Duration("backoff-base", defaultBackoffBase, "initial redelivery delay of NACKed messages, 0 disables")
+		backoffMax    = flag.Duration("backoff-max", defaultBackoffMax, "maximum redelivery delay of NACKed messages")
+		backoffJitter = flag.Float64("backoff-jitter", defaultBackoffJitter, "random fraction applied to each redelivery delay")
+		maxDelayed    = flag.Int("max-delayed", defaultMaxDelayed, "maximum delayed messages waiting to be published, 0 is unlimited")
+		topicDelayed  = flag.Int("max-topic-delayed", defaultTopicDelayed, "maximum delayed messages waiting to be published per topic, 0 is unlimited")
+		maxSubs       = flag.Int("max-subscribers", defaultMaxSubs, "maximum concurrent subscribe connections, 0 is unlimited")
+		maxTopicSubs  = flag.Int("max-topic-subscribers", defaultMaxTopicSubs, "maximum concurrent subscribe connections per topic, 0 is unlimited")
+		syncPol       = flag.String("sync", defaultSyncPolicy, "how often writes are synced to disk (none|periodic|always)")
+		syncInterval  = flag.Duration("sync-interval", defaultSyncInterval, "interval between syncs when using the periodic sync policy")
+		batchWindow   = flag.Duration("batch-window", defaultBatchWindow, "coalesce publishes arriving within this of each other into a single store write, 0 disables")
+		batchMax      = flag.Int("batch-max", defaultBatchMax, "maximum messages in a single batched store write, 0 is unlimited")
+		cacheSize     = flag.Int("cache-size", defaultCacheSize, "number of messages cached in memory at the head of each topic, 0 disables")
+		retentionDur  = flag.Duration("retention", defaultRetention, "how long acked messages are kept in the history of each topic, 0 is unbounded")
+		retentionMax  = flag.Int("retention-max", defaultRetentionMax, "maximum acked messages kept in the history of each topic, 0 is unbounded")
+		replayDur     = flag.Duration("replay-retention", defaultReplayDur, "keep a log of the messages published to each topic for this long, for subscribers to replay, 0 is unbounded")
+		replayMax     = flag.Int("replay-max", defaultReplayMax, "maximum messages kept in the replay log of each topic, 0 is unbounded, the log is only kept if either limit is set")
+		ackTimeout    = flag.Duration("ack-timeout", defaultAckTimeout, "return delivered messages to their topic if not ACKed or NACKed within this, 0 disables")
+		confirmWindow = flag.Duration("confirm-window", defaultConfirmWindow, "keep ACKed messages in memory for this long, so duplicate ACKs succeed and they may be replayed, 0 disables")
+		maxAckTimeout = flag.Duration("max-ack-timeout", defaultMaxAckTimeout, "maximum ack timeout a consumer may request, 0 is unlimited")
+		keepalive     = flag.Duration("keepalive", defaultKeepalive, "send a keepalive on subscribe connections idle for this long, 0 disables")
+		maxInFlight   = flag.Int("max-in-flight", defaultMaxInFlight, "maximum consumers of each topic holding outstanding messages at once, unless set by its config, 0 is unlimited")
+		maxSkew       = flag.Duration("max-skew", defaultMaxSkew, "reject publishes with a producer timestamp further than this from the server clock, 0 disables")
+		maxAge        = flag.Duration("max-age", defaultMaxAge, "discard messages waiting to be consumed for longer than this, 0 disables")
+		sweepInterval = flag.Duration("sweep-interval", defaultSweepInterval, "interval between sweeps for messages exceeding the max age or past their delivery deadline, 0 disables")
+		expiredTopic  = flag.Bool("expired-topic", defaultExpiredTopic, "move messages which expire before they're delivered to the <topic>.expired topic, rather than dropping them")
+		idSch         = flag.String("id-scheme", defaultIDScheme, "scheme used to generate message IDs (xid|ulid|seq)")
+		connCap       = flag.Int("connection-cap", defaultConnCap, "maximum publishes and subscribe commands per client connection before it is closed, 0 is unlimited")
+		onDisconnect  = flag.String("on-disconnect", defaultOnDisconnect, "what happens to outstanding messages when a consumer disconnects (nack|ack)")
+		drainTimeout  = flag.Duration("drain-timeout", defaultDrainTimeout, "how long connections, and consumers holding messages, are given to finish on shutdown, and a restarted process waits for the store")
+		flushBytes    = flag.Int("flush-bytes", defaultFlushBytes, "bytes of responses to pipelined subscribe commands written before flushing, 0 flushes every write")
+		flushWrites   = flag.Int("flush-writes", defaultFlushWrites, "responses to pipelined subscribe commands written before flushing, 0 flushes every write")
+		dlqDeliveries = flag.Int("dlq-max-deliveries", defaultDLQDeliveries, "move NACKed messages delivered this many times to the <topic>.dlq topic, 0 disables")
+		dlqAlert      = flag.String("dlq-alert", defaultDLQAlert, "URL sent an alert each time a message is dead-lettered")
+		redriveDelay  = flag.Duration("dlq-redrive-delay", defaultRedriveDelay, "return dead-lettered messages to their topic after this long, 0 disables")
+		maxRedrives   = flag.Int("dlq-max-redrives", defaultMaxRedrives, "times a message is redriven before it stays on the dead-letter topic")
+		topicsFile    = flag.String("topics", defaultTopicsFile, "path to a JSON file declaring topics and their configs, applied at startup")
+		readTimeout   = flag.Duration("read-timeout", defaultReadTimeout, "treat subscribers which send no command for this long as disconnected, NACKing their messages, 0 disables")
+		tcpKeepalive  = flag.Duration("tcp-keepalive", defaultTCPKeepalive, "period between TCP keepalive probes on client connections, 0 keeps the default")
+		writeTimeout  = flag.Duration("write-timeout", defaultWriteTimeout, "close subscribe connections whose writes block for longer than this, NACKing their messages, 0 disables")
+		storeFull     = flag.String("store-full", defaultStoreFull, "what happens to publishes when the store is out of space (reject|shed), shed discards the oldest messages to make room")
+		requireSub    = flag.Bool("require-subscriber", defaultRequireSub, "drop messages published to topics with no subscribers, rather than storing them")
+		follow        = flag.String("follow", defaultFollow, "URL of a primary to follow as a read-only replica, rejecting writes")
+		followCA      = flag.String("follow-ca", defaultFollowCA, "path to a CA certificate used to verify the primary, the system roots if unset")
+		ackReplicas   = flag.Int("ack-replicas", defaultAckReplicas, "acknowledge publishes once applied by this many followers, responding 503 if they haven't within -ack-replicas-timeout, 0 doesn't wait")
+		replicaWait   = flag.Duration("ack-replicas-timeout", defaultReplicaWait, "how long a publish waits for -ack-replicas followers to apply it")
+		peers         = flag.String("peers", defaultPeers, "comma separated URLs of peers whose messages are streamed alongside this instance's to subscribers adding ?federate=true")
+		peersCA       = flag.String("peers-ca", defaultPeersCA, "path to a CA certificate used to verify peers, the system roots if unset")
+		handshake     = flag.Duration("handshake-timeout", defaultHandshake, "require subscribers to send a protocol hello within this before any command, 0 disables")
+		encryptKey    = flag.String("encryption-key", defaultEncryptKey, "path to a file holding a hex encoded AES key (16, 24 or 32 bytes) used to encrypt stored messages, unset disables")
 	)
 
 	flag.Parse()
 
+	declared, err := loadConfig(flag.CommandLine, os.Getenv)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid config")
+	}
+
+	if *configPath != "" {
+		log.Info().Str("path", *configPath).Msg("loaded config file")
+	}
+
 	if *humanReadable {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	}
@@ -47,6 +165,16 @@ func main() {
 		log.Fatal().Msg("invalid log level, see -h")
 	}
 
+	switch syncPolicy(*syncPol) {
+	case syncNone, syncAlways:
+	case syncPeriodic:
+		if *syncInterval <= 0 {
+			log.Fatal().Msg("sync interval must be positive, see -h")
+		}
+	default:
+		log.Fatal().Msg("invalid sync policy, see -h")
+	}
+
 	if *dbPath == defaultDBPath {
 		log.Warn().
 			Msgf("no DB path specified, using default %s", defaultDBPath)
@@ -62,18 +190,253 @@ func main() {
 			Msgf("no TLS key path specified, using default %s", defaultKeyPath)
 	}
 
-	srv := newServer(newBroker(newStore(*dbPath)))
+	bo := backoff{
+		base:   *backoffBase,
+		max:    *backoffMax,
+		jitter: *backoffJitter,
+	}
 
-	// Start the server
+	disconnect, err := parseDisconnectPolicy(*onDisconnect)
+	if err != nil {
+		log.Fatal().Msg("invalid disconnect policy, see -h")
+	}
+
+	storeFullPol, err := parseStoreFullPolicy(*storeFull)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid store full policy, see -h")
+	}
+
+	if *ackReplicas < 0 || (*ackReplicas > 0 && (*follow != "" || *replicaWait <= 0)) {
+		log.Fatal().Msg("ack replicas must be used on a primary with a positive ack timeout, see -h")
+	}
+
+	// Take over the socket of a previous process before waiting on its store, so
+	// that connections queue rather than being refused
 	p := fmt.Sprintf(":%d", *port)
 
+	ln, inherited, err := listen(p, os.Getenv)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to listen")
+	}
+
+	var storeWait time.Duration
+	if inherited {
+		log.Info().
+			Str("addr", ln.Addr().String()).
+			Msg("inherited listener, waiting for previous process to release the store")
+
+		storeWait = *drainTimeout
+	}
+
+	s, err := openStoreRetry(
+		*dbPath,
+		storeWait,
+		withSyncPolicy(syncPolicy(*syncPol), *syncInterval),
+		withHeadCache(*cacheSize),
+		withRetention(*retentionDur, *retentionMax),
+		withReplayLog(*replayDur, *replayMax),
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open store")
+	}
+
+	var replication *replicatedStore
+	if *follow == "" {
+		if replication, err = newReplicatedStore(s); err != nil {
+			log.Fatal().Err(err).Msg("failed to replicate store")
+		}
+
+		s = replication
+	} else {
+		// A follower's store only changes through replication, so nothing
+		// which modifies it runs
+		*maxAge = 0
+		*sweepInterval = 0
+		*redriveDelay = 0
+	}
+
+	ids, err := newIDGenerator(idScheme(*idSch), s)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid id scheme")
+	}
+
+	notifyNets, err := parseNetworks(*notifyAllow)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid notify networks")
+	}
+
+	brokerOpts := []brokerOption{
+		withIDGenerator(ids),
+		withBackoff(bo),
+		withNotifyAllow(notifyNets),
+		withMaxAge(*maxAge, *sweepInterval),
+		withExpiredTopic(*expiredTopic),
+		withAckTimeout(*ackTimeout, *maxAckTimeout),
+		withConfirmWindow(*confirmWindow),
+		withRequireSubscriber(*requireSub),
+		withDisconnectPolicy(disconnect),
+		withStoreFullPolicy(storeFullPol),
+		withMaxSkew(*maxSkew),
+		withMaxInFlight(*maxInFlight),
+		withDeadLetter(*dlqDeliveries),
+		withDeadLetterAlert(*dlqAlert),
+		withRedrive(*redriveDelay, *maxRedrives),
+		withMaxDelayed(*topicDelayed, *maxDelayed),
+		withWriteBatching(*batchWindow, *batchMax),
+	}
+
+	if *encryptKey != "" {
+		aead, err := loadCipher(*encryptKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid encryption key")
+		}
+
+		brokerOpts = append(brokerOpts, withEncryption(aead))
+	}
+
+	b := newBroker(s, brokerOpts...)
+
+	if err := b.LoadTopicConfigs(); err != nil {
+		log.Fatal().Err(err).Msg("failed to load topic configs")
+	}
+
+	if *topicsFile != "" {
+		topics, err := loadTopicsFile(*topicsFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid topics file")
+		}
+
+		// Topics in the topics file take precedence over the config file
+		if declared == nil {
+			declared = map[string]topicConfig{}
+		}
+
+		for topic, cfg := range topics {
+			declared[topic] = cfg
+		}
+	}
+
+	if len(declared) > 0 && *follow == "" {
+		if err := b.DeclareTopics(declared); err != nil {
+			log.Fatal().Err(err).Msg("failed to declare topics")
+		}
+	}
+
+	srvOpts := []serverOption{
+		withSubscribeLimit(*maxSubs, *maxTopicSubs),
+		withKeepalive(*keepalive),
+		withConnectionCap(*connCap),
+		withFlushThreshold(*flushBytes, *flushWrites),
+		withWriteTimeout(*writeTimeout),
+		withReadTimeout(*readTimeout),
+		withTCPKeepalive(*tcpKeepalive),
+		withHandshake(*handshake),
+	}
+
+	ctx, stopFollowing := context.WithCancel(context.Background())
+	defer stopFollowing()
+
+	if *follow == "" {
+		if err := b.Recover(); err != nil {
+			log.Fatal().Err(err).Msg("failed to recover store")
+		}
+
+		srvOpts = append(srvOpts, withReplication(replication), withAckReplicas(*ackReplicas, *replicaWait))
+	} else {
+		client, err := newFollowClient(*followCA)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid follow CA")
+		}
+
+		f, err := newFollower(b, *follow, client)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to follow primary")
+		}
+
+		log.Info().Str("primary", *follow).Msg("following primary as a read-only replica")
+
+		go f.run(ctx)
+
+		srvOpts = append(srvOpts, withFollower(*follow))
+	}
+
+	if *peers != "" {
+		client, err := newFollowClient(*peersCA)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid peers CA")
+		}
+
+		srvOpts = append(srvOpts, withPeers(strings.Split(*peers, ","), client))
+	}
+
+	srv := newServer(b, srvOpts...)
+
+	// Start the server
 	log.Info().
 		Str("port", p).
 		Msg("starting miniqueue")
 
-	if err := http.ListenAndServeTLS(p, *tlsCertPath, *tlsKeyPath, srv); !errors.Is(err, http.ErrServerClosed) {
+	certs, err := newTLSReloader(*tlsCertPath, *tlsKeyPath, *clientCA)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load TLS config")
+	}
+
+	// Renewed certificates are picked up on SIGHUP, without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go certs.reloadOn(hup)
+
+	httpSrv := &http.Server{
+		Addr:        p,
+		Handler:     srv,
+		TLSConfig:   certs.Config(),
+		ConnState:   srv.ConnState,
+		ConnContext: srv.ConnContext,
+	}
+
+	// Drain connections on shutdown, allowing a restarted process to take over,
+	// while consumers resolve the messages they hold
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+
+		log.Info().Msg("shutting down, draining connections")
+
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- httpSrv.Shutdown(ctx)
+		}()
+
+		// Messages still outstanding once ctx is done are returned to their
+		// topics, before the store is closed
+		if err := srv.Stop(ctx); err != nil {
+			log.Err(err).Msg("failed to stop delivering messages")
+		}
+
+		if err := <-shutdown; err != nil {
+			log.Err(err).Msg("failed to drain connections")
+		}
+	}()
+
+	// The certificate and key are served from the TLS config
+	if err := httpSrv.ServeTLS(srv.Listener(ln), "", ""); !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal().
 			Err(err).
 			Msg("server closed")
 	}
+
+	<-drained
+
+	stopFollowing()
+
+	if err := b.Shutdown(); err != nil {
+		log.Err(err).Msg("failed to shut down broker")
+	}
 }
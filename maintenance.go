@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// maintenance is a server wide flag which, when set, rejects publishes while
+// still allowing existing messages to be consumed.
+type maintenance struct {
+	on int32
+}
+
+func (m *maintenance) set(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+
+	atomic.StoreInt32(&m.on, v)
+}
+
+func (m *maintenance) enabled() bool {
+	return atomic.LoadInt32(&m.on) == 1
+}
+
+// rejectDuringMaintenance responds with 503 to requests while the server is in
+// maintenance mode.
+func rejectDuringMaintenance(m *maintenance, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.enabled() {
+			log := log.With().
+				Str("handler", "publish").
+				Str("topic", mux.Vars(r)[topicVarKey]).
+				Logger()
+
+			log.Debug().Msg("rejecting publish during maintenance")
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+			respondError(log, json.NewEncoder(w), errMaintenance.Error())
+
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// setMaintenance enables or disables maintenance mode.
+func setMaintenance(m *maintenance, on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "set_maintenance").
+			Logger()
+
+		m.set(on)
+
+		log.Info().
+			Bool("maintenance", on).
+			Msg("set maintenance mode")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
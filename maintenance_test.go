@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerMaintenance(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	msg := "test_msg"
+	res := helperPublishMessage(t, srv, defaultTopic, msg)
+	defer res.Body.Close()
+
+	helperMaintenance(t, srv, http.MethodPost)
+
+	// Publishes are rejected
+	publishPath := fmt.Sprintf("%s/publish/%s", srv.URL, defaultTopic)
+	req, err := http.NewRequest(http.MethodPost, publishPath, strings.NewReader("rejected_msg"))
+	assert.NoError(err)
+
+	res, err = srv.Client().Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusServiceUnavailable, res.StatusCode)
+
+	// Pending messages are still delivered
+	encoder, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(msg, out.Msg)
+	assert.NoError(encoder.Encode(CmdAck))
+
+	// Clearing maintenance restores publishing
+	helperMaintenance(t, srv, http.MethodDelete)
+
+	res = helperPublishMessage(t, srv, defaultTopic, "test_msg_2")
+	defer res.Body.Close()
+
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal("test_msg_2", out.Msg)
+}
+
+func helperMaintenance(t *testing.T, srv *httptest.Server, method string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/maintenance", srv.URL), nil)
+	assert.NoError(t, err)
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
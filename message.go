@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxNackReasons is the number of NACK reasons kept with each message.
+const maxNackReasons = 5
+
+// messageMeta holds the metadata stored alongside each message, following the
+// message as it moves between the topic and the ack topic.
+type messageMeta struct {
+	// ID uniquely identifies the message.
+	ID string `json:"id"`
+	// Deliveries is the number of times the message has been delivered.
+	Deliveries int `json:"deliveries,omitempty"`
+	// Notify is the URL a receipt is sent to once the message is consumed.
+	Notify string `json:"notify,omitempty"`
+	// ContentType is the content type the message was published with.
+	ContentType string `json:"content_type,omitempty"`
+	// PublishedAt is the time the message was published.
+	PublishedAt time.Time `json:"published_at"`
+	// ReplyTo is the topic a consumer's result is published to when it ACKs
+	// the message.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// InReplyTo is the ID of the message this message is the result of.
+	InReplyTo string `json:"in_reply_to,omitempty"`
+	// NackReasons holds the reasons the message was last NACKed for, oldest
+	// first, up to maxNackReasons.
+	NackReasons []string `json:"nack_reasons,omitempty"`
+	// DeliverBy is the time after which the message is dropped rather than
+	// delivered. Zero never drops the message.
+	DeliverBy time.Time `json:"deliver_by,omitempty"`
+	// TTL is how long after it is published the message expires. It brings
+	// DeliverBy forward once the message is published, and is not stored.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Key is the compaction key of the message. It is only kept on topics with
+	// compaction enabled.
+	Key string `json:"key,omitempty"`
+	// PartitionKey decides the partition of a partitioned topic the message is
+	// stored in, such that messages with the same key are consumed in order.
+	// It defaults to Key.
+	PartitionKey string `json:"partition_key,omitempty"`
+	// DeadLetterSource is the topic the message was last dead-lettered from.
+	DeadLetterSource string `json:"dead_letter_source,omitempty"`
+	// DeadLetteredAt is the time the message was last dead-lettered.
+	DeadLetteredAt time.Time `json:"dead_lettered_at,omitempty"`
+	// DeadLetterDeliveries is the number of times the message had been
+	// delivered when it was last dead-lettered.
+	DeadLetterDeliveries int `json:"dead_letter_deliveries,omitempty"`
+	// Redrives is the number of times the message has been returned to its
+	// topic after being dead-lettered.
+	Redrives int `json:"redrives,omitempty"`
+	// Offset is the position of the message in the log of its topic, counting
+	// up from 0 as messages are published to the topic.
+	Offset int `json:"offset"`
+	// Priority is the priority of the message, from 0 up to maxPriority.
+	// Messages with a higher priority are consumed first.
+	Priority int `json:"priority,omitempty"`
+	// Headers holds the headers the message was published with under
+	// headerPrefix, keyed by their name without the prefix.
+	Headers map[string]string `json:"headers,omitempty"`
+	// BodySize is the size of a value larger than streamThreshold, whose body
+	// is stored in chunks apart from the message, and read back through the
+	// Reader of the store. Zero for values stored whole.
+	BodySize int `json:"body_size,omitempty"`
+
+	// Header holds the headers the message was published with. It is only
+	// available while publishing, and is not stored.
+	Header http.Header `json:"-"`
+
+	// Replayed is set on messages read from the log of their topic, rather
+	// than consumed. It is only set on delivery, and is not stored.
+	Replayed bool `json:"-"`
+
+	// Seq is the sequence number of the delivery to the consumer, counting up
+	// from 1 on each consumer. It is only set on delivery, and is not stored.
+	Seq int `json:"-"`
+}
+
+// pendingMessage is a message waiting to be consumed on a topic.
+type pendingMessage struct {
+	val  value
+	meta messageMeta
+}
+
+// userHeaders returns the headers under headerPrefix, keyed by their name
+// without the prefix, or nil if there are none. Only the first value of each
+// header is kept.
+func userHeaders(h http.Header) map[string]string {
+	var headers map[string]string
+	for name, vals := range h {
+		name = http.CanonicalHeaderKey(name)
+		if !strings.HasPrefix(name, headerPrefix) || len(name) == len(headerPrefix) || len(vals) == 0 {
+			continue
+		}
+
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers[strings.TrimPrefix(name, headerPrefix)] = vals[0]
+	}
+
+	return headers
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// recoverPanics recovers from a panicking handler, responding 500 to its
+// request rather than taking down the server.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			// Deliberately aborted by the handler, left to the http.Server
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			log := log.With().
+				Str("request_id", xid.New().String()).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Logger()
+
+			logPanic(log, rec)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errInternal.Error())
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logPanic logs the value recovered from a panicking handler, along with the
+// stack of the panic.
+func logPanic(log zerolog.Logger, rec interface{}) {
+	log.Error().
+		Interface("panic", rec).
+		Bytes("stack", debug.Stack()).
+		Msg("recovered from panicking handler")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockbrokerer(ctrl)
+	gomock.InOrder(
+		mockBroker.EXPECT().Topics(gomock.Any()).DoAndReturn(func(topicFilter) ([]topicStats, error) {
+			var stats map[string]topicStats
+			stats["test_topic"] = topicStats{}
+
+			return nil, nil
+		}),
+		mockBroker.EXPECT().Topics(gomock.Any()).Return([]topicStats{{Topic: defaultTopic}}, nil),
+	)
+
+	srv := newServer(mockBroker)
+
+	rec := NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/topics", nil))
+
+	assert.Equal(http.StatusInternalServerError, rec.Code)
+	assert.Equal("application/json", rec.Header().Get("Content-Type"))
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal(errInternal.Error(), out.Error)
+
+	// The server carries on serving
+	rec = NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/topics", nil))
+
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var stats []topicStats
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&stats))
+	assert.Equal([]topicStats{{Topic: defaultTopic}}, stats)
+}
+
+func TestRecoverPanics_Subscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	panicked := false
+	b := newBroker(helperNewMemStore(t), withDeliveryInterceptor(func(topic string, msg message) message {
+		if !panicked {
+			panicked = true
+			panic("test_panic")
+		}
+
+		return msg
+	}))
+
+	srv := httptest.NewUnstartedServer(newServer(b))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	// The stream ends with an error, rather than the server
+	res := helperSubscribeRaw(t, srv, defaultTopic)
+	defer res.Body.Close()
+
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal(errInternal.Error(), out.Error)
+
+	_, err = ioutil.ReadAll(res.Body)
+	assert.NoError(err)
+	assert.Equal(streamStatusError, res.Trailer.Get(trailerStreamStatus))
+
+	// And the message delivered when it panicked is returned to the topic, to
+	// be delivered to the next subscriber
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	res = helperSubscribeRaw(t, srv, defaultTopic)
+	defer res.Body.Close()
+
+	assert.NoError(json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal("test_value", out.Msg)
+}
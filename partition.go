@@ -0,0 +1,473 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// partitionPrefix names the partitions of a partitioned topic, each stored as
+// the topic <topic>/partition-<n>. Named groups may not start with it.
+const partitionPrefix = "partition-"
+
+// partitionTopic returns the topic the partition p of the topic is stored as.
+func partitionTopic(topic string, p int) string {
+	return groupTopic(topic, partitionPrefix+strconv.Itoa(p))
+}
+
+// splitPartitionTopic returns the topic and partition number of a partition
+// topic, or false if the topic isn't one.
+func splitPartitionTopic(t string) (topic string, p int, ok bool) {
+	i := strings.LastIndex(t, "/"+partitionPrefix)
+	if i < 0 {
+		return "", 0, false
+	}
+
+	p, err := strconv.Atoi(t[i+1+len(partitionPrefix):])
+	if err != nil || p < 0 {
+		return "", 0, false
+	}
+
+	return t[:i], p, true
+}
+
+// isPartitionGroup reports whether the group is named like a partition.
+func isPartitionGroup(group string) bool {
+	return strings.HasPrefix(group, partitionPrefix)
+}
+
+// partitionOf returns which of n partitions the message is stored in, by the
+// hash of its partition key. Messages without a key are spread by their ID.
+func partitionOf(meta messageMeta, n int) int {
+	key := meta.PartitionKey
+	if key == "" {
+		key = meta.ID
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(n))
+}
+
+// partitions returns the number of partitions of the topic, zero if it isn't
+// partitioned. A group topic is partitioned like the topic of its group,
+// except for the private group of a broadcast consumer, which has only the one
+// consumer.
+func (b *broker) partitions(topic string) int {
+	if _, _, ok := splitPartitionTopic(topic); ok {
+		return 0
+	}
+
+	if n := b.TopicConfig(topic).Partitions; n > 0 {
+		return n
+	}
+
+	parent, group, ok := splitGroupTopic(topic)
+	if !ok || isBroadcastGroup(group) {
+		return 0
+	}
+
+	return b.TopicConfig(parent).Partitions
+}
+
+// partitionedStore wraps a store, spreading the messages inserted into each
+// partitioned topic across its partitions by their partition key. Reading the
+// length or messages of a partitioned topic combines those of its partitions,
+// and listing topics lists the topic rather than its partitions.
+//
+// Messages waiting on the topic itself, published before it was partitioned,
+// are counted along with those of its partitions.
+type partitionedStore struct {
+	storer
+
+	partitions func(topic string) int
+}
+
+// route returns the partition of the topic the message is stored in, or the
+// topic itself if it isn't partitioned.
+func (s *partitionedStore) route(topic string, meta messageMeta) string {
+	n := s.partitions(topic)
+	if n == 0 {
+		return topic
+	}
+
+	return partitionTopic(topic, partitionOf(meta, n))
+}
+
+// topics returns the topic along with each of its partitions.
+func (s *partitionedStore) topics(topic string) []string {
+	topics := []string{topic}
+	for p := 0; p < s.partitions(topic); p++ {
+		topics = append(topics, partitionTopic(topic, p))
+	}
+
+	return topics
+}
+
+// Unwrap returns the wrapped store.
+func (s *partitionedStore) Unwrap() storer {
+	return s.storer
+}
+
+func (s *partitionedStore) Insert(topic string, val value, meta messageMeta) error {
+	return s.storer.Insert(s.route(topic, meta), val, meta)
+}
+
+func (s *partitionedStore) InsertAll(records []record) error {
+	return s.storer.InsertAll(s.routeAll(records))
+}
+
+// ReplaceAll discards the values waiting on each partition of the topics too.
+func (s *partitionedStore) ReplaceAll(topics []string, records []record) error {
+	var all []string
+	for _, t := range topics {
+		all = append(all, s.topics(t)...)
+	}
+
+	return s.storer.ReplaceAll(all, s.routeAll(records))
+}
+
+// routeAll returns the records routed to the partitions of their topics.
+func (s *partitionedStore) routeAll(records []record) []record {
+	routed := make([]record, 0, len(records))
+	for _, r := range records {
+		r.topic = s.route(r.topic, r.meta)
+		routed = append(routed, r)
+	}
+
+	return routed
+}
+
+func (s *partitionedStore) Len(topic string) (int, error) {
+	var total int
+	for _, t := range s.topics(topic) {
+		n, err := s.storer.Len(t)
+		if err != nil {
+			return 0, err
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
+
+// Peek returns the messages waiting on the topic followed by those of each
+// partition in turn. Messages are only ordered within their partition.
+func (s *partitionedStore) Peek(topic string, limit int) ([]pendingMessage, error) {
+	var msgs []pendingMessage
+	for _, t := range s.topics(topic) {
+		if len(msgs) >= limit {
+			break
+		}
+
+		peeked, err := s.storer.Peek(t, limit-len(msgs))
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, peeked...)
+	}
+
+	return msgs, nil
+}
+
+func (s *partitionedStore) Shed(topic string, n int) (int, error) {
+	var shed int
+	for _, t := range s.topics(topic) {
+		if shed >= n {
+			break
+		}
+
+		m, err := s.storer.Shed(t, n-shed)
+		if err != nil {
+			return shed, err
+		}
+
+		shed += m
+	}
+
+	return shed, nil
+}
+
+func (s *partitionedStore) ResetDeliveries(topic string) (int, error) {
+	var total int
+	for _, t := range s.topics(topic) {
+		n, err := s.storer.ResetDeliveries(t)
+		if err != nil {
+			return total, err
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
+
+func (s *partitionedStore) Iterate(topic string, fn func(val value, meta messageMeta) error) error {
+	for _, t := range s.topics(topic) {
+		if err := s.storer.Iterate(t, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Topics lists each partitioned topic once, in place of its partitions.
+func (s *partitionedStore) Topics() ([]string, error) {
+	stored, err := s.storer.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+
+	var topics []string
+	for _, t := range stored {
+		if topic, _, ok := splitPartitionTopic(t); ok {
+			t = topic
+		}
+
+		if !seen[t] {
+			seen[t] = true
+			topics = append(topics, t)
+		}
+	}
+
+	return topics, nil
+}
+
+// DeleteTopic deletes the topic along with every partition stored for it,
+// however many it is configured with now.
+func (s *partitionedStore) DeleteTopic(topic string) error {
+	if err := s.storer.DeleteTopic(topic); err != nil {
+		return err
+	}
+
+	stored, err := s.storer.Topics()
+	if err != nil {
+		return fmt.Errorf("listing topics: %v", err)
+	}
+
+	for _, t := range stored {
+		if parent, _, ok := splitPartitionTopic(t); !ok || parent != topic {
+			continue
+		}
+
+		if err := s.storer.DeleteTopic(t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// partitionAssigner assigns the partitions of partitioned topics to their
+// consumers. A consumer holds a partition while it has messages from it
+// outstanding, and no other consumer may take messages from it meanwhile, so
+// that messages with the same partition key are delivered one after another,
+// in order. Once released, a partition may be claimed by any consumer of the
+// topic, so partitions with messages waiting are consumed in parallel. The
+// zero value is ready to use.
+type partitionAssigner struct {
+	// owners holds the ID of the consumer holding each partition topic.
+	owners map[string]string
+
+	// blocked counts the messages of each partition topic waiting out a
+	// delay before they're returned to it. A blocked partition can't be
+	// consumed, so messages behind them aren't delivered first.
+	blocked map[string]int
+
+	// next is the partition of each topic the next claim starts from, so
+	// that partitions take turns.
+	next map[string]int
+
+	sync.Mutex
+}
+
+// claim claims a partition of the topic, of its n partitions, which has
+// messages waiting and isn't held by another consumer or blocked, returning
+// false if there is none.
+func (a *partitionAssigner) claim(s storer, topic, id string, n int) (string, bool, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.owners == nil {
+		a.owners = map[string]string{}
+		a.blocked = map[string]int{}
+		a.next = map[string]int{}
+	}
+
+	for i := 0; i < n; i++ {
+		p := (a.next[topic] + i) % n
+		t := partitionTopic(topic, p)
+
+		if _, held := a.owners[t]; held || a.blocked[t] > 0 {
+			continue
+		}
+
+		waiting, err := s.Len(t)
+		if err != nil {
+			return "", false, fmt.Errorf("getting length of partition %s: %v", t, err)
+		}
+		if waiting == 0 {
+			continue
+		}
+
+		a.owners[t] = id
+		a.next[topic] = (p + 1) % n
+
+		return t, true, nil
+	}
+
+	return "", false, nil
+}
+
+// release releases the partition, if it is held by the consumer.
+func (a *partitionAssigner) release(t, id string) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.owners[t] == id {
+		delete(a.owners, t)
+	}
+}
+
+// releaseAll releases every partition held by the consumer, returning the
+// number released.
+func (a *partitionAssigner) releaseAll(id string) int {
+	a.Lock()
+	defer a.Unlock()
+
+	var released int
+	for t, owner := range a.owners {
+		if owner == id {
+			delete(a.owners, t)
+			released++
+		}
+	}
+
+	return released
+}
+
+// block blocks the partition until the message waiting out a delay is
+// returned to it, and unblock is called.
+func (a *partitionAssigner) block(t string) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.blocked == nil {
+		a.blocked = map[string]int{}
+	}
+
+	a.blocked[t]++
+}
+
+func (a *partitionAssigner) unblock(t string) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.blocked[t]--; a.blocked[t] <= 0 {
+		delete(a.blocked, t)
+	}
+}
+
+func (a *partitionAssigner) isBlocked(t string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.blocked[t] > 0
+}
+
+// releasePartitions releases the partitions held by a consumer which has
+// unsubscribed, waking the other consumers of its topic to claim them.
+func (b *broker) releasePartitions(cons *consumer) {
+	for i := b.assigner.releaseAll(cons.id); i > 0; i-- {
+		b.NotifyConsumer(cons.topic, eventTypeNack)
+	}
+}
+
+// claimPartition claims a partition for the consumer to take its next message
+// from, if its topic is partitioned and it doesn't hold one already. Without
+// a partition to claim, the consumer reads the topic itself, which holds any
+// messages published before it was partitioned.
+func (c *consumer) claimPartition() error {
+	// A consumer keeps its partition while it has messages from it
+	// outstanding, waiting out any delayed NACK of them
+	if c.source != c.topic {
+		if c.assigner.isBlocked(c.source) {
+			return errNoMessages
+		}
+
+		return nil
+	}
+
+	n := c.partitions(c.topic)
+	if n == 0 {
+		return nil
+	}
+
+	t, ok, err := c.assigner.claim(c.store, c.topic, c.id, n)
+	if err != nil {
+		return err
+	}
+	if ok {
+		c.source = t
+	}
+
+	return nil
+}
+
+// releasePartition releases the partition held by the consumer once it has no
+// messages from it outstanding. Other consumers are woken to claim it if
+// notify is set.
+func (c *consumer) releasePartition(notify bool) {
+	if c.source == c.topic || len(c.outstanding) > 0 {
+		return
+	}
+
+	c.assigner.release(c.source, c.id)
+	c.source = c.topic
+
+	if notify {
+		c.notifier.NotifyConsumer(c.topic, eventTypeAck)
+	}
+}
+
+// getNext takes the next value waiting for the consumer from the store, from
+// the partition it holds if its topic is partitioned.
+func (c *consumer) getNext() (value, messageMeta, int, error) {
+	if err := c.claimPartition(); err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	val, meta, ao, err := c.store.GetNext(c.source)
+	if err != nil {
+		// Nothing is taken from the partition, so no other consumer is
+		// waiting on it
+		c.releasePartition(false)
+
+		return val, meta, ao, err
+	}
+
+	// Bodies are only left in the store for consumers which stream them
+	if meta.BodySize > 0 && !c.streamsBodies() {
+		if val, err = readBody(c.store, c.source, ao, val, &meta); err != nil {
+			if nackErr := c.store.Nack(c.source, ao); nackErr != nil {
+				log.Err(nackErr).Str("topic", c.source).Int("ack_offset", ao).Msg("failed to return unreadable message")
+			}
+
+			c.releasePartition(false)
+
+			return nil, messageMeta{}, 0, err
+		}
+	}
+
+	return val, meta, ao, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartition(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{Partitions: 2}))
+
+	// user-1 is stored in partition 0, user-2 in partition 1
+	for _, msg := range []string{"user-1:a", "user-2:a", "user-1:b", "user-1:c"} {
+		key := strings.Split(msg, ":")[0]
+
+		_, err := b.Publish(defaultTopic, value(msg), messageMeta{PartitionKey: key})
+		assert.NoError(err)
+	}
+
+	// The topic is listed in place of its partitions
+	stats, err := b.Topics(topicFilter{})
+	assert.NoError(err)
+	assert.Equal([]topicStats{{Topic: defaultTopic, Pending: 4}}, stats)
+
+	c1 := b.Subscribe(defaultTopic)
+	c2 := b.Subscribe(defaultTopic)
+
+	next := func(c *consumer) string {
+		val, err := c.TryNext(context.Background())
+		if err == errNoMessages {
+			return ""
+		}
+		assert.NoError(err)
+
+		return string(val)
+	}
+
+	// Different keys are consumed in parallel, while the next message with
+	// the same key waits for the one outstanding
+	assert.Equal("user-1:a", next(c1))
+	assert.Equal("user-2:a", next(c2))
+
+	assert.NoError(c2.Ack())
+	assert.Equal("", next(c2))
+
+	// Once ACKed, any consumer may take the next message with the key
+	assert.NoError(c1.Ack())
+	assert.Equal("user-1:b", next(c2))
+	assert.Equal("", next(c1))
+
+	// A delayed NACK holds back the messages behind it with the same key
+	assert.NoError(c2.NackAfter([]string{c2.Meta().ID}, "", 50*time.Millisecond))
+	assert.Equal("", next(c1))
+
+	assert.Eventually(func() bool {
+		return !b.assigner.isBlocked(partitionTopic(defaultTopic, 0))
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal("user-1:b", next(c1))
+	assert.NoError(c1.Ack())
+	assert.Equal("user-1:c", next(c1))
+
+	// Unsubscribing releases the partitions held
+	b.Unsubscribe(c1)
+	assert.Empty(b.assigner.owners)
+}
+
+func TestPartition_Recover(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+
+	// Left awaiting acknowledgement on the partitions of a group by a
+	// previous run
+	for _, topic := range []string{
+		partitionTopic(defaultTopic, 0),
+		partitionTopic(groupTopic(defaultTopic, "workers"), 1),
+	} {
+		assert.NoError(s.Insert(topic, value("msg_1"), messageMeta{}))
+
+		_, _, _, err := s.GetNext(topic)
+		assert.NoError(err)
+	}
+
+	b := newBroker(s)
+	assert.NoError(b.Recover())
+	assert.Equal(map[string]bool{"workers": true}, b.groups[defaultTopic])
+}
+
+func TestServerPublish_PartitionKey(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+	b := newBroker(s)
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{Partitions: 2}))
+
+	srv := newServer(b)
+
+	for _, key := range []string{headerPartitionKey, headerKey} {
+		req := httptest.NewRequest(http.MethodPost, "/publish/"+defaultTopic, strings.NewReader("msg"))
+		req.Header.Set(key, "user-2")
+
+		rec := NewRecorder()
+		srv.ServeHTTP(rec, req)
+		assert.Equal(http.StatusCreated, rec.Code)
+	}
+
+	// Both are stored in the partition of user-2, the key falling back to
+	// X-MQ-Key
+	n, err := s.Len(partitionTopic(defaultTopic, 1))
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	rec := NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s?group=%s0", defaultTopic, partitionPrefix), nil))
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.Contains(rec.Body.String(), errReservedGroup.Error())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog"
+)
+
+// maxPrefetch is the largest prefetch window a consumer may request.
+const maxPrefetch = 1000
+
+// parsePrefetch validates the prefetch window requested by a consumer on INIT.
+// A consumer replaying its topic holds a single message at a time, so may not
+// request a window.
+func parsePrefetch(n int, from json.RawMessage) (int, error) {
+	if n < 1 || n > maxPrefetch {
+		return 0, errInvalidPrefetch
+	}
+
+	if len(from) > 0 {
+		return 0, errPrefetchReplay
+	}
+
+	return n, nil
+}
+
+// Outstanding returns the number of values delivered to the consumer which
+// await an ACK or NACK.
+func (c *consumer) Outstanding() int {
+	return len(c.outstanding)
+}
+
+// fillWindow sends messages to the consumer without waiting, until it holds
+// prefetch outstanding or the topic runs out. It reports whether the stream
+// may carry on.
+func fillWindow(ctx context.Context, log zerolog.Logger, w http.ResponseWriter, fw *flushWriter, enc *json.Encoder, cons *consumer, prefetch int) bool {
+	for cons.Outstanding() < prefetch {
+		msg, err := cons.TryNext(ctx)
+		switch {
+		case errors.Is(err, errNoMessages), errors.Is(err, errShuttingDown):
+			return true
+		case errors.Is(err, errRequestCancelled):
+			log.Info().Msg("client disconnected while filling prefetch window")
+
+			return false
+		case err != nil:
+			log.Err(err).Msg("failed to get next value for topic")
+			respondError(log, enc, errNextValue.Error())
+			setStreamStatus(w, streamStatusError)
+
+			return false
+		}
+
+		if !respondDelivery(log, w, fw, enc, cons, msg) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribePrefetch(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+
+	for i := 1; i <= 5; i++ {
+		_, err := b.Publish(defaultTopic, []byte(fmt.Sprintf("test_value_%d", i)), messageMeta{})
+		assert.NoError(err)
+	}
+
+	conn := helperDialWebSocket(t, b, defaultTopic)
+
+	read := func() subResponse {
+		var res subResponse
+		assert.NoError(conn.ReadJSON(&res))
+		return res
+	}
+
+	// The window is filled without waiting for an ACK
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`{"cmd": "INIT", "prefetch": 3}`)))
+
+	first := read()
+	assert.Equal("test_value_1", first.Msg)
+	assert.Equal("test_value_2", read().Msg)
+	assert.Equal("test_value_3", read().Msg)
+
+	// Each ACK makes room for another message
+	assert.NoError(conn.WriteJSON(command{Cmd: CmdAck, IDs: []string{first.ID}}))
+	assert.Equal("test_value_4", read().Msg)
+
+	// Until the topic runs out, with messages still outstanding
+	assert.NoError(conn.WriteJSON(command{Cmd: CmdCommit, Seq: 4}))
+	last := read()
+	assert.Equal("test_value_5", last.Msg)
+
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`"STATUS"`)))
+	assert.Equal(signalStatus, read().Signal)
+
+	// Once the window is empty, the consumer waits for the next message
+	assert.NoError(conn.WriteJSON(command{Cmd: CmdAck, IDs: []string{last.ID}}))
+
+	_, err := b.Publish(defaultTopic, []byte("test_value_6"), messageMeta{})
+	assert.NoError(err)
+	assert.Equal("test_value_6", read().Msg)
+}
+
+func TestSubscribePrefetch_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		init string
+		err  serverError
+	}{
+		{name: "negative", init: `{"cmd": "INIT", "prefetch": -1}`, err: errInvalidPrefetch},
+		{name: "too large", init: `{"cmd": "INIT", "prefetch": 1001}`, err: errInvalidPrefetch},
+		{name: "replay", init: `{"cmd": "INIT", "prefetch": 2, "from": "earliest"}`, err: errPrefetchReplay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			conn := helperDialWebSocket(t, newBroker(helperNewMemStore(t)), defaultTopic)
+			assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(tt.init)))
+
+			var res subResponse
+			assert.NoError(conn.ReadJSON(&res))
+			assert.Equal(tt.err.Error(), res.Error)
+
+			var cmd command
+			assert.NoError(json.Unmarshal([]byte(tt.init), &cmd))
+			_, err := parsePrefetch(cmd.Prefetch, cmd.From)
+			assert.Equal(tt.err, err)
+		})
+	}
+}
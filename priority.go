@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// priorityQueryKey is the publish query parameter giving the priority of
+	// the message, from 0 up to maxPriority.
+	priorityQueryKey = "priority"
+
+	// maxPriority is the highest priority a message may be published with.
+	// Messages are published with the lowest priority, 0, by default.
+	maxPriority = 9
+)
+
+// parsePriority parses the priority of a published message.
+func parsePriority(raw string) (int, error) {
+	p, err := strconv.Atoi(raw)
+	if err != nil || !validPriority(p) {
+		return 0, errInvalidPriority
+	}
+
+	return p, nil
+}
+
+func validPriority(p int) bool {
+	return p >= 0 && p <= maxPriority
+}
+
+// prioritise moves the value at offset, waiting on the topic, ahead of the
+// values before it with a lower priority, or behind the values after it with a
+// higher priority, shifting each value it passes by one into its place. The
+// new offset of the value is returned.
+//
+// Keeping each value in place by priority as it is inserted or returned to the
+// topic keeps the topic ordered by priority, highest first, with values of the
+// same priority in the order they were published. Values are consumed from
+// the head in that order, without consumers having to search for the next.
+func prioritise(db readWriter, topic string, offset int) (int, error) {
+	head, err := getPos(db, headPosKeyFmt, topic)
+	if err != nil {
+		return 0, err
+	}
+
+	tail, err := getPos(db, tailPosKeyFmt, topic)
+	if err != nil {
+		return 0, err
+	}
+
+	val, err := db.Get([]byte(fmt.Sprintf(topicFmt, topic, offset)), nil)
+	if err != nil {
+		return 0, fmt.Errorf("getting value at offset %d: %v", offset, err)
+	}
+
+	meta, err := getMeta(db, metaFmt, topic, offset)
+	if err != nil {
+		return 0, err
+	}
+
+	// The value moves towards the tail past those with a higher priority,
+	// unless the value before it has a lower priority, in which case it moves
+	// towards the head past those instead
+	step := 1
+	passes := func(m messageMeta) bool { return m.Priority > meta.Priority }
+
+	if offset > head {
+		prev, err := getMeta(db, metaFmt, topic, offset-1)
+		if err != nil {
+			return 0, err
+		}
+
+		if prev.Priority < meta.Priority {
+			step = -1
+			passes = func(m messageMeta) bool { return m.Priority < meta.Priority }
+		}
+	}
+
+	to := offset
+	for next := to + step; next >= head && next < tail; next += step {
+		m, err := getMeta(db, metaFmt, topic, next)
+		if err != nil {
+			return 0, err
+		}
+
+		if !passes(m) {
+			break
+		}
+
+		v, err := db.Get([]byte(fmt.Sprintf(topicFmt, topic, next)), nil)
+		if err != nil {
+			return 0, fmt.Errorf("getting value at offset %d: %v", next, err)
+		}
+
+		if err := putPending(db, topic, to, v, m); err != nil {
+			return 0, err
+		}
+
+		to = next
+	}
+
+	if to == offset {
+		return offset, nil
+	}
+
+	if err := putPending(db, topic, to, val, meta); err != nil {
+		return 0, err
+	}
+
+	return to, nil
+}
+
+// putPending puts the value waiting on the topic at offset, along with its
+// metadata, indexing its key.
+func putPending(db readWriter, topic string, offset int, val value, meta messageMeta) error {
+	if err := db.Put([]byte(fmt.Sprintf(topicFmt, topic, offset)), val, nil); err != nil {
+		return fmt.Errorf("putting value: %v", err)
+	}
+
+	if err := db.Put([]byte(fmt.Sprintf(metaFmt, topic, offset)), encodeMeta(meta), nil); err != nil {
+		return fmt.Errorf("putting meta: %v", err)
+	}
+
+	return indexKey(db, topic, meta.Key, offset)
+}
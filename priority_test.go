@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorePriority(t *testing.T) {
+	for _, size := range []int{0, 2} {
+		t.Run(fmt.Sprintf("cache_%d", size), func(t *testing.T) {
+			assert := assert.New(t)
+
+			s := newStore(tmpDBPath, withHeadCache(size)).(*store)
+			t.Cleanup(s.Destroy)
+
+			next := func() (string, int) {
+				val, _, offset, err := s.GetNext(defaultTopic)
+				assert.NoError(err)
+				return string(val), offset
+			}
+
+			assert.NoError(s.Insert(defaultTopic, []byte("msg_1"), messageMeta{Priority: 5}))
+			_, outstanding := next()
+
+			for _, m := range []struct {
+				val      string
+				priority int
+			}{
+				{"msg_2", 0},
+				{"msg_3", 5},
+				{"msg_4", 9},
+				{"msg_5", 0},
+				{"msg_6", 5},
+			} {
+				assert.NoError(s.Insert(defaultTopic, []byte(m.val), messageMeta{Priority: m.priority}))
+			}
+
+			// The NACKed value returns to the front of those with the same
+			// priority
+			assert.NoError(s.Nack(defaultTopic, outstanding))
+
+			var got []string
+			for range []int{1, 2, 3, 4, 5, 6} {
+				val, _ := next()
+				got = append(got, val)
+			}
+
+			assert.Equal([]string{"msg_4", "msg_1", "msg_3", "msg_6", "msg_2", "msg_5"}, got)
+		})
+	}
+}
+
+func TestStorePriority_Compacted(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+
+	assert.NoError(s.Insert(defaultTopic, []byte("msg_1"), messageMeta{Key: "test_key"}))
+	assert.NoError(s.Insert(defaultTopic, []byte("msg_2"), messageMeta{Priority: 1}))
+
+	// The value with the key is replaced where it moved to
+	assert.NoError(s.Insert(defaultTopic, []byte("msg_3"), messageMeta{Key: "test_key"}))
+
+	msgs, err := s.Peek(defaultTopic, 10)
+	assert.NoError(err)
+
+	var got []string
+	for _, m := range msgs {
+		got = append(got, string(m.val))
+	}
+
+	assert.Equal([]string{"msg_2", "msg_3"}, got)
+}
+
+func TestPublishPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	srv := newServer(b)
+
+	publish := func(msg, priority string) int {
+		rec := NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/publish/"+defaultTopic+"?priority="+priority, strings.NewReader(msg)))
+		return rec.Code
+	}
+
+	assert.Equal(http.StatusCreated, publish("msg_1", "0"))
+	assert.Equal(http.StatusCreated, publish("msg_2", "9"))
+
+	for _, p := range []string{"-1", "10", "high"} {
+		assert.Equal(http.StatusBadRequest, publish("msg_3", p))
+	}
+
+	c := b.Subscribe(defaultTopic)
+
+	val, err := c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("msg_2"), val)
+	assert.Equal(9, c.Meta().Priority)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// processingBuckets are the upper bounds of the processing time histogram
+// buckets, in the style of Prometheus.
+var processingBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// histogram counts observations into fixed buckets. It is not safe for
+// concurrent use.
+type histogram struct {
+	bounds []time.Duration
+	counts []int
+	count  int
+	sum    time.Duration
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]int, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.count++
+	h.sum += d
+
+	// Observations above the largest bound only count towards the total
+	if i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] }); i < len(h.bounds) {
+		h.counts[i]++
+	}
+}
+
+// histogramSnapshot is a histogram at a point in time. Bucket counts are
+// cumulative, such that each counts the observations less than or equal to
+// its bound.
+type histogramSnapshot struct {
+	Count      int               `json:"count"`
+	SumSeconds float64           `json:"sum_seconds"`
+	Buckets    []histogramBucket `json:"buckets"`
+}
+
+type histogramBucket struct {
+	LE    float64 `json:"le"`
+	Count int     `json:"count"`
+}
+
+func (h *histogram) snapshot() histogramSnapshot {
+	s := histogramSnapshot{
+		Count:      h.count,
+		SumSeconds: h.sum.Seconds(),
+		Buckets:    make([]histogramBucket, len(h.bounds)),
+	}
+
+	var cumulative int
+	for i, b := range h.bounds {
+		cumulative += h.counts[i]
+		s.Buckets[i] = histogramBucket{LE: b.Seconds(), Count: cumulative}
+	}
+
+	return s
+}
+
+// processingTimes records how long each topic's messages take to process,
+// from their delivery to a consumer until it ACKs them. NACKed messages are
+// not recorded. The zero value is ready to use.
+type processingTimes struct {
+	topics map[string]*histogram
+	sync.Mutex
+}
+
+func (p *processingTimes) observe(topic string, d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.topics == nil {
+		p.topics = map[string]*histogram{}
+	}
+
+	h, ok := p.topics[topic]
+	if !ok {
+		h = newHistogram(processingBuckets)
+		p.topics[topic] = h
+	}
+
+	h.observe(d)
+}
+
+func (p *processingTimes) snapshot(topic string) histogramSnapshot {
+	p.Lock()
+	defer p.Unlock()
+
+	h, ok := p.topics[topic]
+	if !ok {
+		return newHistogram(processingBuckets).snapshot()
+	}
+
+	return h.snapshot()
+}
+
+// ProcessingTime returns the histogram of the time taken to process the
+// messages of the topic, from delivery to ACK.
+func (b *broker) ProcessingTime(topic string) histogramSnapshot {
+	return b.processing.snapshot(topic)
+}
+
+// processed records the time taken to process a delivery which has been ACKed.
+func (c *consumer) processed(d *delivery) {
+	took := c.now().Sub(d.at)
+
+	c.processing.observe(c.topic, took)
+	c.hooks.processed(c.topic, d.meta.ID, c.id, took)
+}
+
+// getProcessingTime returns the processing time histogram of the topic.
+func getProcessingTime(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "get_processing_time").
+			Logger()
+
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(broker.ProcessingTime(topic)); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestProcessingTime(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Now()
+
+	var observed []time.Duration
+	b := newBroker(&store{db: db},
+		withClock(func() time.Time { return now }),
+		withOnProcessed(func(topic, id, consumerID string, took time.Duration) {
+			observed = append(observed, took)
+		}),
+	)
+
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+
+	// NACKed messages aren't recorded
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	now = now.Add(time.Second)
+	assert.NoError(c.Nack())
+
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	now = now.Add(200 * time.Millisecond)
+	assert.NoError(c.Ack())
+
+	assert.Equal([]time.Duration{200 * time.Millisecond}, observed)
+
+	snap := b.ProcessingTime(defaultTopic)
+	assert.Equal(1, snap.Count)
+	assert.InDelta(0.2, snap.SumSeconds, 1e-9)
+
+	for _, bucket := range snap.Buckets {
+		if bucket.LE < 0.2 {
+			assert.Zero(bucket.Count, bucket.LE)
+		} else {
+			assert.Equal(1, bucket.Count, bucket.LE)
+		}
+	}
+
+	// Other topics are unaffected
+	assert.Zero(b.ProcessingTime("other").Count)
+}
+
+func TestHistogram(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHistogram([]time.Duration{time.Second, 2 * time.Second})
+	for _, d := range []time.Duration{500 * time.Millisecond, time.Second, 1500 * time.Millisecond, time.Minute} {
+		h.observe(d)
+	}
+
+	assert.Equal(histogramSnapshot{
+		Count:      4,
+		SumSeconds: 63,
+		Buckets: []histogramBucket{
+			{LE: 1, Count: 2},
+			{LE: 2, Count: 3},
+		},
+	}, h.snapshot())
+}
+
+func TestGetProcessingTime(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	b.processing.observe(defaultTopic, 30*time.Millisecond)
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/topics/%s/processing-time", defaultTopic), nil)
+	newServer(b).ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var res histogramSnapshot
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(1, res.Count)
+	assert.Len(res.Buckets, len(processingBuckets))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// batchMessage is a message published as part of a batch.
+type batchMessage struct {
+	Msg         string `json:"msg"`
+	ContentType string `json:"content_type,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Priority    int    `json:"priority,omitempty"`
+}
+
+// batchResult is the outcome of publishing a message of a batch, either the ID
+// it was published with, or the reason it was rejected.
+type batchResult struct {
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// PublishBatch publishes the messages to the topic in a single write. Unlike a
+// transaction, each message is checked against the topic on its own, such that
+// a rejected message doesn't hold back the rest of the batch. The ID of each
+// published message, or the error it was rejected with, is returned in the
+// order given. An error is only returned if the batch couldn't be written.
+func (b *broker) PublishBatch(topic string, msgs []pendingMessage) ([]string, []error, error) {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	var records []record
+	counts := map[string]int{}
+	ids := make([]string, len(msgs))
+	errs := make([]error, len(msgs))
+
+	for i, msg := range msgs {
+		if err := b.checkSkew(msg.meta); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		meta, topics, err := b.prepare(topic, msg.val, msg.meta)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		// Messages are counted against the topics as if published in turn
+		next := map[string]int{}
+		for _, t := range topics {
+			next[t]++
+		}
+		for t, n := range counts {
+			next[t] += n
+		}
+		if err := b.checkLengths(next); err != nil {
+			errs[i] = err
+			continue
+		}
+		counts = next
+
+		for _, t := range topics {
+			records = append(records, record{topic: t, value: msg.val, meta: b.topicMeta(t, meta)})
+		}
+
+		ids[i] = meta.ID
+	}
+
+	if len(records) == 0 {
+		return ids, errs, nil
+	}
+
+	err := b.withSpace(func() error {
+		return b.store.InsertAll(records)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, r := range records {
+		b.hooks.publish(r.topic, r.meta.ID)
+		b.throughput.published(r.topic)
+		b.taps.emit(r.topic, tapPublish, r.value, r.meta, "", r.meta.PublishedAt)
+		b.NotifyConsumer(r.topic, eventTypePublish)
+	}
+
+	for t := range counts {
+		b.checkBacklog(t)
+	}
+
+	return ids, errs, nil
+}
+
+// decodeBatch decodes the messages of a batch, given either as a JSON array or
+// as one JSON message per line.
+func decodeBatch(r io.Reader) ([]batchMessage, error) {
+	br := bufio.NewReader(r)
+
+	var first byte
+	for {
+		b, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			first = b
+			break
+		}
+	}
+
+	if err := br.UnreadByte(); err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(br)
+
+	if first == '[' {
+		var msgs []batchMessage
+		if err := dec.Decode(&msgs); err != nil {
+			return nil, err
+		}
+
+		return msgs, nil
+	}
+
+	var msgs []batchMessage
+	for {
+		var m batchMessage
+		err := dec.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, m)
+	}
+}
+
+// batchError returns the error reported to the producer for a message of a
+// batch which was rejected.
+func batchError(err error) string {
+	switch {
+	case errors.Is(err, errUnsupportedContentType):
+		return errContentType.Error()
+	case errors.Is(err, errNoSubscribers), errors.Is(err, errNoRoute):
+		return err.Error()
+	case errors.Is(err, errInvalidTimestamp), errors.Is(err, errTimestampSkew):
+		return err.Error()
+	case errors.Is(err, errTopicFull):
+		return errTopicFullPublish.Error()
+	default:
+		return errPublish.Error()
+	}
+}
+
+// publishBatch publishes the messages in the request body to the topic in a
+// single write, responding with the result of each message.
+func publishBatch(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "publish_batch").
+			Logger()
+
+		topic, ok := mux.Vars(r)[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		if rejectReservedTopic(log, w, topic) {
+			return
+		}
+
+		log = log.With().Str("topic", topic).Logger()
+
+		batch, err := decodeBatch(r.Body)
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to decode batch")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errDecodingBatch.Error())
+
+			return
+		}
+		defer r.Body.Close()
+
+		if len(batch) == 0 {
+			log.Debug().Msg("empty batch")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errEmptyBatch.Error())
+
+			return
+		}
+
+		msgs := make([]pendingMessage, 0, len(batch))
+		for _, m := range batch {
+			if !validPriority(m.Priority) {
+				log.Debug().Int("priority", m.Priority).Msg("invalid priority in batch")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidPriority.Error())
+
+				return
+			}
+
+			msgs = append(msgs, pendingMessage{
+				val: value(m.Msg),
+				meta: messageMeta{
+					ContentType: m.ContentType,
+					Key:         m.Key,
+					Priority:    m.Priority,
+					Header:      r.Header,
+				},
+			})
+		}
+
+		log.Info().Int("count", len(msgs)).Msg("publishing batch")
+
+		ids, errs, err := broker.PublishBatch(topic, msgs)
+		if errors.Is(err, errStoreFull) {
+			log.Error().Msg("store is out of space")
+
+			w.WriteHeader(http.StatusInsufficientStorage)
+			respondError(log, json.NewEncoder(w), errStoreFullPublish.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to publish batch")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errPublish.Error())
+
+			return
+		}
+
+		results := make([]batchResult, len(msgs))
+		var rejected int
+		for i := range results {
+			if errs[i] != nil {
+				results[i].Error = batchError(errs[i])
+				rejected++
+
+				continue
+			}
+
+			results[i].ID = ids[i]
+		}
+
+		// Some messages of the batch were rejected, the rest published
+		if rejected > 0 {
+			w.WriteHeader(http.StatusMultiStatus)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		respondPublishedBatch(log, json.NewEncoder(w), results)
+
+		log.Debug().
+			Int("published", len(msgs)-rejected).
+			Int("rejected", rejected).
+			Msg("successfully published batch")
+	}
+}
+
+func respondPublishedBatch(log zerolog.Logger, e *json.Encoder, results []batchResult) {
+	if err := e.Encode(batchResponse{Results: results}); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
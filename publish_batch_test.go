@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{MaxLength: 2}))
+
+	ids, errs, err := b.PublishBatch(defaultTopic, []pendingMessage{
+		{val: value("test_value_1")},
+		{val: value("test_value_2")},
+		{val: value("test_value_3")},
+	})
+	assert.NoError(err)
+	assert.Len(ids, 3)
+
+	// The message past the topic's max length is rejected alone
+	assert.NoError(errs[0])
+	assert.NoError(errs[1])
+	assert.Equal(errTopicFull, errs[2])
+	assert.Empty(ids[2])
+
+	msgs, err := b.store.Peek(defaultTopic, 10)
+	assert.NoError(err)
+	assert.Len(msgs, 2)
+	assert.Equal(value("test_value_1"), msgs[0].val)
+	assert.Equal(ids[0], msgs[0].meta.ID)
+	assert.Equal(value("test_value_2"), msgs[1].val)
+	assert.Equal(ids[1], msgs[1].meta.ID)
+}
+
+func TestPublishBatch_Handler(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{
+			name: "array",
+			body: `[{"msg": "test_value_1", "content_type": "text/plain"}, {"msg": "test_value_2", "content_type": "text/plain"}]`,
+			code: http.StatusCreated,
+		},
+		{
+			name: "ndjson",
+			body: "{\"msg\": \"test_value_1\", \"content_type\": \"text/plain\"}\n{\"msg\": \"test_value_2\", \"content_type\": \"text/plain\"}\n",
+			code: http.StatusCreated,
+		},
+		{
+			name: "rejected",
+			body: "{\"msg\": \"test_value_1\", \"content_type\": \"text/plain\"}\n{\"msg\": \"test_value_2\", \"content_type\": \"application/xml\"}\n",
+			code: http.StatusMultiStatus,
+		},
+		{name: "empty", body: "  \n", code: http.StatusBadRequest},
+		{name: "invalid", body: `[{"msg": 1}]`, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			b := newBroker(helperNewMemStore(t))
+			assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{ContentType: "text/plain"}))
+
+			w := NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/publish/"+defaultTopic+"/batch", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+			publishBatch(b)(w, r)
+			assert.Equal(tt.code, w.Code)
+
+			if tt.code == http.StatusBadRequest {
+				return
+			}
+
+			var res batchResponse
+			assert.NoError(json.NewDecoder(w.Body).Decode(&res))
+			assert.Len(res.Results, 2)
+			assert.NotEmpty(res.Results[0].ID)
+
+			n, err := b.store.Len(defaultTopic)
+			assert.NoError(err)
+
+			if tt.code == http.StatusMultiStatus {
+				assert.Equal(errContentType.Error(), res.Results[1].Error)
+				assert.Equal(1, n)
+
+				return
+			}
+
+			assert.NotEmpty(res.Results[1].ID)
+			assert.Equal(2, n)
+		})
+	}
+}
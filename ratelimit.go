@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseRate parses a rate in the form N/s, N/m or N/h, returning the rate per
+// second. A rate without a unit is taken to be per second.
+func parseRate(s string) (float64, error) {
+	n, unit := s, "s"
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		n, unit = s[:i], s[i+1:]
+	}
+
+	count, err := strconv.ParseFloat(n, 64)
+	if err != nil || count <= 0 {
+		return 0, errInvalidRate
+	}
+
+	switch unit {
+	case "s":
+		return count, nil
+	case "m":
+		return count / time.Minute.Seconds(), nil
+	case "h":
+		return count / time.Hour.Seconds(), nil
+	default:
+		return 0, errInvalidRate
+	}
+}
+
+// tokenBucket limits the rate of an operation. A bucket holds up to a single
+// token, refilled at rate tokens per second, such that operations are spaced
+// no closer than 1/rate apart. A nil bucket is unlimited.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	sync.Mutex
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: 1,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available, taking it. If ctx is cancelled
+// before then, the token is returned to the bucket and errRequestCancelled
+// is returned.
+func (tb *tokenBucket) wait(ctx context.Context) error {
+	if tb == nil {
+		return nil
+	}
+
+	tb.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > 1 {
+		tb.tokens = 1
+	}
+	tb.last = now
+
+	// Reserve a token, waiting for the bucket to refill if it is in debt
+	tb.tokens--
+	delay := time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	tb.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		tb.Lock()
+		tb.tokens++
+		tb.Unlock()
+
+		return errRequestCancelled
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "10/s", want: 10},
+		{in: "10", want: 10},
+		{in: "0.5/s", want: 0.5},
+		{in: "120/m", want: 2},
+		{in: "3600/h", want: 1},
+		{in: "0/s", wantErr: true},
+		{in: "-1/s", wantErr: true},
+		{in: "10/d", wantErr: true},
+		{in: "ten/s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseRate(tt.in)
+			if tt.wantErr {
+				assert.Equal(t, errInvalidRate, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestConsumerRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	for i := 0; i < 20; i++ {
+		_, err := b.Publish(defaultTopic, []byte(fmt.Sprint(i)), messageMeta{})
+		assert.NoError(err)
+	}
+
+	const rate = 10
+
+	limited := b.Subscribe(defaultTopic)
+	limited.LimitRate(rate)
+
+	limitedDone := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			_, err := limited.Next(context.Background())
+			assert.NoError(err)
+			assert.NoError(limited.Ack())
+		}
+		limitedDone <- time.Since(start)
+	}()
+
+	// The unlimited consumer drains the rest without waiting on the limited one
+	unlimited := b.Subscribe(defaultTopic)
+
+	start := time.Now()
+	for i := 0; i < 17; i++ {
+		_, err := unlimited.Next(context.Background())
+		assert.NoError(err)
+		assert.NoError(unlimited.Ack())
+	}
+	assert.Less(int64(time.Since(start)), int64(100*time.Millisecond))
+
+	// The first delivery is immediate, the rest are spaced by 1/rate
+	assert.GreaterOrEqual(int64(<-limitedDone), int64(2*time.Second/rate))
+}
+
+func TestTokenBucket_Cancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	tb := newTokenBucket(1)
+	assert.NoError(tb.wait(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(errRequestCancelled, tb.wait(ctx))
+}
+
+func TestSubscribeInvalidRate(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s?rate=fast", defaultTopic), strings.NewReader(`"INIT"`))
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	subscribe(newBroker(&store{db: db}), flushThreshold{})(subW, r)
+
+	assert.Equal(http.StatusBadRequest, subW.Code)
+}
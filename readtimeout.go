@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// withReadTimeout closes subscribe connections on which the server has waited
+// longer than the timeout for the next command, treating the client as
+// disconnected. This detects connections dropped without being closed, which
+// otherwise go unnoticed until the OS gives up on them. Clients must send their
+// next command within the timeout, e.g. ACKing before it passes. Zero waits
+// indefinitely.
+func withReadTimeout(timeout time.Duration) serverOption {
+	return func(s *server) {
+		s.readTimeout = timeout
+	}
+}
+
+// withTCPKeepalive sets the period between TCP keepalive probes on accepted
+// connections, detecting dead peers at the TCP level. Zero keeps the default.
+func withTCPKeepalive(period time.Duration) serverOption {
+	return func(s *server) {
+		s.tcpKeepalive = period
+	}
+}
+
+// Listener applies the TCP keepalive period of the server to the connections
+// accepted by ln.
+func (s *server) Listener(ln net.Listener) net.Listener {
+	if s.tcpKeepalive <= 0 {
+		return ln
+	}
+
+	return &keepaliveListener{Listener: ln, period: s.tcpKeepalive}
+}
+
+type keepaliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l *keepaliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		_ = tc.SetKeepAlive(true)
+		_ = tc.SetKeepAlivePeriod(l.period)
+	}
+
+	return conn, nil
+}
+
+// timeoutReader wraps the body of a subscribe request, closing the underlying
+// connection if a read blocks for longer than the timeout.
+type timeoutReader struct {
+	io.ReadCloser
+	*watchdog
+}
+
+func (tr *timeoutReader) Read(p []byte) (int, error) {
+	if tr.timedOut() {
+		return 0, errReadTimeout
+	}
+
+	defer tr.guard()()
+
+	return tr.ReadCloser.Read(p)
+}
+
+// readTimedOut reports whether reading the next command of the subscribe
+// request timed out, after which the client is treated as disconnected.
+func readTimedOut(r *http.Request) bool {
+	tr, ok := r.Body.(*timeoutReader)
+	return ok && tr.timedOut()
+}
+
+// timeoutSubscriberReads bounds each read of the commands sent on subscribe
+// connections by the timeout. Zero disables the timeout.
+func timeoutSubscriberReads(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if timeout <= 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		r.Body = &timeoutReader{ReadCloser: r.Body, watchdog: newWatchdog(conn, timeout)}
+
+		next(w, r)
+	}
+}
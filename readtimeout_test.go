@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestSubscribeReadTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	const timeout = 100 * time.Millisecond
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.NoError(err)
+
+	// The client sends INIT, then its connection silently drops
+	srvConn, cliConn := net.Pipe()
+	defer cliConn.Close()
+
+	go func() {
+		_ = json.NewEncoder(cliConn).Encode(CmdInit)
+	}()
+
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), srvConn)
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+	r = r.WithContext(context.WithValue(r.Context(), connContextKey{}, srvConn))
+
+	w := NewRecorder()
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		timeoutSubscriberReads(timeout, subscribe(b, flushThreshold{}))(w, r)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the dropped subscriber to be detected")
+	}
+
+	// Detected once the timeout passed without a command
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(int64(elapsed), int64(timeout))
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(w.Body).Decode(&out))
+	assert.Equal("test_msg", out.Msg)
+
+	// The outstanding message was requeued
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	assert.Zero(b.subscribers(defaultTopic))
+}
+
+func TestTimeoutReader(t *testing.T) {
+	assert := assert.New(t)
+
+	srvConn, cliConn := net.Pipe()
+	defer cliConn.Close()
+
+	tr := &timeoutReader{ReadCloser: srvConn, watchdog: newWatchdog(srvConn, 50*time.Millisecond)}
+
+	// Reads which the client sends in time succeed
+	go func() {
+		_, _ = cliConn.Write([]byte("hello"))
+	}()
+
+	buf := make([]byte, 5)
+	n, err := tr.Read(buf)
+	assert.NoError(err)
+	assert.Equal(5, n)
+	assert.False(tr.timedOut())
+
+	// Once a read blocks past the timeout, it and every later read fails
+	_, err = tr.Read(buf)
+	assert.Error(err)
+	assert.True(tr.timedOut())
+
+	_, err = tr.Read(buf)
+	assert.Equal(errReadTimeout, err)
+}
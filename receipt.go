@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// receiptOutcomeAcked indicates the message was consumed and ACKed.
+	receiptOutcomeAcked = "acked"
+	// receiptOutcomeExpired indicates the message was dropped as it was not
+	// delivered by its deadline.
+	receiptOutcomeExpired = "expired"
+)
+
+const (
+	defaultReceiptAttempts = 5
+	defaultReceiptTimeout  = 5 * time.Second
+)
+
+// errNotifyRefused is returned when sending to an address in the refused
+// networks which isn't allowed.
+var errNotifyRefused = errors.New("address refused, private networks aren't sent to unless allowed")
+
+// refusedNetworks are the networks receipts and alerts aren't sent to unless
+// allowed, so that producers can't direct the server at services only it can
+// reach, such as cloud metadata endpoints.
+var refusedNetworks = mustParseNetworks(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including metadata endpoints
+	"172.16.0.0/12",  // private
+	"192.168.0.0/16", // private
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+)
+
+// withNotifyAllow allows receipts and alerts to be sent to the networks, though
+// they're private, loopback or link-local, e.g. for producers running
+// alongside the server.
+func withNotifyAllow(nets []*net.IPNet) brokerOption {
+	return func(b *broker) {
+		b.receipts.allowed = nets
+	}
+}
+
+// parseNetworks parses comma separated CIDRs, e.g. 10.0.0.0/8,::1/128.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("parsing network %q: %v", cidr, err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	nets, err := parseNetworks(strings.Join(cidrs, ","))
+	if err != nil {
+		panic(err)
+	}
+
+	return nets
+}
+
+// NotifyPermitted reports whether receipts may be sent to the URL. Hosts are
+// only checked once resolved as receipts are sent, while addresses in refused
+// networks are rejected up front.
+func (b *broker) NotifyPermitted(rawURL string) bool {
+	return b.receipts.permittedURL(rawURL)
+}
+
+// receipt is sent to a message's notify URL once the message has been
+// consumed.
+type receipt struct {
+	ID      string `json:"id"`
+	Topic   string `json:"topic"`
+	Outcome string `json:"outcome"`
+}
+
+// receiptSender delivers receipts to producers in the background, retrying
+// failed deliveries according to its backoff.
+type receiptSender struct {
+	client   *http.Client
+	attempts int
+	backoff  backoff
+
+	// allowed are the networks sent to, though they're refused by default.
+	allowed []*net.IPNet
+}
+
+func newReceiptSender() *receiptSender {
+	rs := &receiptSender{
+		attempts: defaultReceiptAttempts,
+		backoff: backoff{
+			base:   500 * time.Millisecond,
+			max:    30 * time.Second,
+			jitter: 0.2,
+		},
+	}
+
+	// Addresses are checked as they're dialed, covering hostnames resolving to
+	// refused networks and redirects to them. Connections aren't proxied, so
+	// the address dialed is the one sent to.
+	dialer := &net.Dialer{Timeout: defaultReceiptTimeout, Control: rs.control}
+	rs.client = &http.Client{
+		Timeout:   defaultReceiptTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+
+	return rs
+}
+
+// control refuses connections to addresses which aren't permitted.
+func (rs *receiptSender) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !rs.permitted(ip) {
+		return fmt.Errorf("%w: %s", errNotifyRefused, host)
+	}
+
+	return nil
+}
+
+// permitted reports whether the address may be sent to, being in an allowed
+// network or none of the refused networks.
+func (rs *receiptSender) permitted(ip net.IP) bool {
+	for _, n := range rs.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	for _, n := range refusedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// permittedURL reports whether the URL may be sent to, as far as can be told
+// without resolving its host.
+func (rs *receiptSender) permittedURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(u.Hostname())
+
+	return ip == nil || rs.permitted(ip)
+}
+
+// Send delivers the receipt to the URL without blocking the caller.
+func (rs *receiptSender) Send(url string, rec receipt) {
+	log := log.With().
+		Str("msg_id", rec.ID).
+		Str("topic", rec.Topic).
+		Str("notify", url).
+		Logger()
+
+	go rs.send(log, "receipt", url, rec)
+}
+
+// Alert delivers the dead-letter alert to the URL without blocking the caller.
+func (rs *receiptSender) Alert(url string, alert deadLetterAlert) {
+	log := log.With().
+		Str("msg_id", alert.ID).
+		Str("topic", alert.Topic).
+		Str("alert", url).
+		Logger()
+
+	go rs.send(log, "alert", url, alert)
+}
+
+// send posts v to the URL as JSON, retrying failures. The kind of payload
+// names it in the logs.
+func (rs *receiptSender) send(log zerolog.Logger, kind, url string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Err(err).Msgf("failed to encode %s", kind)
+		return
+	}
+
+	for attempt := 1; attempt <= rs.attempts; attempt++ {
+		err = rs.post(url, body)
+		if err == nil {
+			log.Debug().Msgf("sent %s", kind)
+			return
+		}
+
+		// Retrying won't change the address
+		if errors.Is(err, errNotifyRefused) {
+			log.Warn().Err(err).Msgf("refused to send %s", kind)
+			return
+		}
+
+		log.Warn().
+			Err(err).
+			Int("attempt", attempt).
+			Msgf("failed to send %s", kind)
+
+		if attempt < rs.attempts {
+			time.Sleep(rs.backoff.Delay(attempt))
+		}
+	}
+
+	log.Error().Msgf("giving up sending %s", kind)
+}
+
+func (rs *receiptSender) post(url string, body []byte) error {
+	res, err := rs.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
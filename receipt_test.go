@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// loopbackNetworks allows receipts to be sent to test servers.
+var loopbackNetworks = mustParseNetworks("127.0.0.0/8", "::1/128")
+
+func TestReceiptOnAck(t *testing.T) {
+	assert := assert.New(t)
+
+	receipts := make(chan receipt, 1)
+	notifySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec receipt
+		assert.NoError(json.NewDecoder(r.Body).Decode(&rec))
+		receipts <- rec
+	}))
+	defer notifySrv.Close()
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	srv := httptest.NewUnstartedServer(newServer(newBroker(&store{db: db}, withNotifyAllow(loopbackNetworks))))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// Publish with a notify URL
+	publishPath := fmt.Sprintf("%s/publish/%s?notify=%s", srv.URL, defaultTopic, url.QueryEscape(notifySrv.URL))
+	req, err := http.NewRequest(http.MethodPost, publishPath, strings.NewReader("test_msg_1"))
+	assert.NoError(err)
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusCreated, res.StatusCode)
+
+	var pubRes pubResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&pubRes))
+	assert.NotEmpty(pubRes.ID)
+
+	// Consume and ACK
+	encoder, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal("test_msg_1", out.Msg)
+
+	// No receipt is sent before the message is ACKed
+	select {
+	case <-receipts:
+		assert.FailNow("received receipt before ACK")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(encoder.Encode(CmdAck))
+
+	select {
+	case rec := <-receipts:
+		assert.Equal(receipt{
+			ID:      pubRes.ID,
+			Topic:   defaultTopic,
+			Outcome: receiptOutcomeAcked,
+		}, rec)
+	case <-time.After(time.Second):
+		assert.FailNow("timed out waiting for receipt")
+	}
+}
+
+func TestReceiptSenderRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int
+	done := make(chan struct{})
+	notifySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		close(done)
+	}))
+	defer notifySrv.Close()
+
+	rs := newReceiptSender()
+	rs.backoff = backoff{base: time.Millisecond, max: 10 * time.Millisecond}
+	rs.allowed = loopbackNetworks
+
+	rs.Send(notifySrv.URL, receipt{ID: "test_id", Topic: defaultTopic, Outcome: receiptOutcomeAcked})
+
+	select {
+	case <-done:
+		assert.Equal(3, calls)
+	case <-time.After(time.Second):
+		assert.FailNow("timed out waiting for receipt")
+	}
+}
+
+func TestPublishRefusedNotifyURL(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	srv := newServer(newBroker(NewMockstorer(ctrl)))
+
+	// Metadata endpoints, and other private addresses, aren't sent receipts
+	for _, notify := range []string{"http://169.254.169.254/latest", "http://10.0.0.1", "http://[::1]:8080"} {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?notify=%s", defaultTopic, url.QueryEscape(notify)), strings.NewReader("test_msg"))
+		srv.ServeHTTP(rec, req)
+
+		assert.Equal(http.StatusBadRequest, rec.Code, notify)
+		assert.Contains(rec.Body.String(), errInvalidNotifyURL.Error())
+	}
+}
+
+func TestReceiptSenderRefused(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	notifySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer notifySrv.Close()
+
+	// Named by a hostname, the loopback server is only refused once resolved
+	notifyURL := strings.Replace(notifySrv.URL, "127.0.0.1", "localhost", 1)
+
+	rs := newReceiptSender()
+	assert.True(rs.permittedURL(notifyURL))
+	assert.False(rs.permittedURL(notifySrv.URL))
+
+	body, err := json.Marshal(receipt{ID: "test_id"})
+	assert.NoError(err)
+	assert.True(errors.Is(rs.post(notifyURL, body), errNotifyRefused))
+	assert.Zero(atomic.LoadInt32(&calls))
+
+	// Once allowed, it's sent to
+	rs.allowed = loopbackNetworks
+	assert.NoError(rs.post(notifyURL, body))
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestPublishInvalidNotifyURL(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	srv := newServer(newBroker(NewMockstorer(ctrl)))
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s?notify=not-a-url", defaultTopic), strings.NewReader("test_msg"))
+	srv.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// topicRecovery is the state of a topic recovered from the store on startup.
+type topicRecovery struct {
+	// Pending is the number of messages which were waiting to be consumed.
+	Pending int `json:"pending"`
+	// Requeued is the number of messages which were awaiting acknowledgement,
+	// and have been returned to the queue.
+	Requeued int `json:"requeued"`
+}
+
+// recoveryReport summarises the state recovered from the store on startup.
+type recoveryReport struct {
+	Topics   int                      `json:"topics"`
+	Messages int                      `json:"messages"`
+	Requeued int                      `json:"requeued"`
+	Delayed  int                      `json:"delayed"`
+	Duration time.Duration            `json:"duration_ns"`
+	PerTopic map[string]topicRecovery `json:"per_topic"`
+}
+
+// Recover returns messages left awaiting acknowledgement by a previous run to
+// the front of their topics, as their consumers no longer exist. The state of
+// each recovered topic is returned.
+func (s *store) Recover() (map[string]topicRecovery, error) {
+	topics, err := s.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	recovered := map[string]topicRecovery{}
+	for _, topic := range topics {
+		pending, err := s.Len(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		outstanding, err := s.outstanding(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		// Nack in reverse, leaving the oldest message at the head
+		for i := len(outstanding) - 1; i >= 0; i-- {
+			if err := s.Nack(topic, outstanding[i]); err != nil {
+				return nil, fmt.Errorf("requeueing topic %s offset %d: %v", topic, outstanding[i], err)
+			}
+		}
+
+		recovered[topic] = topicRecovery{
+			Pending:  pending,
+			Requeued: len(outstanding),
+		}
+	}
+
+	return recovered, nil
+}
+
+// Topics returns the name of every topic in the store.
+func (s *store) Topics() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	var topics []string
+	for iter.Next() {
+		key := string(iter.Key())
+		if !strings.HasSuffix(key, "-tail") {
+			continue
+		}
+
+		// Other keys may end in -tail, a topic also has head and ack positions
+		topic := strings.TrimSuffix(key, "-tail")
+
+		head, err := s.db.Has([]byte(fmt.Sprintf(headPosKeyFmt, topic)), nil)
+		if err != nil {
+			return nil, fmt.Errorf("checking for has: %v", err)
+		}
+
+		ack, err := s.db.Has([]byte(fmt.Sprintf(ackTailPosKeyFmt, topic)), nil)
+		if err != nil {
+			return nil, fmt.Errorf("checking for has: %v", err)
+		}
+
+		if head && ack {
+			topics = append(topics, topic)
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating topics: %v", err)
+	}
+
+	return topics, nil
+}
+
+// outstanding returns the offsets of the values awaiting acknowledgement on
+// the topic, in ascending order.
+func (s *store) outstanding(topic string) ([]int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return outstandingOffsets(s.db, topic)
+}
+
+// outstandingOffsets returns the offsets of the values awaiting
+// acknowledgement on the topic, in ascending order. The store lock must be
+// held.
+func outstandingOffsets(db *leveldb.DB, topic string) ([]int, error) {
+	prefix := topic + "-ack-"
+
+	iter := db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	var offsets []int
+	for iter.Next() {
+		// Skip the ack position and metadata keys
+		offset, err := strconv.Atoi(strings.TrimPrefix(string(iter.Key()), prefix))
+		if err != nil {
+			continue
+		}
+
+		offsets = append(offsets, offset)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating outstanding values: %v", err)
+	}
+
+	sort.Ints(offsets)
+
+	return offsets, nil
+}
+
+// Recover recovers the state of the store left by a previous run, recording a
+// report of what was recovered.
+func (b *broker) Recover() error {
+	start := time.Now()
+
+	recovered, err := b.store.Recover()
+	if err != nil {
+		return fmt.Errorf("recovering store: %v", err)
+	}
+
+	report := recoveryReport{
+		Topics:   len(recovered),
+		PerTopic: recovered,
+	}
+
+	for _, r := range recovered {
+		report.Messages += r.Pending + r.Requeued
+		report.Requeued += r.Requeued
+	}
+
+	report.Delayed, err = b.restoreDelayed()
+	if err != nil {
+		return fmt.Errorf("restoring delayed messages: %v", err)
+	}
+
+	report.Duration = time.Since(start)
+
+	log.Info().
+		Int("topics", report.Topics).
+		Int("messages", report.Messages).
+		Int("requeued", report.Requeued).
+		Int("delayed", report.Delayed).
+		Dur("duration", report.Duration).
+		Msg("recovered store")
+
+	if err := b.recoverGroups(recovered); err != nil {
+		return fmt.Errorf("recovering groups: %v", err)
+	}
+
+	b.Lock()
+	b.recovery = report
+	b.Unlock()
+
+	return nil
+}
+
+// RecoveryReport returns the report of the last recovery.
+func (b *broker) RecoveryReport() recoveryReport {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.recovery
+}
+
+func getRecovery(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "get_recovery").
+			Logger()
+
+		if err := json.NewEncoder(w).Encode(broker.RecoveryReport()); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerRecover(t *testing.T) {
+	assert := assert.New(t)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	recovered := map[string]topicRecovery{
+		"topic_a": {Pending: 2, Requeued: 1},
+		"topic_b": {Pending: 3},
+	}
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().Recover().Return(recovered, nil)
+	mockStore.EXPECT().Delayed().Return(nil, nil)
+	mockStore.EXPECT().Groups().Return(nil, nil)
+
+	b := newBroker(mockStore)
+	assert.NoError(b.Recover())
+
+	report := b.RecoveryReport()
+	assert.Equal(2, report.Topics)
+	assert.Equal(6, report.Messages)
+	assert.Equal(1, report.Requeued)
+	assert.Equal(recovered, report.PerTopic)
+
+	// The report is served on the recovery endpoint
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/recovery", nil)
+	newServer(b).ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var out recoveryReport
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal(report, out)
+}
+
+func TestStoreRecover(t *testing.T) {
+	assert := assert.New(t)
+
+	const otherTopic = "other_topic"
+
+	s := newStore(tmpDBPath, withRetention(time.Hour, 0))
+	t.Cleanup(s.Destroy)
+
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_2"), messageMeta{}))
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_3"), messageMeta{}))
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_4"), messageMeta{}))
+	assert.NoError(s.Insert(otherTopic, []byte("other_value"), messageMeta{}))
+
+	// Leave two values outstanding, and one acked into the history
+	_, _, ao, err := s.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.NoError(s.Ack(defaultTopic, ao))
+
+	_, _, _, err = s.GetNext(defaultTopic)
+	assert.NoError(err)
+	_, _, _, err = s.GetNext(defaultTopic)
+	assert.NoError(err)
+
+	// Restart the store
+	assert.NoError(s.Close())
+	s = newStore(tmpDBPath)
+	t.Cleanup(func() { _ = s.Close() })
+
+	recovered, err := s.Recover()
+	assert.NoError(err)
+	assert.Equal(map[string]topicRecovery{
+		defaultTopic: {Pending: 1, Requeued: 2},
+		otherTopic:   {Pending: 1},
+	}, recovered)
+
+	// Outstanding values are consumed again in their original order
+	for _, want := range []string{"test_value_2", "test_value_3", "test_value_4"} {
+		val, _, _, err := s.GetNext(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(value(want), val)
+	}
+}
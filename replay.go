@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	logFmt           = "%s-log-%d"
+	logHeadPosKeyFmt = "%s-log-head"
+	logTailPosKeyFmt = "%s-log-tail"
+)
+
+const (
+	// replayEarliest replays a topic from the oldest message kept in its log.
+	replayEarliest = "earliest"
+	// replayLatest replays a topic from the next message published to it.
+	replayLatest = "latest"
+)
+
+const errReplayLogDisabled = storeError("replay log is not enabled")
+
+// withReplayLog keeps a log of the messages published to each topic, which
+// subscribers replay from an offset, for up to dur after they're published and
+// up to max messages per topic. The log is only kept if either is set.
+func withReplayLog(dur time.Duration, max int) storeOption {
+	return func(s *store) {
+		s.replayLog = retention{dur: dur, max: max}
+	}
+}
+
+// logEntry is a message kept in the log of a topic, at the offset in its
+// metadata.
+type logEntry struct {
+	Value value       `json:"value"`
+	Meta  messageMeta `json:"meta"`
+}
+
+// appendLog assigns the message the next offset of the topic, adding it to the
+// log of the topic if it is kept, and evicting entries which exceed the log's
+// retention. Writes are made through db.
+func (s *store) appendLog(db readWriter, topic string, val value, meta *messageMeta) error {
+	tail, err := readPos(db, logTailPosKeyFmt, topic)
+	if err != nil {
+		return err
+	}
+
+	meta.Offset = tail
+	tail++
+
+	if err := db.Put([]byte(fmt.Sprintf(logTailPosKeyFmt, topic)), encodePos(tail), nil); err != nil {
+		return fmt.Errorf("putting log tail position: %v", err)
+	}
+
+	if !s.replayLog.enabled() {
+		return nil
+	}
+
+	b, err := json.Marshal(logEntry{Value: val, Meta: *meta})
+	if err != nil {
+		return fmt.Errorf("encoding log entry: %v", err)
+	}
+
+	if err := db.Put([]byte(fmt.Sprintf(logFmt, topic, meta.Offset)), b, nil); err != nil {
+		return fmt.Errorf("putting log entry: %v", err)
+	}
+
+	head, err := readPos(db, logHeadPosKeyFmt, topic)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	now := s.clock()
+
+	// Offsets assigned while the log wasn't kept have no entry
+	for ; head < meta.Offset; head++ {
+		if s.replayLog.max > 0 && tail-head > s.replayLog.max {
+			batch.Delete([]byte(fmt.Sprintf(logFmt, topic, head)))
+			continue
+		}
+
+		entry, err := getLogEntry(db, topic, head)
+		if errors.Is(err, errNoMessages) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !s.replayLog.expired(entry.Meta.PublishedAt, now) {
+			break
+		}
+
+		batch.Delete([]byte(fmt.Sprintf(logFmt, topic, head)))
+	}
+
+	batch.Put([]byte(fmt.Sprintf(logHeadPosKeyFmt, topic)), encodePos(head))
+
+	return db.Write(batch, nil)
+}
+
+// ReadLog returns the first message kept in the log of the topic at or after
+// offset, or errNoMessages if none has been published there yet. Messages
+// evicted from the log are skipped.
+func (s *store) ReadLog(topic string, offset int) (logEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.replayLog.enabled() {
+		return logEntry{}, errReplayLogDisabled
+	}
+
+	head, tail, err := s.logPos(topic)
+	if err != nil {
+		return logEntry{}, err
+	}
+
+	if offset < head {
+		offset = head
+	}
+
+	now := s.clock()
+	for ; offset < tail; offset++ {
+		entry, err := getLogEntry(s.db, topic, offset)
+		if errors.Is(err, errNoMessages) {
+			continue
+		}
+		if err != nil {
+			return logEntry{}, err
+		}
+
+		// Expired entries are evicted on the next publish
+		if s.replayLog.expired(entry.Meta.PublishedAt, now) {
+			continue
+		}
+
+		return entry, nil
+	}
+
+	return logEntry{}, errNoMessages
+}
+
+// LogOffsets returns the offset of the oldest message kept in the log of the
+// topic, and the offset the next message published to it is assigned.
+func (s *store) LogOffsets(topic string) (head, tail int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.replayLog.enabled() {
+		return 0, 0, errReplayLogDisabled
+	}
+
+	return s.logPos(topic)
+}
+
+func (s *store) logPos(topic string) (head, tail int, err error) {
+	if head, err = readPos(s.db, logHeadPosKeyFmt, topic); err != nil {
+		return 0, 0, err
+	}
+
+	if tail, err = readPos(s.db, logTailPosKeyFmt, topic); err != nil {
+		return 0, 0, err
+	}
+
+	return head, tail, nil
+}
+
+// readPos returns the position stored for the topic under the key format, zero
+// if none has been stored.
+func readPos(db readWriter, keyFmt, topic string) (int, error) {
+	b, err := db.Get([]byte(fmt.Sprintf(keyFmt, topic)), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("getting position: %v", err)
+	}
+
+	i, err := binary.ReadVarint(bytes.NewReader(b))
+	if err != nil {
+		return 0, fmt.Errorf("reading position varint: %v", err)
+	}
+
+	return int(i), nil
+}
+
+func getLogEntry(db readWriter, topic string, offset int) (logEntry, error) {
+	b, err := db.Get([]byte(fmt.Sprintf(logFmt, topic, offset)), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return logEntry{}, errNoMessages
+	}
+	if err != nil {
+		return logEntry{}, fmt.Errorf("getting log entry from topic %s at offset %d: %v", topic, offset, err)
+	}
+
+	var entry logEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return logEntry{}, fmt.Errorf("decoding log entry: %v", err)
+	}
+
+	return entry, nil
+}
+
+// replayFrom is the position a consumer starts replaying its topic from.
+type replayFrom struct {
+	// position is replayEarliest or replayLatest, empty to start from offset.
+	position string
+	offset   int
+}
+
+// parseReplayFrom parses the position sent with INIT to replay the topic from,
+// either "earliest", "latest" or an offset, which may be sent as a number or a
+// string.
+func parseReplayFrom(raw json.RawMessage) (replayFrom, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		s = string(raw)
+	}
+
+	switch s {
+	case replayEarliest, replayLatest:
+		return replayFrom{position: s}, nil
+	}
+
+	offset, err := strconv.Atoi(s)
+	if err != nil || offset < 0 {
+		return replayFrom{}, errInvalidFrom
+	}
+
+	return replayFrom{offset: offset}, nil
+}
+
+// replayCursor is the position of a consumer replaying the log of its topic.
+type replayCursor struct {
+	// offset is the next offset read from the log.
+	offset int
+
+	// pending is the entry delivered to the consumer, awaiting an ACK or NACK.
+	pending *logEntry
+
+	// wake is signalled as messages are published to the topic.
+	wake chan struct{}
+}
+
+// notify wakes the consumer if it's waiting for a message, or has it check
+// the log again once it next waits.
+func (rc *replayCursor) notify() {
+	select {
+	case rc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ack moves the cursor past the pending entry.
+func (rc *replayCursor) ack() {
+	rc.pending = nil
+}
+
+// nack moves the cursor back to the pending entry, such that it is delivered
+// again.
+func (rc *replayCursor) nack() {
+	if rc.pending == nil {
+		return
+	}
+
+	rc.offset = rc.pending.Meta.Offset
+	rc.pending = nil
+}
+
+// Seek switches the consumer to replaying the log of its topic from the given
+// position, reading messages without consuming them. Messages are delivered in
+// the order they were published, whether or not they have since been
+// consumed, for as long as the log keeps them.
+func (b *broker) Seek(cons *consumer, from replayFrom) error {
+	head, tail, err := b.store.LogOffsets(cons.topic)
+	if err != nil {
+		return err
+	}
+
+	cursor := &replayCursor{wake: make(chan struct{}, 1)}
+	switch from.position {
+	case replayEarliest:
+		cursor.offset = head
+	case replayLatest:
+		cursor.offset = tail
+	default:
+		cursor.offset = from.offset
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	cons.replay = cursor
+
+	// Publishes are notified through the subscribed copy of the consumer
+	conss := b.consumers[cons.topic]
+	for i := range conss {
+		if conss[i].id == cons.id {
+			conss[i].replay = cursor
+		}
+	}
+
+	return nil
+}
+
+// nextReplay reads the next message from the log of the topic, waiting for
+// one to be published if block is set.
+func (c *consumer) nextReplay(ctx context.Context, block bool) (value, error) {
+	for {
+		if c.stopped() {
+			return nil, errShuttingDown
+		}
+
+		entry, err := c.store.ReadLog(c.topic, c.replay.offset)
+		if errors.Is(err, errNoMessages) {
+			if !block {
+				return nil, errNoMessages
+			}
+
+			select {
+			case <-c.replay.wake:
+				continue
+			case <-c.stopping:
+				continue
+			case <-ctx.Done():
+				return nil, errRequestCancelled
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading log: %v", err)
+		}
+
+		c.replay.offset = entry.Meta.Offset + 1
+		c.replay.pending = &entry
+
+		c.seq++
+		meta := entry.Meta
+		meta.Seq = c.seq
+		meta.Replayed = true
+
+		var val value
+		val, c.meta = c.intercept(entry.Value, meta)
+
+		return val, nil
+	}
+}
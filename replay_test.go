@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func helperNewReplayStore(t *testing.T, max int) *store {
+	t.Helper()
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("opening db: %v", err)
+	}
+
+	return newStoreFromDB("", db, withReplayLog(0, max))
+}
+
+func TestStoreReadLog(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewReplayStore(t, 3)
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(s.Insert(defaultTopic, []byte(fmt.Sprintf("test_value_%d", i)), messageMeta{ID: fmt.Sprint(i)}))
+	}
+	assert.NoError(s.Insert("other_topic", []byte("other_value"), messageMeta{}))
+
+	// Each topic counts its own offsets
+	_, meta, ackOffset, err := s.GetNext("other_topic")
+	assert.NoError(err)
+	assert.Equal(0, meta.Offset)
+	assert.NoError(s.Ack("other_topic", ackOffset))
+
+	// The oldest entry has been evicted, and consuming leaves the log intact
+	_, meta, ackOffset, err = s.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(0, meta.Offset)
+	assert.NoError(s.Ack(defaultTopic, ackOffset))
+
+	head, tail, err := s.LogOffsets(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, head)
+	assert.Equal(4, tail)
+
+	entry, err := s.ReadLog(defaultTopic, 0)
+	assert.NoError(err)
+	assert.Equal(value("test_value_1"), entry.Value)
+	assert.Equal(1, entry.Meta.Offset)
+
+	entry, err = s.ReadLog(defaultTopic, 3)
+	assert.NoError(err)
+	assert.Equal(value("test_value_3"), entry.Value)
+
+	_, err = s.ReadLog(defaultTopic, 4)
+	assert.Equal(errNoMessages, err)
+}
+
+func TestStoreReadLog_Disabled(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value"), messageMeta{}))
+
+	_, err := s.ReadLog(defaultTopic, 0)
+	assert.Equal(errReplayLogDisabled, err)
+
+	_, _, err = s.LogOffsets(defaultTopic)
+	assert.Equal(errReplayLogDisabled, err)
+}
+
+func TestParseReplayFrom(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    replayFrom
+		wantErr bool
+	}{
+		{raw: `"earliest"`, want: replayFrom{position: replayEarliest}},
+		{raw: `"latest"`, want: replayFrom{position: replayLatest}},
+		{raw: `42`, want: replayFrom{offset: 42}},
+		{raw: `"42"`, want: replayFrom{offset: 42}},
+		{raw: `-1`, wantErr: true},
+		{raw: `"soon"`, wantErr: true},
+		{raw: `true`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			from, err := parseReplayFrom(json.RawMessage(tt.raw))
+			if tt.wantErr {
+				assert.Equal(t, errInvalidFrom, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, from)
+		})
+	}
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewReplayStore(t, 10)
+	b := newBroker(s)
+
+	for i := 0; i < 3; i++ {
+		_, err := b.Publish(defaultTopic, []byte(fmt.Sprintf("test_value_%d", i)), messageMeta{})
+		assert.NoError(err)
+	}
+
+	// Consumed messages are still replayed
+	c := b.Subscribe(defaultTopic)
+	_, err := c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.Ack())
+	b.Unsubscribe(c)
+
+	conn := helperDialWebSocket(t, b, defaultTopic)
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`{"cmd": "INIT", "from": 1}`)))
+
+	var res subResponse
+	assert.NoError(conn.ReadJSON(&res))
+	assert.Equal("test_value_1", res.Msg)
+	assert.Equal(1, *res.Offset)
+
+	// A NACK replays the same message
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`"NACK"`)))
+
+	res = subResponse{}
+	assert.NoError(conn.ReadJSON(&res))
+	assert.Equal("test_value_1", res.Msg)
+
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`"ACK"`)))
+
+	res = subResponse{}
+	assert.NoError(conn.ReadJSON(&res))
+	assert.Equal("test_value_2", res.Msg)
+	assert.Equal(2, *res.Offset)
+
+	// Waiting for the next message to be published
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`"ACK"`)))
+
+	_, err = b.Publish(defaultTopic, []byte("test_value_3"), messageMeta{})
+	assert.NoError(err)
+
+	res = subResponse{}
+	assert.NoError(conn.ReadJSON(&res))
+	assert.Equal("test_value_3", res.Msg)
+	assert.Equal(3, *res.Offset)
+
+	// Replaying leaves the topic to its consumers
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(3, n)
+}
+
+func TestSubscribeReplay_Latest(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewReplayStore(t, 10))
+
+	_, err := b.Publish(defaultTopic, []byte("old_value"), messageMeta{})
+	assert.NoError(err)
+
+	conn := helperDialWebSocket(t, b, defaultTopic)
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`{"cmd": "INIT", "from": "latest", "block": false}`)))
+
+	var res subResponse
+	assert.NoError(conn.ReadJSON(&res))
+	assert.True(res.Empty)
+
+	// Consumers of the topic are unaffected by the replay
+	c := b.Subscribe(defaultTopic)
+	_, err = b.Publish(defaultTopic, []byte("new_value"), messageMeta{})
+	assert.NoError(err)
+
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`"ACK"`)))
+
+	res = subResponse{}
+	assert.NoError(conn.ReadJSON(&res))
+	assert.Equal("new_value", res.Msg)
+
+	val, err := c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("old_value"), val)
+}
+
+func TestSubscribeReplay_Disabled(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	conn := helperDialWebSocket(t, b, defaultTopic)
+
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`{"cmd": "INIT", "from": "earliest"}`)))
+
+	var res subResponse
+	assert.NoError(conn.ReadJSON(&res))
+	assert.Equal(errReplayDisabled.Error(), res.Error)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// replicationAckPath is the path followers acknowledge the mutations they have
+// applied on, when the primary requires it.
+const replicationAckPath = replicationPath + "/ack"
+
+// replicaAck acknowledges every mutation up to Seq applied by a follower.
+type replicaAck struct {
+	Follower string `json:"follower"`
+	Seq      uint64 `json:"seq"`
+}
+
+// withAckReplicas holds back the response to each publish until n followers
+// have applied it, responding 503 if they haven't within the timeout. Zero
+// responds once the primary has stored the message.
+func withAckReplicas(n int, timeout time.Duration) serverOption {
+	return func(s *server) {
+		s.ackReplicas = n
+		s.ackTimeout = timeout
+	}
+}
+
+// register starts tracking the mutations applied by a follower, returning the
+// ID it acknowledges them under, until unregister is called.
+func (r *replicatedStore) register() (id string, unregister func()) {
+	r.acksMu.Lock()
+	defer r.acksMu.Unlock()
+
+	id = xid.New().String()
+	r.acks[id] = 0
+
+	return id, func() {
+		r.acksMu.Lock()
+		defer r.acksMu.Unlock()
+
+		delete(r.acks, id)
+	}
+}
+
+// ack records that the follower has applied every mutation up to seq,
+// reporting whether the follower is known.
+func (r *replicatedStore) ack(id string, seq uint64) bool {
+	r.acksMu.Lock()
+	defer r.acksMu.Unlock()
+
+	applied, ok := r.acks[id]
+	if !ok {
+		return false
+	}
+
+	if seq > applied {
+		r.acks[id] = seq
+
+		close(r.acked)
+		r.acked = make(chan struct{})
+	}
+
+	return true
+}
+
+// lastSeq returns the Seq of the last mutation applied to the store.
+func (r *replicatedStore) lastSeq() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.seq
+}
+
+// awaitApplied waits until n followers have applied every mutation up to seq,
+// or until ctx is done, returning its error.
+func (r *replicatedStore) awaitApplied(ctx context.Context, seq uint64, n int) error {
+	for {
+		r.acksMu.Lock()
+		var applied int
+		for _, s := range r.acks {
+			if s >= seq {
+				applied++
+			}
+		}
+		acked := r.acked
+		r.acksMu.Unlock()
+
+		if applied >= n {
+			return nil
+		}
+
+		select {
+		case <-acked:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ackReplication records the mutations a follower acknowledges it has applied.
+func ackReplication(rs *replicatedStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "ack_replication").
+			Logger()
+
+		var ack replicaAck
+		if err := json.NewDecoder(r.Body).Decode(&ack); err != nil {
+			log.Debug().Err(err).Msg("failed to decode ack")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errReplicaAck.Error())
+
+			return
+		}
+		defer r.Body.Close()
+
+		if !rs.ack(ack.Follower, ack.Seq) {
+			log.Debug().Str("follower", ack.Follower).Msg("ack from unknown follower")
+
+			w.WriteHeader(http.StatusNotFound)
+			respondError(log, json.NewEncoder(w), errUnknownFollower.Error())
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// awaitReplicas holds back a successful response until n followers have
+// applied the mutations made to the store by the time the handler returned,
+// responding 503 instead if they haven't within the timeout. The mutations are
+// left in place on the primary either way.
+func awaitReplicas(rs *replicatedStore, n int, timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if rs == nil || n <= 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf := &bufferedResponse{header: w.Header(), code: http.StatusOK}
+		next(buf, r)
+
+		if buf.code >= 200 && buf.code < 300 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			if err := rs.awaitApplied(ctx, rs.lastSeq(), n); err != nil {
+				log := log.With().
+					Str("path", r.URL.Path).
+					Int("replicas", n).
+					Logger()
+
+				log.Warn().Err(err).Msg("write not acknowledged by enough followers")
+
+				w.WriteHeader(http.StatusServiceUnavailable)
+				respondError(log, json.NewEncoder(w), errNotReplicated.Error())
+
+				return
+			}
+		}
+
+		w.WriteHeader(buf.code)
+		_, _ = w.Write(buf.body.Bytes())
+	}
+}
+
+// bufferedResponse holds back the status and body written by a handler, such
+// that they can be replaced before being written to the client. Headers are
+// written straight through.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	b.code = code
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// replicaAcker acknowledges the mutations applied by a follower to its
+// primary. Mutations applied while an acknowledgement is in flight are
+// acknowledged together by the next.
+type replicaAcker struct {
+	// applied is accessed atomically, so comes first to be 64-bit aligned
+	applied uint64
+
+	follower *follower
+	id       string
+	pending  chan struct{}
+}
+
+// ackApplied acknowledges the mutations applied under the ID given by the
+// primary, until ctx is done.
+func (f *follower) ackApplied(ctx context.Context, id string) *replicaAcker {
+	a := &replicaAcker{
+		follower: f,
+		id:       id,
+		pending:  make(chan struct{}, 1),
+	}
+
+	go a.run(ctx)
+
+	return a
+}
+
+// ack acknowledges every mutation up to seq.
+func (a *replicaAcker) ack(seq uint64) {
+	atomic.StoreUint64(&a.applied, seq)
+
+	select {
+	case a.pending <- struct{}{}:
+	default:
+	}
+}
+
+func (a *replicaAcker) run(ctx context.Context) {
+	for {
+		select {
+		case <-a.pending:
+		case <-ctx.Done():
+			return
+		}
+
+		seq := atomic.LoadUint64(&a.applied)
+		if err := a.send(ctx, seq); err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Uint64("seq", seq).Msg("failed to acknowledge replication")
+		}
+	}
+}
+
+func (a *replicaAcker) send(ctx context.Context, seq uint64) error {
+	body, err := json.Marshal(replicaAck{Follower: a.id, Seq: seq})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.follower.primary+replicationAckPath, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %v", err)
+	}
+
+	res, err := a.follower.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending ack: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("primary responded %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// replicaBuffer is the number of ops buffered for each follower. A follower
+// falling further behind is disconnected, and resyncs from a new snapshot once
+// it reconnects.
+const replicaBuffer = 1024
+
+// replicaOpType is a mutation of the store, replayed by followers.
+type replicaOpType string
+
+const (
+	opSnapshot        = replicaOpType("snapshot")
+	opInsert          = replicaOpType("insert")
+	opInsertAll       = replicaOpType("insert_all")
+	opReplaceAll      = replicaOpType("replace_all")
+	opGetNext         = replicaOpType("get_next")
+	opFetch           = replicaOpType("fetch")
+	opAck             = replicaOpType("ack")
+	opDrop            = replicaOpType("drop")
+	opNack            = replicaOpType("nack")
+	opNackReason      = replicaOpType("nack_reason")
+	opPutTopicConfig  = replicaOpType("put_topic_config")
+	opResetDeliveries = replicaOpType("reset_deliveries")
+	opSweep           = replicaOpType("sweep")
+	opSweepExpired    = replicaOpType("sweep_expired")
+	opShed            = replicaOpType("shed")
+	opDeleteTopic     = replicaOpType("delete_topic")
+	opPutGroup        = replicaOpType("put_group")
+	opNextSeq         = replicaOpType("next_seq")
+	opRecover         = replicaOpType("recover")
+	opInsertDelayed   = replicaOpType("insert_delayed")
+	opDeleteDelayed   = replicaOpType("delete_delayed")
+)
+
+// replicaOp is a single frame of the replication stream. The stream starts
+// with a snapshot of the store, followed by each mutation applied to the store
+// since, in order. As the store is deterministic, replaying the mutations onto
+// the snapshot reproduces the state of the primary.
+type replicaOp struct {
+	Op      replicaOpType   `json:"op"`
+	Topic   string          `json:"topic,omitempty"`
+	Topics  []string        `json:"topics,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	Value   []byte          `json:"value,omitempty"`
+	Meta    []byte          `json:"meta,omitempty"`
+	Records []replicaRecord `json:"records,omitempty"`
+	Offsets []int           `json:"offsets,omitempty"`
+	Reason  string          `json:"reason,omitempty"`
+	Config  *topicConfig    `json:"config,omitempty"`
+	Before  *time.Time      `json:"before,omitempty"`
+	Count   int             `json:"count,omitempty"`
+	Entries []replicaEntry  `json:"entries,omitempty"`
+	Delayed *delayedMessage `json:"delayed,omitempty"`
+	Keep    bool            `json:"keep,omitempty"`
+	Group   string          `json:"group,omitempty"`
+
+	// Seq counts up from 1 with each mutation applied to the primary. A
+	// snapshot carries the Seq of the last mutation it reflects, along with
+	// the ID a follower acknowledges the mutations it applies under, if the
+	// primary requires acknowledgements.
+	Seq      uint64 `json:"seq,omitempty"`
+	Follower string `json:"follower,omitempty"`
+}
+
+// replicaRecord is a record inserted by an opInsertAll or opReplaceAll.
+type replicaRecord struct {
+	Topic string `json:"topic"`
+	Value []byte `json:"value"`
+	Meta  []byte `json:"meta"`
+}
+
+// replicaEntry is a key of the store and its value, as sent in a snapshot.
+type replicaEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// snapshotter is implemented by stores able to be replicated.
+type snapshotter interface {
+	// dump returns every entry of the store.
+	dump() ([]replicaEntry, error)
+
+	// load replaces the contents of the store with the entries.
+	load(entries []replicaEntry) error
+}
+
+// replicatedStore wraps the store of a primary, streaming each mutation made
+// to it to the followers of the primary.
+type replicatedStore struct {
+	storer
+	snapshots snapshotter
+
+	// mu serialises mutations, such that they're streamed in the order they
+	// were applied. seq is the Seq of the last mutation.
+	mu        sync.Mutex
+	followers map[chan replicaOp]struct{}
+	seq       uint64
+
+	// acks holds the Seq of the last mutation applied by each follower
+	// acknowledging them, closing acked each time one does.
+	acksMu sync.Mutex
+	acks   map[string]uint64
+	acked  chan struct{}
+}
+
+// withReplication streams the store to the followers of the server.
+func withReplication(rs *replicatedStore) serverOption {
+	return func(s *server) {
+		s.replication = rs
+	}
+}
+
+// newReplicatedStore wraps the store to replicate it to followers, if the
+// store supports it.
+func newReplicatedStore(s storer) (*replicatedStore, error) {
+	snaps, ok := s.(snapshotter)
+	if !ok {
+		return nil, errors.New("store does not support replication")
+	}
+
+	return &replicatedStore{
+		storer:    s,
+		snapshots: snaps,
+		followers: map[chan replicaOp]struct{}{},
+		acks:      map[string]uint64{},
+		acked:     make(chan struct{}),
+	}, nil
+}
+
+// follow returns a snapshot of the store along with the mutations made after
+// it, until stop is called. The channel is closed if the follower falls too
+// far behind.
+func (r *replicatedStore) follow() (snapshot replicaOp, ops <-chan replicaOp, stop func(), err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries, err := r.snapshots.dump()
+	if err != nil {
+		return replicaOp{}, nil, nil, fmt.Errorf("taking snapshot: %v", err)
+	}
+
+	snapshot = replicaOp{Op: opSnapshot, Entries: entries, Seq: r.seq}
+
+	ch := make(chan replicaOp, replicaBuffer)
+	r.followers[ch] = struct{}{}
+
+	stop = func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if _, ok := r.followers[ch]; ok {
+			delete(r.followers, ch)
+			close(ch)
+		}
+	}
+
+	return snapshot, ch, stop, nil
+}
+
+// apply applies the mutation to the store, streaming it to the followers if
+// it succeeds.
+func (r *replicatedStore) apply(op replicaOp, mutate func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := mutate(); err != nil {
+		return err
+	}
+
+	r.seq++
+	op.Seq = r.seq
+
+	for ch := range r.followers {
+		select {
+		case ch <- op:
+		default:
+			log.Warn().Msg("follower fell behind, disconnecting it to resync")
+
+			delete(r.followers, ch)
+			close(ch)
+		}
+	}
+
+	return nil
+}
+
+// Unwrap returns the wrapped store.
+func (r *replicatedStore) Unwrap() storer {
+	return r.storer
+}
+
+func (r *replicatedStore) Insert(topic string, val value, meta messageMeta) error {
+	op := replicaOp{Op: opInsert, Topic: topic, Value: val, Meta: encodeMeta(meta)}
+
+	return r.apply(op, func() error {
+		return r.storer.Insert(topic, val, meta)
+	})
+}
+
+func (r *replicatedStore) InsertAll(records []record) error {
+	op := replicaOp{Op: opInsertAll, Records: encodeRecords(records)}
+
+	return r.apply(op, func() error {
+		return r.storer.InsertAll(records)
+	})
+}
+
+func (r *replicatedStore) ReplaceAll(topics []string, records []record) error {
+	op := replicaOp{Op: opReplaceAll, Topics: topics, Records: encodeRecords(records)}
+
+	return r.apply(op, func() error {
+		return r.storer.ReplaceAll(topics, records)
+	})
+}
+
+func encodeRecords(records []record) []replicaRecord {
+	encoded := make([]replicaRecord, 0, len(records))
+	for _, rec := range records {
+		encoded = append(encoded, replicaRecord{Topic: rec.topic, Value: rec.value, Meta: encodeMeta(rec.meta)})
+	}
+
+	return encoded
+}
+
+func decodeRecords(encoded []replicaRecord) ([]record, error) {
+	records := make([]record, 0, len(encoded))
+	for _, r := range encoded {
+		meta, err := decodeMeta(r.Meta)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record{topic: r.Topic, value: r.Value, meta: meta})
+	}
+
+	return records, nil
+}
+
+func (r *replicatedStore) GetNext(topic string) (val value, meta messageMeta, ackOffset int, err error) {
+	err = r.apply(replicaOp{Op: opGetNext, Topic: topic}, func() error {
+		val, meta, ackOffset, err = r.storer.GetNext(topic)
+		return err
+	})
+
+	return val, meta, ackOffset, err
+}
+
+func (r *replicatedStore) Fetch(topic, id string) (val value, meta messageMeta, ackOffset int, err error) {
+	err = r.apply(replicaOp{Op: opFetch, Topic: topic, ID: id}, func() error {
+		val, meta, ackOffset, err = r.storer.Fetch(topic, id)
+		return err
+	})
+
+	return val, meta, ackOffset, err
+}
+
+func (r *replicatedStore) Ack(topic string, ackOffsets ...int) error {
+	return r.apply(replicaOp{Op: opAck, Topic: topic, Offsets: ackOffsets}, func() error {
+		return r.storer.Ack(topic, ackOffsets...)
+	})
+}
+
+func (r *replicatedStore) Drop(topic string, ackOffsets ...int) error {
+	return r.apply(replicaOp{Op: opDrop, Topic: topic, Offsets: ackOffsets}, func() error {
+		return r.storer.Drop(topic, ackOffsets...)
+	})
+}
+
+func (r *replicatedStore) Nack(topic string, ackOffset int) error {
+	return r.apply(replicaOp{Op: opNack, Topic: topic, Offsets: []int{ackOffset}}, func() error {
+		return r.storer.Nack(topic, ackOffset)
+	})
+}
+
+func (r *replicatedStore) NackReason(topic string, ackOffset int, reason string) error {
+	op := replicaOp{Op: opNackReason, Topic: topic, Offsets: []int{ackOffset}, Reason: reason}
+
+	return r.apply(op, func() error {
+		return r.storer.NackReason(topic, ackOffset, reason)
+	})
+}
+
+func (r *replicatedStore) PutTopicConfig(topic string, cfg topicConfig) error {
+	return r.apply(replicaOp{Op: opPutTopicConfig, Topic: topic, Config: &cfg}, func() error {
+		return r.storer.PutTopicConfig(topic, cfg)
+	})
+}
+
+func (r *replicatedStore) ResetDeliveries(topic string) (n int, err error) {
+	err = r.apply(replicaOp{Op: opResetDeliveries, Topic: topic}, func() error {
+		n, err = r.storer.ResetDeliveries(topic)
+		return err
+	})
+
+	return n, err
+}
+
+func (r *replicatedStore) Sweep(before time.Time, keep bool) (swept map[string][]messageMeta, err error) {
+	err = r.apply(replicaOp{Op: opSweep, Before: &before, Keep: keep}, func() error {
+		swept, err = r.storer.Sweep(before, keep)
+		return err
+	})
+
+	return swept, err
+}
+
+func (r *replicatedStore) SweepExpired(now time.Time, keep bool) (swept map[string][]messageMeta, err error) {
+	err = r.apply(replicaOp{Op: opSweepExpired, Before: &now, Keep: keep}, func() error {
+		swept, err = r.storer.SweepExpired(now, keep)
+		return err
+	})
+
+	return swept, err
+}
+
+func (r *replicatedStore) Shed(topic string, n int) (shed int, err error) {
+	err = r.apply(replicaOp{Op: opShed, Topic: topic, Count: n}, func() error {
+		shed, err = r.storer.Shed(topic, n)
+		return err
+	})
+
+	return shed, err
+}
+
+func (r *replicatedStore) DeleteTopic(topic string) error {
+	return r.apply(replicaOp{Op: opDeleteTopic, Topic: topic}, func() error {
+		return r.storer.DeleteTopic(topic)
+	})
+}
+
+func (r *replicatedStore) PutGroup(topic, group string) error {
+	return r.apply(replicaOp{Op: opPutGroup, Topic: topic, Group: group}, func() error {
+		return r.storer.PutGroup(topic, group)
+	})
+}
+
+func (r *replicatedStore) NextSeq(topic string) (seq int, err error) {
+	err = r.apply(replicaOp{Op: opNextSeq, Topic: topic}, func() error {
+		seq, err = r.storer.NextSeq(topic)
+		return err
+	})
+
+	return seq, err
+}
+
+func (r *replicatedStore) Recover() (recovered map[string]topicRecovery, err error) {
+	err = r.apply(replicaOp{Op: opRecover}, func() error {
+		recovered, err = r.storer.Recover()
+		return err
+	})
+
+	return recovered, err
+}
+
+func (r *replicatedStore) InsertDelayed(msg delayedMessage) error {
+	return r.apply(replicaOp{Op: opInsertDelayed, Delayed: &msg}, func() error {
+		return r.storer.InsertDelayed(msg)
+	})
+}
+
+func (r *replicatedStore) DeleteDelayed(msg delayedMessage) error {
+	return r.apply(replicaOp{Op: opDeleteDelayed, Delayed: &msg}, func() error {
+		return r.storer.DeleteDelayed(msg)
+	})
+}
+
+// replicate streams a snapshot of the store, followed by each mutation made to
+// it, to a follower. With acks set, the follower is asked to acknowledge the
+// mutations it applies.
+func replicate(rs *replicatedStore, acks bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "replicate").
+			Logger()
+
+		snapshot, ops, stop, err := rs.follow()
+		if err != nil {
+			log.Err(err).Msg("failed to start replication")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errReplicate.Error())
+
+			return
+		}
+		defer stop()
+
+		if acks {
+			id, unregister := rs.register()
+			defer unregister()
+
+			snapshot.Follower = id
+		}
+
+		log.Info().Int("entries", len(snapshot.Entries)).Msg("follower connected")
+
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+
+		send := func(op replicaOp) bool {
+			if err := enc.Encode(op); err != nil {
+				log.Debug().Err(err).Msg("follower went away")
+				return false
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			return true
+		}
+
+		if !send(snapshot) {
+			return
+		}
+
+		for {
+			select {
+			case op, ok := <-ops:
+				if !ok {
+					return
+				}
+
+				if !send(op) {
+					return
+				}
+			case <-r.Context().Done():
+				log.Info().Msg("follower disconnected")
+				return
+			}
+		}
+	}
+}
+
+// dump returns every entry of the store.
+func (s *store) dump() ([]replicaEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	var entries []replicaEntry
+	for iter.Next() {
+		entries = append(entries, replicaEntry{
+			Key:   append([]byte(nil), iter.Key()...),
+			Value: append([]byte(nil), iter.Value()...),
+		})
+	}
+
+	return entries, iter.Error()
+}
+
+// load replaces the contents of the store with the entries in a single write.
+func (s *store) load(entries []replicaEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	batch := new(leveldb.Batch)
+
+	iter := s.db.NewIterator(nil, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating store: %v", err)
+	}
+
+	for _, e := range entries {
+		batch.Put(e.Key, e.Value)
+	}
+
+	if err := s.db.Write(batch, nil); err != nil {
+		return fmt.Errorf("writing snapshot: %v", err)
+	}
+
+	// The cached heads no longer reflect the store
+	if s.cache != nil {
+		s.cache = newHeadCache(s.cache.size)
+	}
+
+	return s.written()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func helperNewMemStore(t *testing.T) *store {
+	t.Helper()
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(t, err)
+
+	return &store{db: db}
+}
+
+func helperGetJSON(t *testing.T, srv *httptest.Server, path string, out interface{}) {
+	t.Helper()
+
+	res, err := srv.Client().Get(srv.URL + path)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(out))
+}
+
+func TestReplication(t *testing.T) {
+	assert := assert.New(t)
+
+	rs, err := newReplicatedStore(helperNewMemStore(t))
+	assert.NoError(err)
+
+	primary := newBroker(rs)
+
+	psrv := httptest.NewUnstartedServer(newServer(primary, withReplication(rs)))
+	psrv.EnableHTTP2 = true
+	psrv.StartTLS()
+	defer psrv.Close()
+
+	// Published before the follower connects, so it arrives in the snapshot
+	_, err = primary.Publish(defaultTopic, []byte("before"), messageMeta{})
+	assert.NoError(err)
+
+	fb := newBroker(helperNewMemStore(t))
+
+	f, err := newFollower(fb, psrv.URL, psrv.Client())
+	assert.NoError(err)
+
+	synced := make(chan struct{}, 1)
+	f.synced = func() { synced <- struct{}{} }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go f.run(ctx)
+
+	fsrv := httptest.NewUnstartedServer(newServer(fb, withFollower(psrv.URL)))
+	fsrv.EnableHTTP2 = true
+	fsrv.StartTLS()
+	defer fsrv.Close()
+
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the follower to sync")
+	}
+
+	// Published after, so it is streamed
+	res, err := psrv.Client().Post(fmt.Sprintf("%s/publish/%s", psrv.URL, defaultTopic), "", strings.NewReader("after"))
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusCreated, res.StatusCode)
+
+	peek := func() []string {
+		var msgs []peekResponse
+		helperGetJSON(t, fsrv, fmt.Sprintf("/topics/%s/peek", defaultTopic), &msgs)
+
+		var out []string
+		for _, m := range msgs {
+			out = append(out, m.Msg)
+		}
+
+		return out
+	}
+
+	assert.Eventually(func() bool {
+		return strings.Join(peek(), ",") == "before,after"
+	}, time.Second, 5*time.Millisecond)
+
+	var stats []topicStats
+	helperGetJSON(t, fsrv, "/topics", &stats)
+	assert.Equal([]topicStats{{Topic: defaultTopic, Pending: 2}}, stats)
+
+	// Consuming on the primary is reflected too
+	c := primary.Subscribe(defaultTopic)
+	_, err = c.Next(ctx)
+	assert.NoError(err)
+	assert.NoError(c.Ack())
+
+	assert.Eventually(func() bool {
+		return strings.Join(peek(), ",") == "after"
+	}, time.Second, 5*time.Millisecond)
+
+	// As are topic configs
+	assert.NoError(primary.SetTopicConfig(defaultTopic, topicConfig{MaxLength: 10}))
+
+	assert.Eventually(func() bool {
+		var cfg topicConfig
+		helperGetJSON(t, fsrv, fmt.Sprintf("/topics/%s/config", defaultTopic), &cfg)
+
+		return cfg.MaxLength == 10
+	}, time.Second, 5*time.Millisecond)
+
+	// Whereas writes to the follower are rejected, pointing at the primary
+	res, err = fsrv.Client().Post(fmt.Sprintf("%s/publish/%s", fsrv.URL, defaultTopic), "", strings.NewReader("rejected"))
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	assert.Equal(http.StatusMisdirectedRequest, res.StatusCode)
+	assert.Equal(fmt.Sprintf("%s/publish/%s", psrv.URL, defaultTopic), res.Header.Get("Location"))
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal(errFollower.Error(), out.Error)
+
+	n, err := fb.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestReplication_AckReplicas(t *testing.T) {
+	assert := assert.New(t)
+
+	rs, err := newReplicatedStore(helperNewMemStore(t))
+	assert.NoError(err)
+
+	psrv := httptest.NewUnstartedServer(newServer(newBroker(rs), withReplication(rs), withAckReplicas(1, 200*time.Millisecond)))
+	psrv.EnableHTTP2 = true
+	psrv.StartTLS()
+	defer psrv.Close()
+
+	publish := func(msg string) int {
+		res, err := psrv.Client().Post(fmt.Sprintf("%s/publish/%s", psrv.URL, defaultTopic), "", strings.NewReader(msg))
+		assert.NoError(err)
+		defer res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	// Without a follower, the publish is stored but not acknowledged
+	assert.Equal(http.StatusServiceUnavailable, publish("unreplicated"))
+
+	fb := newBroker(helperNewMemStore(t))
+
+	f, err := newFollower(fb, psrv.URL, psrv.Client())
+	assert.NoError(err)
+
+	synced := make(chan struct{}, 1)
+	f.synced = func() { synced <- struct{}{} }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go f.run(ctx)
+
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the follower to sync")
+	}
+
+	// Once acknowledged, the follower has already applied the publish
+	assert.Equal(http.StatusCreated, publish("replicated"))
+
+	n, err := fb.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(2, n)
+}
+
+func TestReplication_RPC(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newServer(newBroker(helperNewMemStore(t)), withFollower("https://primary:8080"))
+
+	// Reads dispatched over RPC are served, writes rejected
+	res := helperCallRPC(t, s, `{"jsonrpc":"2.0","id":1,"method":"stats","params":{"topic":"test_topic"}}`)
+	assert.Nil(res.Error)
+
+	res = helperCallRPC(t, s, `{"jsonrpc":"2.0","id":2,"method":"publish","params":{"topic":"test_topic","msg":"test_msg"}}`)
+	if assert.NotNil(res.Error) {
+		assert.Equal(http.StatusMisdirectedRequest, res.Error.Code)
+		assert.Equal(errFollower.Error(), res.Error.Message)
+	}
+}
+
+func TestReplication_Replay(t *testing.T) {
+	assert := assert.New(t)
+
+	ps := helperNewMemStore(t)
+	rs, err := newReplicatedStore(ps)
+	assert.NoError(err)
+
+	// Whatever the follower held before is replaced by the snapshot
+	fs := helperNewMemStore(t)
+	assert.NoError(fs.Insert("stale", []byte("stale"), messageMeta{}))
+
+	assert.NoError(rs.Insert(defaultTopic, []byte("snapshotted"), messageMeta{ID: "0"}))
+
+	snapshot, ops, stop, err := rs.follow()
+	assert.NoError(err)
+	defer stop()
+
+	assert.NoError(fs.load(snapshot.Entries))
+
+	// Exercise every mutation of the store
+	assert.NoError(rs.Insert(defaultTopic, []byte("test_value_1"), messageMeta{ID: "1"}))
+	assert.NoError(rs.InsertAll([]record{
+		{topic: defaultTopic, value: []byte("test_value_2"), meta: messageMeta{ID: "2"}},
+		{topic: "other_topic", value: []byte("test_value_3"), meta: messageMeta{ID: "3", PublishedAt: time.Unix(0, 0)}},
+	}))
+
+	assert.NoError(rs.Insert(defaultTopic, []byte("test_value_4"), messageMeta{ID: "4"}))
+	_, _, ackOffset, err := rs.Fetch(defaultTopic, "4")
+	assert.NoError(err)
+	assert.NoError(rs.Ack(defaultTopic, ackOffset))
+
+	_, _, ackOffset, err = rs.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.NoError(rs.NackReason(defaultTopic, ackOffset, "failed"))
+	assert.NoError(rs.Nack(defaultTopic, ackOffset))
+
+	_, _, ackOffset, err = rs.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.NoError(rs.Ack(defaultTopic, ackOffset))
+
+	_, _, ackOffset, err = rs.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.NoError(rs.Drop(defaultTopic, ackOffset))
+
+	assert.NoError(rs.Insert("other_topic", []byte("test_value_5"), messageMeta{ID: "5"}))
+	_, err = rs.Shed("other_topic", 1)
+	assert.NoError(err)
+
+	_, err = rs.ResetDeliveries(defaultTopic)
+	assert.NoError(err)
+	_, err = rs.NextSeq(defaultTopic)
+	assert.NoError(err)
+	_, err = rs.Sweep(time.Unix(1, 0), true)
+	assert.NoError(err)
+	assert.NoError(rs.PutTopicConfig(defaultTopic, topicConfig{MaxLength: 5}))
+
+	_, _, _, err = rs.GetNext(defaultTopic)
+	assert.NoError(err)
+	_, err = rs.Recover()
+	assert.NoError(err)
+
+	// Failed mutations aren't streamed
+	_, _, _, err = rs.GetNext("empty_topic")
+	assert.Equal(errNoMessages, err)
+
+	f := &follower{store: fs, snaps: fs, broker: newBroker(fs)}
+	for len(ops) > 0 {
+		op := <-ops
+
+		// Round trip each op as it is streamed
+		var buf bytes.Buffer
+		assert.NoError(json.NewEncoder(&buf).Encode(op))
+
+		var decoded replicaOp
+		assert.NoError(json.NewDecoder(&buf).Decode(&decoded))
+		assert.NoError(f.apply(decoded), op.Op)
+	}
+
+	want, err := ps.dump()
+	assert.NoError(err)
+	got, err := fs.dump()
+	assert.NoError(err)
+	assert.Equal(want, got)
+}
+
+func TestReplication_FallenBehind(t *testing.T) {
+	assert := assert.New(t)
+
+	rs, err := newReplicatedStore(helperNewMemStore(t))
+	assert.NoError(err)
+
+	_, ops, stop, err := rs.follow()
+	assert.NoError(err)
+	defer stop()
+
+	// A follower which isn't keeping up is cut off, rather than holding up the
+	// primary
+	for i := 0; i <= replicaBuffer; i++ {
+		assert.NoError(rs.Insert(defaultTopic, []byte("test_value"), messageMeta{}))
+	}
+
+	n := 0
+	for range ops {
+		n++
+	}
+	assert.Equal(replicaBuffer, n)
+}
@@ -1,19 +1,199 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog"
 )
 
+type pubResponse struct {
+	ID string `json:"id"`
+}
+
+// frameSignal names the kind of a frame on the subscribe stream which carries no
+// message, allowing clients to tell them apart from messages with a single
+// field. Frames carrying a message have no signal.
+type frameSignal string
+
+const (
+	// signalEmpty is sent to a non-blocking consumer when the topic has no
+	// messages available.
+	signalEmpty frameSignal = "empty"
+	// signalKeepalive is sent on an idle connection to keep it open.
+	signalKeepalive frameSignal = "keepalive"
+	// signalSnapshot describes the topic, before the first message.
+	signalSnapshot frameSignal = "snapshot"
+	// signalStatus describes the consumer, in response to STATUS.
+	signalStatus frameSignal = "status"
+	// signalError reports an error, in Error.
+	signalError frameSignal = "error"
+	// signalHello answers the hello of a client, naming the protocol and
+	// features of the server.
+	signalHello frameSignal = "hello"
+)
+
 type subResponse struct {
-	Msg   string `json:"msg,omitempty"`
-	Error string `json:"error,omitempty"`
+	// Signal is set on every frame which carries no message.
+	Signal frameSignal `json:"signal,omitempty"`
+
+	ID          string `json:"id,omitempty"`
+	Msg         string `json:"msg,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Empty       bool   `json:"empty,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	// Code is the HTTP status of an error, set for requests which match no
+	// route.
+	Code int `json:"code,omitempty"`
+
+	// InReplyTo is the ID of the message this message is the result of.
+	InReplyTo string `json:"in_reply_to,omitempty"`
+
+	// Seq counts up from 1 with each message delivered on the stream, allowing
+	// clients to detect gaps. Redelivered is set if the message has been
+	// delivered before, to this or another consumer.
+	Seq         int  `json:"seq,omitempty"`
+	Redelivered bool `json:"redelivered,omitempty"`
+
+	// NackReasons are the reasons the message was previously NACKed for.
+	NackReasons []string `json:"nack_reasons,omitempty"`
+
+	// PublishedAt is the time the message was published, Deliveries the
+	// number of times it has been delivered including this one, Headers those
+	// it was published with under headerPrefix, and Priority its priority.
+	PublishedAt *time.Time        `json:"published_at,omitempty"`
+	Deliveries  int               `json:"deliveries,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+
+	// DeadLetter describes the last time the message was dead-lettered.
+	DeadLetter *deadLetterRecord `json:"dead_letter,omitempty"`
+
+	// Offset is the position of a replayed message in the log of its topic.
+	Offset *int `json:"offset,omitempty"`
+
+	// Stream indicates the message body follows the response as a chunked
+	// stream of Length bytes, rather than in Msg.
+	Stream bool `json:"stream,omitempty"`
+	Length int  `json:"length,omitempty"`
+
+	// Snapshot describes the topic, sent before the first message when
+	// requested on INIT.
+	Snapshot *topicSnapshot `json:"snapshot,omitempty"`
+
+	// Status describes the message outstanding on the consumer, in response
+	// to STATUS.
+	Status *consumerStatus `json:"status,omitempty"`
+
+	// Keepalive is sent on an idle connection to keep it open, and carries no
+	// message.
+	Keepalive bool `json:"keepalive,omitempty"`
+
+	// Hello is the protocol spoken by the server, and Features the optional
+	// parts of it supported, sent in response to the hello of a client.
+	Hello    string   `json:"hello,omitempty"`
+	Features []string `json:"features,omitempty"`
 }
 
-func respondMsg(log zerolog.Logger, e *json.Encoder, msg []byte) {
+// signalFrame returns the frame for a signal. The empty and keepalive frames
+// also set the flags which predate signals, for existing clients.
+func signalFrame(s frameSignal) subResponse {
+	res := subResponse{Signal: s}
+
+	switch s {
+	case signalEmpty:
+		res.Empty = true
+	case signalKeepalive:
+		res.Keepalive = true
+	}
+
+	return res
+}
+
+// errorFrame returns the frame reporting the error.
+func errorFrame(errMsg string) subResponse {
+	res := signalFrame(signalError)
+	res.Error = errMsg
+
+	return res
+}
+
+// messageFrame returns the frame carrying the message. Messages which are
+// streamed following the frame leave its Msg empty.
+func messageFrame(msg []byte, meta messageMeta, stream bool) subResponse {
 	res := subResponse{
-		Msg: string(msg),
+		ID:          meta.ID,
+		ContentType: meta.ContentType,
+		InReplyTo:   meta.InReplyTo,
+		Seq:         meta.Seq,
+		Redelivered: meta.Deliveries > 1,
+		NackReasons: meta.NackReasons,
+		Deliveries:  meta.Deliveries,
+		Headers:     meta.Headers,
+		Priority:    meta.Priority,
+		DeadLetter:  newDeadLetterRecord(meta),
+	}
+
+	if !meta.PublishedAt.IsZero() {
+		publishedAt := meta.PublishedAt
+		res.PublishedAt = &publishedAt
+	}
+
+	if meta.Replayed {
+		offset := meta.Offset
+		res.Offset = &offset
+	}
+
+	if stream {
+		res.Stream = true
+		res.Length = len(msg)
+	} else {
+		res.Msg = string(msg)
+	}
+
+	return res
+}
+
+const (
+	// peekAllLimit is the maximum number of messages returned by a peek.
+	peekAllLimit = 100
+	// peekBodyLen is the number of bytes of each message body returned by a
+	// peek.
+	peekBodyLen = 64
+)
+
+// resetDeliveriesResponse is the number of messages whose delivery count was
+// reset.
+type resetDeliveriesResponse struct {
+	Reset int `json:"reset"`
+}
+
+// peekResponse is a preview of a message waiting on a topic.
+type peekResponse struct {
+	ID        string `json:"id"`
+	Msg       string `json:"msg"`
+	Truncated bool   `json:"truncated,omitempty"`
+
+	NackReasons []string          `json:"nack_reasons,omitempty"`
+	DeadLetter  *deadLetterRecord `json:"dead_letter,omitempty"`
+}
+
+// historyResponse is an acked message retained in the history of a topic.
+type historyResponse struct {
+	ID          string    `json:"id"`
+	Msg         string    `json:"msg"`
+	ContentType string    `json:"content_type,omitempty"`
+	AckedAt     time.Time `json:"acked_at"`
+}
+
+func respondPublished(log zerolog.Logger, e *json.Encoder, id string) {
+	res := pubResponse{
+		ID: id,
 	}
 
 	if err := e.Encode(res); err != nil {
@@ -21,12 +201,155 @@ func respondMsg(log zerolog.Logger, e *json.Encoder, msg []byte) {
 	}
 }
 
-func respondError(log zerolog.Logger, e *json.Encoder, errMsg string) {
-	res := subResponse{
-		Error: errMsg,
+// respondMsg writes msg to the client. Messages larger than streamThreshold
+// are streamed to fw in chunks following the response, avoiding encoding the
+// whole message into a single buffer.
+func respondMsg(log zerolog.Logger, w http.ResponseWriter, fw io.Writer, e *json.Encoder, msg []byte, meta messageMeta) {
+	if len(msg) > streamThreshold {
+		respondStream(log, w, fw, e, bytes.NewReader(msg), len(msg), meta)
+		return
 	}
 
+	if err := e.Encode(messageFrame(msg, meta, false)); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
+
+// respondStream writes the response for a message whose body of size bytes is
+// streamed from r to fw in chunks following it. Keepalives are held back on w
+// until the whole message is written, so never land between its chunks.
+func respondStream(log zerolog.Logger, w http.ResponseWriter, fw io.Writer, e *json.Encoder, r io.Reader, size int, meta messageMeta) {
+	release := holdKeepalives(w)
+	defer release()
+
+	frame := messageFrame(nil, meta, true)
+	frame.Length = size
+
+	if err := e.Encode(frame); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+		return
+	}
+
+	if err := writeStream(fw, r); err != nil {
+		log.Err(err).Msg("failed to stream message to client")
+	}
+}
+
+// respondDelivery writes the message just delivered to the consumer to the
+// client, streaming a body left in the store straight from it. It reports
+// whether the stream may carry on.
+func respondDelivery(log zerolog.Logger, w http.ResponseWriter, fw io.Writer, e *json.Encoder, cons *consumer, msg []byte) bool {
+	meta := cons.Meta()
+	if meta.BodySize == 0 {
+		respondMsg(log, w, fw, e, msg, meta)
+
+		log.Debug().
+			Int("length", len(msg)).
+			Msg("written message to client")
+
+		return true
+	}
+
+	body, size, err := cons.Body()
+	if err != nil {
+		log.Err(err).Msg("failed to read message body")
+		respondError(log, e, errNextValue.Error())
+		setStreamStatus(w, streamStatusError)
+
+		return false
+	}
+	defer body.Close()
+
+	respondStream(log, w, fw, e, body, size, meta)
+
+	log.Debug().
+		Int("length", size).
+		Msg("streamed message to client")
+
+	return true
+}
+
+// respondSnapshot sends the snapshot of the topic to the client.
+func respondSnapshot(log zerolog.Logger, e *json.Encoder, snap topicSnapshot) {
+	res := signalFrame(signalSnapshot)
+	res.Snapshot = &snap
+
 	if err := e.Encode(res); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
+
+// respondStatus sends the status of the consumer to the client.
+func respondStatus(log zerolog.Logger, e *json.Encoder, status consumerStatus) {
+	res := signalFrame(signalStatus)
+	res.Status = &status
+
+	if err := e.Encode(res); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
+
+// respondEmpty tells a non-blocking consumer that the topic had no messages
+// available.
+func respondEmpty(log zerolog.Logger, e *json.Encoder) {
+	if err := e.Encode(signalFrame(signalEmpty)); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
+
+// respondPeek writes previews of msgs to the client as a single JSON array.
+func respondPeek(log zerolog.Logger, e *json.Encoder, msgs []pendingMessage) {
+	res := make([]peekResponse, 0, len(msgs))
+	for _, m := range msgs {
+		body, truncated := truncate(m.val, peekBodyLen)
+
+		res = append(res, peekResponse{
+			ID:          m.meta.ID,
+			Msg:         string(body),
+			Truncated:   truncated,
+			NackReasons: m.meta.NackReasons,
+			DeadLetter:  newDeadLetterRecord(m.meta),
+		})
+	}
+
+	if err := e.Encode(res); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
+
+// respondHistory writes the retained entries to the client as a single JSON
+// array.
+func respondHistory(log zerolog.Logger, e *json.Encoder, entries []historyEntry) {
+	res := make([]historyResponse, 0, len(entries))
+	for _, h := range entries {
+		res = append(res, historyResponse{
+			ID:          h.Meta.ID,
+			Msg:         string(h.Value),
+			ContentType: h.Meta.ContentType,
+			AckedAt:     h.AckedAt,
+		})
+	}
+
+	if err := e.Encode(res); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
+
+// truncate shortens b to at most n bytes without splitting a UTF-8 sequence.
+func truncate(b []byte, n int) ([]byte, bool) {
+	if len(b) <= n {
+		return b, false
+	}
+
+	for n > 0 && !utf8.RuneStart(b[n]) {
+		n--
+	}
+
+	return b[:n], true
+}
+
+func respondError(log zerolog.Logger, e *json.Encoder, errMsg string) {
+	if err := e.Encode(errorFrame(errMsg)); err != nil {
 		log.Err(err).Msg("writing response to client")
 	}
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestSubscribeFrames(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.NoError(err)
+
+	cmds := strings.Join([]string{
+		`{"cmd":"INIT","block":false,"snapshot":true}`,
+		`"STATUS"`,
+		`"ACK"`,
+		`{`,
+	}, "\n")
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), strings.NewReader(cmds))
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	subscribe(b, flushThreshold{})(subW, r)
+
+	// Decode the frames generically, to assert on their exact shape
+	dec := json.NewDecoder(subW.Body)
+	next := func() map[string]interface{} {
+		var frame map[string]interface{}
+		assert.NoError(dec.Decode(&frame))
+		return frame
+	}
+
+	snapshot := next()
+	assert.Equal(string(signalSnapshot), snapshot["signal"])
+	assert.NotNil(snapshot["snapshot"])
+
+	// Messages carry no signal
+	msg := next()
+	assert.NotContains(msg, "signal")
+	assert.Equal("test_msg", msg["msg"])
+
+	status := next()
+	assert.Equal(string(signalStatus), status["signal"])
+	assert.NotNil(status["status"])
+
+	empty := next()
+	assert.Equal(map[string]interface{}{"signal": "empty", "empty": true}, empty)
+
+	errFrame := next()
+	assert.Equal(map[string]interface{}{"signal": "error", "error": errDecodingCmd.Error()}, errFrame)
+}
+
+func TestKeepaliveFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	rec := NewRecorder()
+	kw := newKeepaliveWriter(rec, time.Second, clock.Now)
+
+	clock.Advance(time.Second)
+	kw.ping()
+
+	var frame map[string]interface{}
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&frame))
+	assert.Equal(map[string]interface{}{"signal": "keepalive", "keepalive": true}, frame)
+}
+
+func TestMessageFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	meta := messageMeta{ID: "id", ContentType: "text/plain", Seq: 2, Deliveries: 2}
+
+	assert.Equal(subResponse{
+		ID:          "id",
+		Msg:         "test_msg",
+		ContentType: "text/plain",
+		Seq:         2,
+		Redelivered: true,
+		Deliveries:  2,
+	}, messageFrame([]byte("test_msg"), meta, false))
+
+	// Streamed messages follow the frame
+	assert.Equal(subResponse{
+		ID:          "id",
+		ContentType: "text/plain",
+		Seq:         2,
+		Redelivered: true,
+		Deliveries:  2,
+		Stream:      true,
+		Length:      8,
+	}, messageFrame([]byte("test_msg"), meta, true))
+}
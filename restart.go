@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envListenFD names the environment variable holding the file descriptor of a
+// listener inherited from a previous process. During a graceful restart, the
+// new process takes over the socket of the old one, which drains its
+// connections, such that no connections are refused.
+const envListenFD = "MINIQUEUE_LISTEN_FD"
+
+// storeRetryInterval is how often opening the store is retried while the
+// previous process still holds it during a graceful restart.
+const storeRetryInterval = 100 * time.Millisecond
+
+// listen returns the listener inherited through envListenFD, if there is one,
+// reporting whether it was inherited. Otherwise a new listener is bound to
+// addr.
+func listen(addr string, getenv func(string) string) (net.Listener, bool, error) {
+	v := getenv(envListenFD)
+	if v == "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, false, fmt.Errorf("listening on %s: %v", addr, err)
+		}
+
+		return ln, false, nil
+	}
+
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < 0 {
+		return nil, false, fmt.Errorf("invalid %s %q, expected a file descriptor", envListenFD, v)
+	}
+
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+
+	// The listener holds its own duplicate of the descriptor
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("inheriting listener from fd %d: %v", fd, err)
+	}
+
+	return ln, true, nil
+}
+
+// openStoreRetry opens the store, retrying for up to wait while it fails. This
+// allows the previous process to finish draining and release the store during
+// a graceful restart.
+func openStoreRetry(dsn string, wait time.Duration, opts ...storeOption) (storer, error) {
+	deadline := time.Now().Add(wait)
+
+	for {
+		s, err := openStore(dsn, opts...)
+		if err == nil || time.Now().After(deadline) {
+			return s, err
+		}
+
+		time.Sleep(storeRetryInterval)
+	}
+}
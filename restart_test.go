@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestListen_Inherited(t *testing.T) {
+	assert := assert.New(t)
+
+	// Open the listener as the previous process would have
+	prev, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+
+	f, err := prev.(*net.TCPListener).File()
+	assert.NoError(err)
+
+	getenv := func(key string) string {
+		if key == envListenFD {
+			return strconv.Itoa(int(f.Fd()))
+		}
+		return ""
+	}
+
+	ln, inherited, err := listen("127.0.0.1:0", getenv)
+	assert.NoError(err)
+	assert.True(inherited)
+	defer ln.Close()
+
+	// The inherited descriptor has already been closed by listen
+	assert.Error(f.Close())
+
+	// No new socket is bound, the inherited socket is served on even once the
+	// previous process has closed its listener
+	assert.Equal(prev.Addr().String(), ln.Addr().String())
+	assert.NoError(prev.Close())
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	httpSrv := &http.Server{Handler: newServer(newBroker(&store{db: db}))}
+	defer httpSrv.Close()
+
+	go httpSrv.Serve(ln)
+
+	res, err := http.Get(fmt.Sprintf("http://%s/topics", ln.Addr()))
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	assert.Equal(http.StatusOK, res.StatusCode)
+}
+
+func TestListen_NotInherited(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, inherited, err := listen("127.0.0.1:0", func(string) string { return "" })
+	assert.NoError(err)
+	assert.False(inherited)
+	assert.NoError(ln.Close())
+}
+
+func TestListen_InvalidFD(t *testing.T) {
+	for _, fd := range []string{"abc", "-1"} {
+		_, _, err := listen("127.0.0.1:0", func(string) string { return fd })
+		assert.Error(t, err)
+	}
+}
+
+func TestOpenStoreRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	// The previous process holds the store until it has drained
+	prev, err := openStore(tmpDBPath)
+	assert.NoError(err)
+	t.Cleanup(prev.Destroy)
+
+	_, err = openStoreRetry(tmpDBPath, 0)
+	assert.Error(err)
+
+	time.AfterFunc(200*time.Millisecond, func() { _ = prev.Close() })
+
+	s, err := openStoreRetry(tmpDBPath, 5*time.Second)
+	assert.NoError(err)
+	assert.NoError(s.Close())
+}
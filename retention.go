@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	historyFmt           = "%s-history-%d"
+	historyHeadPosKeyFmt = "%s-history-head"
+	historyTailPosKeyFmt = "%s-history-tail"
+)
+
+// retention bounds how long acked messages are kept in the history of a
+// topic. A zero duration or count leaves that dimension unbounded.
+type retention struct {
+	dur time.Duration
+	max int
+}
+
+func (r retention) enabled() bool {
+	return r.dur > 0 || r.max > 0
+}
+
+// expired reports whether an entry acked at ackedAt has outlived the
+// retention duration.
+func (r retention) expired(ackedAt, now time.Time) bool {
+	return r.dur > 0 && now.Sub(ackedAt) > r.dur
+}
+
+// withRetention keeps acked messages in the history of their topic for up to
+// dur, and up to max messages per topic, before deleting them.
+func withRetention(dur time.Duration, max int) storeOption {
+	return func(s *store) {
+		s.retention = retention{dur: dur, max: max}
+	}
+}
+
+// historyEntry is an acked message retained in the history of a topic.
+type historyEntry struct {
+	Value   value       `json:"value"`
+	Meta    messageMeta `json:"meta"`
+	AckedAt time.Time   `json:"acked_at"`
+}
+
+// retain adds the values awaiting acknowledgement at ackOffsets to the
+// history of the topic, evicting entries which exceed the retention. Writes
+// are added to batch.
+func (s *store) retain(batch *leveldb.Batch, topic string, ackOffsets []int, now time.Time) error {
+	head, tail, err := s.historyPos(topic)
+	if err != nil {
+		return err
+	}
+
+	// Entries from here on are only in the batch, and are never expired
+	added := tail
+
+	for _, ackOffset := range ackOffsets {
+		val, err := getValue(s.db, ackTopicFmt, topic, ackOffset)
+		if errors.Is(err, errNoMessages) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		meta, err := getMeta(s.db, ackMetaFmt, topic, ackOffset)
+		if err != nil {
+			return err
+		}
+
+		// The body is deleted along with the value, so is retained whole
+		if meta.BodySize > 0 {
+			if val, err = getBody(s.db, topic, meta); err != nil {
+				return err
+			}
+
+			meta.BodySize = 0
+		}
+
+		b, err := json.Marshal(historyEntry{Value: val, Meta: meta, AckedAt: now})
+		if err != nil {
+			return fmt.Errorf("encoding history entry: %v", err)
+		}
+
+		batch.Put([]byte(fmt.Sprintf(historyFmt, topic, tail)), b)
+		tail++
+	}
+
+	if tail == added {
+		return nil
+	}
+
+	for ; head < tail; head++ {
+		if s.retention.max > 0 && tail-head > s.retention.max {
+			batch.Delete([]byte(fmt.Sprintf(historyFmt, topic, head)))
+			continue
+		}
+
+		if head >= added {
+			break
+		}
+
+		entry, err := getHistoryEntry(s.db, topic, head)
+		if err != nil {
+			return err
+		}
+		if !s.retention.expired(entry.AckedAt, now) {
+			break
+		}
+
+		batch.Delete([]byte(fmt.Sprintf(historyFmt, topic, head)))
+	}
+
+	batch.Put([]byte(fmt.Sprintf(historyHeadPosKeyFmt, topic)), encodePos(head))
+	batch.Put([]byte(fmt.Sprintf(historyTailPosKeyFmt, topic)), encodePos(tail))
+
+	return nil
+}
+
+// History returns the acked messages retained for the topic, oldest first.
+func (s *store) History(topic string) ([]historyEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	head, tail, err := s.historyPos(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.clock()
+
+	var entries []historyEntry
+	for offset := head; offset < tail; offset++ {
+		entry, err := getHistoryEntry(s.db, topic, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		// Expired entries are evicted on the next ack
+		if s.retention.expired(entry.AckedAt, now) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// historyPos returns the head and tail positions of the history of the topic.
+func (s *store) historyPos(topic string) (head, tail int, err error) {
+	head, err = getPos(s.db, historyHeadPosKeyFmt, topic)
+	if errors.Is(err, errTopicNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tail, err = getPos(s.db, historyTailPosKeyFmt, topic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return head, tail, nil
+}
+
+func getHistoryEntry(db *leveldb.DB, topic string, offset int) (historyEntry, error) {
+	b, err := db.Get([]byte(fmt.Sprintf(historyFmt, topic, offset)), nil)
+	if err != nil {
+		return historyEntry{}, fmt.Errorf("getting history entry from topic %s at offset %d: %v", topic, offset, err)
+	}
+
+	var entry historyEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return historyEntry{}, fmt.Errorf("decoding history entry: %v", err)
+	}
+
+	return entry, nil
+}
+
+func encodePos(pos int) []byte {
+	b := make([]byte, 8)
+	binary.PutVarint(b, int64(pos))
+
+	return b
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func helperAckValues(t *testing.T, s storer, topic string, vals ...string) {
+	t.Helper()
+
+	for i, v := range vals {
+		assert.NoError(t, s.Insert(topic, []byte(v), messageMeta{ID: fmt.Sprint(i)}))
+
+		_, _, ao, err := s.GetNext(topic)
+		assert.NoError(t, err)
+		assert.NoError(t, s.Ack(topic, ao))
+	}
+}
+
+func TestHistory_Disabled(t *testing.T) {
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	helperAckValues(t, s, defaultTopic, "test_value_1")
+
+	entries, err := s.History(defaultTopic)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestHistory_AfterAck(t *testing.T) {
+	s := newStore(tmpDBPath, withRetention(time.Hour, 0))
+	t.Cleanup(s.Destroy)
+
+	before := time.Now()
+	helperAckValues(t, s, defaultTopic, "test_value_1", "test_value_2")
+
+	entries, err := s.History(defaultTopic)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	assert.Equal(t, value("test_value_1"), entries[0].Value)
+	assert.Equal(t, "0", entries[0].Meta.ID)
+	assert.Equal(t, value("test_value_2"), entries[1].Value)
+	assert.Equal(t, "1", entries[1].Meta.ID)
+	assert.False(t, entries[0].AckedAt.Before(before))
+
+	// Unacked values are not part of the history
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_3"), messageMeta{}))
+	_, _, _, err = s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+
+	entries, err = s.History(defaultTopic)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestHistory_EvictsPastMax(t *testing.T) {
+	s := newStore(tmpDBPath, withRetention(0, 2))
+	t.Cleanup(s.Destroy)
+
+	helperAckValues(t, s, defaultTopic, "test_value_1", "test_value_2", "test_value_3")
+
+	entries, err := s.History(defaultTopic)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, value("test_value_2"), entries[0].Value)
+	assert.Equal(t, value("test_value_3"), entries[1].Value)
+
+	// Evicted entries are deleted from the db
+	has, err := s.(*store).db.Has([]byte(fmt.Sprintf(historyFmt, defaultTopic, 0)), nil)
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestHistory_EvictsExpired(t *testing.T) {
+	s := newStore(tmpDBPath, withRetention(50*time.Millisecond, 0))
+	t.Cleanup(s.Destroy)
+
+	helperAckValues(t, s, defaultTopic, "test_value_1")
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Expired entries are hidden before being evicted
+	entries, err := s.History(defaultTopic)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	helperAckValues(t, s, defaultTopic, "test_value_2")
+
+	entries, err = s.History(defaultTopic)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, value("test_value_2"), entries[0].Value)
+
+	has, err := s.(*store).db.Has([]byte(fmt.Sprintf(historyFmt, defaultTopic, 0)), nil)
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestGetHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db, retention: retention{max: 10}}
+	b := newBroker(s)
+
+	id, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{ContentType: "text/plain"})
+	assert.NoError(err)
+
+	_, _, ao, err := s.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.NoError(s.Ack(defaultTopic, ao))
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/history/%s", defaultTopic), nil)
+	newServer(b).ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var out []historyResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Len(out, 1)
+	assert.Equal(id, out[0].ID)
+	assert.Equal("test_value", out[0].Msg)
+	assert.Equal("text/plain", out[0].ContentType)
+	assert.False(out[0].AckedAt.IsZero())
+}
@@ -0,0 +1,41 @@
+package main
+
+// message is a published message, as seen by a router.
+type message struct {
+	Value value
+	Meta  messageMeta
+}
+
+// router decides the topics a message published to topic is delivered to.
+type router func(topic string, msg message) []string
+
+// withRouter routes each publish to the topics returned by r, allowing
+// messages to be fanned out, sharded or rerouted based on their content or
+// headers. Without a router, messages are published to the requested topic.
+func withRouter(r router) brokerOption {
+	return func(b *broker) {
+		b.router = r
+	}
+}
+
+// route returns the distinct topics a message published to topic is delivered
+// to.
+func (b *broker) route(topic string, msg message) []string {
+	if b.router == nil {
+		return []string{topic}
+	}
+
+	seen := map[string]bool{}
+
+	var topics []string
+	for _, t := range b.router(topic, msg) {
+		if t == "" || seen[t] {
+			continue
+		}
+
+		seen[t] = true
+		topics = append(topics, t)
+	}
+
+	return topics
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestRouter_FanOut(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withRouter(func(topic string, msg message) []string {
+		return []string{topic, topic + "_copy", topic}
+	}))
+
+	id, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	for _, topic := range []string{defaultTopic, defaultTopic + "_copy"} {
+		c := b.Subscribe(topic)
+
+		val, err := c.TryNext(context.Background())
+		assert.NoError(err)
+		assert.Equal(value("test_value"), val)
+		assert.Equal(id, c.Meta().ID)
+
+		// Duplicate topics are only published to once
+		_, err = c.TryNext(context.Background())
+		assert.Equal(errNoMessages, err)
+	}
+}
+
+func TestRouter_RerouteOnHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withRouter(func(topic string, msg message) []string {
+		if region := msg.Meta.Header.Get("X-Region"); region != "" {
+			return []string{topic + "_" + region}
+		}
+
+		return []string{topic}
+	}))
+
+	srv := newServer(b)
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("eu_value"))
+	req.Header.Set("X-Region", "eu")
+	srv.ServeHTTP(rec, req)
+	assert.Equal(http.StatusCreated, rec.Code)
+
+	rec = NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("default_value"))
+	srv.ServeHTTP(rec, req)
+	assert.Equal(http.StatusCreated, rec.Code)
+
+	eu := b.Subscribe(defaultTopic + "_eu")
+	val, err := eu.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("eu_value"), val)
+	assert.Nil(eu.Meta().Header)
+
+	def := b.Subscribe(defaultTopic)
+	val, err = def.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("default_value"), val)
+
+	_, err = def.TryNext(context.Background())
+	assert.Equal(errNoMessages, err)
+}
+
+func TestRouter_NoRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withRouter(func(topic string, msg message) []string {
+		return nil
+	}))
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("test_value"))
+	newServer(b).ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnprocessableEntity, rec.Code)
+}
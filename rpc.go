@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// JSON-RPC error codes of requests which couldn't be dispatched. Errors
+// returned by the dispatched method have the HTTP status of its endpoint as
+// their code.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// rpcParams are the params accepted by the RPC methods, each using those it
+// needs.
+type rpcParams struct {
+	Topic       string `json:"topic"`
+	Msg         string `json:"msg"`
+	ContentType string `json:"content_type"`
+	Key         string `json:"key"`
+	ReplyTo     string `json:"reply_to"`
+	Notify      string `json:"notify"`
+	DeliverBy   string `json:"deliver_by"`
+	TTL         string `json:"ttl"`
+	Delay       string `json:"delay"`
+	DeliverAt   string `json:"deliver_at"`
+	Prefix      string `json:"prefix"`
+	HasPending  *bool  `json:"has_pending"`
+	Group       string `json:"group"`
+	Max         int    `json:"max"`
+	MaxBytes    int    `json:"max_bytes"`
+
+	Messages []txMessage `json:"messages"`
+}
+
+// rpcMethod builds the request to the endpoint implementing the method.
+type rpcMethod struct {
+	// needsTopic rejects calls without a topic.
+	needsTopic bool
+	request    func(p rpcParams) (*http.Request, error)
+
+	// result transforms the response of the endpoint into the result of the
+	// method, nil uses it as is.
+	result func(p rpcParams, body []byte) (json.RawMessage, error)
+}
+
+// rpcMethods maps each RPC method onto the endpoint implementing it. Streaming
+// subscribes aren't available over RPC.
+var rpcMethods = map[string]rpcMethod{
+	"publish": {
+		needsTopic: true,
+		request: func(p rpcParams) (*http.Request, error) {
+			q := url.Values{}
+			setQuery(q, notifyQueryKey, p.Notify)
+			setQuery(q, deliverByQueryKey, p.DeliverBy)
+			setQuery(q, ttlQueryKey, p.TTL)
+			setQuery(q, delayQueryKey, p.Delay)
+			setQuery(q, deliverAtQueryKey, p.DeliverAt)
+
+			r, err := rpcEndpoint(http.MethodPost, "/publish/"+url.PathEscape(p.Topic), q, bytes.NewReader([]byte(p.Msg)))
+			if err != nil {
+				return nil, err
+			}
+
+			setHeader(r.Header, "Content-Type", p.ContentType)
+			setHeader(r.Header, headerKey, p.Key)
+			setHeader(r.Header, headerReplyTo, p.ReplyTo)
+
+			return r, nil
+		},
+	},
+	"tx": {
+		request: func(p rpcParams) (*http.Request, error) {
+			body, err := json.Marshal(txRequest{Messages: p.Messages})
+			if err != nil {
+				return nil, err
+			}
+
+			return rpcEndpoint(http.MethodPost, "/tx", nil, bytes.NewReader(body))
+		},
+	},
+	"topics": {
+		request: func(p rpcParams) (*http.Request, error) {
+			return rpcEndpoint(http.MethodGet, "/topics", topicsQuery(p.Prefix, p.HasPending), nil)
+		},
+	},
+	"stats": {
+		needsTopic: true,
+		request: func(p rpcParams) (*http.Request, error) {
+			return rpcEndpoint(http.MethodGet, "/topics", topicsQuery(p.Topic, nil), nil)
+		},
+		result: func(p rpcParams, body []byte) (json.RawMessage, error) {
+			var topics []topicStats
+			if err := json.Unmarshal(body, &topics); err != nil {
+				return nil, err
+			}
+
+			// The listing matches by prefix, and omits topics never published to
+			stats := topicStats{Topic: p.Topic}
+			for _, t := range topics {
+				if t.Topic == p.Topic {
+					stats = t
+				}
+			}
+
+			return json.Marshal(stats)
+		},
+	},
+	"config": {
+		needsTopic: true,
+		request: func(p rpcParams) (*http.Request, error) {
+			return rpcEndpoint(http.MethodGet, "/topics/"+url.PathEscape(p.Topic)+"/config", nil, nil)
+		},
+	},
+	"processing_time": {
+		needsTopic: true,
+		request: func(p rpcParams) (*http.Request, error) {
+			return rpcEndpoint(http.MethodGet, "/topics/"+url.PathEscape(p.Topic)+"/processing-time", nil, nil)
+		},
+	},
+	"history": {
+		needsTopic: true,
+		request: func(p rpcParams) (*http.Request, error) {
+			return rpcEndpoint(http.MethodGet, "/history/"+url.PathEscape(p.Topic), nil, nil)
+		},
+	},
+	"drain": {
+		needsTopic: true,
+		request: func(p rpcParams) (*http.Request, error) {
+			q := url.Values{}
+			if p.Max > 0 {
+				q.Set(drainMaxQueryKey, strconv.Itoa(p.Max))
+			}
+			if p.MaxBytes > 0 {
+				q.Set(drainMaxBytesQueryKey, strconv.Itoa(p.MaxBytes))
+			}
+
+			return rpcEndpoint(http.MethodPost, "/drain/"+url.PathEscape(p.Topic), q, nil)
+		},
+	},
+	"consumers": {
+		needsTopic: true,
+		request: func(p rpcParams) (*http.Request, error) {
+			q := url.Values{}
+			setQuery(q, groupQueryKey, p.Group)
+
+			return rpcEndpoint(http.MethodGet, "/consumers/"+url.PathEscape(p.Topic), q, nil)
+		},
+	},
+	"recovery": {
+		request: func(p rpcParams) (*http.Request, error) {
+			return rpcEndpoint(http.MethodGet, "/recovery", nil, nil)
+		},
+	},
+}
+
+func rpcEndpoint(method, path string, q url.Values, body io.Reader) (*http.Request, error) {
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	return http.NewRequest(method, path, body)
+}
+
+func topicsQuery(prefix string, hasPending *bool) url.Values {
+	q := url.Values{}
+	setQuery(q, prefixQueryKey, prefix)
+	if hasPending != nil {
+		q.Set(hasPendingQueryKey, strconv.FormatBool(*hasPending))
+	}
+
+	return q
+}
+
+func setQuery(q url.Values, key, val string) {
+	if val != "" {
+		q.Set(key, val)
+	}
+}
+
+func setHeader(h http.Header, key, val string) {
+	if val != "" {
+		h.Set(key, val)
+	}
+}
+
+// rpc dispatches a JSON-RPC style request to the endpoint implementing its
+// method, for clients only able to reach a single endpoint. The response is
+// always 200, with the outcome of the method in its result or error.
+func (s server) rpc(w http.ResponseWriter, r *http.Request) {
+	log := log.With().
+		Str("request_id", xid.New().String()).
+		Str("handler", "rpc").
+		Logger()
+
+	var req rpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Debug().Err(err).Msg("failed to decode rpc request")
+		respondRPC(log, w, rpcResponse{Error: &rpcError{Code: rpcParseError, Message: "parse error"}})
+
+		return
+	}
+	defer r.Body.Close()
+
+	res := rpcResponse{ID: req.ID}
+
+	log = log.With().Str("method", req.Method).Logger()
+
+	if req.Method == "" {
+		res.Error = &rpcError{Code: rpcInvalidRequest, Message: "invalid request, method is required"}
+		respondRPC(log, w, res)
+
+		return
+	}
+
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		log.Debug().Msg("unknown rpc method")
+
+		res.Error = &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+		respondRPC(log, w, res)
+
+		return
+	}
+
+	var params rpcParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			res.Error = &rpcError{Code: rpcInvalidParams, Message: "invalid params"}
+			respondRPC(log, w, res)
+
+			return
+		}
+	}
+
+	if method.needsTopic && params.Topic == "" {
+		res.Error = &rpcError{Code: rpcInvalidParams, Message: "invalid params, topic is required"}
+		respondRPC(log, w, res)
+
+		return
+	}
+
+	inner, err := method.request(params)
+	if err != nil {
+		log.Err(err).Msg("failed to build rpc request")
+
+		res.Error = &rpcError{Code: rpcInvalidParams, Message: "invalid params"}
+		respondRPC(log, w, res)
+
+		return
+	}
+
+	// Carry the client's connection, such that per connection limits apply
+	inner = inner.WithContext(r.Context())
+
+	rec := newRPCRecorder()
+	s.ServeHTTP(rec, inner)
+
+	body := bytes.TrimSpace(rec.body.Bytes())
+
+	if rec.code >= http.StatusBadRequest {
+		var e subResponse
+		_ = json.Unmarshal(body, &e)
+		if e.Error == "" {
+			e.Error = http.StatusText(rec.code)
+		}
+
+		res.Error = &rpcError{Code: rec.code, Message: e.Error}
+		respondRPC(log, w, res)
+
+		return
+	}
+
+	switch {
+	case method.result != nil:
+		if res.Result, err = method.result(params, body); err != nil {
+			log.Err(err).Msg("failed to build rpc result")
+
+			res.Error = &rpcError{Code: http.StatusInternalServerError, Message: "failed to build result"}
+		}
+	case len(body) > 0:
+		res.Result = body
+	default:
+		res.Result = json.RawMessage("null")
+	}
+
+	respondRPC(log, w, res)
+}
+
+func respondRPC(log zerolog.Logger, w http.ResponseWriter, res rpcResponse) {
+	res.JSONRPC = "2.0"
+	if len(res.ID) == 0 {
+		res.ID = json.RawMessage("null")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
+
+// rpcRecorder captures the response of an endpoint dispatched to by an RPC.
+type rpcRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newRPCRecorder() *rpcRecorder {
+	return &rpcRecorder{header: http.Header{}, code: http.StatusOK}
+}
+
+func (rr *rpcRecorder) Header() http.Header         { return rr.header }
+func (rr *rpcRecorder) Write(p []byte) (int, error) { return rr.body.Write(p) }
+func (rr *rpcRecorder) WriteHeader(code int)        { rr.code = code }
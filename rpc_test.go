@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func helperCallRPC(t *testing.T, s *server, body string) rpcResponse {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/rpc", bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var res rpcResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, "2.0", res.JSONRPC)
+
+	return res
+}
+
+func TestRPC(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	s := newServer(b)
+
+	// Publish dispatches to the publish endpoint
+	res := helperCallRPC(t, s, `{"jsonrpc":"2.0","id":1,"method":"publish","params":{"topic":"test_topic","msg":"test_msg"}}`)
+	assert.Nil(res.Error)
+	assert.JSONEq(`1`, string(res.ID))
+
+	var published subResponse
+	assert.NoError(json.Unmarshal(res.Result, &published))
+	assert.NotEmpty(published.ID)
+
+	msgs, err := b.store.Peek(defaultTopic, 1)
+	assert.NoError(err)
+	assert.Equal(value("test_msg"), msgs[0].val)
+	assert.Equal(published.ID, msgs[0].meta.ID)
+
+	// Stats returns the topic's entry of the listing
+	res = helperCallRPC(t, s, `{"jsonrpc":"2.0","id":"two","method":"stats","params":{"topic":"test_topic"}}`)
+	assert.Nil(res.Error)
+	assert.JSONEq(`"two"`, string(res.ID))
+
+	var stats topicStats
+	assert.NoError(json.Unmarshal(res.Result, &stats))
+	assert.Equal(topicStats{Topic: defaultTopic, Pending: 1}, stats)
+
+	// Including those of topics never published to
+	res = helperCallRPC(t, s, `{"jsonrpc":"2.0","id":3,"method":"stats","params":{"topic":"test"}}`)
+	assert.Nil(res.Error)
+	assert.JSONEq(`{"topic":"test","pending":0,"subscribers":0}`, string(res.Result))
+}
+
+func TestRPC_Errors(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(t, err)
+
+	s := newServer(newBroker(&store{db: db}))
+
+	tests := []struct {
+		name    string
+		body    string
+		code    int
+		message string
+	}{
+		{
+			name:    "unknown method",
+			body:    `{"jsonrpc":"2.0","id":1,"method":"subscribe","params":{"topic":"test_topic"}}`,
+			code:    rpcMethodNotFound,
+			message: `method "subscribe" not found`,
+		},
+		{
+			name:    "malformed request",
+			body:    `{"method":`,
+			code:    rpcParseError,
+			message: "parse error",
+		},
+		{
+			name:    "missing method",
+			body:    `{"jsonrpc":"2.0","id":1}`,
+			code:    rpcInvalidRequest,
+			message: "invalid request, method is required",
+		},
+		{
+			name:    "missing topic",
+			body:    `{"jsonrpc":"2.0","id":1,"method":"publish","params":{"msg":"test_msg"}}`,
+			code:    rpcInvalidParams,
+			message: "invalid params, topic is required",
+		},
+		{
+			name:    "failed method",
+			body:    `{"jsonrpc":"2.0","id":1,"method":"publish","params":{"topic":"test_topic","msg":"test_msg","delay":"soon"}}`,
+			code:    http.StatusBadRequest,
+			message: errInvalidDelay.Error(),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			res := helperCallRPC(t, s, tc.body)
+			assert.Nil(res.Result)
+
+			if assert.NotNil(res.Error) {
+				assert.Equal(tc.code, res.Error.Code)
+				assert.Equal(tc.message, res.Error.Message)
+			}
+		})
+	}
+}
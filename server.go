@@ -2,18 +2,54 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/xid"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-const topicVarKey = "topic"
+const (
+	topicVarKey = "topic"
+
+	// notifyQueryKey is the publish query parameter holding the URL a receipt
+	// is sent to once the message has been consumed.
+	notifyQueryKey = "notify"
+	// deliverByQueryKey is the publish query parameter holding the time after
+	// which the message is dropped rather than delivered.
+	deliverByQueryKey = "deliverBy"
+	// ttlQueryKey is the publish query parameter holding how long after it is
+	// published the message expires, e.g. 30s.
+	ttlQueryKey = "ttl"
+	// delayQueryKey is the publish query parameter holding how long the
+	// message is held before it is published, e.g. 30s.
+	delayQueryKey = "delay"
+	// deliverAtQueryKey is the publish query parameter holding the time at
+	// which the message is published, as an alternative to a delay.
+	deliverAtQueryKey = "deliverAt"
+	// rateQueryKey is the subscribe query parameter limiting the rate messages
+	// are delivered to the consumer, e.g. 10/s.
+	rateQueryKey = "rate"
+	// groupQueryKey is the subscribe query parameter naming the consumer group
+	// the consumer joins.
+	groupQueryKey = "group"
+	// broadcastQueryKey is the subscribe query parameter which, set to true,
+	// delivers every message published to the topic to the consumer, rather
+	// than sharing them with its other consumers.
+	broadcastQueryKey = "broadcast"
+	// disconnectQueryKey is the subscribe query parameter overriding the
+	// disconnect policy of the consumer, either nack or ack.
+	disconnectQueryKey = "on_disconnect"
+)
 
 const (
 	// CmdInit is the command to be sent with the initial subscribe request to
@@ -25,6 +61,45 @@ const (
 	// CmdNack notifies the server that the outstanding message was processed
 	// unsuccessfully and should be prepended to the queue to be processed again.
 	CmdNack = "NACK"
+	// CmdClose notifies the server that the client wishes to end the stream. Any
+	// outstanding message is returned to the queue.
+	CmdClose = "CLOSE"
+	// CmdPeekAll requests a preview of the messages waiting on the topic,
+	// without consuming them or affecting the outstanding message.
+	CmdPeekAll = "PEEKALL"
+	// CmdCommit acknowledges every outstanding message delivered up to and
+	// including a sequence number at once.
+	CmdCommit = "COMMIT"
+	// CmdStatus requests the message outstanding on the consumer, without
+	// changing any state.
+	CmdStatus = "STATUS"
+)
+
+const (
+	// trailerStreamStatus is the HTTP trailer sent at the end of a subscribe
+	// stream, allowing clients to distinguish an intentional end of stream from
+	// a dropped connection.
+	trailerStreamStatus = "X-MQ-Status"
+
+	// headerReplyTo is the publish header naming the topic a consumer's result
+	// is published to when it ACKs the message.
+	headerReplyTo = "X-MQ-Reply-To"
+
+	// headerKey is the publish header holding the key of the message, used to
+	// compact topics.
+	headerKey = "X-MQ-Key"
+
+	// headerPartitionKey is the publish header holding the partition key of
+	// the message, ordering it among the messages with the same key on a
+	// partitioned topic. It defaults to the key of the message.
+	headerPartitionKey = "X-MQ-Partition-Key"
+
+	// headerPrefix prefixes the publish headers kept with the message and
+	// delivered along with it, e.g. X-Miniqueue-Trace-Id.
+	headerPrefix = "X-Miniqueue-"
+
+	streamStatusClosed = "closed"
+	streamStatusError  = "error"
 )
 
 const (
@@ -36,6 +111,86 @@ const (
 	errNack              = serverError("error NACKing message")
 	errDecodingCmd       = serverError("error decoding command")
 	errRequestCancelled  = serverError("request context cancelled")
+	errSubscribeLimit    = serverError("too many subscribers, try again later")
+	errPeek              = serverError("failed to peek messages")
+	errSnapshot          = serverError("failed to snapshot topic")
+	errHistory           = serverError("failed to get topic history")
+	errListTopics        = serverError("failed to list topics")
+	errResetDeliveries   = serverError("failed to reset delivery counts")
+	errInvalidRate       = serverError("invalid rate, expected a positive number per s, m or h e.g. 10/s")
+	errInvalidAckTimeout = serverError("invalid ack timeout, expected a positive duration e.g. 30s")
+	errInvalidFrom       = serverError("invalid from, expected earliest, latest or an offset")
+	errReplayDisabled    = serverError("replay is not enabled, see -replay-retention and -replay-max")
+	errSeek              = serverError("failed to seek topic")
+	errInvalidPrefetch   = serverError("invalid prefetch, expected a positive integer up to 1000")
+	errPrefetchReplay    = serverError("prefetch is not supported while replaying")
+	errDisconnectPolicy  = serverError("invalid disconnect policy, expected nack or ack")
+	errMaintenance       = serverError("server is in maintenance mode, publishing is disabled")
+	errShuttingDown      = serverError("server is shutting down")
+	errTopicFullPublish  = serverError("topic is full")
+	errStoreFullPublish  = serverError("store is out of space")
+	errDecodingConfig    = serverError("error decoding topic config")
+	errSetConfig         = serverError("error setting topic config")
+	errReservedTopic     = serverError("invalid topic, names starting with miniqueue- are reserved")
+	errInvalidNotifyURL  = serverError("invalid notify URL")
+	errInvalidCommit     = serverError("invalid commit, expected a positive seq")
+	errCommit            = serverError("error committing messages")
+	errInvalidDeliverBy  = serverError("invalid deliverBy, expected an RFC 3339 time e.g. 2020-01-01T00:00:00Z")
+	errInvalidTTL        = serverError("invalid ttl, expected a positive duration e.g. 30s")
+	errContentType       = serverError("content type not accepted by topic")
+	errNotFound          = serverError("not found")
+	errMethodNotAllowed  = serverError("method not allowed")
+	errConnectionCap     = serverError("connection exceeded its maximum number of operations, reconnect to continue")
+	errWriteTimeout      = serverError("write to client timed out")
+	errReadTimeout       = serverError("read from client timed out")
+	errInvalidDrainMax   = serverError("invalid max, expected a positive number of messages")
+	errInvalidMaxBytes   = serverError("invalid maxBytes, expected a positive number of bytes")
+	errDrain             = serverError("failed to drain topic")
+	errDecodingTx        = serverError("error decoding transaction")
+	errEmptyTx           = serverError("transaction has no messages")
+	errDecodingBatch     = serverError("error decoding batch, expected a JSON array or one message per line")
+	errEmptyBatch        = serverError("batch has no messages")
+	errInvalidDelay      = serverError("invalid delay, expected a positive duration e.g. 30s")
+	errDelayedLimit      = serverError("too many delayed messages, try again later")
+	errInvalidDeliverAt  = serverError("invalid deliverAt, expected an RFC 3339 time e.g. 2020-01-01T00:00:00Z")
+	errDelayConflict     = serverError("only one of delay and deliverAt may be given")
+	errKicked            = serverError("consumer disconnected by operator")
+	errDisconnect        = serverError("failed to disconnect consumer")
+	errInvalidWeight     = serverError("invalid weight, expected a positive integer")
+	errInvalidDecodeErrs = serverError("invalid max_decode_errors, expected a positive integer")
+	errPeekTopic         = serverError("failed to peek topic")
+	errFollower          = serverError("instance is a read-only follower, send writes to the primary")
+	errReplicate         = serverError("failed to start replication")
+	errInternal          = serverError("internal server error")
+	errFetch             = serverError("failed to fetch message")
+	errResolveReceipt    = serverError("failed to resolve receipt")
+	errExport            = serverError("failed to export topic")
+	errImport            = serverError("failed to import messages")
+	errDecodingImport    = serverError("error decoding imported messages, expected one exported message per line")
+	errInvalidImportMode = serverError("invalid mode, expected append or replace")
+	errTopicConflict     = serverError("topic named by the path, query and header must match")
+	errHandshake         = serverError(`invalid handshake, expected {"hello": "` + protocolVersion + `"} before any command`)
+	errHandshakeTimeout  = serverError("timed out waiting for handshake")
+	errConfirmed         = serverError("failed to get confirmed message")
+	errReplay            = serverError("failed to replay message")
+	errNoPeers           = serverError("federated subscribe requires the server to be started with peers")
+	errFederatedCmd      = serverError("command not supported on a federated subscription")
+	errFederatedResolve  = serverError("failed to resolve message at the instance it came from")
+	errPeerUnavailable   = serverError("peer is unavailable")
+	errPeerRejected      = serverError("peer rejected command")
+	errRecover           = serverError("failed to recover dead-lettered messages")
+	errTopicStats        = serverError("failed to get topic stats")
+	errPurge             = serverError("failed to purge topic")
+	errDeleteTopic       = serverError("failed to delete topic")
+	errJoinGroup         = serverError("failed to join consumer group")
+	errReservedGroup     = serverError("invalid group, names starting with broadcast- or partition- are reserved")
+	errBroadcastGroup    = serverError("invalid subscription, broadcast consumers can't join a group")
+	errInvalidPriority   = serverError("invalid priority, expected 0 to 9")
+	errReplicaAck        = serverError("invalid replication ack")
+	errUnknownFollower   = serverError("unknown follower")
+	errNotReplicated     = serverError("stored on the primary, but not applied by enough followers in time")
+	errInvalidTapEvent   = serverError("invalid event, expected publish or deliver")
+	errWebSocketClosed   = serverError("WebSocket connection closed")
 )
 
 type serverError string
@@ -45,29 +200,223 @@ func (e serverError) Error() string {
 }
 
 type brokerer interface {
-	Publish(topic string, value value) error
+	Publish(topic string, value value, meta messageMeta) (id string, err error)
+	PublishTx(msgs []record) (ids []string, err error)
+	PublishBatch(topic string, msgs []pendingMessage) (ids []string, errs []error, err error)
+	PublishDelayed(topic string, value value, meta messageMeta, delay time.Duration) (id string, err error)
+	NotifyPermitted(rawURL string) bool
 	Subscribe(topic string) *consumer
+	SubscribeGroup(topic, group string) (*consumer, error)
+	SubscribeBroadcast(topic string) *consumer
+	Unsubscribe(cons *consumer)
+	SetWeight(cons *consumer, weight int)
+	TopicConfig(topic string) topicConfig
+	SetTopicConfig(topic string, cfg topicConfig) error
+	History(topic string) ([]historyEntry, error)
+	Peek(topic string, limit int) ([]pendingMessage, error)
+	RecoveryReport() recoveryReport
+	ResetDeliveries(topic string) (int, error)
+	RecoverDeadLetters(topic string) (recoverSummary, error)
+	Tap(topic string, events map[tapEvent]bool) *tap
+	Untap(t *tap)
+	Topics(filter topicFilter) ([]topicStats, error)
+	TopicStats(topic string) (topicDetail, error)
+	PurgeTopic(topic string) (purged int, err error)
+	DeleteTopic(topic string) error
+	Drain(topic string, max, maxBytes int) ([]pendingMessage, error)
+	ProcessingTime(topic string) histogramSnapshot
+	Throughput(topic string) throughput
+	ConsumerIDs(topic string) []string
+	DisconnectConsumer(topic, id string) error
+	StopDelivering(ctx context.Context) error
+	Fetch(topic, id string) (*consumer, value, error)
+	AckReceipt(receipt string) error
+	NackReceipt(receipt, reason string) error
+	Export(topic string, fn func(msg pendingMessage) error) error
+	Import(topic string, msgs []pendingMessage, replace bool) error
+	Confirmed(topic, id string) (confirmedMessage, error)
+	Replay(topic, id string) (string, error)
+	Seek(cons *consumer, from replayFrom) error
 }
 
 type server struct {
-	broker brokerer
+	broker      brokerer
+	limiter     *subLimiter
+	maintenance *maintenance
+	shutdown    *shutdown
+	keepalive   time.Duration
+	connCap     *connCap
+	flush       flushThreshold
+
+	// writeTimeout bounds each write to a subscribe connection, zero waits
+	// indefinitely.
+	writeTimeout time.Duration
+
+	// readTimeout bounds how long a subscribe connection waits for the next
+	// command, zero waits indefinitely.
+	readTimeout  time.Duration
+	tcpKeepalive time.Duration
+
+	// handshake is how long a subscriber is given to send its hello, zero
+	// requires no handshake.
+	handshake time.Duration
+
+	// replication streams the store to followers, nil disables replication.
+	replication *replicatedStore
+
+	// ackReplicas is the number of followers which must apply a publish
+	// before it is acknowledged, waiting up to ackTimeout. Zero doesn't wait.
+	ackReplicas int
+	ackTimeout  time.Duration
+
+	// primary is the address of the primary of a follower, which only serves
+	// reads. Empty if the server isn't a follower.
+	primary string
+
+	// peers are the instances whose messages federated subscriptions stream
+	// alongside those of this instance, connected to with peerClient.
+	peers      []string
+	peerClient *http.Client
+}
+
+// serverOption configures optional behaviour of the server.
+type serverOption func(*server)
+
+// withSubscribeLimit limits the number of concurrent subscribe connections in
+// total and per topic. A limit of zero is unlimited.
+func withSubscribeLimit(max, maxTopic int) serverOption {
+	return func(s *server) {
+		s.limiter = newSubLimiter(max, maxTopic)
+	}
+}
+
+// withKeepalive sends a keepalive on subscribe connections which have had
+// nothing written to them for the interval. Zero disables keepalives.
+func withKeepalive(interval time.Duration) serverOption {
+	return func(s *server) {
+		s.keepalive = interval
+	}
 }
 
-func newServer(broker brokerer) *server {
-	return &server{
-		broker: broker,
+// withFlushThreshold coalesces the responses to commands pipelined by a
+// subscriber, flushing once the given number of bytes or writes is reached,
+// or once the pipelined commands run out. Zero values flush every write.
+func withFlushThreshold(bytes, writes int) serverOption {
+	return func(s *server) {
+		s.flush = flushThreshold{bytes: bytes, writes: writes}
 	}
 }
 
+// withConnectionCap closes client connections once they have made max
+// publishes and subscribe commands. Zero is unlimited.
+func withConnectionCap(max int) serverOption {
+	return func(s *server) {
+		s.connCap = newConnCap(max)
+	}
+}
+
+func newServer(broker brokerer, opts ...serverOption) *server {
+	s := &server{
+		broker:      broker,
+		limiter:     newSubLimiter(0, 0),
+		maintenance: &maintenance{},
+		shutdown:    &shutdown{},
+		connCap:     newConnCap(0),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
 func (s server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	route := mux.NewRouter()
+	route.Use(recoverPanics)
+	route.Use(rejectOnFollower(s.primary))
+	route.NotFoundHandler = respondRouteError(http.StatusNotFound, errNotFound)
+	route.MethodNotAllowedHandler = respondRouteError(http.StatusMethodNotAllowed, errMethodNotAllowed)
+
+	replicated := func(next http.HandlerFunc) http.HandlerFunc {
+		return awaitReplicas(s.replication, s.ackReplicas, s.ackTimeout, next)
+	}
+
+	publishHandler := resolveTopic(rejectOnShutdown(s.shutdown, capPublishes(s.connCap, rejectDuringMaintenance(s.maintenance, replicated(publish(s.broker))))))
+	streamHandler := keepaliveSubscribers(s.keepalive, timeoutSubscribers(s.writeTimeout, timeoutSubscriberReads(s.readTimeout, requireHandshake(s.handshake, federate(s.broker, s.peers, s.peerClient, subscribe(s.broker, s.flush))))))
+	subscribeHandler := resolveTopic(rejectOnShutdown(s.shutdown, capSubscribers(s.connCap, limitSubscribers(s.limiter, streamHandler))))
+	wsSubscribeHandler := resolveTopic(rejectOnShutdown(s.shutdown, capSubscribers(s.connCap, limitSubscribers(s.limiter, upgradeSubscribers(streamHandler)))))
 
-	route.HandleFunc("/publish/{topic}", publish(s.broker)).Methods(http.MethodPost)
-	route.HandleFunc("/subscribe/{topic}", subscribe(s.broker)).Methods(http.MethodPost)
+	// Topics may also be named by query or header, see resolveTopic
+	route.HandleFunc("/publish/{topic}", publishHandler).Methods(http.MethodPost)
+	route.HandleFunc("/publish", publishHandler).Methods(http.MethodPost)
+	route.HandleFunc("/publish/{topic}/batch", rejectOnShutdown(s.shutdown, capPublishes(s.connCap, rejectDuringMaintenance(s.maintenance, replicated(publishBatch(s.broker)))))).Methods(http.MethodPost)
+	route.HandleFunc("/tx", rejectOnShutdown(s.shutdown, capPublishes(s.connCap, rejectDuringMaintenance(s.maintenance, replicated(publishTx(s.broker)))))).Methods(http.MethodPost)
+	route.HandleFunc("/subscribe/{topic}", subscribeHandler).Methods(http.MethodPost)
+	route.HandleFunc("/subscribe", subscribeHandler).Methods(http.MethodPost)
+	route.HandleFunc(wsSubscribePath+"/{topic}", wsSubscribeHandler).Methods(http.MethodGet)
+	route.HandleFunc("/subscribe/{topic}/validate", validateSubscribe()).Methods(http.MethodPost)
+	route.HandleFunc("/topics", listTopics(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/topics/{topic}", getTopic(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/topics/{topic}", deleteTopic(s.broker)).Methods(http.MethodDelete)
+	route.HandleFunc("/topics/{topic}/purge", purgeTopic(s.broker)).Methods(http.MethodPost)
+	route.HandleFunc("/topics/{topic}/config", getTopicConfig(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/topics/{topic}/config", putTopicConfig(s.broker)).Methods(http.MethodPut)
+	route.HandleFunc("/topics/{topic}/processing-time", getProcessingTime(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/topics/{topic}/reset-deliveries", resetDeliveries(s.broker)).Methods(http.MethodPost)
+	route.HandleFunc("/topics/{topic}/recover", rejectDuringMaintenance(s.maintenance, recoverDeadLetters(s.broker))).Methods(http.MethodPost)
+	route.HandleFunc("/drain/{topic}", rejectOnShutdown(s.shutdown, drain(s.broker))).Methods(http.MethodPost)
+	route.HandleFunc("/consumers/{topic}", listConsumers(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/consumers/{topic}/{id}/disconnect", disconnectConsumer(s.broker)).Methods(http.MethodPost)
+	route.HandleFunc("/topics/{topic}/peek", getPeek(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/history/{topic}", getHistory(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/tail/{topic}", tail(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/export/{topic}", exportTopic(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/import/{topic}", rejectDuringMaintenance(s.maintenance, importTopic(s.broker))).Methods(http.MethodPost)
+	route.HandleFunc("/confirmed/{topic}/{id}", getConfirmed(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/confirmed/{topic}/{id}/replay", rejectDuringMaintenance(s.maintenance, replayConfirmed(s.broker))).Methods(http.MethodPost)
+	route.HandleFunc("/messages/{topic}/{id}/fetch", fetch(s.broker)).Methods(http.MethodPost)
+	route.HandleFunc("/receipts/{receipt}/ack", resolveReceipt(s.broker, true)).Methods(http.MethodPost)
+	route.HandleFunc("/receipts/{receipt}/nack", resolveReceipt(s.broker, false)).Methods(http.MethodPost)
+	route.HandleFunc("/recovery", getRecovery(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc(uiPath, serveUI).Methods(http.MethodGet)
+	route.HandleFunc(uiStatsPath, getUIStats(s.broker)).Methods(http.MethodGet)
+	route.HandleFunc("/rpc", s.rpc).Methods(http.MethodPost)
+	route.HandleFunc("/maintenance", setMaintenance(s.maintenance, true)).Methods(http.MethodPost)
+	route.HandleFunc("/maintenance", setMaintenance(s.maintenance, false)).Methods(http.MethodDelete)
+
+	if s.replication != nil {
+		route.HandleFunc(replicationPath, replicate(s.replication, s.ackReplicas > 0)).Methods(http.MethodGet)
+		route.HandleFunc(replicationAckPath, ackReplication(s.replication)).Methods(http.MethodPost)
+	}
 
 	route.ServeHTTP(w, r)
 }
 
+// respondRouteError responds to requests which do not match a route with a
+// JSON error, in the same shape as the handlers.
+func respondRouteError(code int, e serverError) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Logger()
+
+		log.Debug().Int("code", code).Msg("no matching route")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+
+		res := errorFrame(e.Error())
+		res.Code = code
+
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
 func publish(broker brokerer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log := log.With().
@@ -87,12 +436,116 @@ func publish(broker brokerer) http.HandlerFunc {
 			return
 		}
 
+		if rejectReservedTopic(log, w, topic) {
+			return
+		}
+
 		log = log.With().
 			Str("topic", topic).
 			Logger()
 
 		log.Info().Msg("publishing to topic")
 
+		var meta messageMeta
+		if notify := r.URL.Query().Get(notifyQueryKey); notify != "" {
+			if !isValidNotifyURL(notify) || !broker.NotifyPermitted(notify) {
+				log.Debug().Str("notify", notify).Msg("invalid notify URL")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidNotifyURL.Error())
+
+				return
+			}
+
+			meta.Notify = notify
+		}
+
+		if deliverBy := r.URL.Query().Get(deliverByQueryKey); deliverBy != "" {
+			t, err := time.Parse(time.RFC3339Nano, deliverBy)
+			if err != nil {
+				log.Debug().Str("deliver_by", deliverBy).Msg("invalid delivery deadline")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidDeliverBy.Error())
+
+				return
+			}
+
+			meta.DeliverBy = t
+		}
+
+		if ttl := r.URL.Query().Get(ttlQueryKey); ttl != "" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil || d <= 0 {
+				log.Debug().Str("ttl", ttl).Msg("invalid ttl")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidTTL.Error())
+
+				return
+			}
+
+			meta.TTL = d
+		}
+
+		if raw := r.URL.Query().Get(priorityQueryKey); raw != "" {
+			p, err := parsePriority(raw)
+			if err != nil {
+				log.Debug().Str("priority", raw).Msg("invalid priority")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidPriority.Error())
+
+				return
+			}
+
+			meta.Priority = p
+		}
+
+		var delay time.Duration
+		if d := r.URL.Query().Get(delayQueryKey); d != "" {
+			var err error
+			delay, err = time.ParseDuration(d)
+			if err != nil || delay <= 0 {
+				log.Debug().Str("delay", d).Msg("invalid delay")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidDelay.Error())
+
+				return
+			}
+		}
+
+		if deliverAt := r.URL.Query().Get(deliverAtQueryKey); deliverAt != "" {
+			if delay > 0 {
+				log.Debug().Msg("both delay and delivery time given")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errDelayConflict.Error())
+
+				return
+			}
+
+			t, err := time.Parse(time.RFC3339Nano, deliverAt)
+			if err != nil {
+				log.Debug().Str("deliver_at", deliverAt).Msg("invalid delivery time")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidDeliverAt.Error())
+
+				return
+			}
+
+			// A time which has already passed publishes straight away
+			delay = time.Until(t)
+		}
+
+		meta.ContentType = r.Header.Get("Content-Type")
+		meta.ReplyTo = r.Header.Get(headerReplyTo)
+		meta.Key = r.Header.Get(headerKey)
+		meta.PartitionKey = r.Header.Get(headerPartitionKey)
+		meta.Header = r.Header
+
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Err(err).Msg("failed reading request body")
@@ -104,7 +557,62 @@ func publish(broker brokerer) http.HandlerFunc {
 		}
 		defer r.Body.Close()
 
-		if err := broker.Publish(topic, b); err != nil {
+		if delay > 0 {
+			publishDelayed(log, w, broker, topic, b, meta, delay)
+			return
+		}
+
+		id, err := broker.Publish(topic, b, meta)
+		if errors.Is(err, errUnsupportedContentType) {
+			log.Debug().
+				Str("content_type", meta.ContentType).
+				Msg("content type not accepted by topic")
+
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			respondError(log, json.NewEncoder(w), errContentType.Error())
+
+			return
+		}
+		if errors.Is(err, errNoSubscribers) {
+			log.Debug().Msg("topic has no subscribers, dropped message")
+
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		}
+		if errors.Is(err, errNoRoute) {
+			log.Debug().Msg("message not routed to any topic")
+
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			respondError(log, json.NewEncoder(w), errNoRoute.Error())
+
+			return
+		}
+		if errors.Is(err, errInvalidTimestamp) || errors.Is(err, errTimestampSkew) {
+			log.Debug().Err(err).Msg("producer timestamp rejected")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), err.Error())
+
+			return
+		}
+		if errors.Is(err, errTopicFull) {
+			log.Warn().Msg("topic is full")
+
+			w.WriteHeader(http.StatusInsufficientStorage)
+			respondError(log, json.NewEncoder(w), errTopicFullPublish.Error())
+
+			return
+		}
+		if errors.Is(err, errStoreFull) {
+			log.Error().Msg("store is out of space")
+
+			w.WriteHeader(http.StatusInsufficientStorage)
+			respondError(log, json.NewEncoder(w), errStoreFullPublish.Error())
+
+			return
+		}
+		if err != nil {
 			log.Err(err).Msg("failed to publish to broker")
 
 			w.WriteHeader(http.StatusInternalServerError)
@@ -114,14 +622,16 @@ func publish(broker brokerer) http.HandlerFunc {
 		}
 
 		w.WriteHeader(http.StatusCreated)
+		respondPublished(log, json.NewEncoder(w), id)
 
 		log.Debug().
+			Str("msg_id", id).
 			Str("body", string(b)).
 			Msg("successfully published to topic")
 	}
 }
 
-func subscribe(broker brokerer) http.HandlerFunc {
+func subscribe(broker brokerer, flush flushThreshold) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
@@ -142,119 +652,480 @@ func subscribe(broker brokerer) http.HandlerFunc {
 			return
 		}
 
+		if rejectReservedTopic(log, w, topic) {
+			return
+		}
+
 		log = log.With().Str("topic", topic).Logger()
 
+		var rate float64
+		if raw := r.URL.Query().Get(rateQueryKey); raw != "" {
+			var err error
+			if rate, err = parseRate(raw); err != nil {
+				log.Debug().Err(err).Msg("invalid rate")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidRate.Error())
+
+				return
+			}
+		}
+
+		var onDisconnect disconnectPolicy
+		if raw := r.URL.Query().Get(disconnectQueryKey); raw != "" {
+			var err error
+			if onDisconnect, err = parseDisconnectPolicy(raw); err != nil {
+				log.Debug().Err(err).Msg("invalid disconnect policy")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errDisconnectPolicy.Error())
+
+				return
+			}
+		}
+
+		weight := defaultWeight
+		if raw := r.URL.Query().Get(weightQueryKey); raw != "" {
+			var err error
+			if weight, err = parseWeight(raw); err != nil {
+				log.Debug().Err(err).Msg("invalid weight")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidWeight.Error())
+
+				return
+			}
+		}
+
+		var maxDecodeErrs int
+		if raw := r.URL.Query().Get(decodeErrorsQueryKey); raw != "" {
+			var err error
+			if maxDecodeErrs, err = parseMaxDecodeErrors(raw); err != nil {
+				log.Debug().Err(err).Msg("invalid max decode errors")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidDecodeErrs.Error())
+
+				return
+			}
+		}
+
+		group := r.URL.Query().Get(groupQueryKey)
+		if group != "" {
+			log = log.With().Str("group", group).Logger()
+		}
+
+		if isBroadcastGroup(group) || isPartitionGroup(group) {
+			log.Debug().Msg("reserved group name")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errReservedGroup.Error())
+
+			return
+		}
+
+		broadcast := r.URL.Query().Get(broadcastQueryKey) == "true"
+		if broadcast && group != "" {
+			log.Debug().Msg("broadcast consumer with a group")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errBroadcastGroup.Error())
+
+			return
+		}
+
 		log.Info().
+			Bool("broadcast", broadcast).
 			Msg("subscribing to topic")
 
-		// Wrap the writer in a flushWriter in order to immediately flush each write
-		// to the client.
-		cons := broker.Subscribe(topic)
-		enc := json.NewEncoder(newFlushWriter(w))
+		var cons *consumer
+		if broadcast {
+			cons = broker.SubscribeBroadcast(topic)
+		} else if group != "" {
+			var err error
+			if cons, err = broker.SubscribeGroup(topic, group); err != nil {
+				log.Err(err).Msg("failed to join group")
+
+				w.WriteHeader(http.StatusInternalServerError)
+				respondError(log, json.NewEncoder(w), errJoinGroup.Error())
+
+				return
+			}
+		} else {
+			cons = broker.Subscribe(topic)
+		}
+		defer broker.Unsubscribe(cons)
+
+		// Large bodies are streamed to the client straight from the store
+		cons.StreamBodies()
+
+		if rate > 0 {
+			cons.LimitRate(rate)
+		}
+		if onDisconnect != "" {
+			cons.SetDisconnectPolicy(onDisconnect)
+		}
+		if weight != defaultWeight {
+			broker.SetWeight(cons, weight)
+		}
+		setResponseHeader(w, "Trailer", trailerStreamStatus)
+
+		// Wrap the writer in a flushWriter in order to flush writes to the client,
+		// coalescing the responses to pipelined commands if configured to.
+		fw := newFlushWriter(w, flush)
+		enc := json.NewEncoder(fw)
 		dec := json.NewDecoder(r.Body)
 
+		// The source of dec, which changes as decoding resumes after malformed
+		// commands
+		var src io.Reader = r.Body
+
+		// Stop waiting on the client once an operator disconnects the consumer,
+		// or the server shuts down before it resolves its messages
+		ctx, stopWatching := watchKick(ctx, r, cons)
+		defer stopWatching()
+
+		defer func() {
+			if !cons.kicked() {
+				return
+			}
+
+			reason := errKicked
+			if cons.stopped() {
+				reason = errShuttingDown
+				log.Warn().Msg("consumer disconnected on shutdown")
+			} else {
+				log.Warn().Msg("consumer disconnected by operator")
+			}
+
+			if err := cons.NackAll(); err != nil {
+				log.Err(err).Msg("failed to nack")
+			}
+
+			respondError(log, enc, reason.Error())
+			setStreamStatus(w, streamStatusError)
+			fw.Flush()
+		}()
+
+		// A panic ends the stream rather than the server, returning the
+		// outstanding messages to the topic
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			logPanic(log, rec)
+
+			if err := cons.NackAll(); err != nil {
+				log.Err(err).Msg("failed to nack")
+			}
+
+			respondError(log, enc, errInternal.Error())
+			setStreamStatus(w, streamStatusError)
+			fw.Flush()
+		}()
+
+		// Whether to wait for a message when the topic is empty, set on INIT
+		block := true
+
+		// How many messages may be outstanding before waiting for an ACK, set on
+		// INIT. Zero sends one message in response to each command.
+		var prefetch int
+
+		// Consecutive malformed commands received, tolerated up to maxDecodeErrs
+		decodeErrs := 0
+
 		for {
 			log := log
 
-			var cmd string
-			if err := dec.Decode(&cmd); isDisconnect(err) {
-				log.Warn().Msg("client disconnected")
+			// Hold back the flush only while there is another command to respond to
+			if !pipelined(dec) {
+				fw.Flush()
+			}
+
+			if writeTimedOut(w) {
+				log.Warn().Msg("client stopped reading, write timed out")
 
-				if err := cons.Nack(); err != nil {
+				if err := cons.NackAll(); err != nil {
 					log.Err(err).Msg("failed to nack")
 				}
 
+				return
+			}
+
+			var cmd command
+			if err := dec.Decode(&cmd); cons.kicked() {
+				return
+			} else if isDisconnect(err) || readTimedOut(r) {
+				log.Warn().Msg("client disconnected")
+
+				if err := cons.Disconnected(); err != nil {
+					log.Err(err).Msg("failed to release outstanding messages")
+				}
+
 				return
 			} else if err != nil {
 				log.Err(err).Msg("failed decoding command")
 				respondError(log, enc, errDecodingCmd.Error())
 
+				decodeErrs++
+				if decodeErrs < maxDecodeErrs {
+					dec, src = resumeDecoding(dec, src, err)
+					continue
+				}
+
+				if maxDecodeErrs > 0 {
+					log.Warn().Int("decode_errors", decodeErrs).Msg("too many malformed commands, closing")
+
+					if err := cons.NackAllWithReason(decodeErrorReason); err != nil {
+						log.Err(err).Msg("failed to nack")
+					}
+				}
+
+				setStreamStatus(w, streamStatusError)
+
 				return
 			}
 
-			log = log.With().Str("cmd", cmd).Logger()
+			decodeErrs = 0
+
+			log = log.With().Str("cmd", cmd.Cmd).Logger()
+
+			if !takeCommand(r) {
+				log.Warn().Msg("connection exceeded its cap, closing")
+				respondError(log, enc, errConnectionCap.Error())
+				setStreamStatus(w, streamStatusError)
 
-			switch cmd {
+				if err := cons.NackAll(); err != nil {
+					log.Err(err).Msg("failed to nack")
+				}
+
+				return
+			}
+
+			switch cmd.Cmd {
 			case CmdInit:
 				log.Debug().Msg("initialising consumer")
 
-				msg, err := cons.Next(ctx)
-				switch {
-				case errors.Is(err, errRequestCancelled):
-					log.Info().Msg("client disconnected while waiting for message")
+				if cmd.Block != nil {
+					block = *cmd.Block
+				}
 
-					return
-				case err != nil:
-					log.Err(err).Msg("failed to get next value for topic")
-					respondError(log, enc, errNextValue.Error())
+				if cmd.AckTimeout != "" {
+					d, err := parseAckTimeout(cmd.AckTimeout)
+					if err != nil {
+						log.Debug().Msg("invalid ack timeout")
+						respondError(log, enc, errInvalidAckTimeout.Error())
+						setStreamStatus(w, streamStatusError)
 
-					return
-				default:
-					respondMsg(log, enc, msg)
+						return
+					}
 
 					log.Debug().
-						Str("msg", string(msg)).
-						Msg("written message to client")
+						Dur("ack_timeout", cons.SetAckTimeout(d)).
+						Msg("set ack timeout")
+				}
+
+				if cmd.Prefetch != 0 {
+					n, err := parsePrefetch(cmd.Prefetch, cmd.From)
+					if err != nil {
+						log.Debug().Err(err).Msg("invalid prefetch")
+						respondError(log, enc, err.Error())
+						setStreamStatus(w, streamStatusError)
+
+						return
+					}
+
+					prefetch = n
+					log.Debug().Int("prefetch", prefetch).Msg("set prefetch window")
+				}
+
+				if len(cmd.From) > 0 {
+					from, err := parseReplayFrom(cmd.From)
+					if err != nil {
+						log.Debug().Msg("invalid replay position")
+						respondError(log, enc, errInvalidFrom.Error())
+						setStreamStatus(w, streamStatusError)
+
+						return
+					}
+
+					if err := broker.Seek(cons, from); errors.Is(err, errReplayLogDisabled) {
+						log.Debug().Msg("replay requested without a replay log")
+						respondError(log, enc, errReplayDisabled.Error())
+						setStreamStatus(w, streamStatusError)
+
+						return
+					} else if err != nil {
+						log.Err(err).Msg("failed to seek topic")
+						respondError(log, enc, errSeek.Error())
+						setStreamStatus(w, streamStatusError)
+
+						return
+					}
+
+					log.Debug().Msg("replaying topic")
+				}
+
+				if cmd.Snapshot {
+					snap, err := cons.Snapshot()
+					if err != nil {
+						log.Err(err).Msg("failed to snapshot topic")
+						respondError(log, enc, errSnapshot.Error())
+						setStreamStatus(w, streamStatusError)
+
+						return
+					}
+
+					respondSnapshot(log, enc, snap)
+				}
+
+				if !respondNext(ctx, log, w, fw, enc, cons, block, prefetch) {
+					return
 				}
 
 			case CmdAck:
 				log.Debug().Msg("ACKing message")
 
-				if err := cons.Ack(); err != nil {
+				var err error
+				switch {
+				case len(cmd.IDs) > 0:
+					err = cons.AckIDs(cmd.IDs)
+				case cmd.Result != nil:
+					err = cons.AckWithResult([]byte(*cmd.Result))
+				default:
+					err = cons.Ack()
+				}
+
+				if errors.Is(err, errAckTimeout) {
+					log.Warn().Msg("ACK received after ack timeout")
+					respondError(log, enc, errAckTimeout.Error())
+
+					continue
+				} else if errors.Is(err, errUnknownAckID) {
+					log.Warn().Strs("ids", cmd.IDs).Msg("ACK for message which is not outstanding")
+					respondError(log, enc, errUnknownAckID.Error())
+
+					continue
+				} else if err != nil {
 					log.Err(err).Msg("failed to ACK")
 					respondError(log, enc, errAck.Error())
+					setStreamStatus(w, streamStatusError)
 
 					return
 				}
 
-				msg, err := cons.Next(ctx)
-				switch {
-				case errors.Is(err, errRequestCancelled):
-					log.Info().Msg("client disconnected while waiting for message")
-
+				if !respondNext(ctx, log, w, fw, enc, cons, block, prefetch) {
 					return
-				case err != nil:
-					log.Err(err).Msg("failed to get next value for topic")
-					respondError(log, enc, errNextValue.Error())
+				}
+
+			case CmdCommit:
+				log = log.With().Int("seq", cmd.Seq).Logger()
+				log.Debug().Msg("committing messages")
+
+				if cmd.Seq < 1 {
+					log.Debug().Msg("invalid commit")
+					respondError(log, enc, errInvalidCommit.Error())
+
+					continue
+				}
+
+				err := cons.Commit(cmd.Seq)
+				if errors.Is(err, errCommitAhead) {
+					log.Warn().Msg("commit beyond the last delivery")
+					respondError(log, enc, errCommitAhead.Error())
+
+					continue
+				} else if errors.Is(err, errAckTimeout) {
+					log.Warn().Msg("commit received after ack timeout")
+					respondError(log, enc, errAckTimeout.Error())
+
+					continue
+				} else if err != nil {
+					log.Err(err).Msg("failed to commit")
+					respondError(log, enc, errCommit.Error())
+					setStreamStatus(w, streamStatusError)
 
 					return
-				default:
-					respondMsg(log, enc, msg)
+				}
 
-					log.Debug().
-						Str("msg", string(msg)).
-						Msg("written message to client")
+				if !respondNext(ctx, log, w, fw, enc, cons, block, prefetch) {
+					return
 				}
 
 			case CmdNack:
 				log.Debug().Msg("NACKing message")
 
-				if err := cons.Nack(); err != nil {
+				var err error
+				switch {
+				case cmd.Delay != "":
+					delay, perr := parseNackDelay(cmd.Delay)
+					if perr != nil {
+						log.Debug().Str("delay", cmd.Delay).Msg("invalid NACK delay")
+						respondError(log, enc, perr.Error())
+
+						continue
+					}
+
+					err = cons.NackAfter(cmd.IDs, cmd.Reason, delay)
+				case len(cmd.IDs) > 0:
+					err = cons.NackIDs(cmd.IDs, cmd.Reason)
+				default:
+					err = cons.NackWithReason(cmd.Reason)
+				}
+
+				if errors.Is(err, errUnknownAckID) {
+					log.Warn().Strs("ids", cmd.IDs).Msg("NACK for message which is not outstanding")
+					respondError(log, enc, errUnknownAckID.Error())
+
+					continue
+				} else if err != nil {
 					log.Err(err).Msg("failed to NACK")
 					respondError(log, enc, errNack.Error())
+					setStreamStatus(w, streamStatusError)
 
 					return
 				}
 
-				msg, err := cons.Next(ctx)
-				switch {
-				case errors.Is(err, errRequestCancelled):
-					log.Info().Msg("client disconnected while waiting for message")
-
+				if !respondNext(ctx, log, w, fw, enc, cons, block, prefetch) {
 					return
-				case err != nil:
-					log.Err(err).Msg("failed to get next value for topic")
-					respondError(log, enc, errNextValue.Error())
+				}
+
+			case CmdPeekAll:
+				log.Debug().Msg("peeking messages")
+
+				msgs, err := cons.Peek(peekAllLimit)
+				if err != nil {
+					log.Err(err).Msg("failed to peek messages")
+					respondError(log, enc, errPeek.Error())
+					setStreamStatus(w, streamStatusError)
 
 					return
-				default:
-					respondMsg(log, enc, msg)
+				}
 
-					log.Debug().
-						Str("msg", string(msg)).
-						Msg("written message to client")
+				respondPeek(log, enc, msgs)
+
+			case CmdStatus:
+				log.Debug().Msg("sending consumer status")
+
+				respondStatus(log, enc, cons.Status())
+
+			case CmdClose:
+				log.Debug().Msg("closing stream")
+
+				if err := cons.NackAll(); err != nil {
+					log.Err(err).Msg("failed to nack")
 				}
 
+				setStreamStatus(w, streamStatusClosed)
+
+				return
+
 			default:
 				log.Warn().Msg("unrecognised command received")
 
@@ -264,7 +1135,107 @@ func subscribe(broker brokerer) http.HandlerFunc {
 	}
 }
 
+// respondNext responds with the next message for the consumer. With a prefetch
+// window, messages are sent until the consumer holds prefetch outstanding, only
+// waiting on the topic while it holds none. It reports whether the stream may
+// carry on.
+func respondNext(ctx context.Context, log zerolog.Logger, w http.ResponseWriter, fw *flushWriter, enc *json.Encoder, cons *consumer, block bool, prefetch int) bool {
+	// A consumer with messages in its window isn't left waiting for more
+	if prefetch > 0 && cons.Outstanding() > 0 {
+		return fillWindow(ctx, log, w, fw, enc, cons, prefetch)
+	}
+
+	msg, err := nextMsg(ctx, cons, block, fw)
+	switch {
+	case errors.Is(err, errRequestCancelled):
+		log.Info().Msg("client disconnected while waiting for message")
+
+		return false
+	case errors.Is(err, errShuttingDown):
+		return respondStopped(log, w, enc, cons)
+	case errors.Is(err, errNoMessages):
+		log.Debug().Msg("no messages available, not blocking")
+		respondEmpty(log, enc)
+
+		return true
+	case err != nil:
+		log.Err(err).Msg("failed to get next value for topic")
+		respondError(log, enc, errNextValue.Error())
+		setStreamStatus(w, streamStatusError)
+
+		return false
+	}
+
+	if !respondDelivery(log, w, fw, enc, cons, msg) {
+		return false
+	}
+
+	if prefetch > 0 {
+		return fillWindow(ctx, log, w, fw, enc, cons, prefetch)
+	}
+
+	return true
+}
+
+// nextMsg retrieves the next message for the consumer. If block is false and
+// the topic is empty, errNoMessages is returned rather than waiting. Responses
+// held back by fw are flushed before waiting for a message.
+func nextMsg(ctx context.Context, cons *consumer, block bool, fw *flushWriter) (value, error) {
+	if !block {
+		return cons.TryNext(ctx)
+	}
+
+	if fw.pending() {
+		msg, err := cons.TryNext(ctx)
+		if !errors.Is(err, errNoMessages) {
+			return msg, err
+		}
+
+		fw.Flush()
+	}
+
+	return cons.Next(ctx)
+}
+
+// parseAckTimeout parses the ack timeout requested by a consumer on INIT.
+func parseAckTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errInvalidAckTimeout
+	}
+
+	return d, nil
+}
+
+// parseNackDelay parses the delay before a NACKed message is redelivered.
+func parseNackDelay(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errInvalidDelay
+	}
+
+	return d, nil
+}
+
+// setStreamStatus sets the status trailer to be sent once the subscribe handler
+// returns.
+func setStreamStatus(w http.ResponseWriter, status string) {
+	setResponseHeader(w, trailerStreamStatus, status)
+}
+
+// isValidNotifyURL reports whether the URL is an absolute HTTP(S) URL which a
+// receipt can be sent to.
+func isValidNotifyURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
 func isDisconnect(err error) bool {
-	return err != nil && (strings.Contains(err.Error(), "client disconnected") ||
+	return err != nil && (errors.Is(err, errWebSocketClosed) ||
+		strings.Contains(err.Error(), "client disconnected") ||
 		strings.Contains(err.Error(), "; CANCEL"))
 }
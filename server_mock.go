@@ -5,8 +5,10 @@
 package main
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
+	time "time"
 )
 
 // Mockbrokerer is a mock of brokerer interface
@@ -33,17 +35,78 @@ func (m *Mockbrokerer) EXPECT() *MockbrokererMockRecorder {
 }
 
 // Publish mocks base method
-func (m *Mockbrokerer) Publish(topic string, value value) error {
+func (m *Mockbrokerer) Publish(topic string, value value, meta messageMeta) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Publish", topic, value)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret := m.ctrl.Call(m, "Publish", topic, value, meta)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // Publish indicates an expected call of Publish
-func (mr *MockbrokererMockRecorder) Publish(topic, value interface{}) *gomock.Call {
+func (mr *MockbrokererMockRecorder) Publish(topic, value, meta interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Publish", reflect.TypeOf((*Mockbrokerer)(nil).Publish), topic, value, meta)
+}
+
+// PublishTx mocks base method
+func (m *Mockbrokerer) PublishTx(msgs []record) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PublishTx", msgs)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PublishTx indicates an expected call of PublishTx
+func (mr *MockbrokererMockRecorder) PublishTx(msgs interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Publish", reflect.TypeOf((*Mockbrokerer)(nil).Publish), topic, value)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishTx", reflect.TypeOf((*Mockbrokerer)(nil).PublishTx), msgs)
+}
+
+// PublishBatch mocks base method
+func (m *Mockbrokerer) PublishBatch(topic string, msgs []pendingMessage) ([]string, []error, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PublishBatch", topic, msgs)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].([]error)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// PublishBatch indicates an expected call of PublishBatch
+func (mr *MockbrokererMockRecorder) PublishBatch(topic, msgs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishBatch", reflect.TypeOf((*Mockbrokerer)(nil).PublishBatch), topic, msgs)
+}
+
+// PublishDelayed mocks base method
+func (m *Mockbrokerer) PublishDelayed(topic string, value value, meta messageMeta, delay time.Duration) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PublishDelayed", topic, value, meta, delay)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PublishDelayed indicates an expected call of PublishDelayed
+func (mr *MockbrokererMockRecorder) PublishDelayed(topic, value, meta, delay interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishDelayed", reflect.TypeOf((*Mockbrokerer)(nil).PublishDelayed), topic, value, meta, delay)
+}
+
+// NotifyPermitted mocks base method
+func (m *Mockbrokerer) NotifyPermitted(rawURL string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NotifyPermitted", rawURL)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// NotifyPermitted indicates an expected call of NotifyPermitted
+func (mr *MockbrokererMockRecorder) NotifyPermitted(rawURL interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyPermitted", reflect.TypeOf((*Mockbrokerer)(nil).NotifyPermitted), rawURL)
 }
 
 // Subscribe mocks base method
@@ -59,3 +122,444 @@ func (mr *MockbrokererMockRecorder) Subscribe(topic interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscribe", reflect.TypeOf((*Mockbrokerer)(nil).Subscribe), topic)
 }
+
+// SubscribeGroup mocks base method
+func (m *Mockbrokerer) SubscribeGroup(topic, group string) (*consumer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SubscribeGroup", topic, group)
+	ret0, _ := ret[0].(*consumer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SubscribeGroup indicates an expected call of SubscribeGroup
+func (mr *MockbrokererMockRecorder) SubscribeGroup(topic, group interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SubscribeGroup", reflect.TypeOf((*Mockbrokerer)(nil).SubscribeGroup), topic, group)
+}
+
+// SubscribeBroadcast mocks base method
+func (m *Mockbrokerer) SubscribeBroadcast(topic string) *consumer {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SubscribeBroadcast", topic)
+	ret0, _ := ret[0].(*consumer)
+	return ret0
+}
+
+// SubscribeBroadcast indicates an expected call of SubscribeBroadcast
+func (mr *MockbrokererMockRecorder) SubscribeBroadcast(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SubscribeBroadcast", reflect.TypeOf((*Mockbrokerer)(nil).SubscribeBroadcast), topic)
+}
+
+// Unsubscribe mocks base method
+func (m *Mockbrokerer) Unsubscribe(cons *consumer) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Unsubscribe", cons)
+}
+
+// Unsubscribe indicates an expected call of Unsubscribe
+func (mr *MockbrokererMockRecorder) Unsubscribe(cons interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unsubscribe", reflect.TypeOf((*Mockbrokerer)(nil).Unsubscribe), cons)
+}
+
+// SetWeight mocks base method
+func (m *Mockbrokerer) SetWeight(cons *consumer, weight int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetWeight", cons, weight)
+}
+
+// SetWeight indicates an expected call of SetWeight
+func (mr *MockbrokererMockRecorder) SetWeight(cons, weight interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetWeight", reflect.TypeOf((*Mockbrokerer)(nil).SetWeight), cons, weight)
+}
+
+// TopicConfig mocks base method
+func (m *Mockbrokerer) TopicConfig(topic string) topicConfig {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TopicConfig", topic)
+	ret0, _ := ret[0].(topicConfig)
+	return ret0
+}
+
+// TopicConfig indicates an expected call of TopicConfig
+func (mr *MockbrokererMockRecorder) TopicConfig(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopicConfig", reflect.TypeOf((*Mockbrokerer)(nil).TopicConfig), topic)
+}
+
+// SetTopicConfig mocks base method
+func (m *Mockbrokerer) SetTopicConfig(topic string, cfg topicConfig) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTopicConfig", topic, cfg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTopicConfig indicates an expected call of SetTopicConfig
+func (mr *MockbrokererMockRecorder) SetTopicConfig(topic, cfg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTopicConfig", reflect.TypeOf((*Mockbrokerer)(nil).SetTopicConfig), topic, cfg)
+}
+
+// History mocks base method
+func (m *Mockbrokerer) History(topic string) ([]historyEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "History", topic)
+	ret0, _ := ret[0].([]historyEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// History indicates an expected call of History
+func (mr *MockbrokererMockRecorder) History(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "History", reflect.TypeOf((*Mockbrokerer)(nil).History), topic)
+}
+
+// Peek mocks base method
+func (m *Mockbrokerer) Peek(topic string, limit int) ([]pendingMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Peek", topic, limit)
+	ret0, _ := ret[0].([]pendingMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Peek indicates an expected call of Peek
+func (mr *MockbrokererMockRecorder) Peek(topic, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Peek", reflect.TypeOf((*Mockbrokerer)(nil).Peek), topic, limit)
+}
+
+// RecoveryReport mocks base method
+func (m *Mockbrokerer) RecoveryReport() recoveryReport {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecoveryReport")
+	ret0, _ := ret[0].(recoveryReport)
+	return ret0
+}
+
+// RecoveryReport indicates an expected call of RecoveryReport
+func (mr *MockbrokererMockRecorder) RecoveryReport() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecoveryReport", reflect.TypeOf((*Mockbrokerer)(nil).RecoveryReport))
+}
+
+// ResetDeliveries mocks base method
+func (m *Mockbrokerer) ResetDeliveries(topic string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetDeliveries", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResetDeliveries indicates an expected call of ResetDeliveries
+func (mr *MockbrokererMockRecorder) ResetDeliveries(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetDeliveries", reflect.TypeOf((*Mockbrokerer)(nil).ResetDeliveries), topic)
+}
+
+// RecoverDeadLetters mocks base method
+func (m *Mockbrokerer) RecoverDeadLetters(topic string) (recoverSummary, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecoverDeadLetters", topic)
+	ret0, _ := ret[0].(recoverSummary)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecoverDeadLetters indicates an expected call of RecoverDeadLetters
+func (mr *MockbrokererMockRecorder) RecoverDeadLetters(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecoverDeadLetters", reflect.TypeOf((*Mockbrokerer)(nil).RecoverDeadLetters), topic)
+}
+
+// Tap mocks base method
+func (m *Mockbrokerer) Tap(topic string, events map[tapEvent]bool) *tap {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Tap", topic, events)
+	ret0, _ := ret[0].(*tap)
+	return ret0
+}
+
+// Tap indicates an expected call of Tap
+func (mr *MockbrokererMockRecorder) Tap(topic, events interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Tap", reflect.TypeOf((*Mockbrokerer)(nil).Tap), topic, events)
+}
+
+// Untap mocks base method
+func (m *Mockbrokerer) Untap(t *tap) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Untap", t)
+}
+
+// Untap indicates an expected call of Untap
+func (mr *MockbrokererMockRecorder) Untap(t interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Untap", reflect.TypeOf((*Mockbrokerer)(nil).Untap), t)
+}
+
+// Topics mocks base method
+func (m *Mockbrokerer) Topics(filter topicFilter) ([]topicStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Topics", filter)
+	ret0, _ := ret[0].([]topicStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Topics indicates an expected call of Topics
+func (mr *MockbrokererMockRecorder) Topics(filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Topics", reflect.TypeOf((*Mockbrokerer)(nil).Topics), filter)
+}
+
+// TopicStats mocks base method
+func (m *Mockbrokerer) TopicStats(topic string) (topicDetail, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TopicStats", topic)
+	ret0, _ := ret[0].(topicDetail)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TopicStats indicates an expected call of TopicStats
+func (mr *MockbrokererMockRecorder) TopicStats(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopicStats", reflect.TypeOf((*Mockbrokerer)(nil).TopicStats), topic)
+}
+
+// PurgeTopic mocks base method
+func (m *Mockbrokerer) PurgeTopic(topic string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeTopic", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeTopic indicates an expected call of PurgeTopic
+func (mr *MockbrokererMockRecorder) PurgeTopic(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeTopic", reflect.TypeOf((*Mockbrokerer)(nil).PurgeTopic), topic)
+}
+
+// DeleteTopic mocks base method
+func (m *Mockbrokerer) DeleteTopic(topic string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteTopic", topic)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteTopic indicates an expected call of DeleteTopic
+func (mr *MockbrokererMockRecorder) DeleteTopic(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteTopic", reflect.TypeOf((*Mockbrokerer)(nil).DeleteTopic), topic)
+}
+
+// Drain mocks base method
+func (m *Mockbrokerer) Drain(topic string, max, maxBytes int) ([]pendingMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Drain", topic, max, maxBytes)
+	ret0, _ := ret[0].([]pendingMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Drain indicates an expected call of Drain
+func (mr *MockbrokererMockRecorder) Drain(topic, max, maxBytes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Drain", reflect.TypeOf((*Mockbrokerer)(nil).Drain), topic, max, maxBytes)
+}
+
+// ProcessingTime mocks base method
+func (m *Mockbrokerer) ProcessingTime(topic string) histogramSnapshot {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProcessingTime", topic)
+	ret0, _ := ret[0].(histogramSnapshot)
+	return ret0
+}
+
+// ProcessingTime indicates an expected call of ProcessingTime
+func (mr *MockbrokererMockRecorder) ProcessingTime(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProcessingTime", reflect.TypeOf((*Mockbrokerer)(nil).ProcessingTime), topic)
+}
+
+// Throughput mocks base method
+func (m *Mockbrokerer) Throughput(topic string) throughput {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Throughput", topic)
+	ret0, _ := ret[0].(throughput)
+	return ret0
+}
+
+// Throughput indicates an expected call of Throughput
+func (mr *MockbrokererMockRecorder) Throughput(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Throughput", reflect.TypeOf((*Mockbrokerer)(nil).Throughput), topic)
+}
+
+// ConsumerIDs mocks base method
+func (m *Mockbrokerer) ConsumerIDs(topic string) []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumerIDs", topic)
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// ConsumerIDs indicates an expected call of ConsumerIDs
+func (mr *MockbrokererMockRecorder) ConsumerIDs(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumerIDs", reflect.TypeOf((*Mockbrokerer)(nil).ConsumerIDs), topic)
+}
+
+// DisconnectConsumer mocks base method
+func (m *Mockbrokerer) DisconnectConsumer(topic, id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DisconnectConsumer", topic, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DisconnectConsumer indicates an expected call of DisconnectConsumer
+func (mr *MockbrokererMockRecorder) DisconnectConsumer(topic, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisconnectConsumer", reflect.TypeOf((*Mockbrokerer)(nil).DisconnectConsumer), topic, id)
+}
+
+// StopDelivering mocks base method
+func (m *Mockbrokerer) StopDelivering(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StopDelivering", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StopDelivering indicates an expected call of StopDelivering
+func (mr *MockbrokererMockRecorder) StopDelivering(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StopDelivering", reflect.TypeOf((*Mockbrokerer)(nil).StopDelivering), ctx)
+}
+
+// Fetch mocks base method
+func (m *Mockbrokerer) Fetch(topic, id string) (*consumer, value, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Fetch", topic, id)
+	ret0, _ := ret[0].(*consumer)
+	ret1, _ := ret[1].(value)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Fetch indicates an expected call of Fetch
+func (mr *MockbrokererMockRecorder) Fetch(topic, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Fetch", reflect.TypeOf((*Mockbrokerer)(nil).Fetch), topic, id)
+}
+
+// AckReceipt mocks base method
+func (m *Mockbrokerer) AckReceipt(receipt string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AckReceipt", receipt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AckReceipt indicates an expected call of AckReceipt
+func (mr *MockbrokererMockRecorder) AckReceipt(receipt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AckReceipt", reflect.TypeOf((*Mockbrokerer)(nil).AckReceipt), receipt)
+}
+
+// NackReceipt mocks base method
+func (m *Mockbrokerer) NackReceipt(receipt, reason string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NackReceipt", receipt, reason)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// NackReceipt indicates an expected call of NackReceipt
+func (mr *MockbrokererMockRecorder) NackReceipt(receipt, reason interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NackReceipt", reflect.TypeOf((*Mockbrokerer)(nil).NackReceipt), receipt, reason)
+}
+
+// Export mocks base method
+func (m *Mockbrokerer) Export(topic string, fn func(pendingMessage) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Export", topic, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Export indicates an expected call of Export
+func (mr *MockbrokererMockRecorder) Export(topic, fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Export", reflect.TypeOf((*Mockbrokerer)(nil).Export), topic, fn)
+}
+
+// Import mocks base method
+func (m *Mockbrokerer) Import(topic string, msgs []pendingMessage, replace bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Import", topic, msgs, replace)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Import indicates an expected call of Import
+func (mr *MockbrokererMockRecorder) Import(topic, msgs, replace interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Import", reflect.TypeOf((*Mockbrokerer)(nil).Import), topic, msgs, replace)
+}
+
+// Confirmed mocks base method
+func (m *Mockbrokerer) Confirmed(topic, id string) (confirmedMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Confirmed", topic, id)
+	ret0, _ := ret[0].(confirmedMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Confirmed indicates an expected call of Confirmed
+func (mr *MockbrokererMockRecorder) Confirmed(topic, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Confirmed", reflect.TypeOf((*Mockbrokerer)(nil).Confirmed), topic, id)
+}
+
+// Replay mocks base method
+func (m *Mockbrokerer) Replay(topic, id string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Replay", topic, id)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Replay indicates an expected call of Replay
+func (mr *MockbrokererMockRecorder) Replay(topic, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Replay", reflect.TypeOf((*Mockbrokerer)(nil).Replay), topic, id)
+}
+
+// Seek mocks base method
+func (m *Mockbrokerer) Seek(cons *consumer, from replayFrom) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Seek", cons, from)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Seek indicates an expected call of Seek
+func (mr *MockbrokererMockRecorder) Seek(cons, from interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Seek", reflect.TypeOf((*Mockbrokerer)(nil).Seek), cons, from)
+}
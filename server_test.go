@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -29,7 +31,7 @@ func TestPublishSingleMessage(t *testing.T) {
 	msg := "test_value"
 
 	mockBroker := NewMockbrokerer(ctrl)
-	mockBroker.EXPECT().Publish(defaultTopic, []byte(msg))
+	mockBroker.EXPECT().Publish(defaultTopic, []byte(msg), messageMeta{Header: http.Header{}}).Return("test_id", nil)
 
 	rec := NewRecorder()
 	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader(msg))
@@ -38,6 +40,73 @@ func TestPublishSingleMessage(t *testing.T) {
 	srv.ServeHTTP(rec, req)
 
 	assert.Equal(http.StatusCreated, rec.Code)
+
+	var out pubResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal("test_id", out.ID)
+}
+
+func TestUnmatchedRoutes(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+		wantErr  serverError
+	}{
+		{
+			name:     "unknown path",
+			method:   http.MethodGet,
+			path:     "/unknown",
+			wantCode: http.StatusNotFound,
+			wantErr:  errNotFound,
+		},
+		{
+			name:     "wrong method",
+			method:   http.MethodGet,
+			path:     fmt.Sprintf("/publish/%s", defaultTopic),
+			wantCode: http.StatusMethodNotAllowed,
+			wantErr:  errMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			srv := newServer(NewMockbrokerer(ctrl))
+
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+			assert.Equal(tt.wantCode, rec.Code)
+			assert.Equal("application/json", rec.Header().Get("Content-Type"))
+
+			var out subResponse
+			assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+			assert.Equal(subResponse{Signal: signalError, Error: tt.wantErr.Error(), Code: tt.wantCode}, out)
+		})
+	}
+}
+
+func TestPublishNoSubscribers(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockBroker := NewMockbrokerer(ctrl)
+	mockBroker.EXPECT().Publish(defaultTopic, gomock.Any(), gomock.Any()).Return("", errNoSubscribers)
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("test_value"))
+
+	srv := newServer(mockBroker)
+	srv.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusNoContent, rec.Code)
+	assert.Empty(rec.Body.String())
 }
 
 func TestSubscribeSingleMessage(t *testing.T) {
@@ -62,7 +131,7 @@ func TestSubscribeSingleMessage(t *testing.T) {
 	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/subscribe/%s", defaultTopic), helperMustEncodeString(CmdInit))
 	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
 
-	go subscribe(b)(subW, r)
+	go subscribe(b, flushThreshold{})(subW, r)
 
 	// Wait for the first message to be written
 	decoder := NewDecodeWaiter(subW)
@@ -111,7 +180,7 @@ func TestSubscribeAck(t *testing.T) {
 	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/subscribe/%s", defaultTopic), reader)
 	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
 
-	go subscribe(b)(subW, r)
+	go subscribe(b, flushThreshold{})(subW, r)
 
 	// Wait for the first message to be written
 	decoder := NewDecodeWaiter(subW)
@@ -127,6 +196,253 @@ func TestSubscribeAck(t *testing.T) {
 	assert.Equal(msg2, out.Msg)
 }
 
+func TestSubscribeStoreError(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().GetNext(defaultTopic).Return(nil, messageMeta{}, 0, errors.New("store failure"))
+
+	b := newBroker(mockStore)
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/subscribe/%s", defaultTopic), helperMustEncodeString(CmdInit))
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	subscribe(b, flushThreshold{})(subW, r)
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(subW.Body).Decode(&out))
+	assert.Equal(errNextValue.Error(), out.Error)
+}
+
+func TestSubscribeNonBlockingEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), strings.NewReader(`{"cmd":"INIT","block":false}`))
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	subscribe(b, flushThreshold{})(subW, r)
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(subW.Body).Decode(&out))
+	assert.True(out.Empty)
+	assert.Empty(out.Msg)
+	assert.Empty(out.Error)
+}
+
+func TestSubscribeNonBlockingMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	msg := "test_message"
+	_, err = b.Publish(defaultTopic, []byte(msg), messageMeta{})
+	assert.NoError(err)
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), strings.NewReader(`{"cmd":"INIT","block":false}`))
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	subscribe(b, flushThreshold{})(subW, r)
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(subW.Body).Decode(&out))
+	assert.False(out.Empty)
+	assert.Equal(msg, out.Msg)
+}
+
+func TestSubscribeBlockingWaits(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go func() {
+		_, _ = writer.Write([]byte(`{"cmd":"INIT","block":true}`))
+	}()
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), reader)
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	go subscribe(b, flushThreshold{})(subW, r)
+
+	// Nothing should be written while the topic is empty
+	time.Sleep(100 * time.Millisecond)
+	subW.Lock()
+	assert.Equal(0, subW.Body.Len())
+	subW.Unlock()
+
+	msg := "test_message"
+	_, err = b.Publish(defaultTopic, []byte(msg), messageMeta{})
+	assert.NoError(err)
+
+	var out subResponse
+	assert.NoError(NewDecodeWaiter(subW).WaitAndDecode(&out))
+	assert.Equal(msg, out.Msg)
+}
+
+func TestSubscribeDuplicateAck(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	_, err = b.Publish(defaultTopic, []byte("test_msg_1"), messageMeta{})
+	assert.NoError(err)
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	enc := json.NewEncoder(writer)
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), reader)
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	go subscribe(b, flushThreshold{})(subW, r)
+
+	dec := NewDecodeWaiter(subW)
+
+	var out subResponse
+	assert.NoError(enc.Encode(json.RawMessage(`{"cmd":"INIT","block":false}`)))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal("test_msg_1", out.Msg)
+
+	// ACK, then ACK again with no outstanding message
+	assert.NoError(enc.Encode(CmdAck))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.True(out.Empty)
+
+	out = subResponse{}
+	assert.NoError(enc.Encode(CmdAck))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Empty(out.Error)
+	assert.True(out.Empty)
+
+	// The next message is unaffected
+	_, err = b.Publish(defaultTopic, []byte("test_msg_2"), messageMeta{})
+	assert.NoError(err)
+
+	out = subResponse{}
+	assert.NoError(enc.Encode(CmdInit))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal("test_msg_2", out.Msg)
+}
+
+func TestSubscribeBatchAck(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db}
+	b := newBroker(s)
+
+	for _, msg := range []string{"test_msg_1", "test_msg_2", "test_msg_3"} {
+		_, err = b.Publish(defaultTopic, []byte(msg), messageMeta{})
+		assert.NoError(err)
+	}
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	enc := json.NewEncoder(writer)
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), reader)
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	go subscribe(b, flushThreshold{})(subW, r)
+
+	dec := NewDecodeWaiter(subW)
+
+	// Take all three messages without acking
+	var ids []string
+	for i := 0; i < 3; i++ {
+		var out subResponse
+		assert.NoError(enc.Encode(json.RawMessage(`{"cmd":"INIT","block":false}`)))
+		assert.NoError(dec.WaitAndDecode(&out))
+		assert.NotEmpty(out.ID)
+		ids = append(ids, out.ID)
+	}
+
+	// A set containing an unknown ID acks nothing
+	var out subResponse
+	assert.NoError(enc.Encode(command{Cmd: CmdAck, IDs: []string{ids[0], "unknown"}}))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal(errUnknownAckID.Error(), out.Error)
+
+	// Ack the first two together
+	out = subResponse{}
+	assert.NoError(enc.Encode(command{Cmd: CmdAck, IDs: ids[:2]}))
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Empty(out.Error)
+	assert.True(out.Empty)
+
+	_, err = s.GetMeta(defaultTopic, 0)
+	assert.Equal(errAckMsgNotExist, err)
+	_, err = s.GetMeta(defaultTopic, 1)
+	assert.Equal(errAckMsgNotExist, err)
+	_, err = s.GetMeta(defaultTopic, 2)
+	assert.NoError(err)
+}
+
+func TestSubscribePeekAll(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db}
+	b := newBroker(s)
+
+	msgs := []string{"msg_1", "msg_2", strings.Repeat("a", peekBodyLen+1)}
+	var ids []string
+	for _, msg := range msgs {
+		id, err := b.Publish(defaultTopic, []byte(msg), messageMeta{})
+		assert.NoError(err)
+		ids = append(ids, id)
+	}
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), helperMustEncodeString(CmdPeekAll))
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	subscribe(b, flushThreshold{})(subW, r)
+
+	var out []peekResponse
+	assert.NoError(json.NewDecoder(subW.Body).Decode(&out))
+	assert.Equal([]peekResponse{
+		{ID: ids[0], Msg: msgs[0]},
+		{ID: ids[1], Msg: msgs[1]},
+		{ID: ids[2], Msg: msgs[2][:peekBodyLen], Truncated: true},
+	}, out)
+
+	// Nothing should have been consumed or marked outstanding
+	l, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(len(msgs), l)
+
+	_, err = s.GetMeta(defaultTopic, 0)
+	assert.Equal(errAckMsgNotExist, err)
+}
+
 func TestServerPublishSubscribeAck(t *testing.T) {
 	assert := assert.New(t)
 
@@ -168,6 +484,31 @@ func TestServerPublishSubscribeAck(t *testing.T) {
 	assert.NoError(encoder.Encode(CmdAck))
 }
 
+func TestServerContentType(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	publishPath := fmt.Sprintf("%s/publish/%s", srv.URL, defaultTopic)
+	req, err := http.NewRequest(http.MethodPost, publishPath, strings.NewReader(`{"hello":"world"}`))
+	assert.NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusCreated, res.StatusCode)
+
+	_, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(`{"hello":"world"}`, out.Msg)
+	assert.Equal("application/json", out.ContentType)
+}
+
 func TestServerNack(t *testing.T) {
 	assert := assert.New(t)
 
@@ -194,6 +535,267 @@ func TestServerNack(t *testing.T) {
 	assert.Equal(msg1, out.Msg)
 }
 
+func TestServerNackReason(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	res := helperPublishMessage(t, srv, defaultTopic, "test_msg_1")
+	res.Body.Close()
+
+	enc, dec, closer := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closer()
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Empty(out.NackReasons)
+
+	assert.NoError(enc.Encode(command{Cmd: CmdNack, Reason: "timeout"}))
+
+	// The redelivered message carries the reason
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("test_msg_1", out.Msg)
+	assert.Equal([]string{"timeout"}, out.NackReasons)
+}
+
+func TestServerNackDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	res := helperPublishMessage(t, srv, defaultTopic, "test_msg_1")
+	res.Body.Close()
+
+	enc, dec, closer := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closer()
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+
+	// An invalid delay leaves the message outstanding
+	assert.NoError(enc.Encode(command{Cmd: CmdNack, Delay: "soon"}))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(errInvalidDelay.Error(), out.Error)
+
+	start := time.Now()
+	assert.NoError(enc.Encode(command{Cmd: CmdNack, Delay: "100ms"}))
+
+	// The message is redelivered once the delay has elapsed
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("test_msg_1", out.Msg)
+	assert.GreaterOrEqual(int64(time.Since(start)), int64(100*time.Millisecond))
+}
+
+func TestServerDeliverySeq(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	for _, msg := range []string{"test_msg_1", "test_msg_2"} {
+		res := helperPublishMessage(t, srv, defaultTopic, msg)
+		res.Body.Close()
+	}
+
+	enc, dec, closer := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closer()
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(subResponse{ID: out.ID, Msg: "test_msg_1", Seq: 1, PublishedAt: out.PublishedAt, Deliveries: 1}, out)
+
+	// The NACKed message is redelivered with the next sequence number
+	assert.NoError(enc.Encode(CmdNack))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(subResponse{ID: out.ID, Msg: "test_msg_1", Seq: 2, Redelivered: true, PublishedAt: out.PublishedAt, Deliveries: 2}, out)
+
+	assert.NoError(enc.Encode(CmdAck))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(subResponse{ID: out.ID, Msg: "test_msg_2", Seq: 3, PublishedAt: out.PublishedAt, Deliveries: 1}, out)
+}
+
+func TestServerMessageEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/publish/%s", srv.URL, defaultTopic), strings.NewReader("test_msg"))
+	assert.NoError(err)
+	req.Header.Set("X-Miniqueue-Trace-Id", "test_trace")
+	req.Header.Set("X-Other", "test_other")
+
+	start := time.Now()
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, res.StatusCode)
+	res.Body.Close()
+
+	enc, dec, closer := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closer()
+
+	// Only the headers under the prefix are delivered
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(map[string]string{"Trace-Id": "test_trace"}, out.Headers)
+	assert.Equal(1, out.Deliveries)
+	if assert.NotNil(out.PublishedAt) {
+		assert.WithinDuration(start, *out.PublishedAt, time.Minute)
+	}
+
+	// The headers are kept as the message is delivered again
+	assert.NoError(enc.Encode(CmdNack))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(map[string]string{"Trace-Id": "test_trace"}, out.Headers)
+	assert.Equal(2, out.Deliveries)
+}
+
+func TestServerCommit(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	for _, msg := range []string{"test_msg_1", "test_msg_2", "test_msg_3", "test_msg_4"} {
+		res := helperPublishMessage(t, srv, defaultTopic, msg)
+		res.Body.Close()
+	}
+
+	enc, dec, closer := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closer()
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(1, out.Seq)
+
+	// Take two more messages without acking
+	for _, seq := range []int{2, 3} {
+		assert.NoError(enc.Encode(CmdInit))
+
+		out = subResponse{}
+		assert.NoError(dec.Decode(&out))
+		assert.Equal(seq, out.Seq)
+	}
+
+	// A commit beyond the last delivery is rejected
+	assert.NoError(enc.Encode(command{Cmd: CmdCommit, Seq: 4}))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(errCommitAhead.Error(), out.Error)
+
+	// Committing acks every message up to the seq, then delivers the next
+	assert.NoError(enc.Encode(command{Cmd: CmdCommit, Seq: 2}))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("test_msg_4", out.Msg)
+	assert.Equal(4, out.Seq)
+
+	// A commit must be for a positive seq
+	assert.NoError(enc.Encode(command{Cmd: CmdCommit}))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(errInvalidCommit.Error(), out.Error)
+}
+
+func TestServerStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	res := helperPublishMessage(t, srv, defaultTopic, "test_msg_1")
+	res.Body.Close()
+
+	enc, dec, closer := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closer()
+
+	var msg subResponse
+	assert.NoError(dec.Decode(&msg))
+
+	assert.NoError(enc.Encode(CmdStatus))
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.NotNil(out.Status)
+	assert.Equal(msg.ID, out.Status.ID)
+	assert.Equal("test_msg_1", out.Status.Msg)
+	assert.Equal(1, out.Status.Deliveries)
+	assert.NotNil(out.Status.DeliveredAt)
+	assert.WithinDuration(time.Now(), *out.Status.DeliveredAt, time.Minute)
+
+	// STATUS changes nothing, the message is still outstanding
+	assert.NoError(enc.Encode(CmdNack))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(msg.ID, out.ID)
+
+	assert.NoError(enc.Encode(CmdStatus))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(msg.ID, out.Status.ID)
+	assert.Equal(2, out.Status.Deliveries)
+}
+
+func TestServerAckWithResult(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	replyTopic := "replies"
+
+	// Publish a request expecting a reply
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/publish/%s", srv.URL, defaultTopic), strings.NewReader("ping"))
+	assert.NoError(err)
+	req.Header.Set(headerReplyTo, replyTopic)
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusCreated, res.StatusCode)
+
+	var pub pubResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&pub))
+
+	// The worker ACKs with its result
+	enc, dec, closeWorker := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeWorker()
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("ping", out.Msg)
+
+	result := "pong"
+	assert.NoError(enc.Encode(command{Cmd: CmdAck, Result: &result}))
+
+	// The result is received on the reply topic
+	_, replyDec, closeReplies := helperSubscribeTopic(t, srv, replyTopic)
+	defer closeReplies()
+
+	out = subResponse{}
+	assert.NoError(replyDec.Decode(&out))
+	assert.Equal("pong", out.Msg)
+	assert.Equal(pub.ID, out.InReplyTo)
+}
+
 func TestServerConnectionLost(t *testing.T) {
 	assert := assert.New(t)
 
@@ -234,6 +836,81 @@ func TestServerConnectionLost(t *testing.T) {
 	assert.Equal(msg1, out.Msg)
 }
 
+func TestServerConnectionLost_AckOnDisconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	for _, msg := range []string{"test_msg_1", "test_msg_2"} {
+		res := helperPublishMessage(t, srv, defaultTopic, msg)
+		res.Body.Close()
+	}
+
+	// Setup a subscriber which drops its message on disconnect
+	_, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic+"?on_disconnect=ack")
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal("test_msg_1", out.Msg)
+
+	closeSub()
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, decoder, closeSub = helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	// The first message is not redelivered
+	out = subResponse{}
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal("test_msg_2", out.Msg)
+}
+
+func TestServerCloseTrailer(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	msg1 := "test_msg_1"
+	res := helperPublishMessage(t, srv, defaultTopic, msg1)
+	defer res.Body.Close()
+
+	reader, writer := io.Pipe()
+	encoder := json.NewEncoder(writer)
+	go func() {
+		assert.NoError(encoder.Encode(CmdInit))
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/subscribe/%s", srv.URL, defaultTopic), reader)
+	assert.NoError(err)
+
+	res, err = srv.Client().Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(res.Body)
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(msg1, out.Msg)
+
+	// Close the stream, the trailer is available once the body is drained
+	assert.NoError(encoder.Encode(CmdClose))
+
+	_, err = io.Copy(ioutil.Discard, res.Body)
+	assert.NoError(err)
+	assert.Equal(streamStatusClosed, res.Trailer.Get(trailerStreamStatus))
+
+	// The outstanding message should have been returned to the queue
+	_, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	assert.NoError(decoder.Decode(&out))
+	assert.Equal(msg1, out.Msg)
+}
+
 func TestServerMultiConsumer(t *testing.T) {
 	assert := assert.New(t)
 
@@ -336,6 +1013,75 @@ func TestServerMultiConsumerConnectionLost(t *testing.T) {
 	}
 }
 
+func TestServerSubscribeLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t, withSubscribeLimit(2, 0))
+	defer srvCloser()
+
+	// Publish enough messages for each subscriber to receive one
+	for _, msg := range []string{"test_msg_1", "test_msg_2", "test_msg_3"} {
+		res := helperPublishMessage(t, srv, defaultTopic, msg)
+		defer res.Body.Close()
+	}
+
+	// Subscribe up to the limit
+	_, decoder1, closeSub1 := helperSubscribeTopic(t, srv, defaultTopic)
+
+	_, decoder2, closeSub2 := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub2()
+
+	var out subResponse
+	assert.NoError(decoder1.Decode(&out))
+	assert.NoError(decoder2.Decode(&out))
+
+	// The next subscriber should be rejected
+	res := helperSubscribeRaw(t, srv, defaultTopic)
+	defer res.Body.Close()
+
+	assert.Equal(http.StatusServiceUnavailable, res.StatusCode)
+	assert.NotEmpty(res.Header.Get("Retry-After"))
+	assert.NoError(json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal(errSubscribeLimit.Error(), out.Error)
+
+	// Free up a slot, giving the server time to notice the disconnect
+	closeSub1()
+	time.Sleep(100 * time.Millisecond)
+
+	_, decoder3, closeSub3 := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub3()
+
+	assert.NoError(decoder3.Decode(&out))
+	assert.NotEmpty(out.Msg)
+}
+
+func TestServerSubscribeTopicLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t, withSubscribeLimit(0, 1))
+	defer srvCloser()
+
+	const otherTopic = "other_topic"
+
+	res := helperPublishMessage(t, srv, defaultTopic, "test_msg_1")
+	defer res.Body.Close()
+
+	res = helperPublishMessage(t, srv, otherTopic, "test_msg_2")
+	defer res.Body.Close()
+
+	_, _, closeSub1 := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub1()
+
+	// A second subscriber on the same topic is rejected
+	res = helperSubscribeRaw(t, srv, defaultTopic)
+	defer res.Body.Close()
+	assert.Equal(http.StatusServiceUnavailable, res.StatusCode)
+
+	// Whereas a different topic is unaffected
+	_, _, closeSub2 := helperSubscribeTopic(t, srv, otherTopic)
+	defer closeSub2()
+}
+
 // Benchmarking
 
 func BenchmarkPublish(b *testing.B) {
@@ -372,16 +1118,19 @@ func BenchmarkPublish(b *testing.B) {
 
 // Returns a new, started, httptest server and a corresponding function which
 // will force close connections and close the server when called.
-func helperNewTestServer(t *testing.T) (*httptest.Server, func()) {
+func helperNewTestServer(t *testing.T, opts ...serverOption) (*httptest.Server, func()) {
 	t.Helper()
 
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	assert.NoError(t, err)
 
-	srv := httptest.NewUnstartedServer(newServer(newBroker(&store{
+	s := newServer(newBroker(&store{
 		path: "",
 		db:   db,
-	})))
+	}), opts...)
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.Config.ConnState = s.ConnState
 
 	srv.EnableHTTP2 = true
 	srv.StartTLS()
@@ -419,6 +1168,24 @@ func helperSubscribeTopic(t *testing.T, srv *httptest.Server, topicName string)
 	}
 }
 
+// helperSubscribeRaw sends a subscribe request for the topic, returning the
+// response without asserting on its status.
+func helperSubscribeRaw(t *testing.T, srv *httptest.Server, topicName string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/subscribe/%s", srv.URL, topicName),
+		helperMustEncodeString(CmdInit),
+	)
+	assert.NoError(t, err)
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(t, err)
+
+	return res
+}
+
 func helperPublishMessage(t *testing.T, srv *httptest.Server, topicName, msg string) *http.Response {
 	t.Helper()
 
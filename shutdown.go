@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// stopPollInterval is how often StopDelivering checks whether every
+	// consumer has unsubscribed.
+	stopPollInterval = 50 * time.Millisecond
+
+	// stopRequeueTimeout is how long StopDelivering waits for the consumers
+	// it disconnects to return their outstanding messages to their topics.
+	stopRequeueTimeout = 5 * time.Second
+)
+
+// StopDelivering stops delivering messages to consumers, as the broker shuts
+// down, and waits for each consumer to resolve the messages outstanding with
+// it and unsubscribe. A consumer holding none unsubscribes straight away.
+//
+// Once ctx is done, the consumers still subscribed are disconnected, returning
+// their outstanding messages to their topics to be redelivered after a
+// restart, and StopDelivering waits for them to unsubscribe.
+func (b *broker) StopDelivering(ctx context.Context) error {
+	b.stopOnce.Do(func() {
+		close(b.stopping)
+	})
+
+	if b.awaitUnsubscribed(ctx) {
+		return nil
+	}
+
+	log.Warn().
+		Int("consumers", b.disconnectAll()).
+		Msg("consumers still hold outstanding messages, returning them to their topics")
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopRequeueTimeout)
+	defer cancel()
+
+	if !b.awaitUnsubscribed(ctx) {
+		return fmt.Errorf("%d consumers still subscribed after disconnecting them", b.consumerCount())
+	}
+
+	return nil
+}
+
+// awaitUnsubscribed waits for every consumer to unsubscribe, reporting false if
+// ctx is done first.
+func (b *broker) awaitUnsubscribed(ctx context.Context) bool {
+	ticker := time.NewTicker(stopPollInterval)
+	defer ticker.Stop()
+
+	for b.consumerCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+// consumerCount returns the number of consumers subscribed across every topic.
+func (b *broker) consumerCount() int {
+	b.RLock()
+	defer b.RUnlock()
+
+	var n int
+	for _, conss := range b.consumers {
+		n += len(conss)
+	}
+
+	return n
+}
+
+// disconnectAll signals every consumer to stop, as DisconnectConsumer does,
+// returning the number signalled. They're left subscribed until they return
+// their outstanding messages and unsubscribe.
+func (b *broker) disconnectAll() int {
+	b.Lock()
+	defer b.Unlock()
+
+	var n int
+	for _, conss := range b.consumers {
+		for _, c := range conss {
+			if !c.kicked() {
+				close(c.kick)
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// stopped reports whether the broker has stopped delivering messages to the
+// consumer, as it shuts down.
+func (c *consumer) stopped() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown is a server wide flag which, once set, rejects new publishes and
+// subscribes while the server shuts down.
+type shutdown struct {
+	on int32
+}
+
+func (s *shutdown) start() {
+	atomic.StoreInt32(&s.on, 1)
+}
+
+func (s *shutdown) started() bool {
+	return atomic.LoadInt32(&s.on) == 1
+}
+
+// Stop starts shutting down the server, rejecting new publishes and subscribes
+// with 503, and stops delivering messages, waiting for consumers to resolve
+// those they hold until ctx is done, see broker.StopDelivering.
+func (s server) Stop(ctx context.Context) error {
+	s.shutdown.start()
+
+	return s.broker.StopDelivering(ctx)
+}
+
+// rejectOnShutdown responds with 503 to requests once the server is shutting
+// down.
+func rejectOnShutdown(s *shutdown, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.started() {
+			log := log.With().
+				Str("path", r.URL.Path).
+				Logger()
+
+			log.Debug().Msg("rejecting request during shutdown")
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+			respondError(log, json.NewEncoder(w), errShuttingDown.Error())
+
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// respondStopped ends the stream of a consumer the broker has stopped
+// delivering to, once it holds no outstanding messages. Until then, the stream
+// carries on for the client to resolve them. It reports whether the stream may
+// carry on.
+func respondStopped(log zerolog.Logger, w http.ResponseWriter, enc *json.Encoder, cons *consumer) bool {
+	if n := cons.Outstanding(); n > 0 {
+		log.Debug().Int("outstanding", n).Msg("shutting down, waiting for outstanding messages")
+
+		return true
+	}
+
+	log.Info().Msg("shutting down, closing stream")
+
+	respondError(log, enc, errShuttingDown.Error())
+	setStreamStatus(w, streamStatusClosed)
+
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerStop(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	s := newServer(b)
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, msg := range []string{"msg_1", "msg_2"} {
+		_, err := b.Publish(defaultTopic, value(msg), messageMeta{})
+		assert.NoError(err)
+	}
+
+	enc, dec, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("msg_1", out.Msg)
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		stopped <- s.Stop(ctx)
+	}()
+
+	assert.Eventually(s.shutdown.started, time.Second, 5*time.Millisecond)
+
+	// New publishes and subscribes are rejected
+	for _, path := range []string{"/publish/", "/subscribe/"} {
+		res, err := srv.Client().Post(srv.URL+path+defaultTopic, "", strings.NewReader("msg_3"))
+		assert.NoError(err)
+
+		var body subResponse
+		assert.NoError(json.NewDecoder(res.Body).Decode(&body))
+		res.Body.Close()
+
+		assert.Equal(http.StatusServiceUnavailable, res.StatusCode)
+		assert.Equal(errShuttingDown.Error(), body.Error)
+	}
+
+	// The subscriber resolves the message it holds, rather than being cut
+	// off, and isn't delivered another
+	assert.NoError(enc.Encode(CmdAck))
+
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(errShuttingDown.Error(), out.Error)
+	assert.Equal(io.EOF, dec.Decode(&out))
+
+	select {
+	case err := <-stopped:
+		assert.NoError(err)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the broker to stop delivering")
+	}
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestServerStop_Timeout(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	s := newServer(b)
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	_, err := b.Publish(defaultTopic, value("msg_1"), messageMeta{})
+	assert.NoError(err)
+
+	// The consumer holds the message without ever ACKing it
+	_, dec, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(dec.Decode(&out))
+	assert.Equal("msg_1", out.Msg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(s.Stop(ctx))
+
+	// Once the drain times out, the consumer is disconnected and its message
+	// returned to the topic
+	out = subResponse{}
+	assert.NoError(dec.Decode(&out))
+	assert.Equal(errShuttingDown.Error(), out.Error)
+	assert.Equal(io.EOF, dec.Decode(&out))
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+	assert.Empty(b.ConsumerIDs(defaultTopic))
+}
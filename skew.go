@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// headerTimestamp is the publish header holding the time the producer
+	// created the message, as an RFC 3339 time.
+	headerTimestamp = "X-MQ-Timestamp"
+	// headerCloudEventsTime holds the time of a CloudEvent in binary content
+	// mode, used if headerTimestamp is absent.
+	headerCloudEventsTime = "Ce-Time"
+)
+
+// withMaxSkew rejects publishes with a producer timestamp more than skew before
+// or after the broker's clock, catching misconfigured producers. Messages
+// without a timestamp are accepted. Zero disables the check.
+func withMaxSkew(skew time.Duration) brokerOption {
+	return func(b *broker) {
+		b.maxSkew = skew
+	}
+}
+
+// producerTimestamp returns the time the producer created the message, from
+// the headers it was published with, reporting whether there was one.
+func producerTimestamp(h http.Header) (time.Time, bool, error) {
+	v := h.Get(headerTimestamp)
+	if v == "" {
+		v = h.Get(headerCloudEventsTime)
+	}
+
+	if v == "" {
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false, errInvalidTimestamp
+	}
+
+	return t, true, nil
+}
+
+// checkSkew returns an error if the producer timestamp of the message is
+// invalid, or outside the allowed skew of the broker's clock.
+func (b *broker) checkSkew(meta messageMeta) error {
+	if b.maxSkew <= 0 {
+		return nil
+	}
+
+	t, ok, err := producerTimestamp(meta.Header)
+	if err != nil || !ok {
+		return err
+	}
+
+	skew := b.now().Sub(t)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	if skew > b.maxSkew {
+		return errTimestampSkew
+	}
+
+	return nil
+}
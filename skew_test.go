@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestBrokerPublish_MaxSkew(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		maxSkew time.Duration
+		header  map[string]string
+		wantErr error
+	}{
+		{
+			name:    "too old",
+			maxSkew: time.Minute,
+			header:  map[string]string{headerTimestamp: "2020-01-01T11:58:00Z"},
+			wantErr: errTimestampSkew,
+		},
+		{
+			name:    "too far in the future",
+			maxSkew: time.Minute,
+			header:  map[string]string{headerTimestamp: "2020-01-01T12:02:00Z"},
+			wantErr: errTimestampSkew,
+		},
+		{
+			name:    "within skew",
+			maxSkew: time.Minute,
+			header:  map[string]string{headerTimestamp: "2020-01-01T11:59:30Z"},
+		},
+		{
+			name:    "cloudevents time",
+			maxSkew: time.Minute,
+			header:  map[string]string{headerCloudEventsTime: "2020-01-01T11:00:00Z"},
+			wantErr: errTimestampSkew,
+		},
+		{
+			name:    "no timestamp",
+			maxSkew: time.Minute,
+		},
+		{
+			name:    "invalid timestamp",
+			maxSkew: time.Minute,
+			header:  map[string]string{headerTimestamp: "yesterday"},
+			wantErr: errInvalidTimestamp,
+		},
+		{
+			name:   "disabled",
+			header: map[string]string{headerTimestamp: "2000-01-01T00:00:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			db, err := leveldb.Open(storage.NewMemStorage(), nil)
+			assert.NoError(err)
+
+			s := &store{db: db}
+			b := newBroker(s,
+				withMaxSkew(tt.maxSkew),
+				withClock(func() time.Time { return now }),
+			)
+
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+
+			_, err = b.Publish(defaultTopic, []byte("test_value"), messageMeta{Header: header})
+			assert.Equal(tt.wantErr, err)
+
+			// Rejected messages aren't stored
+			n, err := s.Len(defaultTopic)
+			assert.NoError(err)
+
+			if tt.wantErr != nil {
+				assert.Equal(0, n)
+			} else {
+				assert.Equal(1, n)
+			}
+		})
+	}
+}
+
+func TestPublishTimestampSkew(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withMaxSkew(time.Minute))
+
+	w := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/publish/"+defaultTopic, strings.NewReader("test_value"))
+	r.Header.Set(headerTimestamp, time.Now().Add(-time.Hour).Format(time.RFC3339))
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	publish(b)(w, r)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), errTimestampSkew.Error())
+}
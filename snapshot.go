@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// topicSnapshot describes the messages waiting on a topic at a point in time.
+type topicSnapshot struct {
+	// Depth is the number of messages waiting to be consumed.
+	Depth int `json:"depth"`
+	// OldestAge is how long the message at the head of the topic has been
+	// waiting, zero if the topic is empty.
+	OldestAge time.Duration `json:"oldest_age_ns"`
+}
+
+// Snapshot returns the current state of the consumer's topic, without
+// consuming any messages.
+func (c *consumer) Snapshot() (topicSnapshot, error) {
+	depth, err := c.store.Len(c.topic)
+	if err != nil {
+		return topicSnapshot{}, fmt.Errorf("getting length of topic %s: %v", c.topic, err)
+	}
+
+	snap := topicSnapshot{Depth: depth}
+	if depth == 0 {
+		return snap, nil
+	}
+
+	head, err := c.Peek(1)
+	if err != nil {
+		return topicSnapshot{}, err
+	}
+
+	if len(head) > 0 && !head[0].meta.PublishedAt.IsZero() {
+		snap.OldestAge = c.now().Sub(head[0].meta.PublishedAt)
+	}
+
+	return snap, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestSubscribeSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Unix(1600000000, 0)
+	b := newBroker(&store{db: db}, withClock(func() time.Time { return now }))
+
+	for _, msg := range []string{"test_msg_1", "test_msg_2"} {
+		_, err = b.Publish(defaultTopic, []byte(msg), messageMeta{})
+		assert.NoError(err)
+	}
+
+	now = now.Add(5 * time.Second)
+
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	enc := json.NewEncoder(writer)
+
+	subW := NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), reader)
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+
+	go subscribe(b, flushThreshold{})(subW, r)
+
+	dec := NewDecodeWaiter(subW)
+
+	assert.NoError(enc.Encode(command{Cmd: CmdInit, Snapshot: true}))
+
+	// The snapshot comes first, without consuming anything
+	var out subResponse
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal(subResponse{Signal: signalSnapshot, Snapshot: &topicSnapshot{Depth: 2, OldestAge: 5 * time.Second}}, out)
+
+	// Followed by the messages
+	out = subResponse{}
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal("test_msg_1", out.Msg)
+	assert.Nil(out.Snapshot)
+
+	assert.NoError(enc.Encode(CmdAck))
+
+	out = subResponse{}
+	assert.NoError(dec.WaitAndDecode(&out))
+	assert.Equal("test_msg_2", out.Msg)
+}
+
+func TestConsumerSnapshot_Empty(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	c := newBroker(&store{db: db}).Subscribe(defaultTopic)
+
+	snap, err := c.Snapshot()
+	assert.NoError(err)
+	assert.Equal(topicSnapshot{}, snap)
+}
@@ -0,0 +1,30 @@
+package main
+
+import "time"
+
+// consumerStatus describes the message outstanding on a consumer. It is empty
+// if nothing is outstanding.
+type consumerStatus struct {
+	ID          string     `json:"id,omitempty"`
+	Msg         string     `json:"msg,omitempty"`
+	Deliveries  int        `json:"deliveries,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Status returns the most recently delivered message which is still
+// outstanding on the consumer, without changing any state.
+func (c *consumer) Status() consumerStatus {
+	d := c.current()
+	if d == nil {
+		return consumerStatus{}
+	}
+
+	at := d.at
+
+	return consumerStatus{
+		ID:          d.meta.ID,
+		Msg:         string(d.val),
+		Deliveries:  d.meta.Deliveries,
+		DeliveredAt: &at,
+	}
+}
@@ -4,32 +4,166 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // storer should be safe for concurrent use.
 type storer interface {
-	// Insert inserts a new record for a given topic.
-	Insert(topic string, value value) error
-
-	// GetNext will retrieve the next value in the topic, as well as the AckKey
-	// allowing future acking/nacking of the value.
-	GetNext(topic string) (val value, ackOffset int, err error)
-
-	// Ack will acknowledge the processing of a value, removing it from the topic
-	// entirely.
-	Ack(topic string, ackOffset int) error
+	// Insert inserts a new record, along with its metadata, for a given topic.
+	// A record with a key replaces the record with the same key waiting on the
+	// topic, if there is one. A record with a priority is placed ahead of the
+	// records waiting with a lower priority.
+	Insert(topic string, value value, meta messageMeta) error
+
+	// InsertAll inserts each record into its topic atomically, such that
+	// either every record is inserted or none are.
+	InsertAll(records []record) error
+
+	// ReplaceAll discards the values waiting on each of the topics and
+	// inserts the records atomically, such that either both happen or neither
+	// does. Values awaiting acknowledgement are kept.
+	ReplaceAll(topics []string, records []record) error
+
+	// GetNext will retrieve the next value in the topic along with its
+	// metadata, as well as the AckKey allowing future acking/nacking of the
+	// value. If there are no values waiting on the topic, errNoMessages is
+	// returned. A value whose key is awaiting acknowledgement is held back
+	// until the outstanding value is resolved, skipped over for the next value
+	// which isn't.
+	// A value larger than streamThreshold is returned empty, with its size in
+	// meta.BodySize, to be read through Reader.
+	GetNext(topic string) (val value, meta messageMeta, ackOffset int, err error)
+
+	// Ack will acknowledge the processing of values, removing them from the
+	// topic entirely. Multiple values are acknowledged atomically. With
+	// retention configured, the values are kept in the history of the topic.
+	Ack(topic string, ackOffsets ...int) error
+
+	// Drop removes values awaiting acknowledgement from the topic entirely,
+	// without retaining them in its history.
+	Drop(topic string, ackOffsets ...int) error
 
 	// Nack will negatively acknowledge the value, on a given topic, returning it
-	// to the front of the consumption queue.
+	// to the front of the consumption queue, behind any values with a higher
+	// priority. A value with a key which has since been superseded is dropped
+	// instead.
 	Nack(topic string, ackOffset int) error
 
+	// Fetch retrieves the value with the ID waiting on the topic, regardless
+	// of its position, in the same way as GetNext. errMsgNotFound is returned
+	// if no value with the ID is waiting, and errMsgOutstanding if it already
+	// awaits acknowledgement.
+	Fetch(topic, id string) (val value, meta messageMeta, ackOffset int, err error)
+
+	// GetMeta returns the metadata of the value awaiting acknowledgement at
+	// ackOffset.
+	GetMeta(topic string, ackOffset int) (messageMeta, error)
+
+	// Reader returns a reader over the value awaiting acknowledgement at
+	// ackOffset, along with its size, reading a value larger than
+	// streamThreshold without holding it in memory whole. The reader must be
+	// closed.
+	Reader(topic string, ackOffset int) (io.ReadCloser, int, error)
+
+	// NackReason records the reason the value awaiting acknowledgement at
+	// ackOffset is being negatively acknowledged, keeping the most recent
+	// maxNackReasons reasons.
+	NackReason(topic string, ackOffset int, reason string) error
+
+	// Topics returns the name of every topic in the store.
+	Topics() ([]string, error)
+
+	// Len returns the number of values waiting to be consumed on the topic.
+	Len(topic string) (int, error)
+
+	// History returns the acked values retained for the topic, oldest first.
+	History(topic string) ([]historyEntry, error)
+
+	// Peek returns up to limit values waiting to be consumed on the topic, in
+	// the order they will be consumed, without modifying the topic.
+	Peek(topic string, limit int) ([]pendingMessage, error)
+
+	// GetTopicConfig returns the config stored for a topic, or
+	// errTopicConfigNotExist if none has been stored.
+	GetTopicConfig(topic string) (topicConfig, error)
+
+	// PutTopicConfig stores the config for a topic, replacing any existing
+	// config.
+	PutTopicConfig(topic string, cfg topicConfig) error
+
+	// TopicConfigs returns all stored topic configs, keyed by topic.
+	TopicConfigs() (map[string]topicConfig, error)
+
+	// ResetDeliveries zeroes the delivery count of each value waiting to be
+	// consumed on the topic, returning the number of values changed.
+	ResetDeliveries(topic string) (int, error)
+
+	// ReadLog returns the first value kept in the replay log of the topic at
+	// or after offset, or errNoMessages if there is none yet.
+	ReadLog(topic string, offset int) (logEntry, error)
+
+	// LogOffsets returns the offset of the oldest value kept in the replay log
+	// of the topic, and the offset assigned to the next value published.
+	LogOffsets(topic string) (head, tail int, err error)
+
+	// Sweep deletes the values waiting at the head of each topic which were
+	// published before the given time, moving them to the expired topic if
+	// keep is set, and returns the metadata of those swept per topic.
+	Sweep(before time.Time, keep bool) (map[string][]messageMeta, error)
+
+	// SweepExpired deletes the values waiting on each topic whose delivery
+	// deadline has passed by now, moving them to the expired topic if keep is
+	// set, and returns the metadata of those swept per topic.
+	SweepExpired(now time.Time, keep bool) (map[string][]messageMeta, error)
+
+	// Iterate calls fn with each value waiting on the topic in order, along
+	// with its metadata, stopping at the first error returned by fn.
+	Iterate(topic string, fn func(val value, meta messageMeta) error) error
+
+	// Shed deletes up to n values waiting at the head of the topic, returning
+	// the number deleted, to make room when the store is out of space.
+	Shed(topic string, n int) (int, error)
+
+	// DeleteTopic deletes everything stored for the topic, including the
+	// values awaiting acknowledgement, its history and its config.
+	DeleteTopic(topic string) error
+
+	// PutGroup registers the consumer group of the topic, such that it is
+	// recovered by the next run.
+	PutGroup(topic, group string) error
+
+	// Groups returns the group topic of each registered consumer group.
+	Groups() ([]string, error)
+
+	// NextSeq increments and returns the sequence number of the topic,
+	// starting from 1.
+	NextSeq(topic string) (int, error)
+
+	// Recover returns values left awaiting acknowledgement by a previous run to
+	// their topics, returning the recovered state of each topic.
+	Recover() (map[string]topicRecovery, error)
+
+	// InsertDelayed holds a delayed message until it is due to be published.
+	InsertDelayed(msg delayedMessage) error
+
+	// DeleteDelayed deletes a delayed message once it has been published.
+	DeleteDelayed(msg delayedMessage) error
+
+	// Delayed returns the delayed messages held, earliest due first.
+	Delayed() ([]delayedMessage, error)
+
 	// Close closes the store.
 	Close() error
 
@@ -39,9 +173,11 @@ type storer interface {
 }
 
 const (
-	errTopicEmpty     = storeError("topic is empty")
+	errNoMessages     = storeError("no messages available on topic")
 	errTopicNotExist  = storeError("topic does not exist")
 	errAckMsgNotExist = storeError("msg to ack does not exist")
+
+	errTopicConfigNotExist = storeError("topic config does not exist")
 )
 
 type storeError string
@@ -57,44 +193,167 @@ const (
 
 	ackTopicFmt      = "%s-ack-%d"
 	ackTailPosKeyFmt = "%s-ack-head"
+
+	metaFmt    = "%s-meta-%d"
+	ackMetaFmt = "%s-ack-meta-%d"
+
+	// syncMarkerKey is written synchronously in order to fsync the journal,
+	// persisting all writes which preceded it.
+	syncMarkerKey = "miniqueue-sync"
+
+	topicConfigPrefix = "miniqueue-config-"
+	topicConfigKeyFmt = topicConfigPrefix + "%s"
+)
+
+// syncPolicy determines how often writes to the store are fsynced to disk.
+type syncPolicy string
+
+const (
+	// syncNone leaves flushing writes to disk to the OS.
+	syncNone = syncPolicy("none")
+	// syncPeriodic fsyncs outstanding writes on a fixed interval.
+	syncPeriodic = syncPolicy("periodic")
+	// syncAlways fsyncs after every operation which writes to the store.
+	syncAlways = syncPolicy("always")
 )
 
 // store handles the the underlying leveldb implementation.
 type store struct {
 	path string
 	db   *leveldb.DB
+
+	syncPolicy   syncPolicy
+	syncInterval time.Duration
+	dirty        bool
+	onSync       func() // called after each fsync, used for inspection in tests
+	done         chan struct{}
+	closeOnce    sync.Once
+	wg           sync.WaitGroup
+
+	cache *headCache
+	reads int // number of values read from the db by GetNext
+
+	retention retention
+	replayLog retention
+	now       func() time.Time // shared with the broker, time.Now if nil
+
 	sync.Mutex
 }
 
-func newStore(dbPath string) storer {
+// storeOption configures optional behaviour of the store.
+type storeOption func(*store)
+
+// withSyncPolicy sets the policy used to fsync writes to disk. The interval is
+// only used by the periodic policy.
+func withSyncPolicy(policy syncPolicy, interval time.Duration) storeOption {
+	return func(s *store) {
+		s.syncPolicy = policy
+		s.syncInterval = interval
+	}
+}
+
+// withHeadCache caches up to size values at the head of each topic in memory,
+// avoiding reading them back from the db on consumption. Zero disables the
+// cache.
+func withHeadCache(size int) storeOption {
+	return func(s *store) {
+		s.cache = newHeadCache(size)
+	}
+}
+
+func newStore(dbPath string, opts ...storeOption) storer {
 	db, err := leveldb.OpenFile(dbPath, nil)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to open levelDB")
 	}
 
-	return &store{
-		path: dbPath,
-		db:   db,
+	return newStoreFromDB(dbPath, db, opts...)
+}
+
+// newStoreFromDB returns a store over an open db, persisted at dbPath.
+func newStoreFromDB(dbPath string, db *leveldb.DB, opts ...storeOption) *store {
+	s := &store{
+		path:       dbPath,
+		db:         db,
+		syncPolicy: syncNone,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.syncPolicy == syncPeriodic && s.syncInterval > 0 {
+		s.done = make(chan struct{})
+		s.wg.Add(1)
+
+		go s.syncPeriodically()
+	}
+
+	return s
+}
+
+func (s *store) setClock(now func() time.Time) {
+	s.now = now
+}
+
+// clock returns the current time, by the clock of the broker if it's shared.
+func (s *store) clock() time.Time {
+	if s.now == nil {
+		return time.Now()
 	}
+
+	return s.now()
 }
 
-// Ack will acknowledge the processing of a value, removing it from the topic
+// Ack will acknowledge the processing of values, removing them from the topic
 // entirely.
-func (s *store) Ack(topic string, ackOffset int) error {
+func (s *store) Ack(topic string, ackOffsets ...int) error {
+	return s.remove(topic, s.retention.enabled(), ackOffsets)
+}
+
+// Drop removes values awaiting acknowledgement from the topic entirely, without
+// retaining them in its history.
+func (s *store) Drop(topic string, ackOffsets ...int) error {
+	return s.remove(topic, false, ackOffsets)
+}
+
+// remove deletes values awaiting acknowledgement, retaining them in the history
+// of the topic if retain is set.
+func (s *store) remove(topic string, retain bool, ackOffsets []int) error {
 	s.Lock()
 	defer s.Unlock()
 
-	// Delete the used value
-	key := fmt.Sprintf(ackTopicFmt, topic, ackOffset)
-	if err := s.db.Delete([]byte(key), nil); err != nil {
+	batch := new(leveldb.Batch)
+	if retain {
+		if err := s.retain(batch, topic, ackOffsets, s.clock()); err != nil {
+			return fmt.Errorf("retaining acked value: %v", err)
+		}
+	}
+
+	// Delete the used values along with their metadata and bodies
+	for _, ackOffset := range ackOffsets {
+		meta, err := getMeta(s.db, ackMetaFmt, topic, ackOffset)
+		if err != nil {
+			return err
+		}
+
+		releaseKey(batch, topic, meta)
+		deleteBody(batch, topic, meta)
+
+		batch.Delete([]byte(fmt.Sprintf(ackTopicFmt, topic, ackOffset)))
+		batch.Delete([]byte(fmt.Sprintf(ackMetaFmt, topic, ackOffset)))
+	}
+
+	if err := s.db.Write(batch, nil); err != nil {
 		return fmt.Errorf("deleting from ack topic: %v", err)
 	}
 
-	return nil
+	return s.written()
 }
 
 // Nack will negatively acknowledge the value, on a given topic, returning it
-// to the front of the consumption queue.
+// to the front of the consumption queue, behind any values with a higher
+// priority.
 func (s *store) Nack(topic string, ackOffset int) error {
 	s.Lock()
 	defer s.Unlock()
@@ -122,9 +381,66 @@ func (s *store) Nack(topic string, ackOffset int) error {
 		return fmt.Errorf("getting ack msg from topic %s at offset %d: %v", topic, ackOffset, err)
 	}
 
-	if _, err := prependValueTx(tx, headPosKeyFmt, topicFmt, topic, val); err != nil {
+	meta, err := getMetaTx(tx, ackMetaFmt, topic, ackOffset)
+	if err != nil {
 		tx.Discard()
-		return fmt.Errorf("prepending value to topic %s: %v", topic, err)
+		return fmt.Errorf("getting meta from topic %s at offset %d: %v", topic, ackOffset, err)
+	}
+
+	var superseded bool
+	if meta.Key != "" {
+		if err := tx.Delete(outstandingKey(topic, meta.Key), nil); err != nil {
+			tx.Discard()
+			return fmt.Errorf("deleting outstanding key %s: %v", meta.Key, err)
+		}
+
+		_, superseded, err = keyOffsetTx(tx, pendingKey(topic, meta.Key), metaFmt, topic, meta.Key)
+		if err != nil {
+			tx.Discard()
+			return err
+		}
+	}
+
+	// A newer value with the same key is waiting, so there is nothing to return
+	headOffset := -1
+	var reordered bool
+	if !superseded {
+		headOffset, err = prependValueTx(tx, headPosKeyFmt, topicFmt, topic, val)
+		if err != nil {
+			tx.Discard()
+			return fmt.Errorf("prepending value to topic %s: %v", topic, err)
+		}
+
+		// Carry the metadata across with the value
+		metaKey := []byte(fmt.Sprintf(metaFmt, topic, headOffset))
+		if err := tx.Put(metaKey, encodeMeta(meta), nil); err != nil {
+			tx.Discard()
+			return fmt.Errorf("putting meta %s: %v", metaKey, err)
+		}
+
+		if meta.Key != "" {
+			if err := tx.Put(pendingKey(topic, meta.Key), encodePos(headOffset), nil); err != nil {
+				tx.Discard()
+				return fmt.Errorf("putting pending key %s: %v", meta.Key, err)
+			}
+		}
+
+		// The value returns to the front of those with the same priority
+		moved, err := prioritise(tx, topic, headOffset)
+		if err != nil {
+			tx.Discard()
+			return fmt.Errorf("prioritising value on topic %s: %v", topic, err)
+		}
+
+		reordered = moved != headOffset
+	} else {
+		batch := new(leveldb.Batch)
+		deleteBody(batch, topic, meta)
+
+		if err := tx.Write(batch, nil); err != nil {
+			tx.Discard()
+			return fmt.Errorf("deleting superseded body: %v", err)
+		}
 	}
 
 	if err := tx.Delete(ackKey, nil); err != nil {
@@ -132,105 +448,656 @@ func (s *store) Nack(topic string, ackOffset int) error {
 		return fmt.Errorf("deleting ackKey %s: %v", ackKey, err)
 	}
 
+	ackMetaKey := []byte(fmt.Sprintf(ackMetaFmt, topic, ackOffset))
+	if err := tx.Delete(ackMetaKey, nil); err != nil {
+		tx.Discard()
+		return fmt.Errorf("deleting ack meta %s: %v", ackMetaKey, err)
+	}
+
 	if err := tx.Commit(); err != nil {
 		tx.Discard()
 		return fmt.Errorf("committing nack transaction: %v", err)
 	}
 
-	return nil
+	switch {
+	case reordered:
+		s.cache.drop(topic)
+	case !superseded:
+		s.cache.prepend(topic, headOffset, cacheEntry{val: val, meta: meta})
+	}
+
+	return s.written()
 }
 
 // Insert creates a new record for a given topic, creating the topic in the
 // store if it doesn't already exist. If it does, the record is placed at the
 // end of the queue.
-func (s *store) Insert(topic string, value value) error {
+func (s *store) Insert(topic string, value value, meta messageMeta) error {
+	s.Lock()
+	defer s.Unlock()
+
+	cache, err := s.insert(s.db, topic, value, meta)
+	if err != nil {
+		return err
+	}
+
+	cache()
+
+	return s.written()
+}
+
+// record is a value to be inserted into a topic, along with its metadata.
+type record struct {
+	topic string
+	value value
+	meta  messageMeta
+}
+
+// InsertAll inserts each record into its topic in a single atomic write,
+// discarding every insert if any fails.
+func (s *store) InsertAll(records []record) error {
 	s.Lock()
 	defer s.Unlock()
 
+	bw := newBatchWriter(s.db)
+
+	caches := make([]func(), 0, len(records))
+	for _, r := range records {
+		cache, err := s.insert(bw, r.topic, r.value, r.meta)
+		if err != nil {
+			return err
+		}
+
+		caches = append(caches, cache)
+	}
+
+	if err := bw.commit(); err != nil {
+		return fmt.Errorf("committing batch: %v", err)
+	}
+
+	for _, cache := range caches {
+		cache()
+	}
+
+	return s.written()
+}
+
+// ReplaceAll discards the values waiting on each of the topics and inserts the
+// records in a single atomic write, discarding nothing if any insert fails.
+func (s *store) ReplaceAll(topics []string, records []record) error {
+	s.Lock()
+	defer s.Unlock()
+
+	bw := newBatchWriter(s.db)
+
+	for _, topic := range topics {
+		if _, err := s.shed(bw, topic, -1); err != nil {
+			return fmt.Errorf("discarding values of topic %s: %v", topic, err)
+		}
+	}
+
+	caches := make([]func(), 0, len(records))
+	for _, r := range records {
+		cache, err := s.insert(bw, r.topic, r.value, r.meta)
+		if err != nil {
+			return err
+		}
+
+		caches = append(caches, cache)
+	}
+
+	if err := bw.commit(); err != nil {
+		return fmt.Errorf("committing batch: %v", err)
+	}
+
+	for _, topic := range topics {
+		s.cache.drop(topic)
+	}
+
+	for _, cache := range caches {
+		cache()
+	}
+
+	return s.written()
+}
+
+// insert inserts the value into the topic through db, which may be a
+// transaction. The cache is only updated once the returned function is called,
+// allowing it to be skipped if the transaction is discarded.
+func (s *store) insert(db readWriter, topic string, value value, meta messageMeta) (cache func(), err error) {
+	// The value is always given whole, so any body recorded is another's
+	meta.BodySize = 0
+
+	if err := s.appendLog(db, topic, value, &meta); err != nil {
+		return nil, err
+	}
+
+	// Large values are stored in chunks, keyed by the offset just assigned
+	value, err = spill(db, topic, value, &meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Key != "" {
+		cache, replaced, err := s.replacePending(db, topic, value, meta)
+		if err != nil {
+			return nil, err
+		}
+
+		if replaced {
+			return cache, nil
+		}
+	}
+
 	headPosKey := []byte(fmt.Sprintf(headPosKeyFmt, topic))
 	tailPosKey := []byte(fmt.Sprintf(tailPosKeyFmt, topic))
 	ackTailPosKey := []byte(fmt.Sprintf(ackTailPosKeyFmt, topic))
 
-	exists, err := s.db.Has(tailPosKey, nil)
+	exists, err := db.Has(tailPosKey, nil)
 	if err != nil {
-		return fmt.Errorf("checking for has: %v", err)
+		return nil, fmt.Errorf("checking for has: %v", err)
 	}
 
 	// The key already exists
 	if exists {
-		if _, err := appendValue(s.db, tailPosKeyFmt, topicFmt, topic, value); err != nil {
-			return err
+		offset, err := appendValue(db, tailPosKeyFmt, topicFmt, topic, value)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil
+		metaKey := []byte(fmt.Sprintf(metaFmt, topic, offset))
+		if err := db.Put(metaKey, encodeMeta(meta), nil); err != nil {
+			return nil, fmt.Errorf("putting meta: %v", err)
+		}
+
+		if err := indexKey(db, topic, meta.Key, offset); err != nil {
+			return nil, err
+		}
+
+		// A value with a priority moves ahead of the values with a lower one
+		if meta.Priority > 0 {
+			moved, err := prioritise(db, topic, offset)
+			if err != nil {
+				return nil, err
+			}
+
+			if moved != offset {
+				return func() { s.cache.drop(topic) }, nil
+			}
+		}
+
+		return func() {
+			s.cache.append(topic, offset, cacheEntry{val: value, meta: meta})
+		}, nil
 	}
 
 	// Write initial head position
 	headPos := make([]byte, 8)
 	binary.PutVarint(headPos, 0)
 
-	if err := s.db.Put(headPosKey, headPos, nil); err != nil {
-		return fmt.Errorf("putting head position value: %v", err)
+	if err := db.Put(headPosKey, headPos, nil); err != nil {
+		return nil, fmt.Errorf("putting head position value: %v", err)
 	}
 
 	// Write initial ack topic head position
 	ackTailPos := make([]byte, 8)
 	binary.PutVarint(ackTailPos, 0)
 
-	if err := s.db.Put(ackTailPosKey, ackTailPos, nil); err != nil {
-		return fmt.Errorf("putting ack head position value: %v", err)
+	if err := db.Put(ackTailPosKey, ackTailPos, nil); err != nil {
+		return nil, fmt.Errorf("putting ack head position value: %v", err)
 	}
 
 	// Write initial tail position
 	tailPos := make([]byte, 8)
 	binary.PutVarint(tailPos, 1)
 
-	if err := s.db.Put(tailPosKey, tailPos, nil); err != nil {
-		return fmt.Errorf("putting tail position value: %v", err)
+	if err := db.Put(tailPosKey, tailPos, nil); err != nil {
+		return nil, fmt.Errorf("putting tail position value: %v", err)
 	}
 
 	// Write new message to head
 	newKey := []byte(fmt.Sprintf(topicFmt, topic, 0))
-	if err := s.db.Put(newKey, value, nil); err != nil {
-		return fmt.Errorf("putting first value for topic: %v", err)
+	if err := db.Put(newKey, value, nil); err != nil {
+		return nil, fmt.Errorf("putting first value for topic: %v", err)
 	}
 
-	return nil
+	metaKey := []byte(fmt.Sprintf(metaFmt, topic, 0))
+	if err := db.Put(metaKey, encodeMeta(meta), nil); err != nil {
+		return nil, fmt.Errorf("putting first meta for topic: %v", err)
+	}
+
+	if err := indexKey(db, topic, meta.Key, 0); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		s.cache.append(topic, 0, cacheEntry{val: value, meta: meta})
+	}, nil
 }
 
 // GetNext retrieves the first record for a topic, incrementing the head
-// position of the main array and pushing the value onto the ack array.
-func (s *store) GetNext(topic string) (value, int, error) {
+// position of the main array and pushing the value onto the ack array. A topic
+// which has not yet been created is treated as empty.
+func (s *store) GetNext(topic string) (value, messageMeta, int, error) {
 	s.Lock()
 	defer s.Unlock()
 
 	headOffset, err := getPos(s.db, headPosKeyFmt, topic)
+	if errors.Is(err, errTopicNotExist) {
+		return nil, messageMeta{}, 0, errNoMessages
+	}
 	if err != nil {
-		return nil, 0, err
+		return nil, messageMeta{}, 0, err
 	}
 
-	val, err := getValue(s.db, topicFmt, topic, headOffset)
+	val, meta, err := s.getHead(topic, headOffset)
 	if err != nil {
-		return nil, 0, err
+		return nil, messageMeta{}, 0, err
+	}
+
+	// Hold back the value until the value with the same key is resolved
+	if meta.Key != "" {
+		_, outstanding, err := keyOffset(s.db, outstandingKey(topic, meta.Key), ackMetaFmt, topic, meta.Key)
+		if err != nil {
+			return nil, messageMeta{}, 0, err
+		}
+
+		if outstanding {
+			s.cache.prepend(topic, headOffset, cacheEntry{val: val, meta: meta})
+			return s.getNextHeldBack(topic, headOffset)
+		}
 	}
 
 	insertedOffset, err := appendValue(s.db, ackTailPosKeyFmt, ackTopicFmt, topic, val)
 	if err != nil {
-		return nil, 0, err
+		return nil, messageMeta{}, 0, err
+	}
+
+	// Move the metadata across to the ack topic, counting this delivery
+	meta.Deliveries++
+
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(fmt.Sprintf(ackMetaFmt, topic, insertedOffset)), encodeMeta(meta))
+	batch.Delete([]byte(fmt.Sprintf(metaFmt, topic, headOffset)))
+
+	if meta.Key != "" {
+		batch.Delete(pendingKey(topic, meta.Key))
+		batch.Put(outstandingKey(topic, meta.Key), encodePos(insertedOffset))
+	}
+
+	if err := s.db.Write(batch, nil); err != nil {
+		return nil, messageMeta{}, 0, fmt.Errorf("moving meta: %v", err)
 	}
 
 	if _, _, err := addPos(s.db, headPosKeyFmt, topic, 1); err != nil {
-		return nil, 0, err
+		return nil, messageMeta{}, 0, err
+	}
+
+	if err := s.written(); err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	return val, meta, insertedOffset, nil
+}
+
+// getNextHeldBack takes the first value behind the head of the topic which
+// isn't held back by an outstanding value with the same key, as the head is.
+// errNoMessages is returned if every value is held back. The lock must be
+// held.
+func (s *store) getNextHeldBack(topic string, headOffset int) (value, messageMeta, int, error) {
+	tailOffset, err := getPos(s.db, tailPosKeyFmt, topic)
+	if err != nil {
+		return nil, messageMeta{}, 0, err
+	}
+
+	for offset := headOffset + 1; offset < tailOffset; offset++ {
+		meta, err := getMeta(s.db, metaFmt, topic, offset)
+		if err != nil {
+			return nil, messageMeta{}, 0, err
+		}
+
+		if meta.Key != "" {
+			_, outstanding, err := keyOffset(s.db, outstandingKey(topic, meta.Key), ackMetaFmt, topic, meta.Key)
+			if err != nil {
+				return nil, messageMeta{}, 0, err
+			}
+
+			if outstanding {
+				continue
+			}
+		}
+
+		return s.take(topic, headOffset, offset, meta)
+	}
+
+	return nil, messageMeta{}, 0, errNoMessages
+}
+
+// getHead returns the value and metadata at the head of the topic, preferring
+// the cache over reading from the db.
+func (s *store) getHead(topic string, headOffset int) (value, messageMeta, error) {
+	if e, ok := s.cache.take(topic, headOffset); ok {
+		return e.val, e.meta, nil
+	}
+
+	s.reads++
+
+	val, err := getValue(s.db, topicFmt, topic, headOffset)
+	if err != nil {
+		return nil, messageMeta{}, err
+	}
+
+	meta, err := getMeta(s.db, metaFmt, topic, headOffset)
+	if err != nil {
+		return nil, messageMeta{}, err
+	}
+
+	return val, meta, nil
+}
+
+// GetMeta returns the metadata of the value awaiting acknowledgement at
+// ackOffset.
+func (s *store) GetMeta(topic string, ackOffset int) (messageMeta, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	exists, err := s.db.Has([]byte(fmt.Sprintf(ackTopicFmt, topic, ackOffset)), nil)
+	if err != nil {
+		return messageMeta{}, fmt.Errorf("checking for has: %v", err)
+	}
+	if !exists {
+		return messageMeta{}, errAckMsgNotExist
+	}
+
+	return getMeta(s.db, ackMetaFmt, topic, ackOffset)
+}
+
+// NackReason records the reason the value awaiting acknowledgement at ackOffset
+// is being negatively acknowledged, keeping the most recent maxNackReasons
+// reasons.
+func (s *store) NackReason(topic string, ackOffset int, reason string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	exists, err := s.db.Has([]byte(fmt.Sprintf(ackTopicFmt, topic, ackOffset)), nil)
+	if err != nil {
+		return fmt.Errorf("checking for has: %v", err)
+	}
+	if !exists {
+		return errAckMsgNotExist
+	}
+
+	meta, err := getMeta(s.db, ackMetaFmt, topic, ackOffset)
+	if err != nil {
+		return err
+	}
+
+	meta.NackReasons = append(meta.NackReasons, reason)
+	if n := len(meta.NackReasons); n > maxNackReasons {
+		meta.NackReasons = meta.NackReasons[n-maxNackReasons:]
+	}
+
+	metaKey := []byte(fmt.Sprintf(ackMetaFmt, topic, ackOffset))
+	if err := s.db.Put(metaKey, encodeMeta(meta), nil); err != nil {
+		return fmt.Errorf("putting meta %s: %v", metaKey, err)
+	}
+
+	return s.written()
+}
+
+// Len returns the number of values waiting to be consumed on the topic. Values
+// awaiting acknowledgement are not counted.
+func (s *store) Len(topic string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	headOffset, err := getPos(s.db, headPosKeyFmt, topic)
+	if errors.Is(err, errTopicNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	tailOffset, err := getPos(s.db, tailPosKeyFmt, topic)
+	if err != nil {
+		return 0, err
+	}
+
+	return tailOffset - headOffset, nil
+}
+
+// Peek returns up to limit values waiting to be consumed on the topic.
+func (s *store) Peek(topic string, limit int) ([]pendingMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	headOffset, err := getPos(s.db, headPosKeyFmt, topic)
+	if errors.Is(err, errTopicNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tailOffset, err := getPos(s.db, tailPosKeyFmt, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []pendingMessage
+	for offset := headOffset; offset < tailOffset && len(msgs) < limit; offset++ {
+		val, err := getValue(s.db, topicFmt, topic, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		meta, err := getMeta(s.db, metaFmt, topic, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.BodySize > 0 {
+			if val, err = getBody(s.db, topic, meta); err != nil {
+				return nil, err
+			}
+
+			meta.BodySize = 0
+		}
+
+		msgs = append(msgs, pendingMessage{val: val, meta: meta})
+	}
+
+	return msgs, nil
+}
+
+// ResetDeliveries zeroes the delivery count of each value waiting to be
+// consumed on the topic.
+func (s *store) ResetDeliveries(topic string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	headOffset, err := getPos(s.db, headPosKeyFmt, topic)
+	if errors.Is(err, errTopicNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	tailOffset, err := getPos(s.db, tailPosKeyFmt, topic)
+	if err != nil {
+		return 0, err
+	}
+
+	batch := new(leveldb.Batch)
+	for offset := headOffset; offset < tailOffset; offset++ {
+		meta, err := getMeta(s.db, metaFmt, topic, offset)
+		if err != nil {
+			return 0, err
+		}
+
+		if meta.Deliveries == 0 {
+			continue
+		}
+
+		meta.Deliveries = 0
+		batch.Put([]byte(fmt.Sprintf(metaFmt, topic, offset)), encodeMeta(meta))
+	}
+
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+
+	if err := s.db.Write(batch, nil); err != nil {
+		return 0, fmt.Errorf("resetting deliveries: %v", err)
+	}
+
+	s.cache.resetDeliveries(topic)
+
+	return batch.Len(), s.written()
+}
+
+// GetTopicConfig returns the config stored for a topic.
+func (s *store) GetTopicConfig(topic string) (topicConfig, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := []byte(fmt.Sprintf(topicConfigKeyFmt, topic))
+
+	val, err := s.db.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return topicConfig{}, errTopicConfigNotExist
+	}
+	if err != nil {
+		return topicConfig{}, fmt.Errorf("getting topic config: %v", err)
+	}
+
+	var cfg topicConfig
+	if err := json.Unmarshal(val, &cfg); err != nil {
+		return topicConfig{}, fmt.Errorf("decoding topic config: %v", err)
+	}
+
+	return cfg, nil
+}
+
+// PutTopicConfig stores the config for a topic, replacing any existing config.
+func (s *store) PutTopicConfig(topic string, cfg topicConfig) error {
+	s.Lock()
+	defer s.Unlock()
+
+	val, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("encoding topic config: %v", err)
 	}
 
-	return val, insertedOffset, nil
+	key := []byte(fmt.Sprintf(topicConfigKeyFmt, topic))
+	if err := s.db.Put(key, val, nil); err != nil {
+		return fmt.Errorf("putting topic config: %v", err)
+	}
+
+	return s.written()
 }
 
-// Close the store.
+// TopicConfigs returns all stored topic configs, keyed by topic.
+func (s *store) TopicConfigs() (map[string]topicConfig, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(topicConfigPrefix)), nil)
+	defer iter.Release()
+
+	configs := map[string]topicConfig{}
+	for iter.Next() {
+		topic := strings.TrimPrefix(string(iter.Key()), topicConfigPrefix)
+
+		var cfg topicConfig
+		if err := json.Unmarshal(iter.Value(), &cfg); err != nil {
+			return nil, fmt.Errorf("decoding topic config for %s: %v", topic, err)
+		}
+
+		configs[topic] = cfg
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("iterating topic configs: %v", err)
+	}
+
+	return configs, nil
+}
+
+// Close the store, flushing any writes which have yet to be synced to disk.
 func (s *store) Close() error {
+	s.closeOnce.Do(func() {
+		if s.done != nil {
+			close(s.done)
+			s.wg.Wait()
+		}
+	})
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("syncing store before close: %v", err)
+	}
+
 	return s.db.Close()
 }
 
+// written marks the store as having unsynced writes, syncing immediately under
+// the always policy. The store lock must be held.
+func (s *store) written() error {
+	s.dirty = true
+
+	if s.syncPolicy == syncAlways {
+		return s.flush()
+	}
+
+	return nil
+}
+
+// flush fsyncs any outstanding writes to disk. The store lock must be held.
+func (s *store) flush() error {
+	if !s.dirty {
+		return nil
+	}
+
+	if err := s.db.Put([]byte(syncMarkerKey), nil, &opt.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("writing sync marker: %v", err)
+	}
+
+	s.dirty = false
+
+	if s.onSync != nil {
+		s.onSync()
+	}
+
+	return nil
+}
+
+// syncPeriodically fsyncs outstanding writes every sync interval until the
+// store is closed.
+func (s *store) syncPeriodically() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Lock()
+			if err := s.flush(); err != nil {
+				log.Err(err).Msg("failed to periodically sync store")
+			}
+			s.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
 // Destroy the underlying store.
 func (s *store) Destroy() {
 	_ = s.Close()
@@ -262,7 +1129,7 @@ func getOffsetTx(db *leveldb.Transaction, topicFmt string, topic string, offset
 }
 
 // getPos gets the integer position value (aka offset) for topic and key format.
-func getPos(db *leveldb.DB, keyFmt string, topic string) (int, error) {
+func getPos(db readWriter, keyFmt string, topic string) (int, error) {
 	key := []byte(fmt.Sprintf(keyFmt, topic))
 
 	pos, err := db.Get(key, nil)
@@ -301,13 +1168,144 @@ func getPosTx(tx *leveldb.Transaction, keyFmt string, topic string) (int, error)
 	return int(i), nil
 }
 
+// readWriter is implemented by both the database and batchWriter, allowing
+// writes to be made either directly or staged to be written atomically.
+type readWriter interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	Has(key []byte, ro *opt.ReadOptions) (bool, error)
+	Put(key, value []byte, wo *opt.WriteOptions) error
+	Write(batch *leveldb.Batch, wo *opt.WriteOptions) error
+}
+
+// batchWriter stages writes in a batch, which is committed to the database in
+// a single atomic write, reading back the staged writes before then. Unlike a
+// transaction, which writes straight to tables, committing a batch is cheap
+// enough to do on every publish.
+type batchWriter struct {
+	db     *leveldb.DB
+	batch  *leveldb.Batch
+	staged map[string]stagedWrite
+}
+
+// stagedWrite is a write to a key staged by a batchWriter.
+type stagedWrite struct {
+	value   []byte
+	deleted bool
+}
+
+func newBatchWriter(db *leveldb.DB) *batchWriter {
+	return &batchWriter{
+		db:     db,
+		batch:  new(leveldb.Batch),
+		staged: map[string]stagedWrite{},
+	}
+}
+
+func (bw *batchWriter) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	if w, ok := bw.staged[string(key)]; ok {
+		if w.deleted {
+			return nil, leveldb.ErrNotFound
+		}
+
+		return append([]byte(nil), w.value...), nil
+	}
+
+	return bw.db.Get(key, ro)
+}
+
+func (bw *batchWriter) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	if w, ok := bw.staged[string(key)]; ok {
+		return !w.deleted, nil
+	}
+
+	return bw.db.Has(key, ro)
+}
+
+func (bw *batchWriter) Put(key, value []byte, _ *opt.WriteOptions) error {
+	bw.batch.Put(key, value)
+	bw.staged[string(key)] = stagedWrite{value: append([]byte(nil), value...)}
+
+	return nil
+}
+
+func (bw *batchWriter) Write(batch *leveldb.Batch, _ *opt.WriteOptions) error {
+	return batch.Replay(batchReplay{bw})
+}
+
+// commit writes the staged writes to the database.
+func (bw *batchWriter) commit() error {
+	return bw.db.Write(bw.batch, nil)
+}
+
+// batchReplay stages the writes of a batch replayed into a batchWriter.
+type batchReplay struct {
+	bw *batchWriter
+}
+
+func (r batchReplay) Put(key, value []byte) {
+	_ = r.bw.Put(key, value, nil)
+}
+
+func (r batchReplay) Delete(key []byte) {
+	r.bw.batch.Delete(key)
+	r.bw.staged[string(key)] = stagedWrite{deleted: true}
+}
+
+// getMeta returns the message metadata stored given a key format, topic and
+// offset. Missing metadata is treated as empty.
+func getMeta(db readWriter, keyFmt string, topic string, offset int) (messageMeta, error) {
+	key := fmt.Sprintf(keyFmt, topic, offset)
+
+	val, err := db.Get([]byte(key), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return messageMeta{}, nil
+	}
+	if err != nil {
+		return messageMeta{}, fmt.Errorf("getting meta with fmt [%s] from topic %s at offset %d: %v", keyFmt, topic, offset, err)
+	}
+
+	return decodeMeta(val)
+}
+
+// getMetaTx returns the message metadata stored given a key format, topic and
+// offset. Missing metadata is treated as empty.
+func getMetaTx(tx *leveldb.Transaction, keyFmt string, topic string, offset int) (messageMeta, error) {
+	key := fmt.Sprintf(keyFmt, topic, offset)
+
+	val, err := tx.Get([]byte(key), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return messageMeta{}, nil
+	}
+	if err != nil {
+		return messageMeta{}, fmt.Errorf("getting meta with fmt [%s] from topic %s at offset %d: %v", keyFmt, topic, offset, err)
+	}
+
+	return decodeMeta(val)
+}
+
+func encodeMeta(meta messageMeta) []byte {
+	// Encoding a struct of plain fields cannot fail
+	b, _ := json.Marshal(meta)
+
+	return b
+}
+
+func decodeMeta(b []byte) (messageMeta, error) {
+	var meta messageMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return messageMeta{}, fmt.Errorf("decoding meta: %v", err)
+	}
+
+	return meta, nil
+}
+
 // getValue returns the raw value stored given a key format, topic and offset.
 func getValue(db *leveldb.DB, keyFmt string, topic string, offset int) (value, error) {
 	key := fmt.Sprintf(keyFmt, topic, offset)
 
 	val, err := db.Get([]byte(key), nil)
 	if errors.Is(err, leveldb.ErrNotFound) {
-		return nil, errTopicEmpty
+		return nil, errNoMessages
 	}
 	if err != nil {
 		return nil, fmt.Errorf("getting value with fmt [%s] from topic %s at offset %d: %v", keyFmt, topic, offset, err)
@@ -318,7 +1316,7 @@ func getValue(db *leveldb.DB, keyFmt string, topic string, offset int) (value, e
 
 // appendValue returns inserts a new value to the end of a topic given,
 // returning the inserted offset.
-func appendValue(db *leveldb.DB, tailPosKeyFmt, keyFmt, topic string, val value) (offset int, err error) {
+func appendValue(db readWriter, tailPosKeyFmt, keyFmt, topic string, val value) (offset int, err error) {
 	tailPosKey := []byte(fmt.Sprintf(tailPosKeyFmt, topic))
 
 	// Fetch the current tail position
@@ -6,7 +6,11 @@ package main
 
 import (
 	gomock "github.com/golang/mock/gomock"
+	leveldb "github.com/syndtr/goleveldb/leveldb"
+	opt "github.com/syndtr/goleveldb/leveldb/opt"
+	io "io"
 	reflect "reflect"
+	time "time"
 )
 
 // Mockstorer is a mock of storer interface
@@ -33,27 +37,56 @@ func (m *Mockstorer) EXPECT() *MockstorerMockRecorder {
 }
 
 // Insert mocks base method
-func (m *Mockstorer) Insert(topic string, value value) error {
+func (m *Mockstorer) Insert(topic string, value value, meta messageMeta) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Insert", topic, value)
+	ret := m.ctrl.Call(m, "Insert", topic, value, meta)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Insert indicates an expected call of Insert
-func (mr *MockstorerMockRecorder) Insert(topic, value interface{}) *gomock.Call {
+func (mr *MockstorerMockRecorder) Insert(topic, value, meta interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Insert", reflect.TypeOf((*Mockstorer)(nil).Insert), topic, value)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Insert", reflect.TypeOf((*Mockstorer)(nil).Insert), topic, value, meta)
+}
+
+// InsertAll mocks base method
+func (m *Mockstorer) InsertAll(records []record) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertAll", records)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// InsertAll indicates an expected call of InsertAll
+func (mr *MockstorerMockRecorder) InsertAll(records interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertAll", reflect.TypeOf((*Mockstorer)(nil).InsertAll), records)
+}
+
+// ReplaceAll mocks base method
+func (m *Mockstorer) ReplaceAll(topics []string, records []record) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReplaceAll", topics, records)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReplaceAll indicates an expected call of ReplaceAll
+func (mr *MockstorerMockRecorder) ReplaceAll(topics, records interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReplaceAll", reflect.TypeOf((*Mockstorer)(nil).ReplaceAll), topics, records)
 }
 
 // GetNext mocks base method
-func (m *Mockstorer) GetNext(topic string) (value, int, error) {
+func (m *Mockstorer) GetNext(topic string) (value, messageMeta, int, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetNext", topic)
 	ret0, _ := ret[0].(value)
-	ret1, _ := ret[1].(int)
-	ret2, _ := ret[2].(error)
-	return ret0, ret1, ret2
+	ret1, _ := ret[1].(messageMeta)
+	ret2, _ := ret[2].(int)
+	ret3, _ := ret[3].(error)
+	return ret0, ret1, ret2, ret3
 }
 
 // GetNext indicates an expected call of GetNext
@@ -63,17 +96,41 @@ func (mr *MockstorerMockRecorder) GetNext(topic interface{}) *gomock.Call {
 }
 
 // Ack mocks base method
-func (m *Mockstorer) Ack(topic string, ackOffset int) error {
+func (m *Mockstorer) Ack(topic string, ackOffsets ...int) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Ack", topic, ackOffset)
+	varargs := []interface{}{topic}
+	for _, a := range ackOffsets {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Ack", varargs...)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Ack indicates an expected call of Ack
-func (mr *MockstorerMockRecorder) Ack(topic, ackOffset interface{}) *gomock.Call {
+func (mr *MockstorerMockRecorder) Ack(topic interface{}, ackOffsets ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*Mockstorer)(nil).Ack), topic, ackOffset)
+	varargs := append([]interface{}{topic}, ackOffsets...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ack", reflect.TypeOf((*Mockstorer)(nil).Ack), varargs...)
+}
+
+// Drop mocks base method
+func (m *Mockstorer) Drop(topic string, ackOffsets ...int) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{topic}
+	for _, a := range ackOffsets {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Drop", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Drop indicates an expected call of Drop
+func (mr *MockstorerMockRecorder) Drop(topic interface{}, ackOffsets ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{topic}, ackOffsets...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Drop", reflect.TypeOf((*Mockstorer)(nil).Drop), varargs...)
 }
 
 // Nack mocks base method
@@ -90,6 +147,393 @@ func (mr *MockstorerMockRecorder) Nack(topic, ackOffset interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Nack", reflect.TypeOf((*Mockstorer)(nil).Nack), topic, ackOffset)
 }
 
+// Fetch mocks base method
+func (m *Mockstorer) Fetch(topic, id string) (value, messageMeta, int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Fetch", topic, id)
+	ret0, _ := ret[0].(value)
+	ret1, _ := ret[1].(messageMeta)
+	ret2, _ := ret[2].(int)
+	ret3, _ := ret[3].(error)
+	return ret0, ret1, ret2, ret3
+}
+
+// Fetch indicates an expected call of Fetch
+func (mr *MockstorerMockRecorder) Fetch(topic, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Fetch", reflect.TypeOf((*Mockstorer)(nil).Fetch), topic, id)
+}
+
+// GetMeta mocks base method
+func (m *Mockstorer) GetMeta(topic string, ackOffset int) (messageMeta, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMeta", topic, ackOffset)
+	ret0, _ := ret[0].(messageMeta)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMeta indicates an expected call of GetMeta
+func (mr *MockstorerMockRecorder) GetMeta(topic, ackOffset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMeta", reflect.TypeOf((*Mockstorer)(nil).GetMeta), topic, ackOffset)
+}
+
+// Reader mocks base method
+func (m *Mockstorer) Reader(topic string, ackOffset int) (io.ReadCloser, int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Reader", topic, ackOffset)
+	ret0, _ := ret[0].(io.ReadCloser)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Reader indicates an expected call of Reader
+func (mr *MockstorerMockRecorder) Reader(topic, ackOffset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reader", reflect.TypeOf((*Mockstorer)(nil).Reader), topic, ackOffset)
+}
+
+// NackReason mocks base method
+func (m *Mockstorer) NackReason(topic string, ackOffset int, reason string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NackReason", topic, ackOffset, reason)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// NackReason indicates an expected call of NackReason
+func (mr *MockstorerMockRecorder) NackReason(topic, ackOffset, reason interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NackReason", reflect.TypeOf((*Mockstorer)(nil).NackReason), topic, ackOffset, reason)
+}
+
+// Topics mocks base method
+func (m *Mockstorer) Topics() ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Topics")
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Topics indicates an expected call of Topics
+func (mr *MockstorerMockRecorder) Topics() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Topics", reflect.TypeOf((*Mockstorer)(nil).Topics))
+}
+
+// Len mocks base method
+func (m *Mockstorer) Len(topic string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Len", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Len indicates an expected call of Len
+func (mr *MockstorerMockRecorder) Len(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Len", reflect.TypeOf((*Mockstorer)(nil).Len), topic)
+}
+
+// History mocks base method
+func (m *Mockstorer) History(topic string) ([]historyEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "History", topic)
+	ret0, _ := ret[0].([]historyEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// History indicates an expected call of History
+func (mr *MockstorerMockRecorder) History(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "History", reflect.TypeOf((*Mockstorer)(nil).History), topic)
+}
+
+// Peek mocks base method
+func (m *Mockstorer) Peek(topic string, limit int) ([]pendingMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Peek", topic, limit)
+	ret0, _ := ret[0].([]pendingMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Peek indicates an expected call of Peek
+func (mr *MockstorerMockRecorder) Peek(topic, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Peek", reflect.TypeOf((*Mockstorer)(nil).Peek), topic, limit)
+}
+
+// GetTopicConfig mocks base method
+func (m *Mockstorer) GetTopicConfig(topic string) (topicConfig, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTopicConfig", topic)
+	ret0, _ := ret[0].(topicConfig)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTopicConfig indicates an expected call of GetTopicConfig
+func (mr *MockstorerMockRecorder) GetTopicConfig(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTopicConfig", reflect.TypeOf((*Mockstorer)(nil).GetTopicConfig), topic)
+}
+
+// PutTopicConfig mocks base method
+func (m *Mockstorer) PutTopicConfig(topic string, cfg topicConfig) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PutTopicConfig", topic, cfg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PutTopicConfig indicates an expected call of PutTopicConfig
+func (mr *MockstorerMockRecorder) PutTopicConfig(topic, cfg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutTopicConfig", reflect.TypeOf((*Mockstorer)(nil).PutTopicConfig), topic, cfg)
+}
+
+// TopicConfigs mocks base method
+func (m *Mockstorer) TopicConfigs() (map[string]topicConfig, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TopicConfigs")
+	ret0, _ := ret[0].(map[string]topicConfig)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TopicConfigs indicates an expected call of TopicConfigs
+func (mr *MockstorerMockRecorder) TopicConfigs() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopicConfigs", reflect.TypeOf((*Mockstorer)(nil).TopicConfigs))
+}
+
+// ResetDeliveries mocks base method
+func (m *Mockstorer) ResetDeliveries(topic string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetDeliveries", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResetDeliveries indicates an expected call of ResetDeliveries
+func (mr *MockstorerMockRecorder) ResetDeliveries(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetDeliveries", reflect.TypeOf((*Mockstorer)(nil).ResetDeliveries), topic)
+}
+
+// ReadLog mocks base method
+func (m *Mockstorer) ReadLog(topic string, offset int) (logEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadLog", topic, offset)
+	ret0, _ := ret[0].(logEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadLog indicates an expected call of ReadLog
+func (mr *MockstorerMockRecorder) ReadLog(topic, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadLog", reflect.TypeOf((*Mockstorer)(nil).ReadLog), topic, offset)
+}
+
+// LogOffsets mocks base method
+func (m *Mockstorer) LogOffsets(topic string) (int, int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LogOffsets", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// LogOffsets indicates an expected call of LogOffsets
+func (mr *MockstorerMockRecorder) LogOffsets(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LogOffsets", reflect.TypeOf((*Mockstorer)(nil).LogOffsets), topic)
+}
+
+// Sweep mocks base method
+func (m *Mockstorer) Sweep(before time.Time, keep bool) (map[string][]messageMeta, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Sweep", before, keep)
+	ret0, _ := ret[0].(map[string][]messageMeta)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Sweep indicates an expected call of Sweep
+func (mr *MockstorerMockRecorder) Sweep(before, keep interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Sweep", reflect.TypeOf((*Mockstorer)(nil).Sweep), before, keep)
+}
+
+// SweepExpired mocks base method
+func (m *Mockstorer) SweepExpired(now time.Time, keep bool) (map[string][]messageMeta, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SweepExpired", now, keep)
+	ret0, _ := ret[0].(map[string][]messageMeta)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SweepExpired indicates an expected call of SweepExpired
+func (mr *MockstorerMockRecorder) SweepExpired(now, keep interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SweepExpired", reflect.TypeOf((*Mockstorer)(nil).SweepExpired), now, keep)
+}
+
+// Iterate mocks base method
+func (m *Mockstorer) Iterate(topic string, fn func(value, messageMeta) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Iterate", topic, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Iterate indicates an expected call of Iterate
+func (mr *MockstorerMockRecorder) Iterate(topic, fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Iterate", reflect.TypeOf((*Mockstorer)(nil).Iterate), topic, fn)
+}
+
+// Shed mocks base method
+func (m *Mockstorer) Shed(topic string, n int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Shed", topic, n)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Shed indicates an expected call of Shed
+func (mr *MockstorerMockRecorder) Shed(topic, n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Shed", reflect.TypeOf((*Mockstorer)(nil).Shed), topic, n)
+}
+
+// DeleteTopic mocks base method
+func (m *Mockstorer) DeleteTopic(topic string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteTopic", topic)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteTopic indicates an expected call of DeleteTopic
+func (mr *MockstorerMockRecorder) DeleteTopic(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteTopic", reflect.TypeOf((*Mockstorer)(nil).DeleteTopic), topic)
+}
+
+// PutGroup mocks base method
+func (m *Mockstorer) PutGroup(topic, group string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PutGroup", topic, group)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PutGroup indicates an expected call of PutGroup
+func (mr *MockstorerMockRecorder) PutGroup(topic, group interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutGroup", reflect.TypeOf((*Mockstorer)(nil).PutGroup), topic, group)
+}
+
+// Groups mocks base method
+func (m *Mockstorer) Groups() ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Groups")
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Groups indicates an expected call of Groups
+func (mr *MockstorerMockRecorder) Groups() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Groups", reflect.TypeOf((*Mockstorer)(nil).Groups))
+}
+
+// NextSeq mocks base method
+func (m *Mockstorer) NextSeq(topic string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NextSeq", topic)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NextSeq indicates an expected call of NextSeq
+func (mr *MockstorerMockRecorder) NextSeq(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NextSeq", reflect.TypeOf((*Mockstorer)(nil).NextSeq), topic)
+}
+
+// Recover mocks base method
+func (m *Mockstorer) Recover() (map[string]topicRecovery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Recover")
+	ret0, _ := ret[0].(map[string]topicRecovery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Recover indicates an expected call of Recover
+func (mr *MockstorerMockRecorder) Recover() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Recover", reflect.TypeOf((*Mockstorer)(nil).Recover))
+}
+
+// InsertDelayed mocks base method
+func (m *Mockstorer) InsertDelayed(msg delayedMessage) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertDelayed", msg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// InsertDelayed indicates an expected call of InsertDelayed
+func (mr *MockstorerMockRecorder) InsertDelayed(msg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertDelayed", reflect.TypeOf((*Mockstorer)(nil).InsertDelayed), msg)
+}
+
+// DeleteDelayed mocks base method
+func (m *Mockstorer) DeleteDelayed(msg delayedMessage) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteDelayed", msg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteDelayed indicates an expected call of DeleteDelayed
+func (mr *MockstorerMockRecorder) DeleteDelayed(msg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteDelayed", reflect.TypeOf((*Mockstorer)(nil).DeleteDelayed), msg)
+}
+
+// Delayed mocks base method
+func (m *Mockstorer) Delayed() ([]delayedMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delayed")
+	ret0, _ := ret[0].([]delayedMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delayed indicates an expected call of Delayed
+func (mr *MockstorerMockRecorder) Delayed() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delayed", reflect.TypeOf((*Mockstorer)(nil).Delayed))
+}
+
 // Close mocks base method
 func (m *Mockstorer) Close() error {
 	m.ctrl.T.Helper()
@@ -115,3 +559,84 @@ func (mr *MockstorerMockRecorder) Destroy() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Destroy", reflect.TypeOf((*Mockstorer)(nil).Destroy))
 }
+
+// MockreadWriter is a mock of readWriter interface
+type MockreadWriter struct {
+	ctrl     *gomock.Controller
+	recorder *MockreadWriterMockRecorder
+}
+
+// MockreadWriterMockRecorder is the mock recorder for MockreadWriter
+type MockreadWriterMockRecorder struct {
+	mock *MockreadWriter
+}
+
+// NewMockreadWriter creates a new mock instance
+func NewMockreadWriter(ctrl *gomock.Controller) *MockreadWriter {
+	mock := &MockreadWriter{ctrl: ctrl}
+	mock.recorder = &MockreadWriterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockreadWriter) EXPECT() *MockreadWriterMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method
+func (m *MockreadWriter) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", key, ro)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get
+func (mr *MockreadWriterMockRecorder) Get(key, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockreadWriter)(nil).Get), key, ro)
+}
+
+// Has mocks base method
+func (m *MockreadWriter) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Has", key, ro)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Has indicates an expected call of Has
+func (mr *MockreadWriterMockRecorder) Has(key, ro interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Has", reflect.TypeOf((*MockreadWriter)(nil).Has), key, ro)
+}
+
+// Put mocks base method
+func (m *MockreadWriter) Put(key, value []byte, wo *opt.WriteOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Put", key, value, wo)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Put indicates an expected call of Put
+func (mr *MockreadWriterMockRecorder) Put(key, value, wo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockreadWriter)(nil).Put), key, value, wo)
+}
+
+// Write mocks base method
+func (m *MockreadWriter) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Write", batch, wo)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Write indicates an expected call of Write
+func (mr *MockreadWriterMockRecorder) Write(batch, wo interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Write", reflect.TypeOf((*MockreadWriter)(nil).Write), batch, wo)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -14,9 +16,9 @@ func TestInsert_Single(t *testing.T) {
 	s := newStore(tmpDBPath)
 	t.Cleanup(s.Destroy)
 
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value")))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value"), messageMeta{}))
 
-	val, _, err := s.GetNext(defaultTopic)
+	val, _, _, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	assert.Equal(t, "test_value", string(val))
 }
@@ -25,8 +27,8 @@ func TestInsert_TwoSameTopic(t *testing.T) {
 	s := newStore(tmpDBPath).(*store)
 	t.Cleanup(s.Destroy)
 
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1")))
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_2")))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_2"), messageMeta{}))
 
 	val, err := getOffset(s.db, topicFmt, defaultTopic, 0)
 	assert.NoError(t, err)
@@ -41,9 +43,9 @@ func TestInsert_ThreeSameTopic(t *testing.T) {
 	s := newStore(tmpDBPath).(*store)
 	t.Cleanup(s.Destroy)
 
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1")))
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_2")))
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_3")))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_2"), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_3"), messageMeta{}))
 
 	val, err := getOffset(s.db, topicFmt, defaultTopic, 0)
 	assert.NoError(t, err)
@@ -63,28 +65,28 @@ func TestGetNext(t *testing.T) {
 	s := newStore(tmpDBPath)
 	t.Cleanup(s.Destroy)
 
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1")))
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_2")))
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_3")))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_2"), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_3"), messageMeta{}))
 
-	val, offset, err := s.GetNext(defaultTopic)
+	val, _, offset, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	assert.Equal(t, "test_value_1", string(val))
 	assert.Equal(t, 0, offset)
 
-	val, offset, err = s.GetNext(defaultTopic)
+	val, _, offset, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	assert.Equal(t, "test_value_2", string(val))
 	assert.Equal(t, 1, offset)
 
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_4")))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_4"), messageMeta{}))
 
-	val, offset, err = s.GetNext(defaultTopic)
+	val, _, offset, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	assert.Equal(t, "test_value_3", string(val))
 	assert.Equal(t, 2, offset)
 
-	val, offset, err = s.GetNext(defaultTopic)
+	val, _, offset, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	assert.Equal(t, "test_value_4", string(val))
 	assert.Equal(t, 3, offset)
@@ -94,8 +96,22 @@ func TestGetNext_TopicNotInitialised(t *testing.T) {
 	s := newStore(tmpDBPath)
 	t.Cleanup(s.Destroy)
 
-	val, _, err := s.GetNext(defaultTopic)
-	assert.Equal(t, errTopicNotExist, err)
+	val, _, _, err := s.GetNext(defaultTopic)
+	assert.Equal(t, errNoMessages, err)
+	assert.Equal(t, "", string(val))
+}
+
+func TestGetNext_TopicEmpty(t *testing.T) {
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
+
+	_, _, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+
+	val, _, _, err := s.GetNext(defaultTopic)
+	assert.Equal(t, errNoMessages, err)
 	assert.Equal(t, "", string(val))
 }
 
@@ -119,10 +135,10 @@ func TestAckWithPos(t *testing.T) {
 	s := newStore(tmpDBPath).(*store)
 	t.Cleanup(s.Destroy)
 
-	err := s.Insert(defaultTopic, []byte("test_value_1"))
+	err := s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{})
 	assert.NoError(t, err)
 
-	val, ackOffset, err := s.GetNext(defaultTopic)
+	val, _, ackOffset, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	assert.Equal(t, "test_value_1", string(val))
 
@@ -141,9 +157,9 @@ func TestNack(t *testing.T) {
 	s := newStore(tmpDBPath)
 	t.Cleanup(s.Destroy)
 
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1")))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
 
-	_, offset, err := s.GetNext(defaultTopic)
+	_, _, offset, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 
 	assert.NoError(t, s.Nack(defaultTopic, offset))
@@ -153,9 +169,9 @@ func TestNackTwice(t *testing.T) {
 	s := newStore(tmpDBPath)
 	t.Cleanup(s.Destroy)
 
-	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1")))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
 
-	_, offset, err := s.GetNext(defaultTopic)
+	_, _, offset, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 
 	// First Nack
@@ -176,20 +192,225 @@ func TestNackAndGet(t *testing.T) {
 		msg2 = "test_value_2"
 	)
 
-	assert.NoError(t, s.Insert(defaultTopic, []byte(msg1)))
-	assert.NoError(t, s.Insert(defaultTopic, []byte(msg2)))
+	assert.NoError(t, s.Insert(defaultTopic, []byte(msg1), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte(msg2), messageMeta{}))
 
-	val, offset, err := s.GetNext(defaultTopic)
+	val, _, offset, err := s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	assert.Equal(t, msg1, string(val))
 
 	assert.NoError(t, s.Nack(defaultTopic, offset))
 
-	val, _, err = s.GetNext(defaultTopic)
+	val, _, _, err = s.GetNext(defaultTopic)
 	assert.NoError(t, err)
 	assert.Equal(t, msg1, string(val))
 }
 
+// GetMeta
+func TestGetMeta(t *testing.T) {
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{ID: "test_id"}))
+
+	_, _, offset, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+
+	meta, err := s.GetMeta(defaultTopic, offset)
+	assert.NoError(t, err)
+	assert.Equal(t, messageMeta{ID: "test_id", Deliveries: 1}, meta)
+
+	// Redeliver the value, expecting the meta to follow it
+	assert.NoError(t, s.Nack(defaultTopic, offset))
+
+	_, _, offset, err = s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+
+	meta, err = s.GetMeta(defaultTopic, offset)
+	assert.NoError(t, err)
+	assert.Equal(t, messageMeta{ID: "test_id", Deliveries: 2}, meta)
+
+	// Acking removes the value and its meta
+	assert.NoError(t, s.Ack(defaultTopic, offset))
+
+	_, err = s.GetMeta(defaultTopic, offset)
+	assert.Equal(t, errAckMsgNotExist, err)
+}
+
+// NackReason
+func TestNackReason(t *testing.T) {
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{ID: "test_id"}))
+
+	// NACK more times than reasons are kept
+	var reasons []string
+	for i := 0; i < maxNackReasons+2; i++ {
+		_, _, offset, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+
+		reason := fmt.Sprintf("reason_%d", i)
+		reasons = append(reasons, reason)
+
+		assert.NoError(t, s.NackReason(defaultTopic, offset, reason))
+		assert.NoError(t, s.Nack(defaultTopic, offset))
+	}
+
+	// The most recent reasons follow the value
+	_, meta, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, reasons[2:], meta.NackReasons)
+
+	assert.Equal(t, errAckMsgNotExist, s.NackReason(defaultTopic, 100, "reason"))
+}
+
+// Len
+func TestLen(t *testing.T) {
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_2"), messageMeta{}))
+
+	n, err = s.Len(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	_, _, _, err = s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+
+	n, err = s.Len(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// Topic config
+func TestPeek(t *testing.T) {
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	msgs, err := s.Peek(defaultTopic, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{ID: "1"}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_2"), messageMeta{ID: "2"}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_3"), messageMeta{ID: "3"}))
+
+	msgs, err = s.Peek(defaultTopic, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []pendingMessage{
+		{val: []byte("test_value_1"), meta: messageMeta{ID: "1"}},
+		{val: []byte("test_value_2"), meta: messageMeta{ID: "2", Offset: 1}},
+	}, msgs)
+
+	// Peeking leaves the topic untouched
+	val, _, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, value("test_value_1"), val)
+}
+
+func TestTopicConfigs(t *testing.T) {
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	_, err := s.GetTopicConfig(defaultTopic)
+	assert.Equal(t, errTopicConfigNotExist, err)
+
+	assert.NoError(t, s.PutTopicConfig("topic_a", topicConfig{MaxLength: 1}))
+	assert.NoError(t, s.PutTopicConfig("topic_b", topicConfig{MaxLength: 2}))
+
+	cfg, err := s.GetTopicConfig("topic_a")
+	assert.NoError(t, err)
+	assert.Equal(t, topicConfig{MaxLength: 1}, cfg)
+
+	configs, err := s.TopicConfigs()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]topicConfig{
+		"topic_a": {MaxLength: 1},
+		"topic_b": {MaxLength: 2},
+	}, configs)
+}
+
+// Sync policy
+func helperSyncCounter(s *store) func() int {
+	var (
+		count int
+		mu    sync.Mutex
+	)
+
+	s.Lock()
+	s.onSync = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		count++
+	}
+	s.Unlock()
+
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return count
+	}
+}
+
+func TestSyncAlways(t *testing.T) {
+	s := newStore(tmpDBPath, withSyncPolicy(syncAlways, 0)).(*store)
+	t.Cleanup(s.Destroy)
+
+	syncs := helperSyncCounter(s)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
+	assert.Equal(t, 1, syncs())
+
+	_, _, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, syncs())
+}
+
+func TestSyncPeriodic(t *testing.T) {
+	s := newStore(tmpDBPath, withSyncPolicy(syncPeriodic, 50*time.Millisecond)).(*store)
+	t.Cleanup(s.Destroy)
+
+	syncs := helperSyncCounter(s)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_2"), messageMeta{}))
+	assert.Equal(t, 0, syncs())
+
+	time.Sleep(150 * time.Millisecond)
+
+	// Both writes are persisted by a single sync, with no further syncs while
+	// the store is idle
+	assert.Equal(t, 1, syncs())
+}
+
+func TestSyncNone_FlushesOnClose(t *testing.T) {
+	s := newStore(tmpDBPath, withSyncPolicy(syncNone, 0)).(*store)
+	t.Cleanup(s.Destroy)
+
+	syncs := helperSyncCounter(s)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{}))
+	assert.Equal(t, 0, syncs())
+
+	assert.NoError(t, s.Close())
+	assert.Equal(t, 1, syncs())
+
+	// Reopen the store, expecting the value to have been persisted
+	s = newStore(tmpDBPath).(*store)
+
+	val, _, _, err := s.GetNext(defaultTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_value_1", string(val))
+	assert.NoError(t, s.Close())
+}
+
 // Close
 func TestClose(t *testing.T) {
 	// TODO
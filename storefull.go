@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const errStoreFull = storeError("store is out of space")
+
+// maxShed is the most messages shed to make room for a single publish, before
+// giving up and rejecting it.
+const maxShed = 100
+
+// storeFullPolicy determines what happens to a publish when the store is out of
+// space.
+type storeFullPolicy string
+
+const (
+	// storeFullReject rejects the publish. This is the default.
+	storeFullReject = storeFullPolicy("reject")
+	// storeFullShed discards the oldest messages waiting in the store, across
+	// every topic, until the publish fits.
+	storeFullShed = storeFullPolicy("shed")
+)
+
+// parseStoreFullPolicy parses the store full policy of the broker.
+func parseStoreFullPolicy(s string) (storeFullPolicy, error) {
+	switch p := storeFullPolicy(s); p {
+	case storeFullReject, storeFullShed:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid store full policy %q, expected reject or shed", s)
+	}
+}
+
+// withStoreFullPolicy sets what happens to publishes when the store runs out of
+// space.
+func withStoreFullPolicy(p storeFullPolicy) brokerOption {
+	return func(b *broker) {
+		b.storeFull = p
+	}
+}
+
+// isStoreFull reports whether the error is the store running out of disk, or
+// exceeding its quota. Stores may flatten the errors of the filesystem into
+// their own, so their messages are matched as well.
+func isStoreFull(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, errStoreFull) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return true
+	}
+
+	msg := err.Error()
+
+	return strings.Contains(msg, syscall.ENOSPC.Error()) || strings.Contains(msg, syscall.EDQUOT.Error())
+}
+
+// withSpace runs insert, returning errStoreFull if the store is out of space.
+// With the shed policy, the oldest waiting message is discarded and insert
+// retried, until it succeeds or there is nothing left to shed.
+func (b *broker) withSpace(insert func() error) error {
+	err := insert()
+
+	for shed := 0; isStoreFull(err) && b.storeFull == storeFullShed && shed < maxShed; shed++ {
+		ok, shedErr := b.shedOldest()
+		if shedErr != nil {
+			log.Err(shedErr).Msg("failed to shed messages")
+			break
+		}
+
+		if !ok {
+			break
+		}
+
+		err = insert()
+	}
+
+	if isStoreFull(err) {
+		log.Err(err).Msg("store is out of space")
+		return errStoreFull
+	}
+
+	return err
+}
+
+// shedOldest discards the message which has been waiting longest across every
+// topic, reporting whether there was one to discard.
+func (b *broker) shedOldest() (bool, error) {
+	topics, err := b.store.Topics()
+	if err != nil {
+		return false, fmt.Errorf("listing topics: %v", err)
+	}
+
+	var oldest *pendingMessage
+	var oldestTopic string
+
+	for _, t := range topics {
+		msgs, err := b.store.Peek(t, 1)
+		if err != nil {
+			return false, fmt.Errorf("peeking topic %s: %v", t, err)
+		}
+
+		if len(msgs) == 0 {
+			continue
+		}
+
+		if oldest == nil || msgs[0].meta.PublishedAt.Before(oldest.meta.PublishedAt) {
+			oldest, oldestTopic = &msgs[0], t
+		}
+	}
+
+	if oldest == nil {
+		return false, nil
+	}
+
+	n, err := b.store.Shed(oldestTopic, 1)
+	if err != nil {
+		return false, fmt.Errorf("shedding topic %s: %v", oldestTopic, err)
+	}
+
+	log.Warn().
+		Str("topic", oldestTopic).
+		Str("msg_id", oldest.meta.ID).
+		Msg("store is out of space, shed oldest message")
+
+	return n > 0, nil
+}
+
+// Shed deletes up to n values waiting at the head of the topic, returning the
+// number deleted.
+func (s *store) Shed(topic string, n int) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	shed, err := s.shed(s.db, topic, n)
+	if err != nil || shed == 0 {
+		return shed, err
+	}
+
+	s.cache.drop(topic)
+
+	return shed, s.written()
+}
+
+// shed deletes up to n values waiting at the head of the topic through db,
+// or every value waiting if n is negative, returning the number deleted. The
+// cache of the topic is left to the caller to drop.
+func (s *store) shed(db readWriter, topic string, n int) (int, error) {
+	head, err := getPos(db, headPosKeyFmt, topic)
+	if errors.Is(err, errTopicNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	tail, err := getPos(db, tailPosKeyFmt, topic)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		n = tail - head
+	}
+
+	batch := new(leveldb.Batch)
+	offset := head
+	for ; offset < tail && offset-head < n; offset++ {
+		meta, err := getMeta(db, metaFmt, topic, offset)
+		if err != nil {
+			return 0, err
+		}
+
+		if meta.Key != "" {
+			batch.Delete(pendingKey(topic, meta.Key))
+		}
+
+		deleteBody(batch, topic, meta)
+		batch.Delete([]byte(fmt.Sprintf(topicFmt, topic, offset)))
+		batch.Delete([]byte(fmt.Sprintf(metaFmt, topic, offset)))
+	}
+
+	if offset == head {
+		return 0, nil
+	}
+
+	batch.Put([]byte(fmt.Sprintf(headPosKeyFmt, topic)), encodePos(offset))
+
+	if err := db.Write(batch, nil); err != nil {
+		return 0, fmt.Errorf("deleting shed values: %v", err)
+	}
+
+	return offset - head, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish_StoreFull(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	full := &os.PathError{Op: "write", Path: "000001.log", Err: syscall.ENOSPC}
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().Insert(defaultTopic, gomock.Any(), gomock.Any()).Return(full)
+
+	srv := newServer(newBroker(mockStore))
+
+	rec := NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("test_value")))
+
+	assert.Equal(http.StatusInsufficientStorage, rec.Code)
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal(errStoreFullPublish.Error(), out.Error)
+}
+
+func TestPublish_StoreFullShed(t *testing.T) {
+	assert := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		now   = time.Now()
+		full  = errors.New("leveldb: write /var/lib/miniqueue/000001.log: no space left on device")
+		older = pendingMessage{val: []byte("test_value_1"), meta: messageMeta{ID: "1", PublishedAt: now.Add(-time.Hour)}}
+		newer = pendingMessage{val: []byte("test_value_2"), meta: messageMeta{ID: "2", PublishedAt: now}}
+	)
+
+	mockStore := NewMockstorer(ctrl)
+	gomock.InOrder(
+		mockStore.EXPECT().Insert(defaultTopic, gomock.Any(), gomock.Any()).Return(full),
+		mockStore.EXPECT().Topics().Return([]string{"test_topic_1", "test_topic_2"}, nil),
+		mockStore.EXPECT().Peek("test_topic_1", 1).Return([]pendingMessage{newer}, nil),
+		mockStore.EXPECT().Peek("test_topic_2", 1).Return([]pendingMessage{older}, nil),
+		// The oldest message across every topic is shed to make room
+		mockStore.EXPECT().Shed("test_topic_2", 1).Return(1, nil),
+		mockStore.EXPECT().Insert(defaultTopic, gomock.Any(), gomock.Any()).Return(nil),
+	)
+
+	srv := newServer(newBroker(mockStore, withStoreFullPolicy(storeFullShed)))
+
+	rec := NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("test_value")))
+
+	assert.Equal(http.StatusCreated, rec.Code)
+}
+
+func TestPublish_StoreFullShedEmpty(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := NewMockstorer(ctrl)
+	mockStore.EXPECT().Insert(defaultTopic, gomock.Any(), gomock.Any()).Return(syscall.EDQUOT)
+	mockStore.EXPECT().Topics().Return([]string{defaultTopic}, nil)
+	mockStore.EXPECT().Peek(defaultTopic, 1).Return(nil, nil)
+
+	b := newBroker(mockStore, withStoreFullPolicy(storeFullShed))
+
+	// With nothing left to shed, the publish is rejected
+	_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.Equal(t, errStoreFull, err)
+}
+
+func TestStoreShed(t *testing.T) {
+	assert := assert.New(t)
+
+	s := helperNewMemStore(t)
+	s.cache = newHeadCache(10)
+
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_1"), messageMeta{ID: "1", Key: "a"}))
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_2"), messageMeta{ID: "2"}))
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_3"), messageMeta{ID: "3"}))
+
+	n, err := s.Shed(defaultTopic, 2)
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	// The key of a shed value no longer indexes it
+	assert.NoError(s.Insert(defaultTopic, []byte("test_value_1b"), messageMeta{ID: "1b", Key: "a"}))
+
+	for _, want := range []string{"test_value_3", "test_value_1b"} {
+		val, _, _, err := s.GetNext(defaultTopic)
+		assert.NoError(err)
+		assert.Equal(value(want), val)
+	}
+
+	n, err = s.Shed(defaultTopic, 1)
+	assert.NoError(err)
+	assert.Zero(n)
+
+	n, err = s.Shed("missing_topic", 1)
+	assert.NoError(err)
+	assert.Zero(n)
+}
+
+func TestIsStoreFull(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "disk full", err: &os.PathError{Op: "write", Path: "db", Err: syscall.ENOSPC}, want: true},
+		{name: "quota exceeded", err: syscall.EDQUOT, want: true},
+		{name: "flattened", err: fmt.Errorf("committing batch: %v", syscall.ENOSPC), want: true},
+		{name: "other", err: errors.New("test_error"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isStoreFull(tt.err))
+		})
+	}
+}
+
+func TestParseStoreFullPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := parseStoreFullPolicy("shed")
+	assert.NoError(err)
+	assert.Equal(storeFullShed, p)
+
+	_, err = parseStoreFullPolicy("invalid")
+	assert.Error(err)
+}
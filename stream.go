@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+const (
+	// streamThreshold is the size above which messages are streamed to
+	// consumers in chunks, rather than encoded into a single JSON response.
+	streamThreshold = 1 << 20
+	// streamChunkSize is the maximum size of each streamed chunk.
+	streamChunkSize = 32 << 10
+)
+
+// bodyFmt is the key of each chunk of a value larger than streamThreshold, by
+// its topic, the offset of the message in the log of the topic, and the index
+// of the chunk. The body stays put as the message moves between the topic and
+// the ack topic, in place of the value.
+const bodyFmt = "%s-body-%d-%d"
+
+// getter reads from the database, or a snapshot of it.
+type getter interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+}
+
+// bodyChunks returns the number of chunks a body of size bytes is stored in.
+func bodyChunks(size int) int {
+	return (size + streamChunkSize - 1) / streamChunkSize
+}
+
+func bodyKey(topic string, offset, chunk int) []byte {
+	return []byte(fmt.Sprintf(bodyFmt, topic, offset, chunk))
+}
+
+// spill writes a value larger than streamThreshold in chunks through db,
+// returning the empty value to store in its place and recording its size in
+// meta. Smaller values are returned as they are.
+func spill(db readWriter, topic string, val value, meta *messageMeta) (value, error) {
+	if len(val) <= streamThreshold {
+		return val, nil
+	}
+
+	for i := 0; i < bodyChunks(len(val)); i++ {
+		end := (i + 1) * streamChunkSize
+		if end > len(val) {
+			end = len(val)
+		}
+
+		if err := db.Put(bodyKey(topic, meta.Offset, i), val[i*streamChunkSize:end], nil); err != nil {
+			return nil, fmt.Errorf("putting body chunk %d: %v", i, err)
+		}
+	}
+
+	meta.BodySize = len(val)
+
+	return value{}, nil
+}
+
+// deleteBody adds the deletion of the body of the message, if it has one, to
+// the batch.
+func deleteBody(batch *leveldb.Batch, topic string, meta messageMeta) {
+	for i := 0; i < bodyChunks(meta.BodySize); i++ {
+		batch.Delete(bodyKey(topic, meta.Offset, i))
+	}
+}
+
+// getBody returns the whole body of the message, read from db.
+func getBody(db getter, topic string, meta messageMeta) (value, error) {
+	val := make(value, 0, meta.BodySize)
+	for i := 0; i < bodyChunks(meta.BodySize); i++ {
+		chunk, err := db.Get(bodyKey(topic, meta.Offset, i), nil)
+		if err != nil {
+			return nil, fmt.Errorf("getting body chunk %d of topic %s at offset %d: %v", i, topic, meta.Offset, err)
+		}
+
+		val = append(val, chunk...)
+	}
+
+	return val, nil
+}
+
+// Reader returns a reader over the value awaiting acknowledgement at
+// ackOffset, along with its size. A body stored in chunks is read from a
+// snapshot of the store one chunk at a time, so is never held in memory
+// whole. The reader must be closed.
+func (s *store) Reader(topic string, ackOffset int) (io.ReadCloser, int, error) {
+	s.Lock()
+	snap, err := s.db.GetSnapshot()
+	s.Unlock()
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("taking snapshot: %v", err)
+	}
+
+	val, err := snap.Get([]byte(fmt.Sprintf(ackTopicFmt, topic, ackOffset)), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		snap.Release()
+		return nil, 0, errAckMsgNotExist
+	}
+	if err != nil {
+		snap.Release()
+		return nil, 0, fmt.Errorf("getting value from ack topic %s at offset %d: %v", topic, ackOffset, err)
+	}
+
+	b, err := snap.Get([]byte(fmt.Sprintf(ackMetaFmt, topic, ackOffset)), nil)
+	if err != nil {
+		snap.Release()
+		return nil, 0, fmt.Errorf("getting meta from ack topic %s at offset %d: %v", topic, ackOffset, err)
+	}
+
+	meta, err := decodeMeta(b)
+	if err != nil {
+		snap.Release()
+		return nil, 0, err
+	}
+
+	if meta.BodySize == 0 {
+		snap.Release()
+		return ioutil.NopCloser(bytes.NewReader(val)), len(val), nil
+	}
+
+	return &bodyReader{snap: snap, topic: topic, meta: meta}, meta.BodySize, nil
+}
+
+// bodyReader reads a body stored in chunks from a snapshot, holding no more
+// than a single chunk at a time.
+type bodyReader struct {
+	snap  *leveldb.Snapshot
+	topic string
+	meta  messageMeta
+
+	chunk []byte // unread remainder of the current chunk
+	next  int    // index of the next chunk to read
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.next == bodyChunks(r.meta.BodySize) {
+			return 0, io.EOF
+		}
+
+		chunk, err := r.snap.Get(bodyKey(r.topic, r.meta.Offset, r.next), nil)
+		if err != nil {
+			return 0, fmt.Errorf("getting body chunk %d of topic %s at offset %d: %v", r.next, r.topic, r.meta.Offset, err)
+		}
+
+		r.chunk = chunk
+		r.next++
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+
+	return n, nil
+}
+
+// Close releases the snapshot read from.
+func (r *bodyReader) Close() error {
+	r.snap.Release()
+	return nil
+}
+
+// readBody returns the whole value awaiting acknowledgement at ackOffset on
+// the topic, given the value and metadata it was taken with, reading a body
+// stored in chunks back into memory. meta no longer records a body once read.
+func readBody(s storer, topic string, ackOffset int, val value, meta *messageMeta) (value, error) {
+	if meta.BodySize == 0 {
+		return val, nil
+	}
+
+	r, _, err := s.Reader(topic, ackOffset)
+	if err != nil {
+		return nil, fmt.Errorf("opening body: %v", err)
+	}
+	defer r.Close()
+
+	val, err = ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %v", err)
+	}
+
+	meta.BodySize = 0
+
+	return val, nil
+}
+
+// writeStream copies r to w as a sequence of chunks, each prefixed with its
+// length as a big endian uint32. The end of the stream is marked by an empty
+// chunk.
+func writeStream(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 4+streamChunkSize)
+
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	binary.BigEndian.PutUint32(buf, 0)
+	_, err := w.Write(buf[:4])
+
+	return err
+}
+
+// readStream copies a stream written by writeStream from r to w.
+func readStream(w io.Writer, r io.Reader) error {
+	var prefix [4]byte
+
+	for {
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			return err
+		}
+
+		n := binary.BigEndian.Uint32(prefix[:])
+		if n == 0 {
+			return nil
+		}
+
+		if _, err := io.CopyN(w, r, int64(n)); err != nil {
+			return err
+		}
+	}
+}
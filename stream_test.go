@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// limitedWriter fails any single write larger than max.
+type limitedWriter struct {
+	w   io.Writer
+	max int
+}
+
+func (l limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.max {
+		return 0, errors.New("write exceeds limit")
+	}
+
+	return l.w.Write(p)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, streamChunkSize, streamChunkSize + 1, 3 * streamChunkSize} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+
+		var buf bytes.Buffer
+		w := limitedWriter{w: &buf, max: 4 + streamChunkSize}
+		assert.NoError(t, writeStream(w, bytes.NewReader(payload)))
+
+		var out bytes.Buffer
+		assert.NoError(t, readStream(&out, &buf))
+		assert.True(t, bytes.Equal(payload, out.Bytes()))
+		assert.Zero(t, buf.Len())
+	}
+}
+
+func TestServerStreamLargeMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	payload := make([]byte, 4<<20)
+	rand.Read(payload)
+
+	res := helperPublishMessage(t, srv, defaultTopic, string(payload))
+	defer res.Body.Close()
+
+	res = helperSubscribeRaw(t, srv, defaultTopic)
+	defer res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	decoder := json.NewDecoder(res.Body)
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.True(out.Stream)
+	assert.Empty(out.Msg)
+	assert.Equal(len(payload), out.Length)
+
+	// The stream follows the newline terminating the response
+	r := io.MultiReader(decoder.Buffered(), res.Body)
+
+	var newline [1]byte
+	_, err := io.ReadFull(r, newline[:])
+	assert.NoError(err)
+	assert.Equal(byte('\n'), newline[0])
+
+	// Read the chunks, expecting none to exceed the chunk size
+
+	var body bytes.Buffer
+	for {
+		var prefix [4]byte
+		_, err := io.ReadFull(r, prefix[:])
+		assert.NoError(err)
+
+		n := binary.BigEndian.Uint32(prefix[:])
+		if n == 0 {
+			break
+		}
+		assert.LessOrEqual(int(n), streamChunkSize)
+
+		_, err = io.CopyN(&body, r, int64(n))
+		assert.NoError(err)
+	}
+
+	assert.Equal(payload, body.Bytes())
+}
+
+func TestServerSmallMessageNotStreamed(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, srvCloser := helperNewTestServer(t)
+	defer srvCloser()
+
+	res := helperPublishMessage(t, srv, defaultTopic, "test_value")
+	defer res.Body.Close()
+
+	_, decoder, closeSub := helperSubscribeTopic(t, srv, defaultTopic)
+	defer closeSub()
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.False(out.Stream)
+	assert.Equal("test_value", out.Msg)
+}
+
+func TestStoreLargeValueInChunks(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath).(*store)
+	t.Cleanup(s.Destroy)
+
+	payload := make([]byte, 3*streamThreshold+1)
+	rand.Read(payload)
+
+	assert.NoError(s.Insert(defaultTopic, payload, messageMeta{ID: "large"}))
+
+	msgs, err := s.Peek(defaultTopic, 1)
+	assert.NoError(err)
+	assert.Len(msgs, 1)
+	assert.True(bytes.Equal(payload, msgs[0].val))
+	assert.Zero(msgs[0].meta.BodySize)
+
+	// The body is left in the store rather than returned
+	val, meta, ackOffset, err := s.GetNext(defaultTopic)
+	assert.NoError(err)
+	assert.Empty(val)
+	assert.Equal(len(payload), meta.BodySize)
+
+	r, size, err := s.Reader(defaultTopic, ackOffset)
+	assert.NoError(err)
+	assert.Equal(len(payload), size)
+
+	// No read returns more than a chunk, however much is asked for
+	var body bytes.Buffer
+	p := make([]byte, len(payload))
+	for {
+		n, err := r.Read(p)
+		assert.LessOrEqual(n, streamChunkSize)
+		body.Write(p[:n])
+
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(err)
+	}
+	assert.NoError(r.Close())
+	assert.True(bytes.Equal(payload, body.Bytes()))
+
+	// ACKing the value deletes its body
+	assert.NoError(s.Ack(defaultTopic, ackOffset))
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(defaultTopic+"-body-")), nil)
+	defer iter.Release()
+	assert.False(iter.Next())
+}
+
+// pingingReader reads from r, sending a keepalive on kw before each read if
+// the connection is idle.
+type pingingReader struct {
+	r     io.Reader
+	kw    *keepaliveWriter
+	clock *fakeClock
+}
+
+func (p pingingReader) Read(b []byte) (int, error) {
+	p.clock.Advance(time.Minute)
+	p.kw.ping()
+
+	return p.r.Read(b)
+}
+
+func TestRespondStreamHoldsKeepalives(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rec := NewRecorder()
+	kw := newKeepaliveWriter(rec, time.Minute, clock.Now)
+
+	payload := make([]byte, 3*streamChunkSize)
+	rand.Read(payload)
+
+	pr := pingingReader{r: bytes.NewReader(payload), kw: kw, clock: clock}
+	respondStream(zerolog.Nop(), kw, kw, json.NewEncoder(kw), pr, len(payload), messageMeta{ID: "large"})
+
+	decoder := json.NewDecoder(rec.Body)
+
+	var out subResponse
+	assert.NoError(decoder.Decode(&out))
+	assert.True(out.Stream)
+	assert.Equal(len(payload), out.Length)
+
+	// Nothing but the chunks follows the newline terminating the response
+	r := io.MultiReader(decoder.Buffered(), rec.Body)
+
+	var newline [1]byte
+	_, err := io.ReadFull(r, newline[:])
+	assert.NoError(err)
+	assert.Equal(byte('\n'), newline[0])
+
+	var body bytes.Buffer
+	assert.NoError(readStream(&body, r))
+	assert.True(bytes.Equal(payload, body.Bytes()))
+	assert.Zero(rec.Body.Len())
+
+	// Keepalives resume once the message is written
+	kw.ping()
+	assert.Zero(rec.Body.Len())
+
+	clock.Advance(time.Minute)
+	kw.ping()
+
+	out = subResponse{}
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.True(out.Keepalive)
+}
+
+func TestConsumerStreamBodies(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db}, withConfirmWindow(time.Minute))
+
+	payload := make([]byte, streamThreshold+1)
+	rand.Read(payload)
+
+	_, err = b.Publish(defaultTopic, payload, messageMeta{})
+	assert.NoError(err)
+	_, err = b.Publish(defaultTopic, payload, messageMeta{})
+	assert.NoError(err)
+
+	ctx := context.Background()
+
+	// Consumers read values whole unless they stream them
+	cons := b.Subscribe(defaultTopic)
+	defer b.Unsubscribe(cons)
+
+	val, err := cons.Next(ctx)
+	assert.NoError(err)
+	assert.True(bytes.Equal(payload, val))
+	assert.Zero(cons.Meta().BodySize)
+	assert.NoError(cons.Ack())
+
+	cons.StreamBodies()
+
+	val, err = cons.Next(ctx)
+	assert.NoError(err)
+	assert.Empty(val)
+	assert.Equal(len(payload), cons.Meta().BodySize)
+
+	body, size, err := cons.Body()
+	assert.NoError(err)
+	assert.Equal(len(payload), size)
+
+	streamed, err := ioutil.ReadAll(body)
+	assert.NoError(err)
+	assert.NoError(body.Close())
+	assert.True(bytes.Equal(payload, streamed))
+
+	// The confirmed value is kept whole, though its body is deleted on ACK
+	id := cons.Meta().ID
+	assert.NoError(cons.Ack())
+
+	confirmed, err := b.Confirmed(defaultTopic, id)
+	assert.NoError(err)
+	assert.True(bytes.Equal(payload, confirmed.val))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// withMaxAge discards messages which have been waiting to be consumed for
+// longer than maxAge, sweeping every topic on the given interval. Each sweep
+// also removes messages past their delivery deadline. Outstanding messages are
+// never swept. Swept messages are expired like those past their deadline,
+// sending their receipts and moving to the expired topic if it's kept.
+func withMaxAge(maxAge, interval time.Duration) brokerOption {
+	return func(b *broker) {
+		b.maxAge = maxAge
+		b.sweepInterval = interval
+	}
+}
+
+// withClock replaces the clock used by the broker to timestamp and expire
+// messages. The store shares it to timestamp the values it retains.
+func withClock(now func() time.Time) brokerOption {
+	return func(b *broker) {
+		b.now = now
+	}
+}
+
+// clocked is implemented by stores which timestamp the values they retain.
+type clocked interface {
+	setClock(now func() time.Time)
+}
+
+// setStoreClock shares the clock with the store, beneath any stores wrapping
+// it.
+func setStoreClock(s storer, now func() time.Time) {
+	for {
+		if c, ok := s.(clocked); ok {
+			c.setClock(now)
+			return
+		}
+
+		us, ok := s.(interface{ Unwrap() storer })
+		if !ok {
+			return
+		}
+		s = us.Unwrap()
+	}
+}
+
+// sweepPeriodically sweeps expired messages until the broker is shut down.
+func (b *broker) sweepPeriodically() {
+	ticker := time.NewTicker(b.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.sweep(); err != nil {
+				log.Err(err).Msg("failed to sweep expired messages")
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// sweep discards messages published more than maxAge ago, if there's a
+// maximum age, and those past their delivery deadline.
+func (b *broker) sweep() error {
+	if b.maxAge > 0 {
+		swept, err := b.store.Sweep(b.now().Add(-b.maxAge), b.keepExpired)
+		if err != nil {
+			return fmt.Errorf("sweeping store: %v", err)
+		}
+
+		for topic, metas := range swept {
+			log.Info().
+				Str("topic", topic).
+				Int("count", len(metas)).
+				Msg("swept expired messages")
+
+			b.expired(topic, metas)
+		}
+	}
+
+	return b.sweepExpired()
+}
+
+// Sweep deletes the messages at the head of each topic which were published
+// before the given time, returning the metadata of those swept from each
+// topic. With keep, they are moved to the expired topic of their topic
+// instead, and expired topics are left alone so that they hold on to them.
+// Messages without a publish time are never swept.
+func (s *store) Sweep(before time.Time, keep bool) (map[string][]messageMeta, error) {
+	topics, err := s.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	swept := map[string][]messageMeta{}
+	for _, topic := range topics {
+		if keep && isExpiredTopic(topic) {
+			continue
+		}
+
+		metas, err := s.sweepTopic(topic, before, keep)
+		if err != nil {
+			return swept, fmt.Errorf("sweeping topic %s: %v", topic, err)
+		}
+
+		if len(metas) > 0 {
+			swept[topic] = metas
+		}
+	}
+
+	return swept, nil
+}
+
+func (s *store) sweepTopic(topic string, before time.Time, keep bool) ([]messageMeta, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	head, err := getPos(s.db, headPosKeyFmt, topic)
+	if errors.Is(err, errTopicNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tail, err := getPos(s.db, tailPosKeyFmt, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only sweep from the head, so the topic stays contiguous. Kept values are
+	// moved in the same write, so they're never lost or left on both topics.
+	bw := newBatchWriter(s.db)
+	batch := new(leveldb.Batch)
+
+	var swept []messageMeta
+	var caches []func()
+	offset := head
+	for ; offset < tail; offset++ {
+		meta, err := getMeta(s.db, metaFmt, topic, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.PublishedAt.IsZero() || !meta.PublishedAt.Before(before) {
+			break
+		}
+
+		if keep {
+			cache, err := s.keepExpired(bw, topic, offset, meta)
+			if err != nil {
+				return nil, err
+			}
+
+			caches = append(caches, cache)
+		}
+
+		if meta.Key != "" {
+			batch.Delete(pendingKey(topic, meta.Key))
+		}
+
+		deleteBody(batch, topic, meta)
+		batch.Delete([]byte(fmt.Sprintf(topicFmt, topic, offset)))
+		batch.Delete([]byte(fmt.Sprintf(metaFmt, topic, offset)))
+
+		swept = append(swept, meta)
+	}
+
+	if offset == head {
+		return nil, nil
+	}
+
+	batch.Put([]byte(fmt.Sprintf(headPosKeyFmt, topic)), encodePos(offset))
+
+	if err := bw.Write(batch, nil); err != nil {
+		return nil, fmt.Errorf("deleting expired values: %v", err)
+	}
+
+	if err := bw.commit(); err != nil {
+		return nil, fmt.Errorf("committing batch: %v", err)
+	}
+
+	for _, cache := range caches {
+		cache()
+	}
+
+	return swept, s.written()
+}
+
+// keepExpired inserts the value waiting at the offset of the topic into its
+// expired topic through bw.
+func (s *store) keepExpired(bw *batchWriter, topic string, offset int, meta messageMeta) (cache func(), err error) {
+	val, err := getValue(s.db, topicFmt, topic, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.BodySize > 0 {
+		if val, err = getBody(s.db, topic, meta); err != nil {
+			return nil, err
+		}
+	}
+
+	meta.Deliveries = 0
+	meta.Key = ""
+
+	cache, err = s.insert(bw, topic+expiredSuffix, val, meta)
+	if err != nil {
+		return nil, fmt.Errorf("moving to %s: %v", topic+expiredSuffix, err)
+	}
+
+	return cache, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestBrokerSweep(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &store{db: db}
+	b := newBroker(s,
+		withMaxAge(time.Hour, 0),
+		withClock(func() time.Time { return now }),
+	)
+
+	_, err = b.Publish(defaultTopic, []byte("outstanding"), messageMeta{})
+	assert.NoError(err)
+	_, err = b.Publish(defaultTopic, []byte("expired"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	val, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("outstanding"), val)
+
+	now = now.Add(30 * time.Minute)
+	_, err = b.Publish(defaultTopic, []byte("fresh"), messageMeta{})
+	assert.NoError(err)
+
+	// Nothing has reached the max age yet
+	assert.NoError(b.sweep())
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	now = now.Add(45 * time.Minute)
+	assert.NoError(b.sweep())
+
+	n, err = s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	// The outstanding message is left alone
+	_, err = s.GetMeta(defaultTopic, c.ackOffset)
+	assert.NoError(err)
+	assert.NoError(c.Ack())
+
+	val, err = c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("fresh"), val)
+}
+
+func TestBrokerSweep_Periodic(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db}
+	b := newBroker(s, withMaxAge(time.Millisecond, 10*time.Millisecond))
+	t.Cleanup(func() { _ = b.Shutdown() })
+
+	_, err = b.Publish(defaultTopic, []byte("expired"), messageMeta{})
+	assert.NoError(err)
+
+	assert.Eventually(func() bool {
+		n, err := s.Len(defaultTopic)
+		return err == nil && n == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStoreSweep_HeadOnly(t *testing.T) {
+	s := newStore(tmpDBPath, withHeadCache(10))
+	t.Cleanup(s.Destroy)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.NoError(t, s.Insert(defaultTopic, []byte("old"), messageMeta{PublishedAt: start}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("new"), messageMeta{PublishedAt: start.Add(time.Hour)}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("old_again"), messageMeta{PublishedAt: start}))
+	assert.NoError(t, s.Insert(defaultTopic, []byte("unknown"), messageMeta{}))
+
+	swept, err := s.Sweep(start.Add(time.Minute), false)
+	assert.NoError(t, err)
+	assert.Len(t, swept[defaultTopic], 1)
+
+	// Sweeping stops at the first message which has not expired
+	for _, want := range []string{"new", "old_again", "unknown"} {
+		val, _, _, err := s.GetNext(defaultTopic)
+		assert.NoError(t, err)
+		assert.Equal(t, value(want), val)
+	}
+}
+
+func TestBrokerSweep_KeepExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	receipts := make(chan receipt, 1)
+	notifySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec receipt
+		assert.NoError(json.NewDecoder(r.Body).Decode(&rec))
+		receipts <- rec
+	}))
+	defer notifySrv.Close()
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &store{db: db}
+	b := newBroker(s,
+		withMaxAge(time.Hour, 0),
+		withExpiredTopic(true),
+		withNotifyAllow(loopbackNetworks),
+		withClock(func() time.Time { return now }),
+	)
+
+	id, err := b.Publish(defaultTopic, []byte("expired"), messageMeta{Notify: notifySrv.URL})
+	assert.NoError(err)
+
+	now = now.Add(2 * time.Hour)
+	assert.NoError(b.sweep())
+
+	select {
+	case rec := <-receipts:
+		assert.Equal(receipt{
+			ID:      id,
+			Topic:   defaultTopic,
+			Outcome: receiptOutcomeExpired,
+		}, rec)
+	case <-time.After(time.Second):
+		assert.FailNow("timed out waiting for receipt")
+	}
+
+	n, err := s.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(0, n)
+
+	expired, err := s.Peek(defaultTopic+expiredSuffix, 10)
+	assert.NoError(err)
+	assert.Len(expired, 1)
+	assert.Equal(value("expired"), expired[0].val)
+
+	// Expired topics hold on to the messages moved to them
+	assert.NoError(b.sweep())
+
+	n, err = s.Len(defaultTopic + expiredSuffix)
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestBrokerClock_Retention(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newStoreFromDB("", db, withRetention(time.Hour, 0))
+	b := newBroker(s, withClock(func() time.Time { return now }))
+
+	_, err = b.Publish(defaultTopic, []byte("acked"), messageMeta{})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.Ack())
+
+	// Values are retained by the clock of the broker
+	entries, err := s.History(defaultTopic)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.True(now.Equal(entries[0].AckedAt))
+
+	now = now.Add(2 * time.Hour)
+	entries, err = s.History(defaultTopic)
+	assert.NoError(err)
+	assert.Empty(entries)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// tailEventQueryKey is the tail query parameter restricting the events
+	// observed to a comma separated list, e.g. "publish". Every event is
+	// observed by default.
+	tailEventQueryKey = "event"
+
+	// tapBuffer is the number of observed copies held for a tail which has
+	// fallen behind, beyond which copies are dropped rather than holding up
+	// publishes and deliveries.
+	tapBuffer = 256
+)
+
+// tapEvent is a point in the life of a message at which a tail observes a copy
+// of it.
+type tapEvent string
+
+const (
+	tapPublish tapEvent = "publish"
+	tapDeliver tapEvent = "deliver"
+)
+
+// parseTapEvents parses the comma separated events a tail observes, every
+// event if empty.
+func parseTapEvents(s string) (map[tapEvent]bool, error) {
+	events := map[tapEvent]bool{}
+
+	if s == "" {
+		events[tapPublish] = true
+		events[tapDeliver] = true
+
+		return events, nil
+	}
+
+	for _, e := range strings.Split(s, ",") {
+		switch ev := tapEvent(strings.TrimSpace(e)); ev {
+		case tapPublish, tapDeliver:
+			events[ev] = true
+		default:
+			return nil, errInvalidTapEvent
+		}
+	}
+
+	return events, nil
+}
+
+// tapFrame is an observed copy of a message, streamed to a tail. Observed is
+// always set, so that copies can't be mistaken for deliveries.
+type tapFrame struct {
+	Observed    bool      `json:"observed"`
+	Event       tapEvent  `json:"event"`
+	ID          string    `json:"id"`
+	Msg         string    `json:"msg"`
+	ContentType string    `json:"content_type,omitempty"`
+	At          time.Time `json:"at"`
+
+	// ConsumerID is the consumer the message was delivered to.
+	ConsumerID string `json:"consumer_id,omitempty"`
+
+	// Dropped is the number of copies dropped before this one, as the tail
+	// fell behind.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// tap receives copies of the messages of a topic as they are observed.
+type tap struct {
+	topic  string
+	events map[tapEvent]bool
+	frames chan tapFrame
+
+	// dropped counts the copies dropped since the last one sent.
+	dropped int
+	sync.Mutex
+}
+
+// send passes the frame to the tap without waiting, dropping it if the tap
+// has fallen behind.
+func (t *tap) send(f tapFrame) {
+	t.Lock()
+	defer t.Unlock()
+
+	f.Dropped = t.dropped
+
+	select {
+	case t.frames <- f:
+		t.dropped = 0
+	default:
+		t.dropped++
+	}
+}
+
+// taps holds the taps attached to each topic.
+type taps struct {
+	topics map[string]map[*tap]bool
+	sync.RWMutex
+}
+
+// emit sends a copy of the message to the taps of the topic observing the
+// event. It never blocks, so has no effect on publishes or deliveries.
+func (ts *taps) emit(topic string, ev tapEvent, val value, meta messageMeta, consumerID string, at time.Time) {
+	if ts == nil {
+		return
+	}
+
+	ts.RLock()
+	defer ts.RUnlock()
+
+	for t := range ts.topics[topic] {
+		if !t.events[ev] {
+			continue
+		}
+
+		t.send(tapFrame{
+			Observed:    true,
+			Event:       ev,
+			ID:          meta.ID,
+			Msg:         string(val),
+			ContentType: meta.ContentType,
+			At:          at,
+			ConsumerID:  consumerID,
+		})
+	}
+}
+
+// Tap attaches a tap to the topic, observing copies of its messages at the
+// given events until it is detached by Untap.
+func (b *broker) Tap(topic string, events map[tapEvent]bool) *tap {
+	t := &tap{
+		topic:  topic,
+		events: events,
+		frames: make(chan tapFrame, tapBuffer),
+	}
+
+	b.taps.Lock()
+	defer b.taps.Unlock()
+
+	if b.taps.topics == nil {
+		b.taps.topics = map[string]map[*tap]bool{}
+	}
+	if b.taps.topics[topic] == nil {
+		b.taps.topics[topic] = map[*tap]bool{}
+	}
+
+	b.taps.topics[topic][t] = true
+
+	return t
+}
+
+// Untap detaches the tap from its topic.
+func (b *broker) Untap(t *tap) {
+	b.taps.Lock()
+	defer b.taps.Unlock()
+
+	delete(b.taps.topics[t.topic], t)
+	if len(b.taps.topics[t.topic]) == 0 {
+		delete(b.taps.topics, t.topic)
+	}
+}
+
+// tail streams copies of the messages of a topic as they are published or
+// delivered, as newline delimited JSON, without consuming them.
+func tail(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "tail").
+			Logger()
+
+		topic, ok := mux.Vars(r)[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().Str("topic", topic).Logger()
+
+		events, err := parseTapEvents(r.URL.Query().Get(tailEventQueryKey))
+		if err != nil {
+			log.Debug().Err(err).Msg("invalid tail events")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTapEvent.Error())
+
+			return
+		}
+
+		t := broker.Tap(topic, events)
+		defer broker.Untap(t)
+
+		log.Info().Msg("tailing topic")
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		fw := newFlushWriter(w, flushThreshold{})
+		fw.flush()
+
+		enc := json.NewEncoder(fw)
+
+		for {
+			select {
+			case f := <-t.frames:
+				if f.Dropped > 0 {
+					log.Warn().Int("dropped", f.Dropped).Msg("tail fell behind, dropped copies")
+				}
+
+				if err := enc.Encode(f); err != nil {
+					log.Debug().Err(err).Msg("failed to write to tail")
+					return
+				}
+			case <-ctx.Done():
+				log.Info().Msg("tail disconnected")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTail(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	srv := helperNewTLSServer(t, newServer(b))
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/tail/%s", srv.URL, defaultTopic), nil)
+	assert.NoError(err)
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("application/x-ndjson", res.Header.Get("Content-Type"))
+
+	// The message is published and consumed as usual
+	id, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{ContentType: "text/plain"})
+	assert.NoError(err)
+
+	c := b.Subscribe(defaultTopic)
+	val, err := c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("test_value"), val)
+	assert.Equal(id, c.Meta().ID)
+	assert.Equal(1, c.Meta().Deliveries)
+	assert.NoError(c.Ack())
+
+	// The tail observed a copy as it was published, then delivered
+	dec := json.NewDecoder(res.Body)
+
+	var published tapFrame
+	assert.NoError(dec.Decode(&published))
+	assert.True(published.Observed)
+	assert.Equal(tapPublish, published.Event)
+	assert.Equal(id, published.ID)
+	assert.Equal("test_value", published.Msg)
+	assert.Equal("text/plain", published.ContentType)
+
+	var delivered tapFrame
+	assert.NoError(dec.Decode(&delivered))
+	assert.True(delivered.Observed)
+	assert.Equal(tapDeliver, delivered.Event)
+	assert.Equal(id, delivered.ID)
+	assert.Equal(c.id, delivered.ConsumerID)
+
+	// Nothing was left behind by the tail
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Zero(n)
+}
+
+func TestTail_Events(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+
+	events, err := parseTapEvents("deliver")
+	assert.NoError(err)
+
+	tp := b.Tap(defaultTopic, events)
+	defer b.Untap(tp)
+
+	_, err = b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	// Only the delivery is observed
+	assert.Empty(tp.frames)
+
+	_, err = b.Subscribe(defaultTopic).TryNext(context.Background())
+	assert.NoError(err)
+
+	if assert.Len(tp.frames, 1) {
+		assert.Equal(tapDeliver, (<-tp.frames).Event)
+	}
+
+	// Unknown events are rejected
+	rec := NewRecorder()
+	newServer(b).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/tail/%s?event=ack", defaultTopic), nil))
+	assert.Equal(http.StatusBadRequest, rec.Code)
+}
+
+func TestTap_Dropped(t *testing.T) {
+	assert := assert.New(t)
+
+	tp := &tap{frames: make(chan tapFrame, 1)}
+
+	// A tap which has fallen behind drops copies rather than blocking
+	tp.send(tapFrame{ID: "1"})
+	tp.send(tapFrame{ID: "2"})
+	tp.send(tapFrame{ID: "3"})
+
+	assert.Equal("1", (<-tp.frames).ID)
+
+	// The next copy sent counts those dropped
+	tp.send(tapFrame{ID: "4"})
+
+	f := <-tp.frames
+	assert.Equal("4", f.ID)
+	assert.Equal(2, f.Dropped)
+}
@@ -0,0 +1,60 @@
+package main
+
+import "sync"
+
+// throughput counts the messages published to, and ACKed on, a topic since the
+// broker started. Rates are derived by comparing two counts over time.
+type throughput struct {
+	Published int `json:"published"`
+	Acked     int `json:"acked"`
+}
+
+// throughputs records the throughput of each topic. The zero value is ready to
+// use.
+type throughputs struct {
+	topics map[string]*throughput
+	sync.Mutex
+}
+
+func (t *throughputs) add(topic string, published, acked int) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.topics == nil {
+		t.topics = map[string]*throughput{}
+	}
+
+	tp, ok := t.topics[topic]
+	if !ok {
+		tp = &throughput{}
+		t.topics[topic] = tp
+	}
+
+	tp.Published += published
+	tp.Acked += acked
+}
+
+func (t *throughputs) published(topic string) {
+	t.add(topic, 1, 0)
+}
+
+func (t *throughputs) acked(topic string) {
+	t.add(topic, 0, 1)
+}
+
+func (t *throughputs) snapshot(topic string) throughput {
+	t.Lock()
+	defer t.Unlock()
+
+	if tp, ok := t.topics[topic]; ok {
+		return *tp
+	}
+
+	return throughput{}
+}
+
+// Throughput returns the number of messages published to, and ACKed on, the
+// topic since the broker started.
+func (b *broker) Throughput(topic string) throughput {
+	return b.throughput.snapshot(topic)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// tlsReloader holds the TLS config of the server, loaded from the certificate,
+// key and client CA files, such that they can be reloaded without a restart,
+// e.g. once a certificate is renewed. Connections made before a reload keep
+// the config they were made with.
+type tlsReloader struct {
+	certPath     string
+	keyPath      string
+	clientCAPath string
+
+	mu  sync.RWMutex
+	cfg *tls.Config
+}
+
+// newTLSReloader loads the certificate and key of the server. With a client
+// CA, clients must present a certificate signed by it.
+func newTLSReloader(certPath, keyPath, clientCAPath string) (*tlsReloader, error) {
+	r := &tlsReloader{
+		certPath:     certPath,
+		keyPath:      keyPath,
+		clientCAPath: clientCAPath,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reload loads the files again, keeping the current config if any fails to
+// load.
+func (r *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.clientCAPath != "" {
+		b, err := ioutil.ReadFile(r.clientCAPath)
+		if err != nil {
+			return fmt.Errorf("reading client CA: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return errors.New("client CA holds no PEM certificates")
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.mu.Lock()
+	r.cfg = cfg
+	r.mu.Unlock()
+
+	return nil
+}
+
+// current returns the config new connections are made with.
+func (r *tlsReloader) current() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cfg
+}
+
+// Config returns the TLS config of the server, which uses the most recently
+// loaded config for each connection.
+func (r *tlsReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+// reloadOn reloads the files each time a signal is received, until sig is
+// closed. A failed reload is logged, and the current config kept.
+func (r *tlsReloader) reloadOn(sig <-chan os.Signal) {
+	for range sig {
+		if err := r.reload(); err != nil {
+			log.Err(err).Msg("failed to reload TLS config, keeping the current config")
+			continue
+		}
+
+		log.Info().Msg("reloaded TLS config")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helperCert is a certificate and its key, signed by a CA unless it is one.
+type helperCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// helperNewCert creates a certificate with the common name, valid for
+// localhost, signed by ca, or self-signed as a CA if ca is nil.
+func helperNewCert(t *testing.T, name string, ca *helperCert) *helperCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+
+	return &helperCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key as PEM files to dir, returning their
+// paths.
+func (c *helperCert) write(t *testing.T, dir string) (certPath, keyPath string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("encoding key: %v", err)
+	}
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+
+	for path, block := range map[string]*pem.Block{
+		certPath: {Type: "CERTIFICATE", Bytes: c.der},
+		keyPath:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("writing %s: %v", path, err)
+		}
+	}
+
+	return certPath, keyPath
+}
+
+// tlsKeyPair returns the certificate for use in a TLS config.
+func (c *helperCert) tlsKeyPair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// helperServeTLS serves the topics of an empty broker with the TLS config of
+// the reloader.
+func helperServeTLS(t *testing.T, r *tlsReloader) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(newServer(newBroker(helperNewMemStore(t))))
+	srv.TLS = r.Config()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestTLSReloader_Reload(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	ca := helperNewCert(t, "ca", nil)
+	certPath, keyPath := helperNewCert(t, "first", ca).write(t, dir)
+
+	r, err := newTLSReloader(certPath, keyPath, "")
+	assert.NoError(err)
+
+	srv := helperServeTLS(t, r)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	servedName := func() string {
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatalf("dialing: %v", err)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	assert.Equal("first", servedName())
+
+	// A renewed certificate is served once reloaded
+	sig := make(chan os.Signal)
+	defer close(sig)
+	go r.reloadOn(sig)
+
+	helperNewCert(t, "second", ca).write(t, dir)
+	sig <- os.Interrupt
+
+	assert.Eventually(func() bool {
+		return servedName() == "second"
+	}, time.Second, 10*time.Millisecond)
+
+	// A broken certificate is rejected, keeping the current one
+	assert.NoError(ioutil.WriteFile(certPath, []byte("not a certificate"), 0o600))
+	assert.Error(r.reload())
+	assert.Equal("second", servedName())
+}
+
+func TestTLSReloader_ClientCA(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	ca := helperNewCert(t, "ca", nil)
+	certPath, keyPath := helperNewCert(t, "server", ca).write(t, dir)
+
+	caDir := t.TempDir()
+	caPath, _ := ca.write(t, caDir)
+
+	r, err := newTLSReloader(certPath, keyPath, caPath)
+	assert.NoError(err)
+
+	srv := helperServeTLS(t, r)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(certs ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+
+		return client.Get(srv.URL + "/topics")
+	}
+
+	// Clients without a certificate are refused
+	_, err = get()
+	assert.Error(err)
+
+	// As are those with a certificate from another CA
+	other := helperNewCert(t, "other", nil)
+	_, err = get(helperNewCert(t, "client", other).tlsKeyPair())
+	assert.Error(err)
+
+	res, err := get(helperNewCert(t, "client", ca).tlsKeyPair())
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+}
+
+func TestNewTLSReloader_Invalid(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	certPath, keyPath := helperNewCert(t, "server", nil).write(t, dir)
+
+	_, err := newTLSReloader(certPath, keyPath+".missing", "")
+	assert.Error(err)
+
+	_, err = newTLSReloader(certPath, keyPath, keyPath)
+	assert.Error(err)
+}
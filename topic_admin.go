@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// topicKeySuffix matches what follows "<topic>-" in the keys holding the
+// messages, bodies, positions, history and log of a topic.
+var topicKeySuffix = regexp.MustCompile(`^(\d+|head|tail|ack-\d+|ack-head|meta-\d+|ack-meta-\d+|body-\d+-\d+|history-\d+|history-head|history-tail|log-\d+|log-head|log-tail)$`)
+
+// topicDetail describes the current state of a single topic.
+type topicDetail struct {
+	topicStats
+
+	// OldestAge is how long the message at the head of the topic has been
+	// waiting, zero if the topic is empty.
+	OldestAge time.Duration `json:"oldest_age_ns"`
+}
+
+type purgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// DeleteTopic deletes every message of the topic, whether waiting or awaiting
+// acknowledgement, along with its history, replay log and config.
+func (s *store) DeleteTopic(topic string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	batch := new(leveldb.Batch)
+
+	prefix := topic + "-"
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		if topicKeySuffix.MatchString(strings.TrimPrefix(string(iter.Key()), prefix)) {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+	}
+	iter.Release()
+
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterating topic keys: %v", err)
+	}
+
+	// Compaction indexes are keyed by the length of the topic, so don't
+	// overlap those of other topics
+	for _, prefix := range [][]byte{pendingKey(topic, ""), outstandingKey(topic, "")} {
+		iter := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+
+		if err := iter.Error(); err != nil {
+			return fmt.Errorf("iterating key indexes: %v", err)
+		}
+	}
+
+	batch.Delete([]byte(fmt.Sprintf(seqKeyFmt, topic)))
+	batch.Delete([]byte(fmt.Sprintf(topicConfigKeyFmt, topic)))
+
+	if err := s.db.Write(batch, nil); err != nil {
+		return fmt.Errorf("deleting topic: %v", err)
+	}
+
+	s.cache.drop(topic)
+
+	return s.written()
+}
+
+// TopicStats returns the stats of the topic, along with the age of its oldest
+// waiting message.
+func (b *broker) TopicStats(topic string) (topicDetail, error) {
+	pending, err := b.store.Len(topic)
+	if err != nil {
+		return topicDetail{}, fmt.Errorf("getting length of topic %s: %v", topic, err)
+	}
+
+	detail := topicDetail{topicStats: topicStats{
+		Topic:       topic,
+		Pending:     pending,
+		Subscribers: b.subscribers(topic),
+	}}
+
+	head, err := b.store.Peek(topic, 1)
+	if err != nil {
+		return topicDetail{}, fmt.Errorf("peeking topic %s: %v", topic, err)
+	}
+
+	if len(head) > 0 {
+		detail.OldestAge = b.now().Sub(head[0].meta.PublishedAt)
+	}
+
+	return detail, nil
+}
+
+// PurgeTopic discards every message waiting on the topic, returning the number
+// discarded. Messages awaiting acknowledgement are kept, to be resolved by
+// their consumers.
+func (b *broker) PurgeTopic(topic string) (int, error) {
+	n, err := b.store.Len(topic)
+	if err != nil {
+		return 0, fmt.Errorf("getting length of topic %s: %v", topic, err)
+	}
+
+	purged, err := b.store.Shed(topic, n)
+	if err != nil {
+		return 0, fmt.Errorf("purging topic %s: %v", topic, err)
+	}
+
+	b.checkBacklog(topic)
+
+	return purged, nil
+}
+
+// DeleteTopic deletes the topic and everything stored for it, including its
+// config. A topic with subscribers is not deleted, returning errTopicInUse, as
+// they may hold messages awaiting acknowledgement.
+func (b *broker) DeleteTopic(topic string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.consumers[topic]) > 0 {
+		return errTopicInUse
+	}
+
+	if err := b.store.DeleteTopic(topic); err != nil {
+		return err
+	}
+
+	delete(b.configs, topic)
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestGetTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBroker(&store{db: db}, withClock(func() time.Time { return now }))
+	srv := newServer(b)
+
+	for _, val := range []string{"test_value_1", "test_value_2"} {
+		_, err := b.Publish(defaultTopic, []byte(val), messageMeta{})
+		assert.NoError(err)
+	}
+
+	b.Subscribe(defaultTopic)
+	now = now.Add(time.Minute)
+
+	rec := NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/topics/"+defaultTopic, nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var got topicDetail
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(topicDetail{
+		topicStats: topicStats{Topic: defaultTopic, Pending: 2, Subscribers: 1},
+		OldestAge:  time.Minute,
+	}, got)
+}
+
+func TestPurgeTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	srv := newServer(b)
+
+	for _, val := range []string{"test_value_1", "test_value_2", "test_value_3"} {
+		_, err := b.Publish(defaultTopic, []byte(val), messageMeta{})
+		assert.NoError(err)
+	}
+
+	c := b.Subscribe(defaultTopic)
+	_, err := c.Next(context.Background())
+	assert.NoError(err)
+
+	rec := NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/topics/"+defaultTopic+"/purge", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var res purgeResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(2, res.Purged)
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Zero(n)
+
+	// The outstanding message is left to its consumer
+	assert.NoError(c.Nack())
+
+	val, err := c.TryNext(context.Background())
+	assert.NoError(err)
+	assert.Equal(value("test_value_1"), val)
+}
+
+func TestDeleteTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	srv := newServer(b)
+
+	assert.NoError(b.SetTopicConfig("orders", topicConfig{Compact: true, MaxLength: 10}))
+	for _, topic := range []string{"orders", "orders-eu"} {
+		_, err := b.Publish(topic, []byte("test_value"), messageMeta{Key: "test_key"})
+		assert.NoError(err)
+		_, err = b.Publish(topic, []byte("test_value"), messageMeta{})
+		assert.NoError(err)
+	}
+
+	// A topic with subscribers isn't deleted
+	c := b.Subscribe("orders")
+	_, err := c.Next(context.Background())
+	assert.NoError(err)
+
+	del := func() int {
+		rec := NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/topics/orders", nil))
+		return rec.Code
+	}
+
+	assert.Equal(http.StatusConflict, del())
+
+	b.Unsubscribe(c)
+	assert.Equal(http.StatusNoContent, del())
+
+	stats, err := b.Topics(topicFilter{})
+	assert.NoError(err)
+	assert.Equal([]topicStats{{Topic: "orders-eu", Pending: 2}}, stats)
+	assert.Equal(topicConfig{}, b.TopicConfig("orders"))
+
+	_, err = b.store.GetTopicConfig("orders")
+	assert.Equal(errTopicConfigNotExist, err)
+
+	// The topic starts afresh once published to again
+	_, err = b.Publish("orders", []byte("test_value"), messageMeta{Key: "test_key"})
+	assert.NoError(err)
+
+	msgs, err := b.store.Peek("orders", 10)
+	assert.NoError(err)
+	assert.Len(msgs, 1)
+	assert.Zero(msgs[0].meta.Offset)
+}
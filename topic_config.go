@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// reservedTopicPrefix begins the keys the store keeps alongside messages, such
+// as topic configs, and the topics used internally. The keys of messages on a
+// topic with the prefix could otherwise collide with them.
+const reservedTopicPrefix = "miniqueue-"
+
+// reservedTopic reports whether the topic may not be published or subscribed
+// to by clients, as its name is reserved.
+func reservedTopic(topic string) bool {
+	return strings.HasPrefix(topic, reservedTopicPrefix)
+}
+
+// topicConfig holds the settings of a single topic. It is persisted in the
+// store so that it survives restarts.
+type topicConfig struct {
+	// MaxLength is the maximum number of messages waiting to be consumed on
+	// the topic. Publishing to a full topic is rejected. Zero is unlimited.
+	MaxLength int `json:"max_length"`
+
+	// ContentType restricts publishes to the topic to the given media type.
+	// Empty accepts any content type.
+	ContentType string `json:"content_type,omitempty"`
+
+	// RequireSubscriber drops messages published while the topic has no
+	// subscribers, rather than storing them for later.
+	RequireSubscriber bool `json:"require_subscriber,omitempty"`
+
+	// Compact keeps only the latest message published with each key waiting
+	// on the topic. A message published with a key replaces the waiting
+	// message with the same key.
+	Compact bool `json:"compact,omitempty"`
+
+	// WarnDepth and CriticalDepth are the number of messages waiting to be
+	// consumed at which a warning, or critical, alert is raised. The alert is
+	// cleared once the depth drops back below. Zero disables the alert.
+	WarnDepth     int `json:"warn_depth,omitempty"`
+	CriticalDepth int `json:"critical_depth,omitempty"`
+
+	// Headers are merged into the headers of each message published to the
+	// topic. A header set by the producer takes precedence over the default.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// MaxInFlight is the maximum number of consumers of the topic which may
+	// hold outstanding messages at once. Zero falls back to the broker's
+	// limit.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// TTL is how long messages published to the topic wait to be consumed
+	// before they expire, as a duration e.g. 1h. A message published with a
+	// shorter TTL, or an earlier deadline, keeps it. Empty never expires
+	// messages.
+	TTL string `json:"ttl,omitempty"`
+
+	// BackoffBase and BackoffMax override the broker's backoff for messages
+	// NACKed on the topic, as durations e.g. 1s. The redelivery delay starts
+	// at BackoffBase, doubling with each delivery up to BackoffMax, which is
+	// unbounded if empty. Empty falls back to the broker's backoff.
+	BackoffBase string `json:"backoff_base,omitempty"`
+	BackoffMax  string `json:"backoff_max,omitempty"`
+
+	// Partitions spreads the messages published to the topic across the
+	// number of partitions by their partition key. Messages with the same key
+	// are delivered in order, one at a time, while those of different keys
+	// are consumed in parallel. Zero doesn't partition the topic.
+	Partitions int `json:"partitions,omitempty"`
+}
+
+// validate returns an error describing the first invalid setting.
+func (c topicConfig) validate() error {
+	if c.MaxLength < 0 {
+		return errors.New("max_length must not be negative")
+	}
+
+	if c.MaxInFlight < 0 {
+		return errors.New("max_in_flight must not be negative")
+	}
+
+	if c.Partitions < 0 {
+		return errors.New("partitions must not be negative")
+	}
+
+	if c.WarnDepth < 0 || c.CriticalDepth < 0 {
+		return errors.New("warn_depth and critical_depth must not be negative")
+	}
+
+	if c.WarnDepth > 0 && c.CriticalDepth > 0 && c.CriticalDepth < c.WarnDepth {
+		return errors.New("critical_depth must not be less than warn_depth")
+	}
+
+	for name := range c.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return errors.New("headers must have valid names")
+		}
+	}
+
+	if c.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(c.ContentType); err != nil {
+			return errors.New("content_type must be a valid media type")
+		}
+	}
+
+	if c.TTL != "" {
+		if ttl, err := time.ParseDuration(c.TTL); err != nil || ttl <= 0 {
+			return errors.New("ttl must be a positive duration")
+		}
+	}
+
+	if c.BackoffBase != "" {
+		if base, err := time.ParseDuration(c.BackoffBase); err != nil || base <= 0 {
+			return errors.New("backoff_base must be a positive duration")
+		}
+	}
+
+	if c.BackoffMax != "" {
+		max, err := time.ParseDuration(c.BackoffMax)
+		if err != nil || max <= 0 {
+			return errors.New("backoff_max must be a positive duration")
+		}
+
+		if c.BackoffBase == "" {
+			return errors.New("backoff_max requires backoff_base")
+		}
+
+		if base, _ := time.ParseDuration(c.BackoffBase); max < base {
+			return errors.New("backoff_max must not be less than backoff_base")
+		}
+	}
+
+	return nil
+}
+
+// ttl returns how long messages wait on the topic before they expire, zero if
+// they never do.
+func (c topicConfig) ttl() time.Duration {
+	ttl, _ := time.ParseDuration(c.TTL)
+	return ttl
+}
+
+// backoff returns the backoff of messages NACKed on the topic, keeping the
+// jitter of the broker's, or the broker's itself if the topic sets none.
+func (c topicConfig) backoff(broker backoff) backoff {
+	base, _ := time.ParseDuration(c.BackoffBase)
+	if base <= 0 {
+		return broker
+	}
+
+	max, _ := time.ParseDuration(c.BackoffMax)
+
+	return backoff{base: base, max: max, jitter: broker.jitter}
+}
+
+// acceptsContentType reports whether a message published with the content type
+// may be published to the topic. Parameters, such as charset, are ignored.
+func (c topicConfig) acceptsContentType(contentType string) bool {
+	if c.ContentType == "" {
+		return true
+	}
+
+	want, _, err := mime.ParseMediaType(c.ContentType)
+	if err != nil {
+		return false
+	}
+
+	got, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return want == got
+}
+
+// mergeHeaders returns the headers of a message published to the topic, with
+// the default headers of the topic added. Headers set by the producer are
+// kept, even where the topic has a default for them.
+func (c topicConfig) mergeHeaders(h http.Header) http.Header {
+	if len(c.Headers) == 0 {
+		return h
+	}
+
+	merged := h.Clone()
+	if merged == nil {
+		merged = http.Header{}
+	}
+
+	for name, val := range c.Headers {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := merged[name]; ok {
+			continue
+		}
+
+		merged.Set(name, val)
+	}
+
+	return merged
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// listTopics lists the stats of each topic, filtered by the query.
+func listTopics(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "list_topics").
+			Logger()
+
+		filter, err := parseTopicFilter(r.URL.Query())
+		if err != nil {
+			log.Debug().Err(err).Msg("invalid topic filter")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), err.Error())
+
+			return
+		}
+
+		stats, err := broker.Topics(filter)
+		if err != nil {
+			log.Err(err).Msg("failed to list topics")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errListTopics.Error())
+
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// getTopic returns the stats of a single topic, including the age of its
+// oldest waiting message.
+func getTopic(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "get_topic").
+			Logger()
+
+		topic, ok := mux.Vars(r)[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		stats, err := broker.TopicStats(topic)
+		if err != nil {
+			log.Err(err).Msg("failed to get topic stats")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errTopicStats.Error())
+
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// purgeTopic discards the messages waiting on a topic.
+func purgeTopic(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "purge_topic").
+			Logger()
+
+		topic, ok := mux.Vars(r)[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		n, err := broker.PurgeTopic(topic)
+		if err != nil {
+			log.Err(err).Msg("failed to purge topic")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errPurge.Error())
+
+			return
+		}
+
+		log.Info().
+			Int("count", n).
+			Msg("purged topic")
+
+		if err := json.NewEncoder(w).Encode(purgeResponse{Purged: n}); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// deleteTopic deletes a topic which has no subscribers, along with everything
+// stored for it.
+func deleteTopic(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "delete_topic").
+			Logger()
+
+		topic, ok := mux.Vars(r)[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		err := broker.DeleteTopic(topic)
+		if errors.Is(err, errTopicInUse) {
+			log.Debug().Msg("topic has subscribers, not deleted")
+
+			w.WriteHeader(http.StatusConflict)
+			respondError(log, json.NewEncoder(w), errTopicInUse.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to delete topic")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errDeleteTopic.Error())
+
+			return
+		}
+
+		log.Info().Msg("deleted topic")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// rejectReservedTopic responds 400 if the topic is reserved, reporting whether
+// it was.
+func rejectReservedTopic(log zerolog.Logger, w http.ResponseWriter, topic string) bool {
+	if !reservedTopic(topic) {
+		return false
+	}
+
+	log.Debug().Str("topic", topic).Msg("reserved topic name")
+
+	w.WriteHeader(http.StatusBadRequest)
+	respondError(log, json.NewEncoder(w), errReservedTopic.Error())
+
+	return true
+}
+
+func getTopicConfig(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "get_topic_config").
+			Logger()
+
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		if err := json.NewEncoder(w).Encode(broker.TopicConfig(topic)); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+func putTopicConfig(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "put_topic_config").
+			Logger()
+
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		defer r.Body.Close()
+
+		var cfg topicConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			log.Debug().Err(err).Msg("failed decoding topic config")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errDecodingConfig.Error())
+
+			return
+		}
+
+		if err := cfg.validate(); err != nil {
+			log.Debug().Err(err).Msg("invalid topic config")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), err.Error())
+
+			return
+		}
+
+		if err := broker.SetTopicConfig(topic, cfg); err != nil {
+			log.Err(err).Msg("failed to set topic config")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errSetConfig.Error())
+
+			return
+		}
+
+		log.Info().Msg("updated topic config")
+
+		if err := json.NewEncoder(w).Encode(cfg); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+func resetDeliveries(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "reset_deliveries").
+			Logger()
+
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		n, err := broker.ResetDeliveries(topic)
+		if err != nil {
+			log.Err(err).Msg("failed to reset delivery counts")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errResetDeliveries.Error())
+
+			return
+		}
+
+		log.Info().
+			Int("count", n).
+			Msg("reset delivery counts")
+
+		if err := json.NewEncoder(w).Encode(resetDeliveriesResponse{Reset: n}); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+func getHistory(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "get_history").
+			Logger()
+
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		entries, err := broker.History(topic)
+		if err != nil {
+			log.Err(err).Msg("failed to get topic history")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errHistory.Error())
+
+			return
+		}
+
+		respondHistory(log, json.NewEncoder(w), entries)
+	}
+}
+
+// getPeek returns previews of the messages waiting to be consumed on the topic,
+// in the order they will be consumed, without consuming them.
+func getPeek(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "get_peek").
+			Logger()
+
+		vars := mux.Vars(r)
+		topic, ok := vars[topicVarKey]
+		if !ok {
+			log.Debug().Msg("invalid topic in path")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+			return
+		}
+
+		log = log.With().
+			Str("topic", topic).
+			Logger()
+
+		msgs, err := broker.Peek(topic, peekAllLimit)
+		if err != nil {
+			log.Err(err).Msg("failed to peek topic")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errPeekTopic.Error())
+
+			return
+		}
+
+		respondPeek(log, json.NewEncoder(w), msgs)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestTopicConfigPersistedAcrossRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	b := newBroker(s)
+	assert.NoError(b.LoadTopicConfigs())
+	srv := newServer(b)
+
+	// Set the config
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/topics/%s/config", defaultTopic), strings.NewReader(`{"max_length": 1}`))
+	srv.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	// Restart the broker on the same store
+	assert.NoError(s.Close())
+	s = newStore(tmpDBPath)
+	t.Cleanup(func() { _ = s.Close() })
+
+	b = newBroker(s)
+	assert.NoError(b.LoadTopicConfigs())
+	srv = newServer(b)
+
+	rec = NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/topics/%s/config", defaultTopic), nil)
+	srv.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var cfg topicConfig
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&cfg))
+	assert.Equal(topicConfig{MaxLength: 1}, cfg)
+
+	// Expect the max length to be applied
+	rec = NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("test_value_1"))
+	srv.ServeHTTP(rec, req)
+	assert.Equal(http.StatusCreated, rec.Code)
+
+	rec = NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader("test_value_2"))
+	srv.ServeHTTP(rec, req)
+	assert.Equal(http.StatusInsufficientStorage, rec.Code)
+}
+
+func TestTopicConfigDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	srv := newServer(newBroker(s))
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/topics/%s/config", defaultTopic), nil)
+	srv.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var cfg topicConfig
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&cfg))
+	assert.Equal(topicConfig{}, cfg)
+}
+
+func TestReservedTopic(t *testing.T) {
+	const reserved = reservedTopicPrefix + "config"
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+	}{
+		{name: "publish", target: "/publish/" + reserved, body: "test_value"},
+		{name: "publish by query", target: "/publish?topic=" + reserved, body: "test_value"},
+		{name: "subscribe", target: "/subscribe/" + reserved},
+		{name: "batch", target: "/publish/" + reserved + "/batch", body: "test_value"},
+		{name: "import", target: "/import/" + reserved},
+		{name: "transaction", target: "/tx", body: fmt.Sprintf(`{"messages": [{"topic": %q, "msg": "test_value"}]}`, reserved)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			s := newStore(tmpDBPath)
+			t.Cleanup(s.Destroy)
+
+			srv := newServer(newBroker(s))
+
+			rec := NewRecorder()
+			srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+			assert.Equal(http.StatusBadRequest, rec.Code)
+
+			var out subResponse
+			assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+			assert.Equal(errReservedTopic.Error(), out.Error)
+
+			// Nothing is stored which could be mistaken for a topic config
+			_, err := s.TopicConfigs()
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestTopicConfigInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	srv := newServer(newBroker(s))
+
+	for _, body := range []string{`{"max_length": -1}`, `not json`} {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/topics/%s/config", defaultTopic), strings.NewReader(body))
+		srv.ServeHTTP(rec, req)
+		assert.Equal(http.StatusBadRequest, rec.Code, body)
+
+		var out subResponse
+		assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+		assert.NotEmpty(out.Error)
+	}
+
+	// The invalid config should not have been stored
+	_, err := s.GetTopicConfig(defaultTopic)
+	assert.Equal(errTopicConfigNotExist, err)
+}
+
+func TestPublishContentTypeRestricted(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore(tmpDBPath)
+	t.Cleanup(s.Destroy)
+
+	b := newBroker(s)
+	assert.NoError(b.SetTopicConfig(defaultTopic, topicConfig{ContentType: "application/json"}))
+
+	srv := newServer(b)
+
+	tests := []struct {
+		contentType string
+		code        int
+	}{
+		{"application/json", http.StatusCreated},
+		{"application/json; charset=utf-8", http.StatusCreated},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		rec := NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/publish/%s", defaultTopic), strings.NewReader(`{}`))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+
+		srv.ServeHTTP(rec, req)
+		assert.Equal(tt.code, rec.Code, tt.contentType)
+	}
+}
+
+func TestResetDeliveries(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db, cache: newHeadCache(10)}
+	b := newBroker(s)
+
+	_, err = b.Publish(defaultTopic, []byte("test_value_1"), messageMeta{})
+	assert.NoError(err)
+	_, err = b.Publish(defaultTopic, []byte("test_value_2"), messageMeta{})
+	assert.NoError(err)
+
+	// NACK the first message twice to bump its delivery count
+	c := b.Subscribe(defaultTopic)
+	for i := 0; i < 2; i++ {
+		_, err := c.Next(context.Background())
+		assert.NoError(err)
+		assert.NoError(c.Nack())
+	}
+
+	msgs, err := s.Peek(defaultTopic, 2)
+	assert.NoError(err)
+	assert.Equal(2, msgs[0].meta.Deliveries)
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/topics/%s/reset-deliveries", defaultTopic), nil)
+	newServer(b).ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var out resetDeliveriesResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+	assert.Equal(1, out.Reset)
+
+	msgs, err = s.Peek(defaultTopic, 2)
+	assert.NoError(err)
+	for _, m := range msgs {
+		assert.Zero(m.meta.Deliveries)
+	}
+
+	// The next delivery counts from zero
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.Equal(1, c.Meta().Deliveries)
+}
+
+func TestListTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	srv := newServer(b)
+
+	for _, topic := range []string{"orders.a", "orders.b", "users.a"} {
+		_, err := b.Publish(topic, []byte("test_value"), messageMeta{})
+		assert.NoError(err)
+	}
+
+	// Drain orders.b, leaving it with nothing pending
+	c := b.Subscribe("orders.b")
+	_, err = c.Next(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.Ack())
+
+	tests := []struct {
+		name  string
+		query string
+		want  []topicStats
+	}{
+		{
+			name: "all",
+			want: []topicStats{
+				{Topic: "orders.a", Pending: 1},
+				{Topic: "orders.b", Subscribers: 1},
+				{Topic: "users.a", Pending: 1},
+			},
+		},
+		{
+			name:  "prefix",
+			query: "?prefix=orders.",
+			want: []topicStats{
+				{Topic: "orders.a", Pending: 1},
+				{Topic: "orders.b", Subscribers: 1},
+			},
+		},
+		{
+			name:  "has pending",
+			query: "?hasPending=true",
+			want: []topicStats{
+				{Topic: "orders.a", Pending: 1},
+				{Topic: "users.a", Pending: 1},
+			},
+		},
+		{
+			name:  "prefix and has pending",
+			query: "?prefix=orders.&hasPending=true",
+			want: []topicStats{
+				{Topic: "orders.a", Pending: 1},
+			},
+		},
+		{
+			name:  "prefix and not has pending",
+			query: "?prefix=orders.&hasPending=false",
+			want: []topicStats{
+				{Topic: "orders.b", Subscribers: 1},
+			},
+		},
+		{
+			name:  "no match",
+			query: "?prefix=payments.",
+			want:  []topicStats{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/topics"+tt.query, nil)
+			srv.ServeHTTP(rec, req)
+			assert.Equal(http.StatusOK, rec.Code)
+
+			var got []topicStats
+			assert.NoError(json.NewDecoder(rec.Body).Decode(&got))
+			assert.Equal(tt.want, got)
+		})
+	}
+}
+
+func TestListTopics_InvalidFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	srv := newServer(newBroker(&store{db: db}))
+
+	rec := NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/topics?hasPending=maybe", nil)
+	srv.ServeHTTP(rec, req)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	var res subResponse
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal("hasPending must be a boolean", res.Error)
+}
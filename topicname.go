@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// topicQueryKey is the publish and subscribe query parameter naming the
+	// topic, for names which can't be given in the path, such as those
+	// containing a slash.
+	topicQueryKey = "topic"
+
+	// headerTopic is the publish and subscribe header naming the topic, as an
+	// alternative to topicQueryKey.
+	headerTopic = "X-MQ-Topic"
+)
+
+// resolveTopic allows the topic of a publish or subscribe to be named by the
+// topic query parameter or the X-MQ-Topic header, rather than the path. The
+// topic is set as the path variable of the request, so that the handlers
+// which follow read it from the path as usual.
+//
+// A topic may be named in any of the three places, but where it is named in
+// more than one, the names must match, otherwise the request is rejected with
+// 400. Empty names are ignored.
+func resolveTopic(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		var topic string
+		for _, name := range []string{vars[topicVarKey], r.URL.Query().Get(topicQueryKey), r.Header.Get(headerTopic)} {
+			if name == "" {
+				continue
+			}
+
+			if topic != "" && name != topic {
+				log := log.With().
+					Str("topic", topic).
+					Str("conflicting_topic", name).
+					Logger()
+
+				log.Debug().Msg("conflicting topic names")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errTopicConflict.Error())
+
+				return
+			}
+
+			topic = name
+		}
+
+		if topic == "" {
+			next(w, r)
+			return
+		}
+
+		withTopic := map[string]string{}
+		for k, v := range vars {
+			withTopic[k] = v
+		}
+		withTopic[topicVarKey] = topic
+
+		next(w, mux.SetURLVars(r, withTopic))
+	}
+}
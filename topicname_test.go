@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveTopic(t *testing.T) {
+	const slashed = "orders/eu-west"
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		topic  string
+	}{
+		{
+			name:   "path",
+			target: fmt.Sprintf("/publish/%s", defaultTopic),
+			topic:  defaultTopic,
+		},
+		{
+			name:   "query",
+			target: "/publish?topic=" + url.QueryEscape(slashed),
+			topic:  slashed,
+		},
+		{
+			name:   "header",
+			target: "/publish",
+			header: slashed,
+			topic:  slashed,
+		},
+		{
+			name:   "matching path and query",
+			target: fmt.Sprintf("/publish/%s?topic=%s", defaultTopic, defaultTopic),
+			topic:  defaultTopic,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			b := newBroker(helperNewMemStore(t))
+			srv := newServer(b)
+
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader("test_value"))
+			if tt.header != "" {
+				req.Header.Set(headerTopic, tt.header)
+			}
+
+			rec := NewRecorder()
+			srv.ServeHTTP(rec, req)
+			assert.Equal(http.StatusCreated, rec.Code)
+
+			msgs, err := b.Peek(tt.topic, 1)
+			assert.NoError(err)
+			if assert.Len(msgs, 1) {
+				assert.Equal(value("test_value"), msgs[0].val)
+			}
+		})
+	}
+}
+
+func TestResolveTopic_Conflict(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header string
+	}{
+		{
+			name:   "path and query",
+			target: fmt.Sprintf("/publish/%s?topic=other_topic", defaultTopic),
+		},
+		{
+			name:   "query and header",
+			target: fmt.Sprintf("/publish?topic=%s", defaultTopic),
+			header: "other_topic",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			b := newBroker(helperNewMemStore(t))
+			srv := newServer(b)
+
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader("test_value"))
+			if tt.header != "" {
+				req.Header.Set(headerTopic, tt.header)
+			}
+
+			rec := NewRecorder()
+			srv.ServeHTTP(rec, req)
+			assert.Equal(http.StatusBadRequest, rec.Code)
+
+			var out subResponse
+			assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+			assert.Equal(errTopicConflict.Error(), out.Error)
+
+			topics, err := b.store.Topics()
+			assert.NoError(err)
+			assert.Empty(topics)
+		})
+	}
+}
+
+func TestResolveTopic_Subscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	const slashed = "orders/eu-west"
+
+	b := newBroker(helperNewMemStore(t))
+
+	srv := httptest.NewUnstartedServer(newServer(b))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	_, err := b.Publish(slashed, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/subscribe?topic="+url.QueryEscape(slashed), helperMustEncodeString(CmdInit))
+	assert.NoError(err)
+
+	res, err := srv.Client().Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+
+	var out subResponse
+	assert.NoError(json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal("test_value", out.Msg)
+
+	// A topic named nowhere is rejected
+	rec := NewRecorder()
+	newServer(b).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/subscribe", nil))
+	assert.Equal(http.StatusBadRequest, rec.Code)
+}
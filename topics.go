@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	prefixQueryKey     = "prefix"
+	hasPendingQueryKey = "hasPending"
+)
+
+// topicStats describes the current state of a topic.
+type topicStats struct {
+	Topic       string `json:"topic"`
+	Pending     int    `json:"pending"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// topicFilter selects topics from the topic listing. Every set filter must
+// match for a topic to be listed.
+type topicFilter struct {
+	// Prefix matches topics whose name starts with it.
+	Prefix string
+	// HasPending, if set, matches topics which do or do not have messages
+	// waiting to be consumed.
+	HasPending *bool
+}
+
+// parseTopicFilter parses the filter of a topic listing from its query.
+func parseTopicFilter(q url.Values) (topicFilter, error) {
+	f := topicFilter{Prefix: q.Get(prefixQueryKey)}
+
+	if v := q.Get(hasPendingQueryKey); v != "" {
+		hasPending, err := strconv.ParseBool(v)
+		if err != nil {
+			return topicFilter{}, fmt.Errorf("%s must be a boolean", hasPendingQueryKey)
+		}
+
+		f.HasPending = &hasPending
+	}
+
+	return f, nil
+}
+
+func (f topicFilter) matchName(topic string) bool {
+	return strings.HasPrefix(topic, f.Prefix)
+}
+
+func (f topicFilter) matchStats(stats topicStats) bool {
+	return f.HasPending == nil || *f.HasPending == (stats.Pending > 0)
+}
+
+// Topics returns the stats of each topic in the store matching the filter,
+// sorted by topic name.
+func (b *broker) Topics(filter topicFilter) ([]topicStats, error) {
+	topics, err := b.store.Topics()
+	if err != nil {
+		return nil, fmt.Errorf("listing topics: %v", err)
+	}
+
+	sort.Strings(topics)
+
+	stats := []topicStats{}
+	for _, topic := range topics {
+		if !filter.matchName(topic) {
+			continue
+		}
+
+		pending, err := b.store.Len(topic)
+		if err != nil {
+			return nil, fmt.Errorf("getting length of topic %s: %v", topic, err)
+		}
+
+		s := topicStats{
+			Topic:       topic,
+			Pending:     pending,
+			Subscribers: b.subscribers(topic),
+		}
+
+		if filter.matchStats(s) {
+			stats = append(stats, s)
+		}
+	}
+
+	return stats, nil
+}
+
+// subscribers returns the number of consumers subscribed to the topic.
+func (b *broker) subscribers(topic string) int {
+	b.RLock()
+	defer b.RUnlock()
+
+	return len(b.consumers[topic])
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// txMessage is a message published as part of a transaction.
+type txMessage struct {
+	Topic       string `json:"topic"`
+	Msg         string `json:"msg"`
+	ContentType string `json:"content_type,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Priority    int    `json:"priority,omitempty"`
+}
+
+type txRequest struct {
+	Messages []txMessage `json:"messages"`
+}
+
+type txResponse struct {
+	IDs []string `json:"ids"`
+}
+
+// PublishTx publishes each message to its topic atomically, such that either
+// every message is published or none are. The IDs of the messages are returned
+// in the order given.
+func (b *broker) PublishTx(msgs []record) ([]string, error) {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	var records []record
+	counts := map[string]int{}
+	ids := make([]string, 0, len(msgs))
+
+	for _, msg := range msgs {
+		if err := b.checkSkew(msg.meta); err != nil {
+			return nil, err
+		}
+
+		meta, topics, err := b.prepare(msg.topic, msg.value, msg.meta)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range topics {
+			records = append(records, record{topic: t, value: msg.value, meta: b.topicMeta(t, meta)})
+			counts[t]++
+		}
+
+		ids = append(ids, meta.ID)
+	}
+
+	if err := b.checkLengths(counts); err != nil {
+		return nil, err
+	}
+
+	err := b.withSpace(func() error {
+		return b.store.InsertAll(records)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range records {
+		b.hooks.publish(r.topic, r.meta.ID)
+		b.throughput.published(r.topic)
+		b.taps.emit(r.topic, tapPublish, r.value, r.meta, "", r.meta.PublishedAt)
+		b.NotifyConsumer(r.topic, eventTypePublish)
+	}
+
+	for t := range counts {
+		b.checkBacklog(t)
+	}
+
+	return ids, nil
+}
+
+// publishTx publishes the messages in the request body to their topics in a
+// single transaction. If any message can't be published, none are.
+func publishTx(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "publish_tx").
+			Logger()
+
+		var req txRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Debug().Err(err).Msg("failed to decode transaction")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errDecodingTx.Error())
+
+			return
+		}
+		defer r.Body.Close()
+
+		if len(req.Messages) == 0 {
+			log.Debug().Msg("empty transaction")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), errEmptyTx.Error())
+
+			return
+		}
+
+		msgs := make([]record, 0, len(req.Messages))
+		for _, m := range req.Messages {
+			// Topics can't contain a slash, as they can't be published to
+			if m.Topic == "" || strings.Contains(m.Topic, "/") {
+				log.Debug().Str("topic", m.Topic).Msg("invalid topic in transaction")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidTopicValue.Error())
+
+				return
+			}
+
+			if rejectReservedTopic(log, w, m.Topic) {
+				return
+			}
+
+			if !validPriority(m.Priority) {
+				log.Debug().Int("priority", m.Priority).Msg("invalid priority in transaction")
+
+				w.WriteHeader(http.StatusBadRequest)
+				respondError(log, json.NewEncoder(w), errInvalidPriority.Error())
+
+				return
+			}
+
+			msgs = append(msgs, record{
+				topic: m.Topic,
+				value: value(m.Msg),
+				meta: messageMeta{
+					ContentType: m.ContentType,
+					Key:         m.Key,
+					Priority:    m.Priority,
+					Header:      r.Header,
+				},
+			})
+		}
+
+		log.Info().Int("count", len(msgs)).Msg("publishing transaction")
+
+		ids, err := broker.PublishTx(msgs)
+		if errors.Is(err, errUnsupportedContentType) {
+			log.Debug().Msg("content type not accepted by topic")
+
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			respondError(log, json.NewEncoder(w), errContentType.Error())
+
+			return
+		}
+		if errors.Is(err, errNoSubscribers) {
+			log.Debug().Msg("topic has no subscribers, dropped transaction")
+
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			respondError(log, json.NewEncoder(w), errNoSubscribers.Error())
+
+			return
+		}
+		if errors.Is(err, errNoRoute) {
+			log.Debug().Msg("message not routed to any topic")
+
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			respondError(log, json.NewEncoder(w), errNoRoute.Error())
+
+			return
+		}
+		if errors.Is(err, errInvalidTimestamp) || errors.Is(err, errTimestampSkew) {
+			log.Debug().Err(err).Msg("producer timestamp rejected")
+
+			w.WriteHeader(http.StatusBadRequest)
+			respondError(log, json.NewEncoder(w), err.Error())
+
+			return
+		}
+		if errors.Is(err, errTopicFull) {
+			log.Warn().Msg("topic is full")
+
+			w.WriteHeader(http.StatusInsufficientStorage)
+			respondError(log, json.NewEncoder(w), errTopicFullPublish.Error())
+
+			return
+		}
+		if errors.Is(err, errStoreFull) {
+			log.Error().Msg("store is out of space")
+
+			w.WriteHeader(http.StatusInsufficientStorage)
+			respondError(log, json.NewEncoder(w), errStoreFullPublish.Error())
+
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to publish transaction")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errPublish.Error())
+
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		respondPublishedTx(log, json.NewEncoder(w), ids)
+
+		log.Debug().
+			Strs("msg_ids", ids).
+			Msg("successfully published transaction")
+	}
+}
+
+func respondPublishedTx(log zerolog.Logger, e *json.Encoder, ids []string) {
+	if err := e.Encode(txResponse{IDs: ids}); err != nil {
+		log.Err(err).Msg("failed to write response to client")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestPublishTx(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	ids, err := b.PublishTx([]record{
+		{topic: "orders", value: value("order_1")},
+		{topic: "invoices", value: value("invoice_1")},
+		{topic: "orders", value: value("order_2")},
+	})
+	assert.NoError(err)
+	assert.Len(ids, 3)
+
+	orders, err := b.store.Peek("orders", 10)
+	assert.NoError(err)
+	assert.Len(orders, 2)
+	assert.Equal(value("order_1"), orders[0].val)
+	assert.Equal(ids[0], orders[0].meta.ID)
+	assert.Equal(value("order_2"), orders[1].val)
+	assert.Equal(ids[2], orders[1].meta.ID)
+
+	invoices, err := b.store.Peek("invoices", 10)
+	assert.NoError(err)
+	assert.Len(invoices, 1)
+	assert.Equal(value("invoice_1"), invoices[0].val)
+	assert.Equal(ids[1], invoices[0].meta.ID)
+}
+
+func TestPublishTxRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	assert.NoError(b.SetTopicConfig("invoices", topicConfig{MaxLength: 1}))
+
+	_, err = b.Publish("invoices", []byte("invoice_1"), messageMeta{})
+	assert.NoError(err)
+
+	// The full topic rejects the whole transaction
+	_, err = b.PublishTx([]record{
+		{topic: "orders", value: value("order_1")},
+		{topic: "invoices", value: value("invoice_2")},
+	})
+	assert.Equal(errTopicFull, err)
+
+	n, err := b.store.Len("orders")
+	assert.NoError(err)
+	assert.Zero(n)
+
+	n, err = b.store.Len("invoices")
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestInsertAllRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	s := &store{db: db}
+	assert.NoError(s.Insert("orders", value("order_1"), messageMeta{}))
+
+	// A corrupt tail position fails the insert into the second topic
+	assert.NoError(db.Put([]byte(fmt.Sprintf(tailPosKeyFmt, "broken")), nil, nil))
+
+	err = s.InsertAll([]record{
+		{topic: "orders", value: value("order_2")},
+		{topic: "broken", value: value("broken_1")},
+	})
+	assert.Error(err)
+
+	// The insert which succeeded before the failure was rolled back
+	n, err := s.Len("orders")
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	msgs, err := s.Peek("orders", 10)
+	assert.NoError(err)
+	assert.Len(msgs, 1)
+	assert.Equal(value("order_1"), msgs[0].val)
+
+	// Including from the cache
+	val, _, _, err := s.GetNext("orders")
+	assert.NoError(err)
+	assert.Equal(value("order_1"), val)
+
+	_, _, _, err = s.GetNext("orders")
+	assert.Equal(errNoMessages, err)
+}
+
+func TestPublishTxHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	assert.NoError(b.SetTopicConfig("invoices", topicConfig{ContentType: "application/json"}))
+
+	srv := newServer(b)
+
+	t.Run("publishes every message", func(t *testing.T) {
+		body, err := json.Marshal(txRequest{Messages: []txMessage{
+			{Topic: "orders", Msg: "order_1"},
+			{Topic: "invoices", Msg: `{"id":1}`, ContentType: "application/json"},
+		}})
+		assert.NoError(err)
+
+		rec := NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tx", bytes.NewReader(body)))
+		assert.Equal(http.StatusCreated, rec.Code)
+
+		var res txResponse
+		assert.NoError(json.NewDecoder(rec.Body).Decode(&res))
+		assert.Len(res.IDs, 2)
+
+		for _, topic := range []string{"orders", "invoices"} {
+			n, err := b.store.Len(topic)
+			assert.NoError(err)
+			assert.Equal(1, n, topic)
+		}
+	})
+
+	t.Run("publishes nothing if a message is rejected", func(t *testing.T) {
+		body, err := json.Marshal(txRequest{Messages: []txMessage{
+			{Topic: "orders", Msg: "order_2"},
+			{Topic: "invoices", Msg: "not json", ContentType: "text/plain"},
+		}})
+		assert.NoError(err)
+
+		rec := NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tx", bytes.NewReader(body)))
+		assert.Equal(http.StatusUnsupportedMediaType, rec.Code)
+
+		for _, topic := range []string{"orders", "invoices"} {
+			n, err := b.store.Len(topic)
+			assert.NoError(err)
+			assert.Equal(1, n, topic)
+		}
+	})
+
+	t.Run("rejects an empty transaction", func(t *testing.T) {
+		rec := NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tx", bytes.NewReader([]byte(`{"messages":[]}`))))
+		assert.Equal(http.StatusBadRequest, rec.Code)
+	})
+}
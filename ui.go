@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// uiPath serves the dashboard.
+	uiPath = "/ui"
+
+	// uiStatsPath serves the state of every topic shown on the dashboard.
+	uiStatsPath = uiPath + "/stats"
+)
+
+// uiTopic is the state of a topic shown on the dashboard.
+type uiTopic struct {
+	topicStats
+	throughput
+
+	Consumers []string `json:"consumers"`
+}
+
+// getUIStats returns the state of every topic, along with its throughput and
+// the IDs of its consumers, in a single request for the dashboard to poll.
+func getUIStats(broker brokerer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "get_ui_stats").
+			Logger()
+
+		stats, err := broker.Topics(topicFilter{})
+		if err != nil {
+			log.Err(err).Msg("failed to list topics")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			respondError(log, json.NewEncoder(w), errListTopics.Error())
+
+			return
+		}
+
+		res := make([]uiTopic, 0, len(stats))
+		for _, s := range stats {
+			res = append(res, uiTopic{
+				topicStats: s,
+				throughput: broker.Throughput(s.Topic),
+				Consumers:  broker.ConsumerIDs(s.Topic),
+			})
+		}
+
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// serveUI serves the dashboard, a single page which polls uiStatsPath and
+// calls the existing endpoints to peek at topics and requeue dead letters.
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if _, err := io.WriteString(w, uiPage); err != nil {
+		log.Err(err).Str("handler", "serve_ui").Msg("failed to write response to client")
+	}
+}
+
+const uiPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>miniqueue</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .4em .8em; border-bottom: 1px solid #ddd; }
+td.num, th.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr.dlq td:first-child { color: #b00; }
+button { margin-right: .4em; }
+pre { background: #f6f6f6; padding: 1em; overflow: auto; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>miniqueue</h1>
+<p id="error"></p>
+<table>
+<thead>
+<tr>
+<th>Topic</th>
+<th class="num">Pending</th>
+<th class="num">Subscribers</th>
+<th class="num">Published/s</th>
+<th class="num">ACKed/s</th>
+<th>Consumers</th>
+<th></th>
+</tr>
+</thead>
+<tbody id="topics"></tbody>
+</table>
+<h2 id="peek-title" hidden></h2>
+<pre id="peek" hidden></pre>
+<script>
+const dlqSuffix = ".dlq";
+const interval = 2000;
+let last = {};
+
+function cell(row, text, cls) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+  return td;
+}
+
+function button(td, label, fn) {
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.onclick = fn;
+  td.appendChild(b);
+}
+
+function rate(now, prev, at, prevAt) {
+  if (prev === undefined) return "-";
+  return ((now - prev) / ((at - prevAt) / 1000)).toFixed(1);
+}
+
+async function peek(topic) {
+  const res = await fetch("/topics/" + encodeURIComponent(topic) + "/peek");
+  const title = document.getElementById("peek-title");
+  const out = document.getElementById("peek");
+  title.textContent = "Peek " + topic;
+  out.textContent = JSON.stringify(await res.json(), null, 2);
+  title.hidden = out.hidden = false;
+}
+
+async function requeue(topic) {
+  const source = topic.slice(0, -dlqSuffix.length);
+  if (!confirm("Return the dead letters of " + source + " to it?")) return;
+  const res = await fetch("/topics/" + encodeURIComponent(source) + "/recover", { method: "POST" });
+  const body = await res.json();
+  if (!res.ok) return alert(body.error || res.statusText);
+  alert("Requeued " + body.recovered + " messages to " + source);
+  refresh();
+}
+
+async function refresh() {
+  const err = document.getElementById("error");
+  let topics;
+  try {
+    const res = await fetch("/ui/stats");
+    topics = await res.json();
+    if (!res.ok) throw new Error(topics.error || res.statusText);
+    err.textContent = "";
+  } catch (e) {
+    err.textContent = "Failed to load topics: " + e.message;
+    return;
+  }
+
+  const at = Date.now();
+  const body = document.getElementById("topics");
+  body.textContent = "";
+
+  const next = {};
+  for (const t of topics) {
+    const prev = last[t.topic] || {};
+    next[t.topic] = { published: t.published, acked: t.acked, at };
+
+    const row = body.insertRow();
+    if (t.topic.endsWith(dlqSuffix)) row.className = "dlq";
+
+    cell(row, t.topic);
+    cell(row, t.pending, "num");
+    cell(row, t.subscribers, "num");
+    cell(row, rate(t.published, prev.published, at, prev.at), "num");
+    cell(row, rate(t.acked, prev.acked, at, prev.at), "num");
+    cell(row, t.consumers.join(", "));
+
+    const actions = cell(row, "");
+    button(actions, "Peek", () => peek(t.topic));
+    if (t.topic.endsWith(dlqSuffix) && t.pending > 0) {
+      button(actions, "Requeue", () => requeue(t.topic));
+    }
+  }
+
+  last = next;
+}
+
+refresh();
+setInterval(refresh, interval);
+</script>
+</body>
+</html>
+`
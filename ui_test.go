@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUI(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	srv := newServer(b)
+
+	for _, msg := range []string{"msg_1", "msg_2"} {
+		_, err := b.Publish(defaultTopic, value(msg), messageMeta{})
+		assert.NoError(err)
+	}
+
+	c := b.Subscribe(defaultTopic)
+	_, err := c.Next(context.Background())
+	assert.NoError(err)
+	assert.NoError(c.Ack())
+
+	rec := NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, uiStatsPath, nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var stats []uiTopic
+	assert.NoError(json.NewDecoder(rec.Body).Decode(&stats))
+	assert.Equal([]uiTopic{{
+		topicStats: topicStats{Topic: defaultTopic, Pending: 1, Subscribers: 1},
+		throughput: throughput{Published: 2, Acked: 1},
+		Consumers:  []string{c.id},
+	}}, stats)
+
+	rec = NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, uiPath, nil))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(rec.Body.String(), uiStatsPath)
+}
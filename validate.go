@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// validateResponse lists the invalid options of a subscribe request.
+type validateResponse struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// validateSubscribe validates the options a subscribe request would carry, in
+// its query and INIT command, without creating a consumer. The body holds the
+// INIT command, and may be empty.
+func validateSubscribe() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "validate_subscribe").
+			Logger()
+
+		res := validateResponse{
+			Errors: validateSubscribeOptions(r),
+		}
+		res.Valid = len(res.Errors) == 0
+
+		if !res.Valid {
+			log.Debug().
+				Strs("errors", res.Errors).
+				Msg("invalid subscribe options")
+
+			w.WriteHeader(http.StatusBadRequest)
+		}
+
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Err(err).Msg("failed to write response to client")
+		}
+	}
+}
+
+// validateSubscribeOptions returns a description of each invalid option of
+// the subscribe request.
+func validateSubscribeOptions(r *http.Request) []string {
+	var errs []string
+
+	if raw := r.URL.Query().Get(rateQueryKey); raw != "" {
+		if _, err := parseRate(raw); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", rateQueryKey, err))
+		}
+	}
+
+	if raw := r.URL.Query().Get(disconnectQueryKey); raw != "" {
+		if _, err := parseDisconnectPolicy(raw); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", disconnectQueryKey, err))
+		}
+	}
+
+	if raw := r.URL.Query().Get(weightQueryKey); raw != "" {
+		if _, err := parseWeight(raw); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", weightQueryKey, err))
+		}
+	}
+
+	var cmd command
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err == io.EOF {
+		return errs
+	} else if err != nil {
+		return append(errs, fmt.Sprintf("%v: %v", errDecodingCmd, err))
+	}
+
+	if cmd.Cmd != CmdInit {
+		errs = append(errs, fmt.Sprintf("cmd: expected %s, got %q", CmdInit, cmd.Cmd))
+	}
+
+	if cmd.AckTimeout != "" {
+		if _, err := parseAckTimeout(cmd.AckTimeout); err != nil {
+			errs = append(errs, fmt.Sprintf("ack_timeout: %v", err))
+		}
+	}
+
+	if len(cmd.From) > 0 {
+		if _, err := parseReplayFrom(cmd.From); err != nil {
+			errs = append(errs, fmt.Sprintf("from: %v", err))
+		}
+	}
+
+	if cmd.Prefetch != 0 {
+		if _, err := parsePrefetch(cmd.Prefetch, cmd.From); err != nil {
+			errs = append(errs, fmt.Sprintf("prefetch: %v", err))
+		}
+	}
+
+	if len(cmd.IDs) > 0 {
+		errs = append(errs, "ids: not accepted on INIT")
+	}
+
+	if cmd.Result != nil {
+		errs = append(errs, "result: not accepted on INIT")
+	}
+
+	return errs
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSubscribe(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		body       string
+		wantStatus int
+		wantErrs   []string
+	}{
+		{
+			name:       "valid options",
+			query:      "?rate=10/s&group=workers&weight=3",
+			body:       `{"cmd":"INIT","block":false,"ack_timeout":"30s"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "plain INIT",
+			body:       `"INIT"`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no body",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid options",
+			query:      "?rate=fast",
+			body:       `{"cmd":"ACK","ack_timeout":"-1s"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErrs: []string{
+				"rate: " + errInvalidRate.Error(),
+				`cmd: expected INIT, got "ACK"`,
+				"ack_timeout: " + errInvalidAckTimeout.Error(),
+			},
+		},
+		{
+			name:       "invalid weight",
+			query:      "?weight=0",
+			wantStatus: http.StatusBadRequest,
+			wantErrs:   []string{"weight: " + errInvalidWeight.Error()},
+		},
+		{
+			name:       "malformed command",
+			body:       `{"cmd":"INIT","block":"yes"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			// No consumer is created
+			srv := newServer(NewMockbrokerer(ctrl))
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s/validate%s", defaultTopic, tt.query), strings.NewReader(tt.body))
+			srv.ServeHTTP(rec, req)
+
+			assert.Equal(tt.wantStatus, rec.Code)
+
+			var out validateResponse
+			assert.NoError(json.NewDecoder(rec.Body).Decode(&out))
+			assert.Equal(tt.wantStatus == http.StatusOK, out.Valid)
+
+			if tt.wantStatus == http.StatusOK {
+				assert.Empty(out.Errors)
+			} else {
+				assert.NotEmpty(out.Errors)
+			}
+
+			if tt.wantErrs != nil {
+				assert.Equal(tt.wantErrs, out.Errors)
+			}
+		})
+	}
+}
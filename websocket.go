@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// wsSubscribePath prefixes the WebSocket subscribe route.
+const wsSubscribePath = "/ws/subscribe"
+
+// wsUpgrader upgrades WebSocket subscribe requests, refusing those from
+// browsers on another origin.
+var wsUpgrader = websocket.Upgrader{}
+
+// wsResponseWriter carries the responses of a subscribe stream over a
+// WebSocket connection, one message per response. As writes are sent as they
+// are made, there's nothing to flush, and the status and headers of the
+// stream were settled by the upgrade.
+type wsResponseWriter struct {
+	conn   *websocket.Conn
+	header http.Header
+}
+
+func (ww *wsResponseWriter) Header() http.Header {
+	return ww.header
+}
+
+func (ww *wsResponseWriter) WriteHeader(int) {}
+
+func (ww *wsResponseWriter) Flush() {}
+
+// Write sends p as a single message. JSON responses are sent as text, while
+// the chunks of a streamed message are sent as binary.
+func (ww *wsResponseWriter) Write(p []byte) (int, error) {
+	typ, msg := websocket.BinaryMessage, p
+	if json.Valid(p) {
+		typ, msg = websocket.TextMessage, bytes.TrimSuffix(p, []byte("\n"))
+	}
+
+	if err := ww.conn.WriteMessage(typ, msg); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// close ends the stream, closing the connection with a code reflecting the
+// stream status set by the subscribe handler.
+func (ww *wsResponseWriter) close() {
+	code := websocket.CloseNormalClosure
+
+	status := ww.header.Get(trailerStreamStatus)
+	if status == streamStatusError {
+		code = websocket.CloseInternalServerErr
+	}
+
+	_ = ww.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, status), time.Now().Add(time.Second))
+	_ = ww.conn.Close()
+}
+
+// readCommands copies the messages received on the connection to w, each
+// followed by a newline, such that they are decoded as commands. Reading
+// continues ahead of the commands being handled, so that control messages
+// are answered and a disconnect is noticed while waiting for a message, at
+// which point cancel is called.
+func readCommands(conn *websocket.Conn, w *io.PipeWriter, cancel func()) {
+	defer cancel()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			w.CloseWithError(errWebSocketClosed)
+			return
+		}
+
+		if _, err := w.Write(append(msg, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+// upgradeSubscribers upgrades subscribe requests to WebSocket connections,
+// adapting the connection to the request body and response of the chunked
+// HTTP subscribe stream. Each message sent by the client is a command, and
+// each response is sent as a message.
+func upgradeSubscribers(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := log.With().
+			Str("request_id", xid.New().String()).
+			Str("handler", "ws_subscribe").
+			Logger()
+
+		// The upgrader responds to a failed upgrade itself
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to upgrade to WebSocket")
+			return
+		}
+
+		ww := &wsResponseWriter{conn: conn, header: http.Header{}}
+		defer ww.close()
+
+		// The request context isn't cancelled once the connection is hijacked,
+		// so is cancelled by the reader when the client goes away instead
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		pr, pw := io.Pipe()
+		defer pr.Close()
+
+		go readCommands(conn, pw, cancel)
+
+		r = r.WithContext(ctx)
+		r.Body = pr
+
+		next(ww, r)
+	}
+}
+
+// isWebSocketSubscribe reports whether the request subscribes over a
+// WebSocket connection.
+func isWebSocketSubscribe(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, wsSubscribePath+"/")
+}
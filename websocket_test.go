@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// helperDialWebSocket subscribes to the topic over a WebSocket connection to
+// the server, closed when the test ends.
+func helperDialWebSocket(t *testing.T, b *broker, topic string) *websocket.Conn {
+	t.Helper()
+
+	srv := httptest.NewServer(newServer(b))
+	t.Cleanup(srv.Close)
+
+	url := fmt.Sprintf("ws%s%s/%s", strings.TrimPrefix(srv.URL, "http"), wsSubscribePath, topic)
+
+	conn, res, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status upgrading: %d", res.StatusCode)
+	}
+
+	return conn
+}
+
+func TestWebSocketSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+
+	for i := 0; i < 2; i++ {
+		_, err := b.Publish(defaultTopic, []byte(fmt.Sprintf("test_value_%d", i)), messageMeta{})
+		assert.NoError(err)
+	}
+
+	conn := helperDialWebSocket(t, b, defaultTopic)
+
+	// Each command is a message, answered by a message
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`"INIT"`)))
+
+	var res subResponse
+	assert.NoError(conn.ReadJSON(&res))
+	assert.Equal("test_value_0", res.Msg)
+	assert.Equal(1, res.Seq)
+
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`{"cmd": "ACK"}`)))
+
+	res = subResponse{}
+	assert.NoError(conn.ReadJSON(&res))
+	assert.Equal("test_value_1", res.Msg)
+	assert.Equal(2, res.Seq)
+
+	// Closing the stream returns the outstanding message, and closes the
+	// connection normally
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`"CLOSE"`)))
+
+	_, _, err := conn.ReadMessage()
+	assert.True(websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestWebSocketSubscribe_Error(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	conn := helperDialWebSocket(t, b, defaultTopic)
+
+	// A malformed command ends the stream with an error
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`{"cmd" "INIT"}`)))
+
+	var res subResponse
+	assert.NoError(conn.ReadJSON(&res))
+	assert.Equal(signalError, res.Signal)
+	assert.Equal(errDecodingCmd.Error(), res.Error)
+
+	_, _, err := conn.ReadMessage()
+	assert.True(websocket.IsCloseError(err, websocket.CloseInternalServerErr), err)
+}
+
+func TestWebSocketSubscribe_Disconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newBroker(helperNewMemStore(t))
+	conn := helperDialWebSocket(t, b, defaultTopic)
+
+	// The consumer waits on the empty topic
+	assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`"INIT"`)))
+	assert.Eventually(func() bool {
+		return len(b.ConsumerIDs(defaultTopic)) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Dropping the connection unsubscribes it while it waits
+	assert.NoError(conn.Close())
+	assert.Eventually(func() bool {
+		return len(b.ConsumerIDs(defaultTopic)) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Leaving a message published afterwards for the next consumer
+	_, err := b.Publish(defaultTopic, []byte("test_value"), messageMeta{})
+	assert.NoError(err)
+
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestReadOnlyRequest_WebSocketSubscribe(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s", wsSubscribePath, defaultTopic), nil)
+
+	// Subscribing consumes messages, so is sent to the primary
+	assert.False(t, readOnlyRequest(req))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// weightQueryKey is the subscribe query parameter holding the weight of
+	// the consumer.
+	weightQueryKey = "weight"
+	defaultWeight  = 1
+)
+
+// consumerWeights chooses which waiting consumer of a topic is notified of an
+// event, by smooth weighted round-robin over the weights of the consumers.
+// Consumers without a weight have the default weight of 1. The zero value is
+// ready to use.
+//
+// Only waiting consumers can be notified, those busy are skipped and take the
+// next message themselves once ready, so the distribution is proportional
+// to the weights while the consumers keep up.
+type consumerWeights struct {
+	topics map[string]map[string]*weightedConsumer
+	sync.Mutex
+}
+
+type weightedConsumer struct {
+	weight  int
+	current int
+}
+
+// parseWeight parses the weight of a consumer, a positive integer.
+func parseWeight(raw string) (int, error) {
+	w, err := strconv.Atoi(raw)
+	if err != nil || w < 1 {
+		return 0, errInvalidWeight
+	}
+
+	return w, nil
+}
+
+// SetWeight sets the weight of the consumer, the share of the messages of its
+// topic it is notified of relative to the other consumers.
+func (b *broker) SetWeight(cons *consumer, weight int) {
+	b.weights.set(cons.topic, cons.id, weight)
+}
+
+// set the weight of the consumer of the topic, restarting the schedule of the
+// topic.
+func (w *consumerWeights) set(topic, id string, weight int) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.topics == nil {
+		w.topics = map[string]map[string]*weightedConsumer{}
+	}
+	if w.topics[topic] == nil {
+		w.topics[topic] = map[string]*weightedConsumer{}
+	}
+
+	w.topics[topic][id] = &weightedConsumer{weight: weight}
+	w.reset(topic)
+}
+
+// remove the consumer of the topic, restarting the schedule of the topic.
+func (w *consumerWeights) remove(topic, id string) {
+	w.Lock()
+	defer w.Unlock()
+
+	delete(w.topics[topic], id)
+	if len(w.topics[topic]) == 0 {
+		delete(w.topics, topic)
+		return
+	}
+
+	w.reset(topic)
+}
+
+// reset restarts the schedule of the topic, such that consumers joining or
+// leaving don't skew it towards those subscribed the longest. The lock must be
+// held.
+func (w *consumerWeights) reset(topic string) {
+	for _, c := range w.topics[topic] {
+		c.current = 0
+	}
+}
+
+// notify tries to notify the consumers of the topic, starting with the one due
+// next, until one accepts. It reports whether any did.
+func (w *consumerWeights) notify(topic string, conss []consumer, try func(c consumer) bool) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.topics == nil {
+		w.topics = map[string]map[string]*weightedConsumer{}
+	}
+	if w.topics[topic] == nil {
+		w.topics[topic] = map[string]*weightedConsumer{}
+	}
+
+	weighted := make([]*weightedConsumer, len(conss))
+	total := 0
+	for i, c := range conss {
+		// A consumer without a weight keeps its place in the schedule like
+		// any other, or it would never build up to a turn
+		wc, ok := w.topics[topic][c.id]
+		if !ok {
+			wc = &weightedConsumer{weight: defaultWeight}
+			w.topics[topic][c.id] = wc
+		}
+
+		wc.current += wc.weight
+		total += wc.weight
+		weighted[i] = wc
+	}
+
+	order := make([]int, len(conss))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return weighted[order[i]].current > weighted[order[j]].current
+	})
+
+	// Busy consumers sit out the round, rather than catching up on the turns
+	// they missed once they're waiting again
+	for _, i := range order {
+		if try(conss[i]) {
+			weighted[i].current -= total
+			return true
+		}
+
+		weighted[i].current -= weighted[i].weight
+		total -= weighted[i].weight
+	}
+
+	return false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// helperNotifyN notifies the consumers of the topic n times, every consumer
+// waiting unless busy, and returns the number of notifications each
+// received.
+func helperNotifyN(b *broker, topic string, n int, busy ...string) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		b.weights.notify(topic, b.consumers[topic], func(c consumer) bool {
+			for _, id := range busy {
+				if c.id == id {
+					return false
+				}
+			}
+
+			counts[c.id]++
+
+			return true
+		})
+	}
+
+	return counts
+}
+
+func TestWeightedNotify(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	heavy := b.Subscribe(defaultTopic)
+	b.SetWeight(heavy, 3)
+	light := b.Subscribe(defaultTopic)
+
+	counts := helperNotifyN(b, defaultTopic, 400)
+	assert.Equal(300, counts[heavy.id])
+	assert.Equal(100, counts[light.id])
+
+	// Each round gives the heavy consumer three turns and the light one, with
+	// the heavy consumer going first
+	var order []string
+	for i := 0; i < 4; i++ {
+		b.weights.notify(defaultTopic, b.consumers[defaultTopic], func(c consumer) bool {
+			order = append(order, c.id)
+			return true
+		})
+	}
+	assert.ElementsMatch([]string{heavy.id, heavy.id, heavy.id, light.id}, order)
+	assert.NotEqual(light.id, order[0])
+}
+
+func TestWeightedNotify_DefaultWeights(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	heavy := b.Subscribe(defaultTopic)
+	b.SetWeight(heavy, 2)
+	first := b.Subscribe(defaultTopic)
+	second := b.Subscribe(defaultTopic)
+
+	counts := helperNotifyN(b, defaultTopic, 400)
+	assert.Equal(200, counts[heavy.id])
+	assert.Equal(100, counts[first.id])
+	assert.Equal(100, counts[second.id])
+
+	// Including consumers whose weight was never set
+	var w consumerWeights
+	w.set(defaultTopic, heavy.id, 2)
+
+	conss := []consumer{*heavy, *first, *second}
+	counts = map[string]int{}
+	for i := 0; i < 400; i++ {
+		w.notify(defaultTopic, conss, func(c consumer) bool {
+			counts[c.id]++
+			return true
+		})
+	}
+	assert.Equal(200, counts[heavy.id])
+	assert.Equal(100, counts[first.id])
+	assert.Equal(100, counts[second.id])
+}
+
+func TestWeightedNotify_JoinLeave(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	heavy := b.Subscribe(defaultTopic)
+	b.SetWeight(heavy, 3)
+	light := b.Subscribe(defaultTopic)
+
+	// Leave the schedule part way through a round
+	counts := helperNotifyN(b, defaultTopic, 2)
+	assert.Equal(2, counts[heavy.id])
+
+	// A consumer joining mid-stream gets its share from then on
+	joined := b.Subscribe(defaultTopic)
+	b.SetWeight(joined, 2)
+
+	counts = helperNotifyN(b, defaultTopic, 600)
+	assert.Equal(300, counts[heavy.id])
+	assert.Equal(100, counts[light.id])
+	assert.Equal(200, counts[joined.id])
+
+	// As do the remaining consumers once it leaves
+	b.Unsubscribe(joined)
+
+	counts = helperNotifyN(b, defaultTopic, 400)
+	assert.Equal(300, counts[heavy.id])
+	assert.Equal(100, counts[light.id])
+	assert.Zero(counts[joined.id])
+
+	// Including when disconnected by an operator
+	assert.NoError(b.DisconnectConsumer(defaultTopic, heavy.id))
+
+	counts = helperNotifyN(b, defaultTopic, 10)
+	assert.Equal(10, counts[light.id])
+}
+
+func TestWeightedNotify_Busy(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+
+	heavy := b.Subscribe(defaultTopic)
+	b.SetWeight(heavy, 3)
+	light := b.Subscribe(defaultTopic)
+
+	// A busy consumer is skipped in favour of one waiting
+	counts := helperNotifyN(b, defaultTopic, 10, heavy.id)
+	assert.Equal(10, counts[light.id])
+
+	// While no consumer waiting takes nobody's turn
+	counts = helperNotifyN(b, defaultTopic, 10, heavy.id, light.id)
+	assert.Empty(counts)
+
+	// Once waiting again, the busy consumer doesn't catch up on the turns it
+	// missed
+	counts = helperNotifyN(b, defaultTopic, 400)
+	assert.Equal(300, counts[heavy.id])
+	assert.Equal(100, counts[light.id])
+}
+
+func TestParseWeight(t *testing.T) {
+	assert := assert.New(t)
+
+	w, err := parseWeight("3")
+	assert.NoError(err)
+	assert.Equal(3, w)
+
+	for _, raw := range []string{"0", "-1", "1.5", "heavy"} {
+		_, err := parseWeight(raw)
+		assert.Equal(errInvalidWeight, err, raw)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type connContextKey struct{}
+
+// ConnContext makes the client connection available to the handlers serving
+// it, to be set as the ConnContext hook of the http.Server.
+func (s *server) ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// withWriteTimeout bounds how long a single write to a subscribe connection
+// may block, closing the connection of a client which has stopped reading.
+// Zero waits indefinitely.
+func withWriteTimeout(timeout time.Duration) serverOption {
+	return func(s *server) {
+		s.writeTimeout = timeout
+	}
+}
+
+// watchdog closes a client connection if an operation on it blocks for
+// longer than the timeout. A deadline on the connection alone isn't enough, as
+// over HTTP/2 a stalled stream blocks on flow control rather than on the
+// socket.
+type watchdog struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func newWatchdog(conn net.Conn, timeout time.Duration) *watchdog {
+	return &watchdog{conn: conn, timeout: timeout}
+}
+
+// guard closes the connection if the timeout passes before the returned
+// function is called.
+func (wd *watchdog) guard() (stop func()) {
+	t := time.AfterFunc(wd.timeout, func() {
+		wd.mu.Lock()
+		wd.expired = true
+		wd.mu.Unlock()
+
+		_ = wd.conn.Close()
+	})
+
+	return func() { t.Stop() }
+}
+
+// timedOut reports whether the connection was closed by the watchdog.
+func (wd *watchdog) timedOut() bool {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	return wd.expired
+}
+
+// timeoutWriter wraps the response of a subscribe connection, closing the
+// underlying connection if a write or flush blocks for longer than the
+// timeout. Once timed out, further writes fail immediately.
+type timeoutWriter struct {
+	http.ResponseWriter
+	*watchdog
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	if tw.timedOut() {
+		return 0, errWriteTimeout
+	}
+
+	defer tw.guard()()
+
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *timeoutWriter) Flush() {
+	f, ok := tw.ResponseWriter.(http.Flusher)
+	if !ok || tw.timedOut() {
+		return
+	}
+
+	defer tw.guard()()
+
+	f.Flush()
+}
+
+// Unwrap returns the wrapped response, through which headers are set.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// writeTimedOut reports whether a write to the subscribe connection timed out,
+// after which the client is treated as gone.
+func writeTimedOut(w http.ResponseWriter) bool {
+	tw, ok := w.(*timeoutWriter)
+	return ok && tw.timedOut()
+}
+
+// timeoutSubscribers bounds each write to subscribe connections by the
+// timeout. Zero disables the timeout.
+func timeoutSubscribers(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if timeout <= 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		next(&timeoutWriter{ResponseWriter: w, watchdog: newWatchdog(conn, timeout)}, r)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// connResponseWriter writes the response straight to a connection, such that
+// writes block until the other end reads them.
+type connResponseWriter struct {
+	net.Conn
+	header http.Header
+}
+
+func (cw *connResponseWriter) Header() http.Header { return cw.header }
+func (cw *connResponseWriter) WriteHeader(int)     {}
+func (cw *connResponseWriter) Flush()              {}
+
+func TestSubscribeWriteTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(err)
+
+	b := newBroker(&store{db: db})
+	_, err = b.Publish(defaultTopic, []byte("test_msg"), messageMeta{})
+	assert.NoError(err)
+
+	// The client never reads from its end of the connection
+	srvConn, cliConn := net.Pipe()
+	defer cliConn.Close()
+
+	body, bodyW := io.Pipe()
+	defer bodyW.Close()
+
+	go func() {
+		_, _ = bodyW.Write([]byte("\"INIT\"\n"))
+	}()
+
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/subscribe/%s", defaultTopic), body)
+	r = mux.SetURLVars(r, map[string]string{"topic": defaultTopic})
+	r = r.WithContext(context.WithValue(r.Context(), connContextKey{}, srvConn))
+
+	w := &connResponseWriter{Conn: srvConn, header: http.Header{}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		timeoutSubscribers(50*time.Millisecond, subscribe(b, flushThreshold{}))(w, r)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the stalled subscriber to be closed")
+	}
+
+	// The connection was closed
+	_, err = srvConn.Write([]byte("x"))
+	assert.Error(err)
+
+	// The outstanding message was NACKed
+	n, err := b.store.Len(defaultTopic)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	// The consumer was removed
+	b.RLock()
+	assert.Empty(b.consumers[defaultTopic])
+	b.RUnlock()
+}
+
+func TestTimeoutWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	srvConn, cliConn := net.Pipe()
+	defer cliConn.Close()
+
+	tw := &timeoutWriter{
+		ResponseWriter: &connResponseWriter{Conn: srvConn, header: http.Header{}},
+		watchdog:       newWatchdog(srvConn, 50*time.Millisecond),
+	}
+
+	// Writes which the client reads in time succeed
+	go func() {
+		buf := make([]byte, 5)
+		_, _ = io.ReadFull(cliConn, buf)
+	}()
+
+	n, err := tw.Write([]byte("hello"))
+	assert.NoError(err)
+	assert.Equal(5, n)
+	assert.False(writeTimedOut(tw))
+
+	// Once a write blocks past the timeout, it and every later write fails
+	_, err = tw.Write([]byte("stalled"))
+	assert.Error(err)
+	assert.True(writeTimedOut(tw))
+
+	_, err = tw.Write([]byte("again"))
+	assert.Equal(errWriteTimeout, err)
+}